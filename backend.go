@@ -0,0 +1,334 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// backend is what the CLI commands run against: the database itself, or a bookish
+// server reached over HTTP with a profile (see remote.go)
+type backend interface {
+	CreateBook(args BookArgs) (*Book, error)
+	ListBooks(args BookArgs) ([]Book, error)
+	CreateCollection(args CollectionArgs) (*Collection, error)
+	ListCollections(args CollectionArgs) ([]Collection, error)
+	AddBookToCollection(args AddBookToCollectionArgs) (*Collection, *Book, error)
+	UpdateBook(args BookArgs) (*Book, error)
+	RemoveBookFromCollection(args AddBookToCollectionArgs) (*Collection, *Book, error)
+	SetReadingStatus(args ReadingStatusArgs) (*ReadingStatus, error)
+	ListReadingStatuses(args ReadingStatusArgs) ([]ReadingStatus, error)
+	LogReadingSession(args ReadingSessionArgs) (*ReadingProgress, error)
+	GetReadingProgress(args ReadingSessionArgs) (*ReadingProgress, error)
+	CreateReview(args ReviewArgs) (*Review, error)
+	UpdateReview(args ReviewArgs) (*Review, error)
+	ListReviews(args ReviewArgs) ([]Review, error)
+	CreateNote(args NoteArgs) (*Note, error)
+	UpdateNote(args NoteArgs) (*Note, error)
+	DeleteNote(args NoteArgs) (*Note, error)
+	ListNotes(args NoteArgs) ([]Note, error)
+	LendBook(args LoanArgs) (*Loan, error)
+	ReturnBook(args LoanArgs) (*Loan, error)
+	ListLoans(args LoanArgs) ([]Loan, error)
+	CreateCopy(args CopyArgs) (*Copy, error)
+	UpdateCopy(args CopyArgs) (*Copy, error)
+	DeleteCopy(args CopyArgs) (*Copy, error)
+	ListCopies(args CopyArgs) ([]Copy, error)
+	CreateWish(args WishArgs) (*Wish, error)
+	UpdateWish(args WishArgs) (*Wish, error)
+	DeleteWish(args WishArgs) (*Wish, error)
+	ListWishes(args WishArgs) ([]Wish, error)
+	AcquireWish(args AcquireArgs) (*Acquisition, error)
+	RecordPurchase(args PurchaseArgs) (*Purchase, error)
+	ListPurchases(args PurchaseArgs) ([]Purchase, error)
+	SpendingReport(args PurchaseArgs) ([]MonthlySpending, error)
+	CreateTag(args TagArgs) (*Tag, error)
+	UpdateTag(args TagArgs) (*Tag, error)
+	DeleteTag(args TagArgs) (*Tag, error)
+	ListTags(args TagArgs) ([]Tag, error)
+	TagBook(args BookTagsArgs) (*Book, error)
+	UntagBook(args BookTagsArgs) (*Book, error)
+
+	ImportBooksCSV(r io.Reader, args ImportArgs) (*ImportReport, error)
+	ImportShelvesCSV(r io.Reader, format string) (*ShelfImportReport, error)
+	ImportCitations(r io.Reader, format string) (*ImportReport, error)
+	ImportMARC(r io.Reader, format string) (*ImportReport, error)
+	ImportCalibreLibrary(dir string) (*ShelfImportReport, error)
+	ScanBooks(dir string, args ScanArgs) (*ScanReport, error)
+
+	ExportCatalogue(w io.Writer, args ExportArgs) error
+	ExportCollectionCitations(w io.Writer, collectionID int, format string) error
+	Backup(w io.Writer) (*BackupManifest, error)
+	Restore(r io.ReaderAt, size int64, args RestoreArgs) (*RestoreReport, error)
+}
+
+// cliBackend is opened by the first command that needs it and kept for the next ones
+var cliBackend backend
+
+// openBackend is set from the global flags of the CLI
+var openBackend = openDatabaseBackend
+
+func currentBackend() (backend, error) {
+	if cliBackend == nil {
+		opened, err := openBackend()
+		if err != nil {
+			return nil, err
+		}
+		cliBackend = opened
+	}
+	return cliBackend, nil
+}
+
+// configPath is the configuration file of the database, set by the -config global flag
+var configPath = "config.yml"
+
+// openDatabase sets the package level configuration and connection from a configuration file
+func openDatabase(path string) error {
+	config, err = LoadConfig(path)
+	if err != nil {
+		return err
+	}
+	db, err = ConnectToDb(config.Database.URL)
+	return err
+}
+
+// openDatabaseBackend connects to the database of the configuration file. The schema is
+// only checked, setting it up is the job of the migrate command.
+func openDatabaseBackend() (backend, error) {
+	err := openDatabase(configPath)
+	if err != nil {
+		return nil, err
+	}
+	err = CheckSchema(db)
+	if err != nil {
+		return nil, err
+	}
+	return databaseBackend{db: db}, nil
+}
+
+// databaseBackend runs the commands directly on the database
+type databaseBackend struct {
+	db *sql.DB
+}
+
+func (b databaseBackend) CreateBook(args BookArgs) (*Book, error) {
+	return CreateBook(b.db, args)
+}
+
+func (b databaseBackend) ListBooks(args BookArgs) ([]Book, error) {
+	return ListBooks(b.db, args)
+}
+
+func (b databaseBackend) CreateCollection(args CollectionArgs) (*Collection, error) {
+	return CreateCollection(b.db, args)
+}
+
+func (b databaseBackend) ListCollections(args CollectionArgs) ([]Collection, error) {
+	return ListCollections(b.db, args)
+}
+
+func (b databaseBackend) AddBookToCollection(args AddBookToCollectionArgs) (*Collection, *Book, error) {
+	return AddBookToCollection(b.db, args)
+}
+
+func (b databaseBackend) UpdateBook(args BookArgs) (*Book, error) {
+	return UpdateBook(b.db, args)
+}
+
+func (b databaseBackend) RemoveBookFromCollection(args AddBookToCollectionArgs) (*Collection, *Book, error) {
+	return RemoveBookFromCollection(b.db, args)
+}
+
+func (b databaseBackend) SetReadingStatus(args ReadingStatusArgs) (*ReadingStatus, error) {
+	return SetReadingStatus(b.db, args)
+}
+
+func (b databaseBackend) ListReadingStatuses(args ReadingStatusArgs) ([]ReadingStatus, error) {
+	return ListReadingStatuses(b.db, args)
+}
+
+func (b databaseBackend) LogReadingSession(args ReadingSessionArgs) (*ReadingProgress, error) {
+	return LogReadingSession(b.db, args)
+}
+
+func (b databaseBackend) GetReadingProgress(args ReadingSessionArgs) (*ReadingProgress, error) {
+	return GetReadingProgress(b.db, args)
+}
+
+func (b databaseBackend) CreateReview(args ReviewArgs) (*Review, error) {
+	return CreateReview(b.db, args)
+}
+
+func (b databaseBackend) UpdateReview(args ReviewArgs) (*Review, error) {
+	return UpdateReview(b.db, args)
+}
+
+func (b databaseBackend) ListReviews(args ReviewArgs) ([]Review, error) {
+	return ListReviews(b.db, args)
+}
+
+func (b databaseBackend) CreateNote(args NoteArgs) (*Note, error) {
+	return CreateNote(b.db, args)
+}
+
+func (b databaseBackend) UpdateNote(args NoteArgs) (*Note, error) {
+	return UpdateNote(b.db, args)
+}
+
+func (b databaseBackend) DeleteNote(args NoteArgs) (*Note, error) {
+	return DeleteNote(b.db, args)
+}
+
+func (b databaseBackend) ListNotes(args NoteArgs) ([]Note, error) {
+	return ListNotes(b.db, args)
+}
+
+func (b databaseBackend) LendBook(args LoanArgs) (*Loan, error) {
+	return LendBook(b.db, args)
+}
+
+func (b databaseBackend) ReturnBook(args LoanArgs) (*Loan, error) {
+	return ReturnBook(b.db, args)
+}
+
+func (b databaseBackend) ListLoans(args LoanArgs) ([]Loan, error) {
+	return ListLoans(b.db, args)
+}
+
+func (b databaseBackend) CreateCopy(args CopyArgs) (*Copy, error) {
+	return CreateCopy(b.db, args)
+}
+
+func (b databaseBackend) UpdateCopy(args CopyArgs) (*Copy, error) {
+	return UpdateCopy(b.db, args)
+}
+
+func (b databaseBackend) DeleteCopy(args CopyArgs) (*Copy, error) {
+	return DeleteCopy(b.db, args)
+}
+
+func (b databaseBackend) ListCopies(args CopyArgs) ([]Copy, error) {
+	return ListCopies(b.db, args)
+}
+
+func (b databaseBackend) CreateWish(args WishArgs) (*Wish, error) {
+	return CreateWish(b.db, args)
+}
+
+func (b databaseBackend) UpdateWish(args WishArgs) (*Wish, error) {
+	return UpdateWish(b.db, args)
+}
+
+func (b databaseBackend) DeleteWish(args WishArgs) (*Wish, error) {
+	return DeleteWish(b.db, args)
+}
+
+func (b databaseBackend) ListWishes(args WishArgs) ([]Wish, error) {
+	return ListWishes(b.db, args)
+}
+
+func (b databaseBackend) AcquireWish(args AcquireArgs) (*Acquisition, error) {
+	return AcquireWish(b.db, args)
+}
+
+func (b databaseBackend) RecordPurchase(args PurchaseArgs) (*Purchase, error) {
+	return RecordPurchase(b.db, args)
+}
+
+func (b databaseBackend) ListPurchases(args PurchaseArgs) ([]Purchase, error) {
+	return ListPurchases(b.db, args)
+}
+
+func (b databaseBackend) SpendingReport(args PurchaseArgs) ([]MonthlySpending, error) {
+	return SpendingReport(b.db, args)
+}
+
+func (b databaseBackend) CreateTag(args TagArgs) (*Tag, error) {
+	return CreateTag(b.db, args)
+}
+
+func (b databaseBackend) UpdateTag(args TagArgs) (*Tag, error) {
+	return UpdateTag(b.db, args)
+}
+
+func (b databaseBackend) DeleteTag(args TagArgs) (*Tag, error) {
+	return DeleteTag(b.db, args)
+}
+
+func (b databaseBackend) ListTags(args TagArgs) ([]Tag, error) {
+	return ListTags(b.db, args)
+}
+
+func (b databaseBackend) TagBook(args BookTagsArgs) (*Book, error) {
+	return TagBook(b.db, args)
+}
+
+func (b databaseBackend) UntagBook(args BookTagsArgs) (*Book, error) {
+	return UntagBook(b.db, args)
+}
+
+func (b databaseBackend) ImportBooksCSV(r io.Reader, args ImportArgs) (*ImportReport, error) {
+	return ImportBooksCSV(b.db, r, args)
+}
+
+func (b databaseBackend) ImportShelvesCSV(r io.Reader, format string) (*ShelfImportReport, error) {
+	return ImportShelvesCSV(b.db, r, format)
+}
+
+func (b databaseBackend) ImportCitations(r io.Reader, format string) (*ImportReport, error) {
+	return ImportCitations(b.db, r, format)
+}
+
+func (b databaseBackend) ImportMARC(r io.Reader, format string) (*ImportReport, error) {
+	return ImportMARC(b.db, r, format)
+}
+
+func (b databaseBackend) ImportCalibreLibrary(dir string) (*ShelfImportReport, error) {
+	return ImportCalibreLibrary(b.db, dir)
+}
+
+func (b databaseBackend) ScanBooks(dir string, args ScanArgs) (*ScanReport, error) {
+	return ScanBooks(b.db, dir, args)
+}
+
+func (b databaseBackend) ExportCatalogue(w io.Writer, args ExportArgs) error {
+	return ExportCatalogue(b.db, w, args)
+}
+
+func (b databaseBackend) ExportCollectionCitations(w io.Writer, collectionID int, format string) error {
+	return ExportCollectionCitations(b.db, w, collectionID, format)
+}
+
+func (b databaseBackend) Backup(w io.Writer) (*BackupManifest, error) {
+	return Backup(b.db, w)
+}
+
+func (b databaseBackend) Restore(r io.ReaderAt, size int64, args RestoreArgs) (*RestoreReport, error) {
+	return Restore(b.db, r, size, args)
+}
+
+// openProfileBackend opens the backend chosen by the global flags of the CLI: the
+// database with -direct, otherwise the named profile or the default one of the profile
+// file, and the database when there is no profile at all
+func openProfileBackend(profileName string, direct bool) (backend, error) {
+	if direct {
+		return openDatabaseBackend()
+	}
+
+	profile, err := LoadProfile(profileName)
+	if errors.Is(err, os.ErrNotExist) && profileName == "" {
+		return openDatabaseBackend()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if profile == nil {
+		return openDatabaseBackend()
+	}
+	if profile.URL == "" {
+		return nil, fmt.Errorf("profile %s has no url", profile.Name)
+	}
+	return newRemoteBackend(*profile), nil
+}
@@ -0,0 +1,1142 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// backupVersion is the version of the backups written. Backups of older versions are
+// restored without the records and fields added since, each version added:
+//
+//	2  the book publisher
+//	3  the copies
+//	4  the reading statuses
+//	5  the page counts and the reading sessions
+//	6  the reviews
+//	7  the notes
+//	8  the loans
+//	9  the copy condition, acquisition date and price
+//	10 the wishlist and the purchases
+//	11 the tags
+const backupVersion = 11
+
+const (
+	backupFormat          = "bookish-backup"
+	backupManifestFile    = "manifest.json"
+	backupAuthorsFile     = "authors.json"
+	backupBooksFile       = "books.json"
+	backupCollectionsFile = "collections.json"
+	backupMembershipsFile = "memberships.json"
+	backupCopiesFile      = "copies.json"
+	backupUsersFile       = "users.json"
+	backupStatusesFile    = "reading_statuses.json"
+	backupSessionsFile    = "reading_sessions.json"
+	backupReviewsFile     = "reviews.json"
+	backupNotesFile       = "notes.json"
+	backupLoansFile       = "loans.json"
+	backupWishlistFile    = "wishlist.json"
+	backupPurchasesFile   = "purchases.json"
+	backupTagsFile        = "tags.json"
+	backupBookTagsFile    = "book_tags.json"
+)
+
+// backup records keep the ids of the source database, restore maps them to new ones
+type backupAuthor struct {
+	AuthorID     int       `json:"author_id"`
+	Name         string    `json:"name"`
+	CreationDate time.Time `json:"creation_date"`
+}
+
+type backupBook struct {
+	BookID        int        `json:"book_id"`
+	Title         string     `json:"title"`
+	AuthorID      int        `json:"author_id"`
+	ISBN          *string    `json:"isbn"`
+	PublishedDate *time.Time `json:"published_date"`
+	EditionNumber *int       `json:"edition_number"`
+	Publisher     *string    `json:"publisher"`
+	PageCount     *int       `json:"page_count"`
+	CreationDate  time.Time  `json:"creation_date"`
+}
+
+type backupCollection struct {
+	CollectionID   int       `json:"collection_id"`
+	CollectionName string    `json:"collection_name"`
+	CreationDate   time.Time `json:"creation_date"`
+}
+
+type backupMembership struct {
+	BookID       int `json:"book_id"`
+	CollectionID int `json:"collection_id"`
+}
+
+type backupCopy struct {
+	CopyID       int        `json:"copy_id"`
+	BookID       int        `json:"book_id"`
+	Format       string     `json:"format"`
+	Condition    *string    `json:"condition"`
+	Location     *string    `json:"location"`
+	AcquiredDate *time.Time `json:"acquired_date"`
+	Price        *float64   `json:"price"`
+	CreationDate time.Time  `json:"creation_date"`
+}
+
+type backupUser struct {
+	UserID       int       `json:"user_id"`
+	Name         string    `json:"name"`
+	CreationDate time.Time `json:"creation_date"`
+}
+
+type backupReadingStatus struct {
+	UserID       int        `json:"user_id"`
+	BookID       int        `json:"book_id"`
+	Status       string     `json:"status"`
+	StartedDate  *time.Time `json:"started_date"`
+	FinishedDate *time.Time `json:"finished_date"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+}
+
+type backupReadingSession struct {
+	SessionID int       `json:"session_id"`
+	UserID    int       `json:"user_id"`
+	BookID    int       `json:"book_id"`
+	Date      time.Time `json:"session_date"`
+	Page      *int      `json:"page"`
+	Percent   *float64  `json:"percent"`
+	Pages     *int      `json:"pages"`
+	Minutes   *int      `json:"minutes"`
+}
+
+type backupReview struct {
+	ReviewID  int       `json:"review_id"`
+	UserID    int       `json:"user_id"`
+	BookID    int       `json:"book_id"`
+	Rating    *float64  `json:"rating"`
+	Review    *string   `json:"review"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type backupNote struct {
+	NoteID       int       `json:"note_id"`
+	BookID       int       `json:"book_id"`
+	UserID       *int      `json:"user_id"`
+	Kind         string    `json:"kind"`
+	Text         string    `json:"text"`
+	Page         *int      `json:"page"`
+	Location     *string   `json:"location"`
+	Tags         []string  `json:"tags"`
+	CreationDate time.Time `json:"creation_date"`
+}
+
+type backupLoan struct {
+	LoanID       int        `json:"loan_id"`
+	BookID       int        `json:"book_id"`
+	CopyID       *int       `json:"copy_id"`
+	Borrower     string     `json:"borrower"`
+	LentDate     time.Time  `json:"lent_date"`
+	DueDate      *time.Time `json:"due_date"`
+	ReturnedDate *time.Time `json:"returned_date"`
+}
+
+type backupWish struct {
+	WishID       int       `json:"wish_id"`
+	Title        string    `json:"title"`
+	Author       string    `json:"author"`
+	ISBN         *string   `json:"isbn"`
+	Edition      *string   `json:"edition"`
+	Priority     string    `json:"priority"`
+	Notes        *string   `json:"notes"`
+	CreationDate time.Time `json:"creation_date"`
+}
+
+type backupPurchase struct {
+	PurchaseID   int       `json:"purchase_id"`
+	BookID       int       `json:"book_id"`
+	CopyID       *int      `json:"copy_id"`
+	Store        *string   `json:"store"`
+	Price        float64   `json:"price"`
+	Currency     string    `json:"currency"`
+	PurchaseDate time.Time `json:"purchase_date"`
+}
+
+type backupTag struct {
+	TagID        int       `json:"tag_id"`
+	Name         string    `json:"name"`
+	Kind         *string   `json:"kind"`
+	CreationDate time.Time `json:"creation_date"`
+}
+
+type backupBookTag struct {
+	BookID int `json:"book_id"`
+	TagID  int `json:"tag_id"`
+}
+
+// Backup writes the whole library to a zip archive, one JSON file per table plus a
+// manifest with the format version and a checksum of each file. The tables are the
+// authors, books, collections, memberships, copies, users, reading statuses, reading
+// sessions, reviews, notes, loans, wishes, purchases and tags. They are read in a single
+// snapshot so the archive is consistent.
+func Backup(db *sql.DB, w io.Writer) (*BackupManifest, error) {
+	tx, err := db.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	authors, err := backupAuthors(tx)
+	if err != nil {
+		return nil, err
+	}
+	books, err := backupBooks(tx)
+	if err != nil {
+		return nil, err
+	}
+	collections, err := backupCollections(tx)
+	if err != nil {
+		return nil, err
+	}
+	memberships, err := backupMemberships(tx)
+	if err != nil {
+		return nil, err
+	}
+	copies, err := backupCopies(tx)
+	if err != nil {
+		return nil, err
+	}
+	users, err := backupUsers(tx)
+	if err != nil {
+		return nil, err
+	}
+	statuses, err := backupReadingStatuses(tx)
+	if err != nil {
+		return nil, err
+	}
+	sessions, err := backupReadingSessions(tx)
+	if err != nil {
+		return nil, err
+	}
+	reviews, err := backupReviews(tx)
+	if err != nil {
+		return nil, err
+	}
+	notes, err := backupNotes(tx)
+	if err != nil {
+		return nil, err
+	}
+	loans, err := backupLoans(tx)
+	if err != nil {
+		return nil, err
+	}
+	wishes, err := backupWishlist(tx)
+	if err != nil {
+		return nil, err
+	}
+	purchases, err := backupPurchases(tx)
+	if err != nil {
+		return nil, err
+	}
+	tags, err := backupTags(tx)
+	if err != nil {
+		return nil, err
+	}
+	bookTags, err := backupBookTags(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &BackupManifest{
+		Format:    backupFormat,
+		Version:   backupVersion,
+		CreatedAt: time.Now().UTC(),
+		Files:     map[string]BackupFile{},
+	}
+
+	archive := zip.NewWriter(w)
+	for _, file := range []struct {
+		name    string
+		records any
+		count   int
+	}{
+		{backupAuthorsFile, authors, len(authors)},
+		{backupBooksFile, books, len(books)},
+		{backupCollectionsFile, collections, len(collections)},
+		{backupMembershipsFile, memberships, len(memberships)},
+		{backupCopiesFile, copies, len(copies)},
+		{backupUsersFile, users, len(users)},
+		{backupStatusesFile, statuses, len(statuses)},
+		{backupSessionsFile, sessions, len(sessions)},
+		{backupReviewsFile, reviews, len(reviews)},
+		{backupNotesFile, notes, len(notes)},
+		{backupLoansFile, loans, len(loans)},
+		{backupWishlistFile, wishes, len(wishes)},
+		{backupPurchasesFile, purchases, len(purchases)},
+		{backupTagsFile, tags, len(tags)},
+		{backupBookTagsFile, bookTags, len(bookTags)},
+	} {
+		content, err := json.MarshalIndent(file.records, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		err = writeBackupFile(archive, file.name, content)
+		if err != nil {
+			return nil, err
+		}
+
+		checksum := sha256.Sum256(content)
+		manifest.Files[file.name] = BackupFile{SHA256: hex.EncodeToString(checksum[:]), Records: file.count}
+	}
+
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	err = writeBackupFile(archive, backupManifestFile, content)
+	if err != nil {
+		return nil, err
+	}
+
+	err = archive.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+func writeBackupFile(archive *zip.Writer, name string, content []byte) error {
+	file, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(content)
+	return err
+}
+
+func backupAuthors(q querier) ([]backupAuthor, error) {
+	authors := []backupAuthor{}
+
+	rows, err := q.Query("SELECT author_id, name, creation_date FROM authors ORDER BY author_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var author backupAuthor
+		err := rows.Scan(&author.AuthorID, &author.Name, &author.CreationDate)
+		if err != nil {
+			return nil, err
+		}
+		authors = append(authors, author)
+	}
+
+	return authors, rows.Err()
+}
+
+func backupBooks(q querier) ([]backupBook, error) {
+	books := []backupBook{}
+
+	rows, err := q.Query("SELECT book_id, title, author_id, isbn, published_date, edition_number, publisher, page_count, creation_date FROM books ORDER BY book_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var book backupBook
+		var isbn sql.NullString
+		var publishedDate sql.NullTime
+		var editionNumber sql.NullInt64
+		var publisher sql.NullString
+		var pageCount sql.NullInt64
+		err := rows.Scan(&book.BookID, &book.Title, &book.AuthorID, &isbn, &publishedDate, &editionNumber, &publisher, &pageCount, &book.CreationDate)
+		if err != nil {
+			return nil, err
+		}
+		if isbn.Valid {
+			book.ISBN = &isbn.String
+		}
+		if publishedDate.Valid {
+			book.PublishedDate = &publishedDate.Time
+		}
+		if editionNumber.Valid {
+			edition := int(editionNumber.Int64)
+			book.EditionNumber = &edition
+		}
+		if publisher.Valid {
+			book.Publisher = &publisher.String
+		}
+		book.PageCount = nullableInt(pageCount)
+		books = append(books, book)
+	}
+
+	return books, rows.Err()
+}
+
+func backupCollections(q querier) ([]backupCollection, error) {
+	collections := []backupCollection{}
+
+	rows, err := q.Query("SELECT collection_id, collection_name, creation_date FROM collections ORDER BY collection_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var collection backupCollection
+		err := rows.Scan(&collection.CollectionID, &collection.CollectionName, &collection.CreationDate)
+		if err != nil {
+			return nil, err
+		}
+		collections = append(collections, collection)
+	}
+
+	return collections, rows.Err()
+}
+
+func backupMemberships(q querier) ([]backupMembership, error) {
+	memberships := []backupMembership{}
+
+	rows, err := q.Query("SELECT book_id, collection_id FROM book_in_collection ORDER BY collection_id, book_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var membership backupMembership
+		err := rows.Scan(&membership.BookID, &membership.CollectionID)
+		if err != nil {
+			return nil, err
+		}
+		memberships = append(memberships, membership)
+	}
+
+	return memberships, rows.Err()
+}
+
+func backupCopies(q querier) ([]backupCopy, error) {
+	copies := []backupCopy{}
+
+	rows, err := q.Query("SELECT copy_id, book_id, format, condition, location, acquired_date, price, creation_date FROM copies ORDER BY copy_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var copy backupCopy
+		var condition, location sql.NullString
+		var acquiredDate sql.NullTime
+		var price sql.NullFloat64
+		err := rows.Scan(&copy.CopyID, &copy.BookID, &copy.Format, &condition, &location, &acquiredDate, &price, &copy.CreationDate)
+		if err != nil {
+			return nil, err
+		}
+		if condition.Valid {
+			copy.Condition = &condition.String
+		}
+		if location.Valid {
+			copy.Location = &location.String
+		}
+		if acquiredDate.Valid {
+			copy.AcquiredDate = &acquiredDate.Time
+		}
+		if price.Valid {
+			copy.Price = &price.Float64
+		}
+		copies = append(copies, copy)
+	}
+
+	return copies, rows.Err()
+}
+
+func backupUsers(q querier) ([]backupUser, error) {
+	users := []backupUser{}
+
+	rows, err := q.Query("SELECT user_id, name, creation_date FROM users ORDER BY user_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var user backupUser
+		err := rows.Scan(&user.UserID, &user.Name, &user.CreationDate)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+
+	return users, rows.Err()
+}
+
+func backupReadingStatuses(q querier) ([]backupReadingStatus, error) {
+	statuses := []backupReadingStatus{}
+
+	rows, err := q.Query("SELECT user_id, book_id, status, started_date, finished_date, updated_at FROM reading_status ORDER BY user_id, book_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var status backupReadingStatus
+		var startedDate, finishedDate sql.NullTime
+		err := rows.Scan(&status.UserID, &status.BookID, &status.Status, &startedDate, &finishedDate, &status.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		if startedDate.Valid {
+			status.StartedDate = &startedDate.Time
+		}
+		if finishedDate.Valid {
+			status.FinishedDate = &finishedDate.Time
+		}
+		statuses = append(statuses, status)
+	}
+
+	return statuses, rows.Err()
+}
+
+func backupReadingSessions(q querier) ([]backupReadingSession, error) {
+	sessions := []backupReadingSession{}
+
+	rows, err := q.Query("SELECT session_id, user_id, book_id, session_date, page, percent, pages, minutes FROM reading_sessions ORDER BY session_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var session backupReadingSession
+		var page, pages, minutes sql.NullInt64
+		var percent sql.NullFloat64
+		err := rows.Scan(&session.SessionID, &session.UserID, &session.BookID, &session.Date, &page, &percent, &pages, &minutes)
+		if err != nil {
+			return nil, err
+		}
+		session.Page = nullableInt(page)
+		if percent.Valid {
+			session.Percent = &percent.Float64
+		}
+		session.Pages = nullableInt(pages)
+		session.Minutes = nullableInt(minutes)
+		sessions = append(sessions, session)
+	}
+
+	return sessions, rows.Err()
+}
+
+func backupReviews(q querier) ([]backupReview, error) {
+	reviews := []backupReview{}
+
+	rows, err := q.Query("SELECT review_id, user_id, book_id, rating, review, created_at, updated_at FROM reviews ORDER BY review_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var review backupReview
+		var rating sql.NullFloat64
+		var text sql.NullString
+		err := rows.Scan(&review.ReviewID, &review.UserID, &review.BookID, &rating, &text, &review.CreatedAt, &review.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		if rating.Valid {
+			review.Rating = &rating.Float64
+		}
+		if text.Valid {
+			review.Review = &text.String
+		}
+		reviews = append(reviews, review)
+	}
+
+	return reviews, rows.Err()
+}
+
+func backupNotes(q querier) ([]backupNote, error) {
+	notes := []backupNote{}
+
+	rows, err := q.Query("SELECT note_id, book_id, user_id, kind, text, page, location, tags, creation_date FROM notes ORDER BY note_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var note backupNote
+		var userID, page sql.NullInt64
+		var location sql.NullString
+		err := rows.Scan(&note.NoteID, &note.BookID, &userID, &note.Kind, &note.Text, &page, &location, pq.Array(&note.Tags), &note.CreationDate)
+		if err != nil {
+			return nil, err
+		}
+		note.UserID = nullableInt(userID)
+		note.Page = nullableInt(page)
+		if location.Valid {
+			note.Location = &location.String
+		}
+		notes = append(notes, note)
+	}
+
+	return notes, rows.Err()
+}
+
+func backupLoans(q querier) ([]backupLoan, error) {
+	loans := []backupLoan{}
+
+	rows, err := q.Query("SELECT loan_id, book_id, copy_id, borrower, lent_date, due_date, returned_date FROM loans ORDER BY loan_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var loan backupLoan
+		var copyID sql.NullInt64
+		var dueDate, returnedDate sql.NullTime
+		err := rows.Scan(&loan.LoanID, &loan.BookID, &copyID, &loan.Borrower, &loan.LentDate, &dueDate, &returnedDate)
+		if err != nil {
+			return nil, err
+		}
+		loan.CopyID = nullableInt(copyID)
+		if dueDate.Valid {
+			loan.DueDate = &dueDate.Time
+		}
+		if returnedDate.Valid {
+			loan.ReturnedDate = &returnedDate.Time
+		}
+		loans = append(loans, loan)
+	}
+
+	return loans, rows.Err()
+}
+
+func backupWishlist(q querier) ([]backupWish, error) {
+	wishes := []backupWish{}
+
+	rows, err := q.Query("SELECT wish_id, title, author, isbn, edition, priority, notes, creation_date FROM wishlist ORDER BY wish_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var wish backupWish
+		var isbn, edition, notes sql.NullString
+		err := rows.Scan(&wish.WishID, &wish.Title, &wish.Author, &isbn, &edition, &wish.Priority, &notes, &wish.CreationDate)
+		if err != nil {
+			return nil, err
+		}
+		if isbn.Valid {
+			wish.ISBN = &isbn.String
+		}
+		if edition.Valid {
+			wish.Edition = &edition.String
+		}
+		if notes.Valid {
+			wish.Notes = &notes.String
+		}
+		wishes = append(wishes, wish)
+	}
+
+	return wishes, rows.Err()
+}
+
+func backupPurchases(q querier) ([]backupPurchase, error) {
+	purchases := []backupPurchase{}
+
+	rows, err := q.Query("SELECT purchase_id, book_id, copy_id, store, price, currency, purchase_date FROM purchases ORDER BY purchase_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var purchase backupPurchase
+		var copyID sql.NullInt64
+		var store sql.NullString
+		err := rows.Scan(&purchase.PurchaseID, &purchase.BookID, &copyID, &store, &purchase.Price, &purchase.Currency, &purchase.PurchaseDate)
+		if err != nil {
+			return nil, err
+		}
+		purchase.CopyID = nullableInt(copyID)
+		if store.Valid {
+			purchase.Store = &store.String
+		}
+		purchases = append(purchases, purchase)
+	}
+
+	return purchases, rows.Err()
+}
+
+func backupTags(q querier) ([]backupTag, error) {
+	tags := []backupTag{}
+
+	rows, err := q.Query("SELECT tag_id, name, kind, creation_date FROM tags ORDER BY tag_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var tag backupTag
+		var kind sql.NullString
+		err := rows.Scan(&tag.TagID, &tag.Name, &kind, &tag.CreationDate)
+		if err != nil {
+			return nil, err
+		}
+		if kind.Valid {
+			tag.Kind = &kind.String
+		}
+		tags = append(tags, tag)
+	}
+
+	return tags, rows.Err()
+}
+
+func backupBookTags(q querier) ([]backupBookTag, error) {
+	bookTags := []backupBookTag{}
+
+	rows, err := q.Query("SELECT book_id, tag_id FROM book_tags ORDER BY tag_id, book_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var bookTag backupBookTag
+		err := rows.Scan(&bookTag.BookID, &bookTag.TagID)
+		if err != nil {
+			return nil, err
+		}
+		bookTags = append(bookTags, bookTag)
+	}
+
+	return bookTags, rows.Err()
+}
+
+func nullableInt(value sql.NullInt64) *int {
+	if !value.Valid {
+		return nil
+	}
+	number := int(value.Int64)
+	return &number
+}
+
+// Restore loads a backup archive in a single transaction. In "replace" mode the
+// database is emptied first; in "merge" mode existing authors, collections and books
+// with the same name (or title and author) are reused. Either way records get new ids,
+// and books and memberships are remapped to them.
+func Restore(db *sql.DB, r io.ReaderAt, size int64, args RestoreArgs) (*RestoreReport, error) {
+	if args.Mode != "merge" && args.Mode != "replace" {
+		return nil, fmt.Errorf("unknown restore mode %s, expected merge or replace", args.Mode)
+	}
+
+	archive, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := BackupManifest{}
+	err = readBackupFile(archive, backupManifestFile, nil, &manifest)
+	if err != nil {
+		return nil, err
+	}
+	if manifest.Format != backupFormat {
+		return nil, errors.New("not a bookish backup, manifest format is missing")
+	}
+	if manifest.Version > backupVersion {
+		return nil, fmt.Errorf("backup version %d is newer than the supported version %d", manifest.Version, backupVersion)
+	}
+
+	authors := []backupAuthor{}
+	books := []backupBook{}
+	collections := []backupCollection{}
+	memberships := []backupMembership{}
+	copies := []backupCopy{}
+	users := []backupUser{}
+	statuses := []backupReadingStatus{}
+	sessions := []backupReadingSession{}
+	reviews := []backupReview{}
+	notes := []backupNote{}
+	loans := []backupLoan{}
+	wishes := []backupWish{}
+	purchases := []backupPurchase{}
+	tags := []backupTag{}
+	bookTags := []backupBookTag{}
+	files := map[string]any{
+		backupAuthorsFile:     &authors,
+		backupBooksFile:       &books,
+		backupCollectionsFile: &collections,
+		backupMembershipsFile: &memberships,
+	}
+	// backups older than version 3 have no copies
+	if manifest.Version >= 3 {
+		files[backupCopiesFile] = &copies
+	}
+	// and older than version 4 no reading statuses
+	if manifest.Version >= 4 {
+		files[backupUsersFile] = &users
+		files[backupStatusesFile] = &statuses
+	}
+	// and older than version 5 no reading sessions
+	if manifest.Version >= 5 {
+		files[backupSessionsFile] = &sessions
+	}
+	// and older than version 6 no reviews
+	if manifest.Version >= 6 {
+		files[backupReviewsFile] = &reviews
+	}
+	// and older than version 7 no notes
+	if manifest.Version >= 7 {
+		files[backupNotesFile] = &notes
+	}
+	// and older than version 8 no loans
+	if manifest.Version >= 8 {
+		files[backupLoansFile] = &loans
+	}
+	// and older than version 10 no wishlist and purchases
+	if manifest.Version >= 10 {
+		files[backupWishlistFile] = &wishes
+		files[backupPurchasesFile] = &purchases
+	}
+	// and older than version 11 no tags
+	if manifest.Version >= 11 {
+		files[backupTagsFile] = &tags
+		files[backupBookTagsFile] = &bookTags
+	}
+	for name, records := range files {
+		err = readBackupFile(archive, name, &manifest, records)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // no-op once the transaction is committed
+
+	if args.Mode == "replace" {
+		_, err = tx.Exec("TRUNCATE book_tags, tags, purchases, wishlist, loans, notes, reviews, reading_sessions, reading_status, users, copies, book_in_collection, books, collections, authors RESTART IDENTITY")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	report := &RestoreReport{Mode: args.Mode}
+
+	authorIDs := map[int]int{}
+	for _, author := range authors {
+		var authorID int
+		err = tx.QueryRow("INSERT INTO authors (name, creation_date) VALUES ($1, $2) ON CONFLICT (name) DO UPDATE SET name = EXCLUDED.name RETURNING author_id", author.Name, author.CreationDate).Scan(&authorID)
+		if err != nil {
+			return nil, err
+		}
+		authorIDs[author.AuthorID] = authorID
+	}
+	report.Authors = len(authorIDs)
+
+	bookIDs := map[int]int{}
+	for _, book := range books {
+		authorID, ok := authorIDs[book.AuthorID]
+		if !ok {
+			return nil, fmt.Errorf("book %d refers to author %d, which is not in the backup", book.BookID, book.AuthorID)
+		}
+
+		var bookID int
+		err = tx.QueryRow("INSERT INTO books (title, author_id, isbn, published_date, edition_number, publisher, page_count, creation_date) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) ON CONFLICT (title, author_id) DO UPDATE SET title = EXCLUDED.title RETURNING book_id", book.Title, authorID, book.ISBN, book.PublishedDate, book.EditionNumber, book.Publisher, book.PageCount, book.CreationDate).Scan(&bookID)
+		if err != nil {
+			return nil, err
+		}
+		bookIDs[book.BookID] = bookID
+	}
+	report.Books = len(bookIDs)
+
+	collectionIDs := map[int]int{}
+	for _, collection := range collections {
+		var collectionID int
+		err = tx.QueryRow("INSERT INTO collections (collection_name, creation_date) VALUES ($1, $2) ON CONFLICT (collection_name) DO UPDATE SET collection_name = EXCLUDED.collection_name RETURNING collection_id", collection.CollectionName, collection.CreationDate).Scan(&collectionID)
+		if err != nil {
+			return nil, err
+		}
+		collectionIDs[collection.CollectionID] = collectionID
+	}
+	report.Collections = len(collectionIDs)
+
+	for _, membership := range memberships {
+		bookID, bookFound := bookIDs[membership.BookID]
+		collectionID, collectionFound := collectionIDs[membership.CollectionID]
+		if !bookFound || !collectionFound {
+			return nil, fmt.Errorf("membership of book %d in collection %d refers to records that are not in the backup", membership.BookID, membership.CollectionID)
+		}
+
+		err = linkBookToCollection(tx, bookID, collectionID)
+		if err != nil {
+			return nil, err
+		}
+		report.Memberships++
+	}
+
+	copyIDs := map[int]int{}
+	restoredCopies := []int64{}
+	for _, copy := range copies {
+		bookID, ok := bookIDs[copy.BookID]
+		if !ok {
+			return nil, fmt.Errorf("copy %d refers to book %d, which is not in the backup", copy.CopyID, copy.BookID)
+		}
+
+		// merging the same backup twice must not record a copy twice, the loans of the
+		// copy are then remapped to the copy already recorded. Identical copies, such as
+		// two paperbacks on a shelf, are each matched to a different copy.
+		var copyID int
+		err = tx.QueryRow(`SELECT copy_id FROM copies WHERE book_id = $1 AND format = $2 AND condition IS NOT DISTINCT FROM $3 AND location IS NOT DISTINCT FROM $4
+			AND acquired_date IS NOT DISTINCT FROM $5 AND price IS NOT DISTINCT FROM $6 AND copy_id <> ALL($7) ORDER BY copy_id LIMIT 1`,
+			bookID, copy.Format, copy.Condition, copy.Location, copy.AcquiredDate, copy.Price, pq.Array(restoredCopies)).Scan(&copyID)
+		if err == sql.ErrNoRows {
+			err = tx.QueryRow(`INSERT INTO copies (book_id, format, condition, location, acquired_date, price, creation_date) VALUES ($1, $2, $3, $4, $5, $6, $7)
+				ON CONFLICT (location) WHERE format = 'ebook' DO UPDATE SET location = EXCLUDED.location RETURNING copy_id`,
+				bookID, copy.Format, copy.Condition, copy.Location, copy.AcquiredDate, copy.Price, copy.CreationDate).Scan(&copyID)
+		}
+		if err != nil {
+			return nil, err
+		}
+		copyIDs[copy.CopyID] = copyID
+		restoredCopies = append(restoredCopies, int64(copyID))
+		report.Copies++
+	}
+
+	userIDs := map[int]int{}
+	for _, user := range users {
+		var userID int
+		err = tx.QueryRow("INSERT INTO users (name, creation_date) VALUES ($1, $2) ON CONFLICT (name) DO UPDATE SET name = EXCLUDED.name RETURNING user_id", user.Name, user.CreationDate).Scan(&userID)
+		if err != nil {
+			return nil, err
+		}
+		userIDs[user.UserID] = userID
+	}
+	report.Users = len(userIDs)
+
+	for _, status := range statuses {
+		bookID, bookFound := bookIDs[status.BookID]
+		userID, userFound := userIDs[status.UserID]
+		if !bookFound || !userFound {
+			return nil, fmt.Errorf("reading status of book %d for user %d refers to records that are not in the backup", status.BookID, status.UserID)
+		}
+
+		// a merge keeps the status updated last
+		_, err = tx.Exec(`INSERT INTO reading_status (user_id, book_id, status, started_date, finished_date, updated_at) VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT (user_id, book_id) DO UPDATE SET status = EXCLUDED.status, started_date = EXCLUDED.started_date, finished_date = EXCLUDED.finished_date, updated_at = EXCLUDED.updated_at
+			WHERE reading_status.updated_at < EXCLUDED.updated_at`,
+			userID, bookID, status.Status, status.StartedDate, status.FinishedDate, status.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		report.Statuses++
+	}
+
+	for _, session := range sessions {
+		bookID, bookFound := bookIDs[session.BookID]
+		userID, userFound := userIDs[session.UserID]
+		if !bookFound || !userFound {
+			return nil, fmt.Errorf("reading session %d refers to records that are not in the backup", session.SessionID)
+		}
+
+		// merging the same backup twice must not log a session twice
+		_, err = tx.Exec(`INSERT INTO reading_sessions (user_id, book_id, session_date, page, percent, pages, minutes) SELECT $1, $2, $3, $4, $5, $6, $7
+			WHERE NOT EXISTS (SELECT 1 FROM reading_sessions WHERE user_id = $1 AND book_id = $2 AND session_date = $3 AND page IS NOT DISTINCT FROM $4 AND percent IS NOT DISTINCT FROM $5 AND pages IS NOT DISTINCT FROM $6 AND minutes IS NOT DISTINCT FROM $7)`,
+			userID, bookID, session.Date, session.Page, session.Percent, session.Pages, session.Minutes)
+		if err != nil {
+			return nil, err
+		}
+		report.Sessions++
+	}
+
+	for _, review := range reviews {
+		bookID, bookFound := bookIDs[review.BookID]
+		userID, userFound := userIDs[review.UserID]
+		if !bookFound || !userFound {
+			return nil, fmt.Errorf("review %d refers to records that are not in the backup", review.ReviewID)
+		}
+
+		// a merge keeps the review updated last
+		_, err = tx.Exec(`INSERT INTO reviews (user_id, book_id, rating, review, created_at, updated_at) VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT (user_id, book_id) DO UPDATE SET rating = EXCLUDED.rating, review = EXCLUDED.review, updated_at = EXCLUDED.updated_at
+			WHERE reviews.updated_at < EXCLUDED.updated_at`,
+			userID, bookID, review.Rating, review.Review, review.CreatedAt, review.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		report.Reviews++
+	}
+
+	for _, note := range notes {
+		bookID, ok := bookIDs[note.BookID]
+		if !ok {
+			return nil, fmt.Errorf("note %d refers to book %d, which is not in the backup", note.NoteID, note.BookID)
+		}
+		var userID *int
+		if note.UserID != nil {
+			id, ok := userIDs[*note.UserID]
+			if !ok {
+				return nil, fmt.Errorf("note %d refers to user %d, which is not in the backup", note.NoteID, *note.UserID)
+			}
+			userID = &id
+		}
+		if note.Tags == nil {
+			note.Tags = []string{}
+		}
+
+		// merging the same backup twice must not add a note twice
+		_, err = tx.Exec(`INSERT INTO notes (book_id, user_id, kind, text, page, location, tags, creation_date) SELECT $1, $2, $3, $4, $5, $6, $7, $8
+			WHERE NOT EXISTS (SELECT 1 FROM notes WHERE book_id = $1 AND kind = $3 AND text = $4 AND page IS NOT DISTINCT FROM $5)`,
+			bookID, userID, note.Kind, note.Text, note.Page, note.Location, pq.Array(note.Tags), note.CreationDate)
+		if err != nil {
+			return nil, err
+		}
+		report.Notes++
+	}
+
+	for _, loan := range loans {
+		bookID, ok := bookIDs[loan.BookID]
+		if !ok {
+			return nil, fmt.Errorf("loan %d refers to book %d, which is not in the backup", loan.LoanID, loan.BookID)
+		}
+		// a loan of a copy left out of the backup is kept as a loan of the book, like
+		// the loans of a deleted copy
+		var copyID *int
+		if loan.CopyID != nil {
+			if id, ok := copyIDs[*loan.CopyID]; ok {
+				copyID = &id
+			}
+		}
+
+		// merging the same backup twice must not record a loan twice, nor lend a copy
+		// that is out already
+		_, err = tx.Exec(`INSERT INTO loans (book_id, copy_id, borrower, lent_date, due_date, returned_date) SELECT $1, $2, $3, $4, $5, $6
+			WHERE NOT EXISTS (SELECT 1 FROM loans WHERE book_id = $1 AND copy_id IS NOT DISTINCT FROM $2 AND borrower = $3 AND lent_date = $4)
+			ON CONFLICT DO NOTHING`,
+			bookID, copyID, loan.Borrower, loan.LentDate, loan.DueDate, loan.ReturnedDate)
+		if err != nil {
+			return nil, err
+		}
+		report.Loans++
+	}
+
+	for _, wish := range wishes {
+		// a merge keeps the wish already on the wishlist
+		_, err = tx.Exec("INSERT INTO wishlist (title, author, isbn, edition, priority, notes, creation_date) VALUES ($1, $2, $3, $4, $5, $6, $7) ON CONFLICT (title, author) DO NOTHING",
+			wish.Title, wish.Author, wish.ISBN, wish.Edition, wish.Priority, wish.Notes, wish.CreationDate)
+		if err != nil {
+			return nil, err
+		}
+		report.Wishes++
+	}
+
+	for _, purchase := range purchases {
+		bookID, ok := bookIDs[purchase.BookID]
+		if !ok {
+			return nil, fmt.Errorf("purchase %d refers to book %d, which is not in the backup", purchase.PurchaseID, purchase.BookID)
+		}
+		var copyID *int
+		if purchase.CopyID != nil {
+			id, ok := copyIDs[*purchase.CopyID]
+			if !ok {
+				return nil, fmt.Errorf("purchase %d refers to copy %d, which is not in the backup", purchase.PurchaseID, *purchase.CopyID)
+			}
+			copyID = &id
+		}
+
+		// merging the same backup twice must not record a purchase twice
+		_, err = tx.Exec(`INSERT INTO purchases (book_id, copy_id, store, price, currency, purchase_date) SELECT $1, $2, $3, $4, $5, $6
+			WHERE NOT EXISTS (SELECT 1 FROM purchases WHERE book_id = $1 AND copy_id IS NOT DISTINCT FROM $2 AND store IS NOT DISTINCT FROM $3 AND price = $4 AND currency = $5 AND purchase_date = $6)`,
+			bookID, copyID, purchase.Store, purchase.Price, purchase.Currency, purchase.PurchaseDate)
+		if err != nil {
+			return nil, err
+		}
+		report.Purchases++
+	}
+
+	tagIDs := map[int]int{}
+	for _, tag := range tags {
+		// a merge keeps the tags of the database, taking the kind of the backup when they have none
+		var tagID int
+		err = tx.QueryRow("INSERT INTO tags (name, kind, creation_date) VALUES ($1, $2, $3) ON CONFLICT (name) DO UPDATE SET kind = COALESCE(tags.kind, EXCLUDED.kind) RETURNING tag_id",
+			tag.Name, tag.Kind, tag.CreationDate).Scan(&tagID)
+		if err != nil {
+			return nil, err
+		}
+		tagIDs[tag.TagID] = tagID
+		report.Tags++
+	}
+
+	for _, bookTag := range bookTags {
+		bookID, bookFound := bookIDs[bookTag.BookID]
+		tagID, tagFound := tagIDs[bookTag.TagID]
+		if !bookFound || !tagFound {
+			return nil, fmt.Errorf("tag %d of book %d refers to records that are not in the backup", bookTag.TagID, bookTag.BookID)
+		}
+
+		_, err = tx.Exec("INSERT INTO book_tags (book_id, tag_id) VALUES ($1, $2) ON CONFLICT DO NOTHING", bookID, tagID)
+		if err != nil {
+			return nil, err
+		}
+		report.BookTags++
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+// readBackupFile decodes a file of the archive into v, checking it against the
+// manifest when one is given
+func readBackupFile(archive *zip.Reader, name string, manifest *BackupManifest, v any) error {
+	file, err := archive.Open(name)
+	if err != nil {
+		return fmt.Errorf("backup is missing %s", name)
+	}
+	defer file.Close()
+
+	content, err := io.ReadAll(file)
+	if err != nil {
+		return err
+	}
+
+	if manifest != nil {
+		expected, ok := manifest.Files[name]
+		if !ok {
+			return fmt.Errorf("backup manifest has no entry for %s", name)
+		}
+		checksum := sha256.Sum256(content)
+		if hex.EncodeToString(checksum[:]) != expected.SHA256 {
+			return fmt.Errorf("checksum mismatch for %s, the backup is corrupted", name)
+		}
+	}
+
+	err = json.Unmarshal(content, v)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return nil
+}
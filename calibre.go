@@ -0,0 +1,299 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const calibreDatabaseFile = "metadata.db"
+
+// ReadCalibreLibrary reads the books of a Calibre library directory from its
+// metadata.db database, or from the metadata.opf file Calibre keeps in every book
+// folder when there is no database (a copied backup, for example).
+func ReadCalibreLibrary(dir string) ([]CalibreBook, error) {
+	_, err := os.Stat(filepath.Join(dir, calibreDatabaseFile))
+	if err == nil {
+		return readCalibreDatabase(filepath.Join(dir, calibreDatabaseFile))
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	books := []CalibreBook{}
+	err = filepath.WalkDir(dir, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || entry.Name() != "metadata.opf" {
+			return err
+		}
+		book, err := readCalibreOPF(name)
+		if err != nil {
+			return err
+		}
+		book.Path, _ = filepath.Rel(dir, filepath.Dir(name))
+		books = append(books, *book)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(books) == 0 {
+		return nil, fmt.Errorf("%s is not a calibre library, it has no %s or metadata.opf files", dir, calibreDatabaseFile)
+	}
+	return books, nil
+}
+
+// readCalibreDatabase joins the books of metadata.db with their authors, series, tags,
+// identifiers, ratings and publishers, which Calibre keeps in link tables
+func readCalibreDatabase(name string) ([]CalibreBook, error) {
+	database, err := openSQLiteFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	tables := map[string][]map[string]any{}
+	for _, table := range []string{
+		"books", "authors", "books_authors_link", "series", "books_series_link", "tags", "books_tags_link",
+		"identifiers", "ratings", "books_ratings_link", "publishers", "books_publishers_link",
+	} {
+		tables[table], err = database.table(table)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// names of the authors, series, tags and publishers, and ratings, by id
+	names := func(table string, column string) map[int64]any {
+		values := map[int64]any{}
+		for _, row := range tables[table] {
+			values[calibreInt(row["id"])] = row[column]
+		}
+		return values
+	}
+	authors, series, tags, ratings, publishers := names("authors", "name"), names("series", "name"), names("tags", "name"), names("ratings", "rating"), names("publishers", "name")
+
+	books := map[int64]*CalibreBook{}
+	ids := []int64{}
+	for _, row := range tables["books"] {
+		id := calibreInt(row["id"])
+		book := &CalibreBook{
+			ID:          int(id),
+			Title:       calibreText(row["title"]),
+			Authors:     []string{},
+			Tags:        []string{},
+			Identifiers: map[string]string{},
+			Path:        calibreText(row["path"]),
+		}
+		// sqlite stores whole REAL values such as 1.0 as integers
+		switch seriesIndex := row["series_index"].(type) {
+		case float64:
+			book.SeriesIndex = seriesIndex
+		case int64:
+			book.SeriesIndex = float64(seriesIndex)
+		}
+		book.PublishedDate = calibreDate(calibreText(row["pubdate"]))
+		// the isbn column predates the identifiers table, newer libraries leave it empty
+		if isbn := calibreText(row["isbn"]); isbn != "" {
+			book.Identifiers["isbn"] = isbn
+		}
+		books[id] = book
+		ids = append(ids, id)
+	}
+
+	// link rows are read in id order, which is the order the authors were entered in
+	links := func(table string, column string, fn func(book *CalibreBook, value any)) {
+		rows := tables[table]
+		sort.SliceStable(rows, func(i, j int) bool { return calibreInt(rows[i]["id"]) < calibreInt(rows[j]["id"]) })
+		for _, row := range rows {
+			if book, ok := books[calibreInt(row["book"])]; ok {
+				fn(book, row[column])
+			}
+		}
+	}
+	links("books_authors_link", "author", func(book *CalibreBook, value any) {
+		book.Authors = append(book.Authors, calibreText(authors[calibreInt(value)]))
+	})
+	links("books_series_link", "series", func(book *CalibreBook, value any) {
+		book.Series = calibreText(series[calibreInt(value)])
+	})
+	links("books_tags_link", "tag", func(book *CalibreBook, value any) {
+		book.Tags = append(book.Tags, calibreText(tags[calibreInt(value)]))
+	})
+	links("books_ratings_link", "rating", func(book *CalibreBook, value any) {
+		book.Rating = int(calibreInt(ratings[calibreInt(value)])) / 2 // calibre rates out of ten
+	})
+	links("books_publishers_link", "publisher", func(book *CalibreBook, value any) {
+		book.Publisher = calibreText(publishers[calibreInt(value)])
+	})
+	for _, row := range tables["identifiers"] {
+		if book, ok := books[calibreInt(row["book"])]; ok {
+			book.Identifiers[strings.ToLower(calibreText(row["type"]))] = calibreText(row["val"])
+		}
+	}
+
+	result := []CalibreBook{}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		result = append(result, *books[id])
+	}
+	return result, nil
+}
+
+func calibreInt(value any) int64 {
+	switch number := value.(type) {
+	case int64:
+		return number
+	case float64:
+		return int64(number)
+	case string:
+		parsed, _ := strconv.ParseInt(number, 10, 64)
+		return parsed
+	}
+	return 0
+}
+
+func calibreText(value any) string {
+	switch text := value.(type) {
+	case string:
+		return strings.TrimSpace(text)
+	case []byte:
+		return strings.TrimSpace(string(text))
+	case nil:
+		return ""
+	}
+	return fmt.Sprint(value)
+}
+
+// calibreDate keeps the day of a Calibre timestamp such as "1937-09-21 00:00:00+00:00".
+// Calibre writes the year 101 for books without a publication date.
+func calibreDate(timestamp string) string {
+	if len(timestamp) < 10 || strings.HasPrefix(timestamp, "0101") {
+		return ""
+	}
+	return timestamp[:10]
+}
+
+// readCalibreOPF reads the metadata.opf of a book folder, Calibre stores its series
+// and rating as calibre: metas next to the Dublin Core elements
+func readCalibreOPF(name string) (*CalibreBook, error) {
+	content, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var pkg epubPackage
+	err = xml.Unmarshal(content, &pkg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", name, err)
+	}
+
+	book := &CalibreBook{
+		Title:       firstValue(pkg.Titles),
+		Authors:     []string{},
+		Tags:        []string{},
+		Identifiers: map[string]string{},
+		Publisher:   firstValue(pkg.Publishers),
+	}
+	for _, creator := range pkg.Creators {
+		if name := strings.TrimSpace(creator.Value); name != "" && (creator.Role == "" || creator.Role == "aut") {
+			book.Authors = append(book.Authors, name)
+		}
+	}
+	for _, subject := range pkg.Subjects {
+		if subject = strings.TrimSpace(subject); subject != "" {
+			book.Tags = append(book.Tags, subject)
+		}
+	}
+	for _, identifier := range pkg.Identifiers {
+		scheme := strings.ToLower(identifier.Scheme)
+		if scheme == "calibre" {
+			book.ID, _ = strconv.Atoi(strings.TrimSpace(identifier.Value))
+		} else if scheme != "" {
+			book.Identifiers[scheme] = strings.TrimSpace(identifier.Value)
+		}
+	}
+	for _, date := range pkg.Dates {
+		book.PublishedDate = calibreDate(strings.Replace(strings.TrimSpace(date.Value), "T", " ", 1))
+	}
+	for _, meta := range pkg.Metas {
+		switch meta.Name {
+		case "calibre:series":
+			book.Series = strings.TrimSpace(meta.Content)
+		case "calibre:series_index":
+			book.SeriesIndex, _ = strconv.ParseFloat(meta.Content, 64)
+		case "calibre:rating":
+			rating, _ := strconv.ParseFloat(meta.Content, 64)
+			book.Rating = int(rating) / 2
+		}
+	}
+
+	return book, nil
+}
+
+// shelfEntry maps a Calibre book onto the shelf import: its series, tags and
+// rating (as "Rated 4 stars") become collections
+func (book CalibreBook) shelfEntry() shelfEntry {
+	entry := shelfEntry{line: book.ID}
+	entry.book.Title = optionalValue(book.Title)
+	entry.book.Author = joinAuthors(book.Authors)
+	entry.book.Publisher = optionalValue(book.Publisher)
+	entry.book.PublishedDate = optionalValue(book.PublishedDate)
+	if isbn := book.Identifiers["isbn"]; isbn != "" {
+		if sanitized, err := SanitizeISBN(&isbn); err == nil {
+			entry.book.ISBN = sanitized
+		}
+	}
+
+	shelves := append([]string{book.Series}, book.Tags...)
+	if book.Rating > 0 {
+		shelves = append(shelves, fmt.Sprintf("Rated %d stars", book.Rating))
+	}
+	entry.shelves = uniqueShelves(shelves)
+	return entry
+}
+
+// ImportCalibreLibrary imports the books of a Calibre library like a shelf import:
+// books already in the database are matched by ISBN or by title and author, and
+// series, tags and ratings become collections. Rows in the report are Calibre book ids.
+func ImportCalibreLibrary(db *sql.DB, dir string) (*ShelfImportReport, error) {
+	books, err := ReadCalibreLibrary(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // no-op once the transaction is committed
+
+	index, err := loadBookIndex(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ShelfImportReport{
+		Format:  "calibre",
+		Created: []ShelfImportEntry{},
+		Matched: []ShelfImportEntry{},
+		Skipped: []ShelfImportEntry{},
+	}
+	for _, book := range books {
+		err = importShelfEntry(tx, index, book.shelfEntry(), report)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
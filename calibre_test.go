@@ -0,0 +1,65 @@
+package main_test
+
+import (
+	"testing"
+
+	"bookish"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadCalibreLibrary_Database(t *testing.T) {
+	// Function to test
+	books, err := main.ReadCalibreLibrary("testdata/calibre")
+
+	// Verification
+	require.NoError(t, err)
+	require.Len(t, books, 2)
+
+	assert.Equal(t, main.CalibreBook{
+		ID:            1,
+		Title:         "The Colour of Magic",
+		Authors:       []string{"Terry Pratchett"},
+		Series:        "Discworld",
+		SeriesIndex:   1,
+		Tags:          []string{"Fantasy", "Humour"},
+		Identifiers:   map[string]string{"isbn": "9780552124751", "goodreads": "34497"},
+		Rating:        4,
+		Publisher:     "Colin Smythe",
+		PublishedDate: "1983-11-24",
+		Path:          "Terry Pratchett/The Colour of Magic (1)",
+	}, books[0])
+
+	// authors keep the order they were linked in, undefined dates are dropped
+	assert.Equal(t, []string{"Terry Pratchett", "Neil Gaiman"}, books[1].Authors)
+	assert.Equal(t, "", books[1].PublishedDate)
+	assert.Equal(t, 0, books[1].Rating)
+}
+
+func TestReadCalibreLibrary_OPF(t *testing.T) {
+	// Function to test
+	books, err := main.ReadCalibreLibrary("testdata/calibre-opf")
+
+	// Verification
+	require.NoError(t, err)
+	require.Len(t, books, 1)
+	assert.Equal(t, 4, books[0].ID)
+	assert.Equal(t, "Mort", books[0].Title)
+	assert.Equal(t, []string{"Terry Pratchett"}, books[0].Authors)
+	assert.Equal(t, "Discworld", books[0].Series)
+	assert.Equal(t, 4.0, books[0].SeriesIndex)
+	assert.Equal(t, 5, books[0].Rating)
+	assert.Equal(t, "9780552131063", books[0].Identifiers["isbn"])
+	assert.Equal(t, "1987-11-12", books[0].PublishedDate)
+	assert.Equal(t, "Terry Pratchett/Mort (4)", books[0].Path)
+}
+
+func TestReadCalibreLibrary_NotALibrary(t *testing.T) {
+	// Function to test
+	books, err := main.ReadCalibreLibrary(t.TempDir())
+
+	// Verification
+	assert.Error(t, err)
+	assert.Nil(t, books)
+}
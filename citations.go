@@ -0,0 +1,536 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// citationFormat serializes books for reference managers and reads them back
+type citationFormat struct {
+	contentType string
+	write       func(w io.Writer, books []Book) error
+	parse       func(r io.Reader) ([]citationEntry, error)
+}
+
+var citationFormats = map[string]citationFormat{
+	"bibtex": {contentType: "application/x-bibtex; charset=utf-8", write: WriteBibTeX, parse: parseBibTeX},
+	"ris":    {contentType: "application/x-research-info-systems; charset=utf-8", write: WriteRIS, parse: parseRIS},
+}
+
+// citationEntry is a parsed .bib or .ris record, line is where it starts in the file
+type citationEntry struct {
+	line   int
+	fields map[string][]string
+}
+
+// CitationContentType returns the media type of a citation format, or an error if it is unknown
+func CitationContentType(format string) (string, error) {
+	citationFormat, ok := citationFormats[format]
+	if !ok {
+		return "", fmt.Errorf("unknown citation format %s, expected bibtex or ris", format)
+	}
+	return citationFormat.contentType, nil
+}
+
+// ExportCollectionCitations writes the books of a collection as BibTeX or RIS
+func ExportCollectionCitations(db *sql.DB, w io.Writer, collectionID int, format string) error {
+	_, err := CitationContentType(format)
+	if err != nil {
+		return err
+	}
+
+	// fails when the collection does not exist
+	_, err = ListCollections(db, CollectionArgs{CollectionID: &collectionID})
+	if err != nil {
+		return err
+	}
+
+	books, err := ListBooks(db, BookArgs{CollectionID: &collectionID})
+	if err != nil && !errors.Is(err, errNoBooks) {
+		return err
+	}
+
+	return citationFormats[format].write(w, books)
+}
+
+// bookAuthors splits the shared author entry of co-authored books
+func bookAuthors(book Book) []string {
+	return strings.Split(book.Author, " & ")
+}
+
+var citationStopWords = map[string]bool{"a": true, "an": true, "the": true, "of": true, "on": true, "in": true, "and": true}
+
+// citationKeys builds keys like "tolkien1937hobbit-7" from the first author's surname, the
+// publication year, the first significant title word and the book id. The id keeps apart
+// the books that share the rest, and a book gets the same key in every export.
+func citationKeys(books []Book) []string {
+	asciiWord := func(word string) string {
+		return strings.Map(func(r rune) rune {
+			if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' {
+				return r
+			}
+			return -1
+		}, strings.ToLower(word))
+	}
+
+	keys := make([]string, len(books))
+	for index, book := range books {
+		author := bookAuthors(book)[0]
+		surname := author
+		if before, _, found := strings.Cut(author, ","); found {
+			surname = before
+		} else if words := strings.Fields(author); len(words) > 0 {
+			surname = words[len(words)-1]
+		}
+
+		year := "nd"
+		if book.PublishedDate != nil {
+			year = strconv.Itoa(book.PublishedDate.Year())
+		}
+
+		titleWord := ""
+		for _, word := range strings.Fields(book.Title) {
+			word = asciiWord(word)
+			if word != "" && !citationStopWords[word] {
+				titleWord = word
+				break
+			}
+		}
+
+		keys[index] = fmt.Sprintf("%s%s%s-%d", asciiWord(surname), year, titleWord, book.BookID)
+	}
+
+	return keys
+}
+
+var bibTeXEscaper = strings.NewReplacer(
+	`\`, `\textbackslash{}`, `{`, `\{`, `}`, `\}`, `&`, `\&`, `%`, `\%`,
+	`$`, `\$`, `#`, `\#`, `_`, `\_`, `~`, `\textasciitilde{}`, `^`, `\textasciicircum{}`,
+)
+
+// WriteBibTeX writes a @book entry per book
+func WriteBibTeX(w io.Writer, books []Book) error {
+	for index, key := range citationKeys(books) {
+		book := books[index]
+
+		fields := [][2]string{
+			{"author", strings.Join(bookAuthors(book), " and ")},
+			{"title", book.Title},
+		}
+		if book.Edition != nil {
+			fields = append(fields, [2]string{"edition", strconv.Itoa(*book.Edition)})
+		}
+		if book.PublishedDate != nil {
+			fields = append(fields, [2]string{"year", strconv.Itoa(book.PublishedDate.Year())})
+			fields = append(fields, [2]string{"date", book.PublishedDate.Format("2006-01-02")})
+		}
+		if book.Publisher != "" {
+			fields = append(fields, [2]string{"publisher", book.Publisher})
+		}
+		if book.ISBN != "" {
+			fields = append(fields, [2]string{"isbn", book.ISBN})
+		}
+
+		entry := "@book{" + key + ",\n"
+		for _, field := range fields {
+			entry += fmt.Sprintf("  %s = {%s},\n", field[0], bibTeXEscaper.Replace(field[1]))
+		}
+		entry += "}\n\n"
+
+		_, err := io.WriteString(w, entry)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteRIS writes a BOOK record per book
+func WriteRIS(w io.Writer, books []Book) error {
+	for index, key := range citationKeys(books) {
+		book := books[index]
+
+		record := "TY  - BOOK\n"
+		record += "ID  - " + key + "\n"
+		for _, author := range bookAuthors(book) {
+			record += "AU  - " + author + "\n"
+		}
+		record += "TI  - " + book.Title + "\n"
+		if book.Edition != nil {
+			record += "ET  - " + strconv.Itoa(*book.Edition) + "\n"
+		}
+		if book.PublishedDate != nil {
+			record += "PY  - " + strconv.Itoa(book.PublishedDate.Year()) + "\n"
+			record += "DA  - " + book.PublishedDate.Format("2006/01/02") + "/\n"
+		}
+		if book.Publisher != "" {
+			record += "PB  - " + book.Publisher + "\n"
+		}
+		if book.ISBN != "" {
+			record += "SN  - " + book.ISBN + "\n"
+		}
+		record += "ER  - \n\n"
+
+		_, err := io.WriteString(w, record)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ImportCitations creates a book for every entry of a .bib or .ris file, in one
+// transaction where each entry is guarded by a savepoint like in CSV imports
+func ImportCitations(db *sql.DB, r io.Reader, format string) (*ImportReport, error) {
+	_, err := CitationContentType(format)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := citationFormats[format].parse(r)
+	if err != nil {
+		return nil, importFileError{err}
+	}
+
+	report := &ImportReport{Errors: []ImportRowError{}}
+	rows := []importRow{}
+	for _, entry := range entries {
+		report.Rows++
+		row, err := entry.importRow()
+		if err != nil {
+			report.addError(entry.line, err)
+			continue
+		}
+		rows = append(rows, row)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // no-op once the transaction is committed
+
+	created := importBatch(tx, rows, report)
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	report.Created = created
+
+	return report, nil
+}
+
+// importRow maps the fields of a citation to book arguments
+func (entry citationEntry) importRow() (importRow, error) {
+	row := importRow{line: entry.line}
+	first := func(names ...string) *string {
+		for _, name := range names {
+			if values := entry.fields[name]; len(values) > 0 && values[0] != "" {
+				return &values[0]
+			}
+		}
+		return nil
+	}
+
+	row.book.Title = first("title", "ti", "t1", "bt")
+	if row.book.Title == nil {
+		return row, errors.New("no book title set, book not created")
+	}
+
+	authors := []string{}
+	authors = append(authors, entry.fields["au"]...)
+	authors = append(authors, entry.fields["a1"]...)
+	for _, author := range entry.fields["author"] {
+		authors = append(authors, strings.Split(author, " and ")...)
+	}
+	row.book.Author = joinAuthors(authors)
+
+	row.book.Publisher = first("publisher", "pb")
+
+	// editions are often spelled out, as in {Second}, so only numbers are kept
+	row.book.Edition, _ = SanitizeEdition(first("edition", "et"))
+
+	// RIS dates look like 1937/09/21/, years like 1937///
+	if date := first("date", "da", "year", "py", "y1"); date != nil {
+		parts := strings.FieldsFunc(*date, func(r rune) bool { return r == '/' || r == '-' })
+		publishedDate := strings.Join(parts, "-")
+		row.book.PublishedDate = &publishedDate
+		_, err := SanitizePublishedDate(row.book.PublishedDate)
+		if err != nil {
+			return row, err
+		}
+	}
+
+	// SN may hold several ISBNs, keep the first valid one
+	for _, value := range append(entry.fields["isbn"], entry.fields["sn"]...) {
+		for _, candidate := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ';' || unicode.IsSpace(r) }) {
+			if isbn, err := SanitizeISBN(&candidate); err == nil && isbn != nil {
+				row.book.ISBN = isbn
+				return row, nil
+			}
+		}
+	}
+
+	return row, nil
+}
+
+var risLine = regexp.MustCompile(`^([A-Z][A-Z0-9])  -(?: (.*))?$`)
+
+// parseRIS reads the tagged lines of RIS records, from TY to ER
+func parseRIS(r io.Reader) ([]citationEntry, error) {
+	entries := []citationEntry{}
+	var current *citationEntry
+
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		match := risLine.FindStringSubmatch(strings.TrimRight(strings.TrimPrefix(scanner.Text(), "\ufeff"), "\r"))
+		if match == nil {
+			continue
+		}
+		tag, value := strings.ToLower(match[1]), strings.TrimSpace(match[2])
+
+		switch {
+		case tag == "ty":
+			current = &citationEntry{line: line, fields: map[string][]string{}}
+		case current == nil:
+			return nil, fmt.Errorf("line %d: %s tag outside of a record, records start with TY", line, match[1])
+		case tag == "er":
+			entries = append(entries, *current)
+			current = nil
+		default:
+			current.fields[tag] = append(current.fields[tag], value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if current != nil {
+		return nil, fmt.Errorf("line %d: record is not closed with ER", current.line)
+	}
+
+	return entries, nil
+}
+
+// parseBibTeX reads the entries of a .bib file, skipping @string, @preamble and @comment.
+// Field values may be braced, quoted or bare, and are returned without braces or escapes.
+func parseBibTeX(r io.Reader) ([]citationEntry, error) {
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	parser := &bibTeXParser{input: []rune(string(content))}
+
+	entries := []citationEntry{}
+	for {
+		entry, err := parser.next()
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			return entries, nil
+		}
+		entries = append(entries, *entry)
+	}
+}
+
+type bibTeXParser struct {
+	input    []rune
+	position int
+}
+
+func (parser *bibTeXParser) line() int {
+	return strings.Count(string(parser.input[:parser.position]), "\n") + 1
+}
+
+func (parser *bibTeXParser) errorf(format string, args ...any) error {
+	return fmt.Errorf("line %d: %s", parser.line(), fmt.Sprintf(format, args...))
+}
+
+func (parser *bibTeXParser) skipSpaces() {
+	for parser.position < len(parser.input) && unicode.IsSpace(parser.input[parser.position]) {
+		parser.position++
+	}
+}
+
+// readWhile consumes and returns the runes accepted by keep
+func (parser *bibTeXParser) readWhile(keep func(r rune) bool) string {
+	start := parser.position
+	for parser.position < len(parser.input) && keep(parser.input[parser.position]) {
+		parser.position++
+	}
+	return string(parser.input[start:parser.position])
+}
+
+func (parser *bibTeXParser) expect(r rune) error {
+	parser.skipSpaces()
+	if parser.position >= len(parser.input) || parser.input[parser.position] != r {
+		return parser.errorf("expected %q", r)
+	}
+	parser.position++
+	return nil
+}
+
+// next returns the following entry, or nil at the end of the input
+func (parser *bibTeXParser) next() (*citationEntry, error) {
+	for {
+		// anything outside of an entry is a comment
+		parser.readWhile(func(r rune) bool { return r != '@' })
+		if parser.position >= len(parser.input) {
+			return nil, nil
+		}
+		line := parser.line()
+		parser.position++
+
+		entryType := strings.ToLower(parser.readWhile(func(r rune) bool { return unicode.IsLetter(r) }))
+		parser.skipSpaces()
+		if parser.position >= len(parser.input) || (parser.input[parser.position] != '{' && parser.input[parser.position] != '(') {
+			return nil, parser.errorf("expected { after @%s", entryType)
+		}
+
+		if entryType == "comment" || entryType == "string" || entryType == "preamble" {
+			_, err := parser.readDelimited()
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		closing := '}'
+		if parser.input[parser.position] == '(' {
+			closing = ')'
+		}
+		parser.position++
+
+		parser.skipSpaces()
+		parser.readWhile(func(r rune) bool { return r != ',' && r != closing }) // citation key
+		entry := &citationEntry{line: line, fields: map[string][]string{}}
+
+		for {
+			parser.skipSpaces()
+			if parser.position >= len(parser.input) {
+				return nil, parser.errorf("entry starting at line %d is not closed", line)
+			}
+			if parser.input[parser.position] == closing {
+				parser.position++
+				return entry, nil
+			}
+			if parser.input[parser.position] == ',' {
+				parser.position++
+				continue
+			}
+
+			name := strings.ToLower(parser.readWhile(func(r rune) bool {
+				return !unicode.IsSpace(r) && r != '=' && r != ',' && r != closing
+			}))
+			err := parser.expect('=')
+			if err != nil {
+				return nil, err
+			}
+			value, err := parser.readValue(closing)
+			if err != nil {
+				return nil, err
+			}
+			entry.fields[name] = append(entry.fields[name], value)
+		}
+	}
+}
+
+// readValue reads a field value, joining parts concatenated with #
+func (parser *bibTeXParser) readValue(closing rune) (string, error) {
+	value := ""
+	for {
+		parser.skipSpaces()
+		if parser.position >= len(parser.input) {
+			return "", parser.errorf("missing field value")
+		}
+
+		switch parser.input[parser.position] {
+		case '{':
+			part, err := parser.readDelimited()
+			if err != nil {
+				return "", err
+			}
+			value += part
+		case '"':
+			parser.position++
+			start := parser.position
+			depth := 0
+			for parser.position < len(parser.input) && (parser.input[parser.position] != '"' || depth > 0) {
+				switch parser.input[parser.position] {
+				case '{':
+					depth++
+				case '}':
+					depth--
+				}
+				parser.position++
+			}
+			if parser.position >= len(parser.input) {
+				return "", parser.errorf("unterminated quoted value")
+			}
+			value += string(parser.input[start:parser.position])
+			parser.position++
+		default:
+			value += parser.readWhile(func(r rune) bool {
+				return !unicode.IsSpace(r) && r != ',' && r != '#' && r != closing
+			})
+		}
+
+		parser.skipSpaces()
+		if parser.position < len(parser.input) && parser.input[parser.position] == '#' {
+			parser.position++
+			continue
+		}
+		return cleanBibTeXValue(value), nil
+	}
+}
+
+// readDelimited reads a {...} or (...) group, returning its content without the outer delimiters
+func (parser *bibTeXParser) readDelimited() (string, error) {
+	opening := parser.input[parser.position]
+	closing := '}'
+	if opening == '(' {
+		closing = ')'
+	}
+	parser.position++
+	start := parser.position
+
+	depth := 1
+	for parser.position < len(parser.input) {
+		switch r := parser.input[parser.position]; {
+		case r == '\\':
+			parser.position++ // skip the escaped rune
+		case r == opening:
+			depth++
+		case r == closing:
+			depth--
+			if depth == 0 {
+				content := string(parser.input[start:parser.position])
+				parser.position++
+				return content, nil
+			}
+		}
+		parser.position++
+	}
+	return "", parser.errorf("unbalanced %c", opening)
+}
+
+var bibTeXUnescaper = strings.NewReplacer(
+	`\textbackslash{}`, `\`, `\textasciitilde{}`, `~`, `\textasciicircum{}`, `^`,
+	`\&`, `&`, `\%`, `%`, `\$`, `$`, `\#`, `#`, `\_`, `_`, `\{`, "\x00", `\}`, "\x01",
+)
+
+// cleanBibTeXValue removes grouping braces and escapes and collapses whitespace
+func cleanBibTeXValue(value string) string {
+	value = bibTeXUnescaper.Replace(value)
+	value = strings.NewReplacer("{", "", "}", "").Replace(value)
+	value = strings.NewReplacer("\x00", "{", "\x01", "}").Replace(value)
+	return strings.Join(strings.Fields(value), " ")
+}
@@ -0,0 +1,44 @@
+package main_test
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"bookish"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// the citation writers need no database, so these tests run outside the suite
+
+func TestWriteBibTeX_Keys(t *testing.T) {
+	// Setup
+	publishedDate := time.Date(1987, 11, 1, 0, 0, 0, 0, time.UTC)
+	books := []main.Book{}
+	for id := 1; id <= 30; id++ {
+		books = append(books, main.Book{BookID: id, Title: "Mort", Author: "Terry Pratchett", PublishedDate: &publishedDate})
+	}
+
+	// Function to test
+	var all, alone strings.Builder
+	err := main.WriteBibTeX(&all, books)
+	require.NoError(t, err)
+	err = main.WriteBibTeX(&alone, books[29:])
+	require.NoError(t, err)
+
+	// Verification
+	keys := regexp.MustCompile(`@book\{([^,]*),`).FindAllStringSubmatch(all.String(), -1)
+	require.Len(t, keys, 30)
+	seen := map[string]bool{}
+	for _, key := range keys {
+		assert.Regexp(t, `^[a-z0-9]+-[0-9]+$`, key[1])
+		assert.False(t, seen[key[1]], key[1])
+		seen[key[1]] = true
+	}
+	// a book has the same key whatever it is exported with
+	assert.Equal(t, "pratchett1987mort-30", keys[29][1])
+	assert.True(t, strings.HasPrefix(alone.String(), "@book{pratchett1987mort-30,\n"))
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+const cliName = "bookish"
+
+// exit codes of the CLI
+const (
+	exitOK    = 0
+	exitError = 1 // the command ran and failed
+	exitUsage = 2 // the command line is wrong, nothing ran
+)
+
+// usageError is returned by a command whose arguments are wrong, the dispatcher prints
+// the usage of the command with it and exits with exitUsage
+type usageError struct {
+	message string
+}
+
+func (err usageError) Error() string {
+	return err.message
+}
+
+func usageErrorf(format string, args ...any) error {
+	return usageError{message: fmt.Sprintf(format, args...)}
+}
+
+// newFlagSet returns a flag set that reports its errors to the dispatcher rather than
+// printing them and exiting
+func newFlagSet(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	return flags
+}
+
+// idFlag parses the value of an id flag, an empty value means the flag was not set
+func idFlag(name string, value string) (*int, error) {
+	if value == "" {
+		return nil, nil
+	}
+	id, err := SanitizeIdNumber(&value)
+	if err != nil {
+		return nil, usageErrorf("invalid -%s %q, ids are numbers", name, value)
+	}
+	return id, nil
+}
+
+func isHelpArgument(arg string) bool {
+	return arg == "help" || arg == "-h" || arg == "-help" || arg == "--help"
+}
+
+func findCommand(commands []*Command, name string) *Command {
+	for _, command := range commands {
+		if command.name == name {
+			return command
+		}
+	}
+	return nil
+}
+
+func (command *Command) subcommand(name string) *Subcommand {
+	for _, subcommand := range command.subcommands {
+		if subcommand.name == name {
+			return subcommand
+		}
+	}
+	return nil
+}
+
+// leaf lets a command without subcommands, such as export, run like a subcommand
+func (command *Command) leaf() *Subcommand {
+	return &Subcommand{
+		name:        command.name,
+		description: command.description,
+		flags:       command.flags,
+		arguments:   command.arguments,
+		values:      command.values,
+		run:         command.run,
+	}
+}
+
+// runCLI runs the command named by the arguments (without the program name) and
+// returns the exit code. Help goes to stdout when asked for, to stderr with errors.
+// Global flags, when given, come before the command.
+func runCLI(commands []*Command, globals *flag.FlagSet, args []string, stdout io.Writer, stderr io.Writer) int {
+	if globals != nil {
+		err := globals.Parse(args)
+		if errors.Is(err, flag.ErrHelp) {
+			printUsage(stdout, commands, globals)
+			return exitOK
+		}
+		if err != nil {
+			fmt.Fprintf(stderr, "%v\n\n", err)
+			printUsage(stderr, commands, globals)
+			return exitUsage
+		}
+		args = globals.Args()
+	}
+
+	if len(args) == 0 {
+		printUsage(stderr, commands, globals)
+		return exitUsage
+	}
+	if isHelpArgument(args[0]) {
+		return runHelp(commands, globals, args[1:], stdout, stderr)
+	}
+
+	command := findCommand(commands, args[0])
+	if command == nil {
+		fmt.Fprintf(stderr, "unknown command %q\n\n", args[0])
+		printUsage(stderr, commands, globals)
+		return exitUsage
+	}
+	if len(command.subcommands) == 0 {
+		return runSubcommand(cliName+" "+command.name, command.leaf(), args[1:], stdout, stderr)
+	}
+
+	if len(args) < 2 {
+		fmt.Fprintf(stderr, "no %s subcommand set\n\n", command.name)
+		printCommandUsage(stderr, command)
+		return exitUsage
+	}
+	if isHelpArgument(args[1]) {
+		printCommandUsage(stdout, command)
+		return exitOK
+	}
+	subcommand := command.subcommand(args[1])
+	if subcommand == nil {
+		fmt.Fprintf(stderr, "unknown %s subcommand %q\n\n", command.name, args[1])
+		printCommandUsage(stderr, command)
+		return exitUsage
+	}
+	return runSubcommand(cliName+" "+command.name+" "+subcommand.name, subcommand, args[2:], stdout, stderr)
+}
+
+func runSubcommand(path string, subcommand *Subcommand, args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := subcommand.flags
+	if flags == nil {
+		flags = newFlagSet(subcommand.name)
+	}
+
+	err := flags.Parse(args)
+	if errors.Is(err, flag.ErrHelp) {
+		printSubcommandUsage(stdout, path, subcommand)
+		return exitOK
+	}
+	if err == nil && subcommand.arguments == "" && flags.NArg() > 0 {
+		err = fmt.Errorf("unexpected argument %q", flags.Arg(0))
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "%s: %v\n\n", path, err)
+		printSubcommandUsage(stderr, path, subcommand)
+		return exitUsage
+	}
+
+	err = subcommand.run(stdout, flags.Args())
+	var usage usageError
+	if errors.As(err, &usage) {
+		fmt.Fprintf(stderr, "%s: %v\n\n", path, err)
+		printSubcommandUsage(stderr, path, subcommand)
+		return exitUsage
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "%s: %v\n", path, err)
+		return exitError
+	}
+	return exitOK
+}
+
+// runHelp prints the help of a command or subcommand, or the list of commands
+func runHelp(commands []*Command, globals *flag.FlagSet, args []string, stdout io.Writer, stderr io.Writer) int {
+	if len(args) == 0 {
+		printUsage(stdout, commands, globals)
+		return exitOK
+	}
+
+	command := findCommand(commands, args[0])
+	if command == nil {
+		fmt.Fprintf(stderr, "unknown command %q\n\n", args[0])
+		printUsage(stderr, commands, globals)
+		return exitUsage
+	}
+	if len(command.subcommands) == 0 {
+		printSubcommandUsage(stdout, cliName+" "+command.name, command.leaf())
+		return exitOK
+	}
+	if len(args) == 1 {
+		printCommandUsage(stdout, command)
+		return exitOK
+	}
+
+	subcommand := command.subcommand(args[1])
+	if subcommand == nil {
+		fmt.Fprintf(stderr, "unknown %s subcommand %q\n\n", command.name, args[1])
+		printCommandUsage(stderr, command)
+		return exitUsage
+	}
+	printSubcommandUsage(stdout, cliName+" "+command.name+" "+subcommand.name, subcommand)
+	return exitOK
+}
+
+func printUsage(w io.Writer, commands []*Command, globals *flag.FlagSet) {
+	if globals != nil {
+		fmt.Fprintf(w, "Usage: %s [<global flags>] <command> [<subcommand>] [<flags>]\n\nCommands:\n", cliName)
+	} else {
+		fmt.Fprintf(w, "Usage: %s <command> [<subcommand>] [<flags>]\n\nCommands:\n", cliName)
+	}
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, command := range commands {
+		if command.hidden {
+			continue
+		}
+		if len(command.subcommands) == 0 {
+			fmt.Fprintf(table, "  %s\t%s\n", command.name, command.description)
+		}
+		for _, subcommand := range command.subcommands {
+			fmt.Fprintf(table, "  %s %s\t%s\n", command.name, subcommand.name, subcommand.description)
+		}
+	}
+	fmt.Fprintf(table, "  help [<command>]\tShow the help of a command\n")
+	table.Flush()
+
+	if globals != nil {
+		fmt.Fprintf(w, "\nGlobal flags:\n")
+		globals.SetOutput(w)
+		globals.PrintDefaults()
+		globals.SetOutput(io.Discard)
+	}
+	fmt.Fprintf(w, "\nRun '%s help <command> [<subcommand>]' for its flags.\n", cliName)
+}
+
+func printCommandUsage(w io.Writer, command *Command) {
+	fmt.Fprintf(w, "Usage: %s %s <subcommand> [<flags>]\n\n%s\n\nSubcommands:\n", cliName, command.name, command.description)
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, subcommand := range command.subcommands {
+		fmt.Fprintf(table, "  %s\t%s\n", subcommand.name, subcommand.description)
+	}
+	table.Flush()
+	fmt.Fprintf(w, "\nRun '%s help %s <subcommand>' for its flags.\n", cliName, command.name)
+}
+
+func printSubcommandUsage(w io.Writer, path string, subcommand *Subcommand) {
+	hasFlags := false
+	if subcommand.flags != nil {
+		subcommand.flags.VisitAll(func(*flag.Flag) { hasFlags = true })
+	}
+
+	usage := []string{"Usage: " + path}
+	if hasFlags {
+		usage = append(usage, "[<flags>]")
+	}
+	if subcommand.arguments != "" {
+		usage = append(usage, subcommand.arguments)
+	}
+	fmt.Fprintf(w, "%s\n\n%s\n", strings.Join(usage, " "), subcommand.description)
+
+	if hasFlags {
+		fmt.Fprintf(w, "\nFlags:\n")
+		subcommand.flags.SetOutput(w)
+		subcommand.flags.PrintDefaults()
+		subcommand.flags.SetOutput(io.Discard)
+	}
+}
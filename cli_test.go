@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// the dispatcher needs no database, these commands only record how they were run
+
+func testCommands(ran *[]string) []*Command {
+	var name string
+	flags := newFlagSet("greet")
+	flags.StringVar(&name, "n", "", "Name to greet")
+
+	return []*Command{
+		{
+			name:        "greet",
+			description: "Greet someone",
+			subcommands: []*Subcommand{
+				{
+					name:        "hello",
+					description: "Say hello",
+					flags:       flags,
+					run: func(out io.Writer, args []string) error {
+						if name == "" {
+							return usageErrorf("no name set")
+						}
+						*ran = append(*ran, "hello "+name)
+						return nil
+					},
+				},
+				{
+					name:        "fail",
+					description: "Fail on purpose",
+					arguments:   "<reason>",
+					run: func(out io.Writer, args []string) error {
+						return errors.New("failed: " + args[0])
+					},
+				},
+			},
+		},
+		{
+			name:        "version",
+			description: "Print the version",
+			run: func(out io.Writer, args []string) error {
+				*ran = append(*ran, "version")
+				return nil
+			},
+		},
+	}
+}
+
+func TestRunCLI_ExitCodes(t *testing.T) {
+	for _, test := range []struct {
+		args []string
+		code int
+		ran  []string
+	}{
+		{args: []string{"greet", "hello", "-n", "Bilbo"}, code: exitOK, ran: []string{"hello Bilbo"}},
+		{args: []string{"version"}, code: exitOK, ran: []string{"version"}},
+		{args: []string{}, code: exitUsage},
+		{args: []string{"farewell"}, code: exitUsage},
+		{args: []string{"greet"}, code: exitUsage},
+		{args: []string{"greet", "goodbye"}, code: exitUsage},
+		{args: []string{"greet", "hello", "-x"}, code: exitUsage},
+		{args: []string{"greet", "hello"}, code: exitUsage},
+		{args: []string{"version", "extra"}, code: exitUsage},
+		{args: []string{"greet", "fail", "on purpose"}, code: exitError},
+		{args: []string{"greet", "hello", "-h"}, code: exitOK},
+		{args: []string{"help", "greet"}, code: exitOK},
+		{args: []string{"help", "farewell"}, code: exitUsage},
+	} {
+		// Setup
+		ran := []string{}
+		var stdout, stderr bytes.Buffer
+
+		// Function to test
+		code := runCLI(testCommands(&ran), nil, test.args, &stdout, &stderr)
+
+		// Verification
+		assert.Equal(t, test.code, code, "%v: %s", test.args, stderr.String())
+		if test.ran == nil {
+			test.ran = []string{}
+		}
+		assert.Equal(t, test.ran, ran, "%v", test.args)
+	}
+}
+
+func TestRunCLI_Help(t *testing.T) {
+	// Setup
+	var stdout, stderr bytes.Buffer
+
+	// Function to test
+	code := runCLI(testCommands(&[]string{}), nil, []string{"help", "greet", "hello"}, &stdout, &stderr)
+
+	// Verification
+	assert.Equal(t, exitOK, code)
+	assert.Empty(t, stderr.String())
+	assert.Contains(t, stdout.String(), "Usage: bookish greet hello [<flags>]")
+	assert.Contains(t, stdout.String(), "Say hello")
+	assert.Contains(t, stdout.String(), "-n string")
+	assert.Contains(t, stdout.String(), "Name to greet")
+}
+
+func TestRunCLI_UnknownFlag(t *testing.T) {
+	// Setup
+	var stdout, stderr bytes.Buffer
+
+	// Function to test
+	code := runCLI(testCommands(&[]string{}), nil, []string{"greet", "hello", "-x"}, &stdout, &stderr)
+
+	// Verification
+	assert.Equal(t, exitUsage, code)
+	assert.Empty(t, stdout.String())
+	assert.Contains(t, stderr.String(), "flag provided but not defined: -x")
+	assert.Contains(t, stderr.String(), "Usage: bookish greet hello")
+}
+
+func TestCLICommands_Help(t *testing.T) {
+	// Setup
+	var stdout, stderr bytes.Buffer
+
+	// Function to test
+	code := runCLI(cliCommands(), nil, []string{"help"}, &stdout, &stderr)
+
+	// Verification
+	assert.Equal(t, exitOK, code)
+	for _, command := range []string{"book create", "book list", "book import", "book scan", "collection create", "collection list", "book update", "book status", "book progress", "collection add", "collection remove", "collection export", "review create", "review edit", "review list", "note add", "note list", "note edit", "note delete", "copy add", "copy list", "copy edit", "copy delete", "copy where", "loan out", "loan return", "loan list", "wish add", "wish list", "wish edit", "wish delete", "wish acquire", "purchase add", "purchase list", "purchase spending", "tag create", "tag list", "tag edit", "tag delete", "tag apply", "tag remove", "tui", "export", "backup", "restore"} {
+		assert.Contains(t, stdout.String(), "  "+command+" ")
+	}
+
+	// every command has help of its own
+	for _, command := range cliCommands() {
+		for _, subcommand := range command.subcommands {
+			stdout.Reset()
+			assert.Equal(t, exitOK, runCLI(cliCommands(), nil, []string{"help", command.name, subcommand.name}, &stdout, &stderr))
+			assert.Contains(t, stdout.String(), subcommand.description)
+		}
+	}
+}
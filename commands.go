@@ -3,286 +3,2611 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
+	"log"
+	"net/http"
 	"os"
+	"strings"
+	"time"
 )
 
-func createBookCommands() Command {
-	var createBookTitle string
-	var createBookAuthor string
-	var listBookTitle string
-	var listBookAuthor string
-	var listBookId string
+// cliCommands registers the commands of the CLI, in the order the help lists them
+func cliCommands() []*Command {
+	return []*Command{
+		createBookCommands(),
+		createCollectionCommands(),
+		createReviewCommands(),
+		createNoteCommands(),
+		createCopyCommands(),
+		createLoanCommands(),
+		createWishCommands(),
+		createPurchaseCommands(),
+		createTagCommands(),
+		createExportCommand(),
+		createBackupCommand(),
+		createRestoreCommand(),
+		createServeCommand(),
+		createMigrateCommand(),
+		createShellCommand(),
+		createTuiCommand(),
+		createCompletionCommand(),
+		createCompleteCommand(),
+	}
+}
+
+// newGlobalFlags returns the flags given before the command, which choose whether the
+// commands run on the database or on a server with a profile
+func newGlobalFlags() (*flag.FlagSet, *string, *bool) {
+	globals := newFlagSet(cliName)
+	profile := globals.String("profile", os.Getenv("BOOKISH_PROFILE"), "Profile of the server to work with, the default one of the profile file when empty")
+	direct := globals.Bool("direct", false, "Work on the database of the configuration file even when there is a default profile")
+	globals.StringVar(&configPath, "config", configPath, "Configuration file of the database, used by serve, migrate and the commands run without a profile")
+	return globals, profile, direct
+}
+
+// globalValues completes the values of the global flags
+var globalValues = map[string]flagValues{
+	"profile": {library: completeProfiles},
+	"config":  {path: "file"},
+}
+
+func CLIcommands() {
+	globals, profile, direct := newGlobalFlags()
+	openBackend = func() (backend, error) {
+		return openProfileBackend(*profile, *direct)
+	}
+
+	// with no arguments the server starts and sets up the schema, as it did before
+	// the serve command
+	args := os.Args[1:]
+	if len(args) == 0 {
+		args = []string{"serve", "-migrate"}
+	}
+	os.Exit(runCLI(cliCommands(), globals, args, os.Stdout, os.Stderr))
+}
+
+// outputFile returns the file named by an -o flag, or out when the flag is empty.
+// The returned function closes the file.
+func outputFile(out io.Writer, name string) (io.Writer, func() error, error) {
+	if name == "" {
+		return out, func() error { return nil }, nil
+	}
+	file, err := os.Create(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	return file, file.Close, nil
+}
 
-	// Define command-line interface
-	bookCmd := Command{
+func createBookCommands() *Command {
+	return &Command{
 		name:        "book",
 		description: "Manage books in the database",
 		subcommands: []*Subcommand{
-			{
-				name:        "create",
-				description: "Create a new book",
-				flags:       flag.NewFlagSet("create", flag.ExitOnError),
-			},
-			{
-				name:        "list",
-				description: "List all books",
-				flags:       flag.NewFlagSet("list", flag.ExitOnError),
-			},
+			createBookCreateCommand(),
+			createBookListCommand(),
+			createBookUpdateCommand(),
+			createBookStatusCommand(),
+			createBookProgressCommand(),
+			createBookImportCommand(),
+			createBookScanCommand(),
 		},
 	}
+}
+
+func createBookCreateCommand() *Subcommand {
+	var title string
+	var author string
+	var pageCount int
 
-	// Define flags for the 'create' subcommand of the 'book' command
-	createBookCmd := bookCmd.subcommands[0].flags
-	createBookCmd.StringVar(&createBookTitle, "t", "", "Title of the book")
-	createBookCmd.StringVar(&createBookAuthor, "a", "", "Name of the author")
+	flags := newFlagSet("create")
+	flags.StringVar(&title, "t", "", "Title of the book")
+	flags.StringVar(&author, "a", "", "Name of the author")
+	flags.IntVar(&pageCount, "pages", 0, "Number of pages of the book")
+	output := addOutputFlags(flags)
+
+	return &Subcommand{
+		name:        "create",
+		description: "Create a new book",
+		flags:       flags,
+		values:      map[string]flagValues{"a": {library: completeAuthors}},
+		run: func(out io.Writer, args []string) error {
+			err := output.validate()
+			if err != nil {
+				return err
+			}
 
-	// Define flags for the 'list' subcommand of the 'book' command
-	listBookCmd := bookCmd.subcommands[1].flags
-	listBookCmd.StringVar(&listBookTitle, "t", "", "Title of the book")
-	listBookCmd.StringVar(&listBookAuthor, "a", "", "Name of the author")
-	listBookCmd.StringVar(&listBookId, "i", "", "Id of the book")
+			library, err := currentBackend()
+			if err != nil {
+				return err
+			}
 
-	return bookCmd
+			bookArgs := BookArgs{Title: optionalValue(title), Author: optionalValue(author)}
+			if pageCount != 0 {
+				bookArgs.PageCount = &pageCount
+			}
+			book, err := library.CreateBook(bookArgs)
+			if err != nil {
+				return err
+			}
+			if output.format == "table" && !output.quiet {
+				fmt.Fprintf(out, "Creating book with title %s\n", book.Title)
+				return nil
+			}
+			return writeRecord(out, output, *book, bookView)
+		},
+	}
 }
 
-func createCollectionCommands() Command {
-	var createCollectionName string
-	var listCollectionName string
-	var listCollectionId string
+func createBookListCommand() *Subcommand {
+	var title string
+	var author string
+	var id string
+	var status string
+	var user string
+	var sort string
+	var tags string
+	var match string
 
-	var addCollectionId string
-	var addBookId string
+	flags := newFlagSet("list")
+	flags.StringVar(&title, "t", "", "Title of the book")
+	flags.StringVar(&author, "a", "", "Name of the author")
+	flags.StringVar(&id, "i", "", "Id of the book")
+	flags.StringVar(&status, "status", "", "Reading status of the books: want-to-read, reading, read or abandoned")
+	flags.StringVar(&user, "u", "", "User whose reading status is listed, anyone's when empty")
+	flags.StringVar(&sort, "sort", "id", "Order of the books: id, or rating for the best rated first")
+	flags.StringVar(&tags, "tags", "", "Comma separated tags of the books")
+	flags.StringVar(&match, "match", "all", "Whether the books have all the tags or any of them: all or any")
+	output := addOutputFlags(flags)
 
-	collectionCmd := Command{
-		name:        "collection",
-		description: "Manage collections in the database",
-		subcommands: []*Subcommand{
-			{
-				name:        "create",
-				description: "Create a new collection",
-				flags:       flag.NewFlagSet("create", flag.ExitOnError),
-			},
-			{
-				name:        "list",
-				description: "List all collections",
-				flags:       flag.NewFlagSet("list", flag.ExitOnError),
-			},
-			{
-				name:        "add",
-				description: "Add a book to a collection",
-				flags:       flag.NewFlagSet("add", flag.ExitOnError),
-			},
+	return &Subcommand{
+		name:        "list",
+		description: "List all books",
+		flags:       flags,
+		values:      map[string]flagValues{"t": {library: completeTitles}, "a": {library: completeAuthors}, "i": {library: completeBookIDs}, "status": {words: readingStatuses}, "sort": {words: bookSorts}, "tags": {library: completeTagNames}, "match": {words: tagMatches}},
+		run: func(out io.Writer, args []string) error {
+			err := output.validate()
+			if err != nil {
+				return err
+			}
+			bookID, err := idFlag("i", id)
+			if err != nil {
+				return err
+			}
+
+			library, err := currentBackend()
+			if err != nil {
+				return err
+			}
+
+			books, err := library.ListBooks(BookArgs{BookID: bookID, Title: optionalValue(title), Author: optionalValue(author), Status: optionalValue(status), User: optionalValue(user), Sort: optionalValue(sort), Tags: splitTags(tags), TagMatch: optionalValue(match)})
+			if err != nil {
+				return err
+			}
+			return writeRecords(out, output, books, bookView)
 		},
 	}
+}
+
+func createBookUpdateCommand() *Subcommand {
+	var id string
+	var title string
+	var author string
+	var isbn string
+	var publishedDate string
+	var edition int
+	var publisher string
+	var pageCount int
 
-	// Define flags for the 'create' subcommand of the 'collection' command
-	createCollectionCmd := collectionCmd.subcommands[0].flags
-	createCollectionCmd.StringVar(&createCollectionName, "n", "", "Name of the collection")
+	flags := newFlagSet("update")
+	flags.StringVar(&id, "i", "", "Id of the book")
+	flags.StringVar(&title, "t", "", "New title of the book")
+	flags.StringVar(&author, "a", "", "New author of the book")
+	flags.StringVar(&isbn, "isbn", "", "New ISBN, empty to clear it")
+	flags.StringVar(&publishedDate, "date", "", "New published date (YYYY, YYYY-MM or YYYY-MM-DD), empty to clear it")
+	flags.IntVar(&edition, "edition", 0, "New edition number, 0 to clear it")
+	flags.StringVar(&publisher, "publisher", "", "New publisher, empty to clear it")
+	flags.IntVar(&pageCount, "pages", 0, "New number of pages, 0 to clear it")
+	output := addOutputFlags(flags)
+
+	return &Subcommand{
+		name:        "update",
+		description: "Change the metadata of a book, only the flags given are changed",
+		flags:       flags,
+		values:      map[string]flagValues{"i": {library: completeBookIDs}, "t": {library: completeTitles}, "a": {library: completeAuthors}},
+		run: func(out io.Writer, args []string) error {
+			err := output.validate()
+			if err != nil {
+				return err
+			}
+			bookID, err := idFlag("i", id)
+			if err != nil {
+				return err
+			}
+			if bookID == nil {
+				return usageErrorf("no book chosen, set its id with -i")
+			}
 
-	// Define flags for the 'list' subcommand of the 'collection' command
-	listCollectionCmd := collectionCmd.subcommands[1].flags
-	listCollectionCmd.StringVar(&listCollectionName, "n", "", "Name of the collection")
-	listCollectionCmd.StringVar(&listCollectionId, "i", "", "Id of the collection")
+			// the flags left out keep their value, set ones may be empty to clear a field
+			bookArgs := BookArgs{BookID: bookID}
+			flags.Visit(func(f *flag.Flag) {
+				switch f.Name {
+				case "t":
+					bookArgs.Title = &title
+				case "a":
+					bookArgs.Author = &author
+				case "isbn":
+					bookArgs.ISBN = &isbn
+				case "date":
+					bookArgs.PublishedDate = &publishedDate
+				case "edition":
+					bookArgs.Edition = &edition
+				case "publisher":
+					bookArgs.Publisher = &publisher
+				case "pages":
+					bookArgs.PageCount = &pageCount
+				}
+			})
 
-	// Define flags for the 'list' subcommand of the 'collection' command
-	addCollectionCmd := collectionCmd.subcommands[2].flags
-	addCollectionCmd.StringVar(&addCollectionId, "i", "", "Id of the collection")
-	addCollectionCmd.StringVar(&addBookId, "bi", "", "Id of the book to be added")
+			library, err := currentBackend()
+			if err != nil {
+				return err
+			}
 
-	return collectionCmd
+			book, err := library.UpdateBook(bookArgs)
+			if err != nil {
+				return err
+			}
+			if output.format == "table" && !output.quiet {
+				fmt.Fprintf(out, "Book %s updated\n", book.Title)
+				return nil
+			}
+			return writeRecord(out, output, *book, bookView)
+		},
+	}
 }
 
-func CLIcommands() {
+// readingUser is the user of the -u flag, or of the BOOKISH_USER environment variable
+func readingUser(user string) *string {
+	if user == "" {
+		user = os.Getenv("BOOKISH_USER")
+	}
+	return optionalValue(user)
+}
 
-	bookCmd := createBookCommands()
-	createBookCmd := bookCmd.subcommands[0].flags
-	listBookCmd := bookCmd.subcommands[1].flags
-
-	collectionCmd := createCollectionCommands()
-	createCollectionCmd := collectionCmd.subcommands[0].flags
-	listCollectionCmd := collectionCmd.subcommands[1].flags
-	addCollectionCmd := collectionCmd.subcommands[2].flags
-
-	// Parse command-line arguments
-	if len(os.Args) < 2 {
-		fmt.Println("Usage: books-database <command> [<args>]")
-		fmt.Println("Commands:")
-		fmt.Println("\tbook create\tCreate a new book")
-		fmt.Println("\tbook list\t\t\tList all books")
-		fmt.Println("\tcollection create\t\tCreate a new collection")
-		fmt.Println("\tcollection list\t\tList all collections")
-		fmt.Println("\tcollection add\t\tAdd a book to a collection")
-		os.Exit(1)
-	}
-
-	switch os.Args[1] {
-	case "book":
-		// Parse subcommand arguments
-		if len(os.Args) < 3 {
-			fmt.Println("No book title set, book not created")
-			fmt.Println("Usage: books-database book <subcommand> [<args>]")
-			fmt.Println("Subcommands:")
-			fmt.Println("\tcreate\tCreate a new book")
-			fmt.Println("\tlist\t\t\tList all books")
-			os.Exit(1)
-		}
-
-		var bookArgs BookArgs
-		switch os.Args[2] {
-		case "create":
-			bookCmd.subcommands[0].flags.Parse(os.Args[3:])
-			var tFlag *string 
-			var aFlag *string 
-			
-			if createBookCmd.Lookup("t").Value.String() != "" {
-				tFlagString := createBookCmd.Lookup("t").Value.String() //not addressable
-				tFlag = &tFlagString
-			}
-			if createBookCmd.Lookup("a").Value.String() != "" {
-				aFlagString := createBookCmd.Lookup("a").Value.String() //not addressable
-				aFlag = &aFlagString
-				
-			}
-
-			bookArgs = BookArgs{Title: tFlag, Author: aFlag}
-
-			result, err := CreateBook(db, bookArgs)
-			if err != nil {
-				fmt.Println(err)
-			} else {
-				fmt.Printf("Creating book with title %s\n", result.Title)
-			}
+func createBookStatusCommand() *Subcommand {
+	var id string
+	var user string
+	var status string
+	var started string
+	var finished string
 
-		case "list":
-			bookCmd.subcommands[1].flags.Parse(os.Args[3:])
-			var tFlag *string 
-			var aFlag *string 
-			var iFlag *int 
+	flags := newFlagSet("status")
+	flags.StringVar(&id, "i", "", "Id of the book")
+	flags.StringVar(&user, "u", "", "User whose reading it is, BOOKISH_USER when empty")
+	flags.StringVar(&status, "s", "", "New status: want-to-read, reading, read or abandoned; the statuses of the book are listed when empty")
+	flags.StringVar(&started, "started", "", "Day the reading started (YYYY-MM-DD), today when a book starts being read")
+	flags.StringVar(&finished, "finished", "", "Day the reading ended (YYYY-MM-DD), today when a book is read or abandoned")
+	output := addOutputFlags(flags)
 
-			if listBookCmd.Lookup("t").Value.String() != "" {
-				tFlagString := listBookCmd.Lookup("t").Value.String() //not addressable
-				tFlag = &tFlagString
+	return &Subcommand{
+		name:        "status",
+		description: "Set the reading status of a book for a user, or list the statuses of a book",
+		flags:       flags,
+		values:      map[string]flagValues{"i": {library: completeBookIDs}, "s": {words: readingStatuses}},
+		run: func(out io.Writer, args []string) error {
+			err := output.validate()
+			if err != nil {
+				return err
 			}
-			if listBookCmd.Lookup("a").Value.String() != "" {
-				aFlagString := listBookCmd.Lookup("a").Value.String() //not addressable
-				aFlag = &aFlagString
+			bookID, err := idFlag("i", id)
+			if err != nil {
+				return err
+			}
+			if bookID == nil {
+				return usageErrorf("no book chosen, set its id with -i")
+			}
+
+			library, err := currentBackend()
+			if err != nil {
+				return err
 			}
-			if listBookCmd.Lookup("i").Value.String() != "" {
-				iString := listBookCmd.Lookup("i").Value.String()
-				iFlag, err = SanitizeIdNumber(&iString) //not addressable
+
+			if status == "" {
+				// only the user of the -u flag narrows the list, everyone's statuses are shown otherwise
+				statuses, err := library.ListReadingStatuses(ReadingStatusArgs{BookID: bookID, User: optionalValue(user)})
 				if err != nil {
-					fmt.Println(err)
-					os.Exit(1)
+					return err
 				}
+				return writeRecords(out, output, statuses, readingStatusView)
+			}
+
+			statusArgs := ReadingStatusArgs{BookID: bookID, User: readingUser(user), Status: &status, StartedDate: optionalValue(started), FinishedDate: optionalValue(finished)}
+			if statusArgs.User == nil {
+				return usageErrorf("no user set, set it with -u or BOOKISH_USER")
 			}
-			
-			bookArgs = BookArgs{BookID: iFlag, Title: tFlag, Author: aFlag}
-			result, err := ListBooks(db, bookArgs)
+			readingStatus, err := library.SetReadingStatus(statusArgs)
 			if err != nil {
-				fmt.Println(err)
-			} else {
-				fmt.Println(result)
-			}
-		default:
-			fmt.Println("Invalid subcommand. Expected 'create' or 'list'.")
-			os.Exit(1)
-		}
-
-	case "collection":
-		// Parse subcommand arguments
-		if len(os.Args) < 3 {
-			fmt.Println("No collenction name set, collection not created")
-			fmt.Println("Usage: books-database collection <subcommand> [<args>]")
-			fmt.Println("Subcommands:")
-			fmt.Println("\tcreate\tCreate a new author")
-			fmt.Println("\tlist\tList all authors")
-			fmt.Println("\add\tAdd a book to a collection")
-			os.Exit(1)
-		}
-
-		var collectionArgs CollectionArgs
-		switch os.Args[2] {
-		case "create":
-			collectionCmd.subcommands[0].flags.Parse(os.Args[3:])
-			var nFlag *string 
-			
-			if createCollectionCmd.Lookup("n").Value.String() != "" {
-				nFlagString := createCollectionCmd.Lookup("n").Value.String() //not addressable
-				nFlag = &nFlagString
-			}
-
-			collectionArgs = CollectionArgs{ CollectionName: nFlag}
-
-			result, err := CreateCollection(db, collectionArgs)
-			if err != nil {
-				fmt.Println(err)
+				return err
+			}
+			if output.format == "table" && !output.quiet {
+				fmt.Fprintf(out, "Book %s is %s for %s\n", readingStatus.Title, readingStatus.Status, readingStatus.User)
+				return nil
+			}
+			return writeRecord(out, output, *readingStatus, readingStatusView)
+		},
+	}
+}
+
+func createBookProgressCommand() *Subcommand {
+	var id string
+	var user string
+	var date string
+	var page int
+	var percent float64
+	var pages int
+	var minutes int
+	var sessions bool
+
+	flags := newFlagSet("progress")
+	flags.StringVar(&id, "i", "", "Id of the book")
+	flags.StringVar(&user, "u", "", "User whose reading it is, BOOKISH_USER when empty")
+	flags.StringVar(&date, "date", "", "Day of the session (YYYY-MM-DD), today when empty")
+	flags.IntVar(&page, "page", 0, "Page reached in the session")
+	flags.Float64Var(&percent, "percent", 0, "Percentage of the book reached in the session, for books read without pages")
+	flags.IntVar(&pages, "pages", 0, "Pages read in the session, the pages since the previous session when a page is reached")
+	flags.IntVar(&minutes, "minutes", 0, "Minutes spent reading in the session")
+	flags.BoolVar(&sessions, "sessions", false, "List the reading sessions instead of the progress")
+	output := addOutputFlags(flags)
+
+	return &Subcommand{
+		name:        "progress",
+		description: "Log a reading session of a book, or show the progress, pace and estimated finish of its reading",
+		flags:       flags,
+		values:      map[string]flagValues{"i": {library: completeBookIDs}},
+		run: func(out io.Writer, args []string) error {
+			err := output.validate()
+			if err != nil {
+				return err
+			}
+			bookID, err := idFlag("i", id)
+			if err != nil {
+				return err
+			}
+			if bookID == nil {
+				return usageErrorf("no book chosen, set its id with -i")
+			}
+			sessionArgs := ReadingSessionArgs{BookID: bookID, User: readingUser(user), Date: optionalValue(date)}
+			if sessionArgs.User == nil {
+				return usageErrorf("no user set, set it with -u or BOOKISH_USER")
+			}
+
+			// a session is logged when any of its measures is given, even a page 0
+			logged := false
+			flags.Visit(func(f *flag.Flag) {
+				switch f.Name {
+				case "page":
+					sessionArgs.Page = &page
+				case "percent":
+					sessionArgs.Percent = &percent
+				case "pages":
+					sessionArgs.Pages = &pages
+				case "minutes":
+					sessionArgs.Minutes = &minutes
+				default:
+					return
+				}
+				logged = true
+			})
+
+			library, err := currentBackend()
+			if err != nil {
+				return err
+			}
+
+			var progress *ReadingProgress
+			if logged {
+				progress, err = library.LogReadingSession(sessionArgs)
 			} else {
-				fmt.Printf("Creating collection with name %s\n", result.CollectionName)
+				progress, err = library.GetReadingProgress(sessionArgs)
+			}
+			if err != nil {
+				return err
+			}
+			if sessions {
+				return writeRecords(out, output, progress.Sessions, readingSessionView)
 			}
+			return writeRecord(out, output, *progress, readingProgressView)
+		},
+	}
+}
+
+func createBookImportCommand() *Subcommand {
+	var fileName string
+	var mapping string
+	var dryRun bool
+	var batchSize int
+	var format string
 
-		case "list":
-			collectionCmd.subcommands[1].flags.Parse(os.Args[3:])
-			var nFlag *string 
-			var iFlag *int 
+	flags := newFlagSet("import")
+	flags.StringVar(&fileName, "file", "", "Path of the file to import, or of the library directory for calibre")
+	flags.StringVar(&mapping, "map", "", "Column mapping, e.g. title=Book Title,author=Written By")
+	flags.BoolVar(&dryRun, "dry-run", false, "Validate the rows without saving any book")
+	flags.IntVar(&batchSize, "batch-size", 0, "Number of rows saved per transaction")
+	flags.StringVar(&format, "format", "csv", "Format of the file: csv, goodreads, storygraph, bibtex, ris, marc, marcxml, or calibre for a library directory")
 
-			if listCollectionCmd.Lookup("n").Value.String() != "" {
-				nFlagString := listCollectionCmd.Lookup("n").Value.String() //not addressable
-				nFlag = &nFlagString
+	return &Subcommand{
+		name:        "import",
+		description: "Import books from a CSV, reading tracker, citation or MARC file, or a Calibre library",
+		flags:       flags,
+		values:      map[string]flagValues{"file": {path: "file"}, "format": {words: []string{"csv", "goodreads", "storygraph", "bibtex", "ris", "marc", "marcxml", "calibre"}}},
+		run: func(out io.Writer, args []string) error {
+			if fileName == "" {
+				return usageErrorf("no file set, use -file <path>")
+			}
+			if batchSize < 0 {
+				return usageErrorf("invalid -batch-size %d", batchSize)
+			}
+
+			library, err := currentBackend()
+			if err != nil {
+				return err
 			}
-			if listCollectionCmd.Lookup("i").Value.String() != "" {
-				iString := listCollectionCmd.Lookup("i").Value.String()
-				iFlag, err = SanitizeIdNumber(&iString) //not addressable
+
+			// a calibre library is a directory rather than a file
+			if format == "calibre" {
+				report, err := library.ImportCalibreLibrary(fileName)
 				if err != nil {
-					fmt.Println(err)
-					os.Exit(1)
+					return err
+				}
+				for _, entry := range report.Skipped {
+					fmt.Fprintf(out, "calibre book %d skipped: %s\n", entry.Row, entry.Reason)
 				}
+				fmt.Fprintf(out, "Imported calibre library: %d books created, %d matched, %d skipped\n", len(report.Created), len(report.Matched), len(report.Skipped))
+				return nil
 			}
-			
-			collectionArgs = CollectionArgs{CollectionID: iFlag,CollectionName: nFlag}
-			result, err := ListCollections(db, collectionArgs)
+
+			file, err := os.Open(fileName)
 			if err != nil {
-				fmt.Println(err)
-			} else {
-				fmt.Println(result)
+				return err
 			}
+			defer file.Close()
+
+			switch format {
+			// citation files are not tabular, they are read entry by entry
+			case "bibtex", "ris":
+				report, err := library.ImportCitations(file, format)
+				if err != nil {
+					return err
+				}
+				for _, rowError := range report.Errors {
+					fmt.Fprintf(out, "line %d: %s\n", rowError.Row, rowError.Message)
+				}
+				fmt.Fprintf(out, "Imported %d of %d books\n", report.Created, report.Rows)
+				return nil
 
-		case "add":
-			collectionCmd.subcommands[2].flags.Parse(os.Args[3:])
-			var iFlag *int 
-			var biFlag *int 
-			
-			if addCollectionCmd.Lookup("i").Value.String() != "" {
-				iFlagString := addCollectionCmd.Lookup("i").Value.String() //not addressable
-				iFlag, err = SanitizeIdNumber(&iFlagString) //not addressable
+			// MARC records are binary or XML, not rows
+			case "marc", "marcxml":
+				report, err := library.ImportMARC(file, format)
 				if err != nil {
-					fmt.Println(err)
-					os.Exit(1)
+					return err
 				}
+				for _, rowError := range report.Errors {
+					fmt.Fprintf(out, "record %d: %s\n", rowError.Row, rowError.Message)
+				}
+				fmt.Fprintf(out, "Imported %d of %d books\n", report.Created, report.Rows)
+				return nil
+
+			case "csv":
+
+			// reading tracker exports have their own columns and report
+			default:
+				report, err := library.ImportShelvesCSV(file, format)
+				if err != nil {
+					return err
+				}
+				for _, entry := range report.Skipped {
+					fmt.Fprintf(out, "row %d skipped: %s\n", entry.Row, entry.Reason)
+				}
+				fmt.Fprintf(out, "Imported %s export: %d books created, %d matched, %d skipped\n", report.Format, len(report.Created), len(report.Matched), len(report.Skipped))
+				return nil
+			}
+
+			columns, err := ParseColumnMapping(mapping)
+			if err != nil {
+				return usageError{message: err.Error()}
+			}
+
+			report, err := library.ImportBooksCSV(file, ImportArgs{Columns: columns, DryRun: dryRun, BatchSize: batchSize})
+			if report != nil {
+				for _, rowError := range report.Errors {
+					fmt.Fprintf(out, "row %d: %s\n", rowError.Row, rowError.Message)
+				}
+				if report.DryRun {
+					fmt.Fprintf(out, "Dry run: %d of %d books would be imported\n", report.Created, report.Rows)
+				} else {
+					fmt.Fprintf(out, "Imported %d of %d books\n", report.Created, report.Rows)
+				}
+			}
+			return err
+		},
+	}
+}
+
+func createBookScanCommand() *Subcommand {
+	var recordCopy bool
+
+	flags := newFlagSet("scan")
+	flags.BoolVar(&recordCopy, "copy", false, "Record each file as an ebook copy of its book")
+
+	return &Subcommand{
+		name:        "scan",
+		description: "Create books from the EPUB and PDF files of a directory",
+		flags:       flags,
+		arguments:   "<dir>",
+		values:      map[string]flagValues{"": {path: "dir"}},
+		run: func(out io.Writer, args []string) error {
+			if len(args) != 1 {
+				return usageErrorf("expected one directory, got %d arguments", len(args))
+			}
+
+			library, err := currentBackend()
+			if err != nil {
+				return err
+			}
+
+			report, err := library.ScanBooks(args[0], ScanArgs{RecordCopy: recordCopy})
+			if err != nil {
+				return err
+			}
+			for _, entry := range report.Skipped {
+				fmt.Fprintf(out, "%s skipped: %s\n", entry.Path, entry.Reason)
+			}
+			fmt.Fprintf(out, "Scanned %d files: %d books created, %d matched, %d skipped\n", len(report.Created)+len(report.Matched)+len(report.Skipped), len(report.Created), len(report.Matched), len(report.Skipped))
+			return nil
+		},
+	}
+}
+
+func createCollectionCommands() *Command {
+	return &Command{
+		name:        "collection",
+		description: "Manage collections in the database",
+		subcommands: []*Subcommand{
+			createCollectionCreateCommand(),
+			createCollectionListCommand(),
+			createCollectionAddCommand(),
+			createCollectionRemoveCommand(),
+			createCollectionExportCommand(),
+		},
+	}
+}
+
+func createReviewCommands() *Command {
+	return &Command{
+		name:        "review",
+		description: "Rate and review books",
+		subcommands: []*Subcommand{
+			createReviewCreateCommand(),
+			createReviewEditCommand(),
+			createReviewListCommand(),
+		},
+	}
+}
+
+// flagText is the text of the -text flag, or the content of the file of the -f flag
+func flagText(text string, fileName string) (*string, error) {
+	if fileName == "" {
+		return &text, nil
+	}
+	if text != "" {
+		return nil, usageErrorf("set the text with -text or -f, not both")
+	}
+	content, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	review := string(content)
+	return &review, nil
+}
+
+func createReviewCreateCommand() *Subcommand {
+	var id string
+	var user string
+	var rating float64
+	var text string
+	var fileName string
+
+	flags := newFlagSet("create")
+	flags.StringVar(&id, "i", "", "Id of the book")
+	flags.StringVar(&user, "u", "", "User who writes the review, BOOKISH_USER when empty")
+	flags.Float64Var(&rating, "r", 0, "Rating from 0.5 to 5 stars, in half stars")
+	flags.StringVar(&text, "text", "", "Review, in markdown")
+	flags.StringVar(&fileName, "f", "", "Markdown file with the review")
+	output := addOutputFlags(flags)
+
+	return &Subcommand{
+		name:        "create",
+		description: "Rate or review a book",
+		flags:       flags,
+		values:      map[string]flagValues{"i": {library: completeBookIDs}, "f": {path: "file"}},
+		run: func(out io.Writer, args []string) error {
+			err := output.validate()
+			if err != nil {
+				return err
+			}
+			bookID, err := idFlag("i", id)
+			if err != nil {
+				return err
+			}
+			if bookID == nil {
+				return usageErrorf("no book chosen, set its id with -i")
+			}
+			reviewArgs := ReviewArgs{BookID: bookID, User: readingUser(user)}
+			if reviewArgs.User == nil {
+				return usageErrorf("no user set, set it with -u or BOOKISH_USER")
+			}
+			if rating != 0 {
+				reviewArgs.Rating = &rating
+			}
+			reviewArgs.Review, err = flagText(text, fileName)
+			if err != nil {
+				return err
+			}
+
+			library, err := currentBackend()
+			if err != nil {
+				return err
+			}
+
+			review, err := library.CreateReview(reviewArgs)
+			if err != nil {
+				return err
+			}
+			if output.format == "table" && !output.quiet {
+				fmt.Fprintf(out, "Review of %s by %s created\n", review.Title, review.User)
+				return nil
+			}
+			return writeRecord(out, output, *review, reviewView)
+		},
+	}
+}
+
+func createReviewEditCommand() *Subcommand {
+	var id string
+	var user string
+	var rating float64
+	var text string
+	var fileName string
+
+	flags := newFlagSet("edit")
+	flags.StringVar(&id, "i", "", "Id of the book")
+	flags.StringVar(&user, "u", "", "User who wrote the review, BOOKISH_USER when empty")
+	flags.Float64Var(&rating, "r", 0, "New rating from 0.5 to 5 stars in half stars, 0 to clear it")
+	flags.StringVar(&text, "text", "", "New review in markdown, empty to clear it")
+	flags.StringVar(&fileName, "f", "", "Markdown file with the new review")
+	output := addOutputFlags(flags)
+
+	return &Subcommand{
+		name:        "edit",
+		description: "Change the rating or the review of a book, only the flags given are changed",
+		flags:       flags,
+		values:      map[string]flagValues{"i": {library: completeBookIDs}, "f": {path: "file"}},
+		run: func(out io.Writer, args []string) error {
+			err := output.validate()
+			if err != nil {
+				return err
+			}
+			bookID, err := idFlag("i", id)
+			if err != nil {
+				return err
 			}
-			if addCollectionCmd.Lookup("bi").Value.String() != "" {
-				biFlagString := addCollectionCmd.Lookup("bi").Value.String() //not addressable
-				biFlag, err = SanitizeIdNumber(&biFlagString) //not addressable
+			if bookID == nil {
+				return usageErrorf("no book chosen, set its id with -i")
+			}
+			reviewArgs := ReviewArgs{BookID: bookID, User: readingUser(user)}
+			if reviewArgs.User == nil {
+				return usageErrorf("no user set, set it with -u or BOOKISH_USER")
+			}
+
+			// the flags left out keep their value, set ones may be empty to clear a field
+			changeReview := false
+			flags.Visit(func(f *flag.Flag) {
+				switch f.Name {
+				case "r":
+					reviewArgs.Rating = &rating
+				case "text", "f":
+					changeReview = true
+				}
+			})
+			if changeReview {
+				reviewArgs.Review, err = flagText(text, fileName)
 				if err != nil {
-					fmt.Println(err)
-					os.Exit(1)
+					return err
 				}
 			}
 
-			addArgs := AddBookToCollectionArgs{ BookID: biFlag, CollectionID: iFlag}
+			library, err := currentBackend()
+			if err != nil {
+				return err
+			}
+
+			review, err := library.UpdateReview(reviewArgs)
+			if err != nil {
+				return err
+			}
+			if output.format == "table" && !output.quiet {
+				fmt.Fprintf(out, "Review of %s by %s updated\n", review.Title, review.User)
+				return nil
+			}
+			return writeRecord(out, output, *review, reviewView)
+		},
+	}
+}
+
+func createReviewListCommand() *Subcommand {
+	var id string
+	var user string
+
+	flags := newFlagSet("list")
+	flags.StringVar(&id, "i", "", "Id of the book")
+	flags.StringVar(&user, "u", "", "User who wrote the reviews, anyone when empty")
+	output := addOutputFlags(flags)
+
+	return &Subcommand{
+		name:        "list",
+		description: "List the reviews of a book, of a user, or all of them",
+		flags:       flags,
+		values:      map[string]flagValues{"i": {library: completeBookIDs}},
+		run: func(out io.Writer, args []string) error {
+			err := output.validate()
+			if err != nil {
+				return err
+			}
+			bookID, err := idFlag("i", id)
+			if err != nil {
+				return err
+			}
+
+			library, err := currentBackend()
+			if err != nil {
+				return err
+			}
+
+			reviews, err := library.ListReviews(ReviewArgs{BookID: bookID, User: optionalValue(user)})
+			if err != nil {
+				return err
+			}
+			return writeRecords(out, output, reviews, reviewView)
+		},
+	}
+}
+
+func createNoteCommands() *Command {
+	return &Command{
+		name:        "note",
+		description: "Keep notes, quotes and highlights of books",
+		subcommands: []*Subcommand{
+			createNoteAddCommand(),
+			createNoteListCommand(),
+			createNoteEditCommand(),
+			createNoteDeleteCommand(),
+		},
+	}
+}
+
+// splitTags reads the comma separated tags of a -tags flag
+func splitTags(tags string) []string {
+	return SanitizeTags(strings.Split(tags, ","))
+}
 
-			_, _, err = AddBookToCollection(db, addArgs)
+func createNoteAddCommand() *Subcommand {
+	var id string
+	var user string
+	var kind string
+	var text string
+	var fileName string
+	var page int
+	var location string
+	var tags string
+
+	flags := newFlagSet("add")
+	flags.StringVar(&id, "i", "", "Id of the book")
+	flags.StringVar(&user, "u", "", "User who takes the note, BOOKISH_USER when empty")
+	flags.StringVar(&kind, "kind", "note", "Kind of note: note, quote or highlight")
+	flags.StringVar(&text, "text", "", "Text of the note")
+	flags.StringVar(&fileName, "f", "", "File with the text of the note")
+	flags.IntVar(&page, "page", 0, "Page of the book the note is about")
+	flags.StringVar(&location, "loc", "", "Location in the book, such as a chapter or an ebook position")
+	flags.StringVar(&tags, "tags", "", "Comma separated tags of the note")
+	output := addOutputFlags(flags)
+
+	return &Subcommand{
+		name:        "add",
+		description: "Add a note, quote or highlight to a book",
+		flags:       flags,
+		values:      map[string]flagValues{"i": {library: completeBookIDs}, "kind": {words: noteKinds}, "f": {path: "file"}},
+		run: func(out io.Writer, args []string) error {
+			err := output.validate()
+			if err != nil {
+				return err
+			}
+			bookID, err := idFlag("i", id)
+			if err != nil {
+				return err
+			}
+			if bookID == nil {
+				return usageErrorf("no book chosen, set its id with -i")
+			}
+			noteArgs := NoteArgs{BookID: bookID, User: readingUser(user), Kind: &kind, Location: optionalValue(location), Tags: splitTags(tags)}
+			noteArgs.Text, err = flagText(text, fileName)
+			if err != nil {
+				return err
+			}
+			if page != 0 {
+				noteArgs.Page = &page
+			}
+
+			library, err := currentBackend()
+			if err != nil {
+				return err
+			}
+
+			note, err := library.CreateNote(noteArgs)
+			if err != nil {
+				return err
+			}
+			if output.format == "table" && !output.quiet {
+				fmt.Fprintf(out, "Added %s %d to book %s\n", note.Kind, note.NoteID, note.Title)
+				return nil
+			}
+			return writeRecord(out, output, *note, noteView)
+		},
+	}
+}
+
+func createNoteListCommand() *Subcommand {
+	var id string
+	var user string
+	var kind string
+	var tags string
+	var search string
+
+	flags := newFlagSet("list")
+	flags.StringVar(&id, "i", "", "Id of the book, the notes of every book are listed when empty")
+	flags.StringVar(&user, "u", "", "User who took the notes, anyone when empty")
+	flags.StringVar(&kind, "kind", "", "Kind of the notes: note, quote or highlight")
+	flags.StringVar(&tags, "tags", "", "Comma separated tags the notes all have")
+	flags.StringVar(&search, "s", "", "Text to search in the notes, ignoring case")
+	output := addOutputFlags(flags)
+
+	return &Subcommand{
+		name:        "list",
+		description: "List and search the notes, quotes and highlights of books",
+		flags:       flags,
+		values:      map[string]flagValues{"i": {library: completeBookIDs}, "kind": {words: noteKinds}},
+		run: func(out io.Writer, args []string) error {
+			err := output.validate()
+			if err != nil {
+				return err
+			}
+			bookID, err := idFlag("i", id)
 			if err != nil {
-				fmt.Println(err)
+				return err
 			}
 
-		default:
-			fmt.Println("Invalid subcommand. Expected 'create' or 'list'.")
-			os.Exit(1)
-		}
+			library, err := currentBackend()
+			if err != nil {
+				return err
+			}
 
-	default:
-		fmt.Println("Invalid command. Expected 'book' or 'colletion'.")
-		os.Exit(1)
+			notes, err := library.ListNotes(NoteArgs{BookID: bookID, User: optionalValue(user), Kind: optionalValue(kind), Tags: splitTags(tags), Search: optionalValue(search)})
+			if err != nil {
+				return err
+			}
+			return writeRecords(out, output, notes, noteView)
+		},
 	}
+}
+
+func createNoteEditCommand() *Subcommand {
+	var id string
+	var kind string
+	var text string
+	var fileName string
+	var page int
+	var location string
+	var tags string
 
-}
\ No newline at end of file
+	flags := newFlagSet("edit")
+	flags.StringVar(&id, "n", "", "Id of the note")
+	flags.StringVar(&kind, "kind", "", "New kind: note, quote or highlight")
+	flags.StringVar(&text, "text", "", "New text of the note")
+	flags.StringVar(&fileName, "f", "", "File with the new text of the note")
+	flags.IntVar(&page, "page", 0, "New page, 0 to clear it")
+	flags.StringVar(&location, "loc", "", "New location, empty to clear it")
+	flags.StringVar(&tags, "tags", "", "New comma separated tags, empty to clear them")
+	output := addOutputFlags(flags)
+
+	return &Subcommand{
+		name:        "edit",
+		description: "Change a note, only the flags given are changed",
+		flags:       flags,
+		values:      map[string]flagValues{"kind": {words: noteKinds}, "f": {path: "file"}},
+		run: func(out io.Writer, args []string) error {
+			err := output.validate()
+			if err != nil {
+				return err
+			}
+			noteID, err := idFlag("n", id)
+			if err != nil {
+				return err
+			}
+			if noteID == nil {
+				return usageErrorf("no note chosen, set its id with -n")
+			}
+
+			// the flags left out keep their value, set ones may be empty to clear a field
+			noteArgs := NoteArgs{NoteID: noteID}
+			changeText := false
+			flags.Visit(func(f *flag.Flag) {
+				switch f.Name {
+				case "kind":
+					noteArgs.Kind = &kind
+				case "text", "f":
+					changeText = true
+				case "page":
+					noteArgs.Page = &page
+				case "loc":
+					noteArgs.Location = &location
+				case "tags":
+					noteArgs.Tags = splitTags(tags)
+				}
+			})
+			if changeText {
+				noteArgs.Text, err = flagText(text, fileName)
+				if err != nil {
+					return err
+				}
+			}
+
+			library, err := currentBackend()
+			if err != nil {
+				return err
+			}
+
+			note, err := library.UpdateNote(noteArgs)
+			if err != nil {
+				return err
+			}
+			if output.format == "table" && !output.quiet {
+				fmt.Fprintf(out, "Note %d of book %s updated\n", note.NoteID, note.Title)
+				return nil
+			}
+			return writeRecord(out, output, *note, noteView)
+		},
+	}
+}
+
+func createNoteDeleteCommand() *Subcommand {
+	var id string
+
+	flags := newFlagSet("delete")
+	flags.StringVar(&id, "n", "", "Id of the note")
+
+	return &Subcommand{
+		name:        "delete",
+		description: "Delete a note",
+		flags:       flags,
+		run: func(out io.Writer, args []string) error {
+			noteID, err := idFlag("n", id)
+			if err != nil {
+				return err
+			}
+			if noteID == nil {
+				return usageErrorf("no note chosen, set its id with -n")
+			}
+
+			library, err := currentBackend()
+			if err != nil {
+				return err
+			}
+
+			note, err := library.DeleteNote(NoteArgs{NoteID: noteID})
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "Note %d of book %s deleted\n", note.NoteID, note.Title)
+			return nil
+		},
+	}
+}
+
+func createCopyCommands() *Command {
+	return &Command{
+		name:        "copy",
+		description: "Keep an inventory of the copies we own and where they are",
+		subcommands: []*Subcommand{
+			createCopyAddCommand(),
+			createCopyListCommand(),
+			createCopyEditCommand(),
+			createCopyDeleteCommand(),
+			createCopyWhereCommand(),
+		},
+	}
+}
+
+func createCopyAddCommand() *Subcommand {
+	var id string
+	var format string
+	var condition string
+	var location string
+	var acquiredDate string
+	var price float64
+
+	flags := newFlagSet("add")
+	flags.StringVar(&id, "i", "", "Id of the book")
+	flags.StringVar(&format, "format", "", "Format of the copy: hardcover, paperback, ebook or audiobook")
+	flags.StringVar(&condition, "condition", "", "Condition of the copy: new, like-new, good, fair or poor")
+	flags.StringVar(&location, "loc", "", "Where the copy is, such as a shelf, or the path of an ebook file under the library root")
+	flags.StringVar(&acquiredDate, "acquired", "", "Day the copy was acquired (YYYY-MM-DD)")
+	flags.Float64Var(&price, "price", 0, "Price paid for the copy")
+	output := addOutputFlags(flags)
+
+	return &Subcommand{
+		name:        "add",
+		description: "Add a copy of a book to the inventory",
+		flags:       flags,
+		values:      map[string]flagValues{"i": {library: completeBookIDs}, "format": {words: copyFormats}, "condition": {words: copyConditions}},
+		run: func(out io.Writer, args []string) error {
+			err := output.validate()
+			if err != nil {
+				return err
+			}
+			bookID, err := idFlag("i", id)
+			if err != nil {
+				return err
+			}
+			if bookID == nil {
+				return usageErrorf("no book chosen, set its id with -i")
+			}
+			if format == "" {
+				return usageErrorf("no format set, set it with -format")
+			}
+			copyArgs := CopyArgs{BookID: bookID, Format: &format, Condition: optionalValue(condition), Location: optionalValue(location), AcquiredDate: optionalValue(acquiredDate)}
+			// a price of 0 is a free copy, the price is unknown when the flag is left out
+			flags.Visit(func(f *flag.Flag) {
+				if f.Name == "price" {
+					copyArgs.Price = &price
+				}
+			})
+
+			library, err := currentBackend()
+			if err != nil {
+				return err
+			}
+
+			copy, err := library.CreateCopy(copyArgs)
+			if err != nil {
+				return err
+			}
+			if output.format == "table" && !output.quiet {
+				fmt.Fprintf(out, "Added %s copy %d of book %s\n", copy.Format, copy.CopyID, copy.Title)
+				return nil
+			}
+			return writeRecord(out, output, *copy, copyView)
+		},
+	}
+}
+
+func createCopyListCommand() *Subcommand {
+	var id string
+	var format string
+	var condition string
+	var location string
+
+	flags := newFlagSet("list")
+	flags.StringVar(&id, "i", "", "Id of the book, the copies of every book are listed when empty")
+	flags.StringVar(&format, "format", "", "Format of the copies: hardcover, paperback, ebook or audiobook")
+	flags.StringVar(&condition, "condition", "", "Condition of the copies: new, like-new, good, fair or poor")
+	flags.StringVar(&location, "loc", "", "Text to search in the locations, such as a shelf, ignoring case")
+	output := addOutputFlags(flags)
+
+	return &Subcommand{
+		name:        "list",
+		description: "List the copies of books",
+		flags:       flags,
+		values:      map[string]flagValues{"i": {library: completeBookIDs}, "format": {words: copyFormats}, "condition": {words: copyConditions}},
+		run: func(out io.Writer, args []string) error {
+			err := output.validate()
+			if err != nil {
+				return err
+			}
+			bookID, err := idFlag("i", id)
+			if err != nil {
+				return err
+			}
+
+			library, err := currentBackend()
+			if err != nil {
+				return err
+			}
+
+			copies, err := library.ListCopies(CopyArgs{BookID: bookID, Format: optionalValue(format), Condition: optionalValue(condition), Location: optionalValue(location)})
+			if err != nil {
+				return err
+			}
+			return writeRecords(out, output, copies, copyView)
+		},
+	}
+}
+
+func createCopyEditCommand() *Subcommand {
+	var id string
+	var format string
+	var condition string
+	var location string
+	var acquiredDate string
+	var price float64
+
+	flags := newFlagSet("edit")
+	flags.StringVar(&id, "c", "", "Id of the copy")
+	flags.StringVar(&format, "format", "", "New format: hardcover, paperback, ebook or audiobook")
+	flags.StringVar(&condition, "condition", "", "New condition, empty to clear it")
+	flags.StringVar(&location, "loc", "", "New location, empty to clear it")
+	flags.StringVar(&acquiredDate, "acquired", "", "New acquisition day (YYYY-MM-DD), empty to clear it")
+	flags.Float64Var(&price, "price", 0, "New price")
+	output := addOutputFlags(flags)
+
+	return &Subcommand{
+		name:        "edit",
+		description: "Change a copy, only the flags given are changed",
+		flags:       flags,
+		values:      map[string]flagValues{"format": {words: copyFormats}, "condition": {words: copyConditions}},
+		run: func(out io.Writer, args []string) error {
+			err := output.validate()
+			if err != nil {
+				return err
+			}
+			copyID, err := idFlag("c", id)
+			if err != nil {
+				return err
+			}
+			if copyID == nil {
+				return usageErrorf("no copy chosen, set its id with -c")
+			}
+
+			// the flags left out keep their value, set ones may be empty to clear a field
+			copyArgs := CopyArgs{CopyID: copyID}
+			flags.Visit(func(f *flag.Flag) {
+				switch f.Name {
+				case "format":
+					copyArgs.Format = &format
+				case "condition":
+					copyArgs.Condition = &condition
+				case "loc":
+					copyArgs.Location = &location
+				case "acquired":
+					copyArgs.AcquiredDate = &acquiredDate
+				case "price":
+					copyArgs.Price = &price
+				}
+			})
+
+			library, err := currentBackend()
+			if err != nil {
+				return err
+			}
+
+			copy, err := library.UpdateCopy(copyArgs)
+			if err != nil {
+				return err
+			}
+			if output.format == "table" && !output.quiet {
+				fmt.Fprintf(out, "Copy %d of book %s updated\n", copy.CopyID, copy.Title)
+				return nil
+			}
+			return writeRecord(out, output, *copy, copyView)
+		},
+	}
+}
+
+func createCopyDeleteCommand() *Subcommand {
+	var id string
+
+	flags := newFlagSet("delete")
+	flags.StringVar(&id, "c", "", "Id of the copy")
+
+	return &Subcommand{
+		name:        "delete",
+		description: "Delete a copy, when it is not lent",
+		flags:       flags,
+		run: func(out io.Writer, args []string) error {
+			copyID, err := idFlag("c", id)
+			if err != nil {
+				return err
+			}
+			if copyID == nil {
+				return usageErrorf("no copy chosen, set its id with -c")
+			}
+
+			library, err := currentBackend()
+			if err != nil {
+				return err
+			}
+
+			copy, err := library.DeleteCopy(CopyArgs{CopyID: copyID})
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "Copy %d of book %s deleted\n", copy.CopyID, copy.Title)
+			return nil
+		},
+	}
+}
+
+func createCopyWhereCommand() *Subcommand {
+	flags := newFlagSet("where")
+	output := addOutputFlags(flags)
+
+	return &Subcommand{
+		name:        "where",
+		description: "Find where the copies of a title are, the title is given after the flags",
+		flags:       flags,
+		run: func(out io.Writer, args []string) error {
+			err := output.validate()
+			if err != nil {
+				return err
+			}
+			title := strings.TrimSpace(strings.Join(args, " "))
+			if title == "" {
+				return usageErrorf("no title given, write the title or a part of it after the command")
+			}
+
+			library, err := currentBackend()
+			if err != nil {
+				return err
+			}
+
+			copies, err := library.ListCopies(CopyArgs{Title: &title})
+			if err != nil {
+				return err
+			}
+			if output.format == "table" && !output.quiet {
+				for _, copy := range copies {
+					place := copy.Location
+					switch {
+					case copy.Borrower != "":
+						place = "lent to " + copy.Borrower
+					case place == "":
+						place = "no location recorded"
+					}
+					fmt.Fprintf(out, "%s, %s copy %d: %s\n", copy.Title, copy.Format, copy.CopyID, place)
+				}
+				return nil
+			}
+			return writeRecords(out, output, copies, copyView)
+		},
+	}
+}
+
+func createLoanCommands() *Command {
+	return &Command{
+		name:        "loan",
+		description: "Lend books and track who has them",
+		subcommands: []*Subcommand{
+			createLoanOutCommand(),
+			createLoanReturnCommand(),
+			createLoanListCommand(),
+		},
+	}
+}
+
+func createLoanOutCommand() *Subcommand {
+	var id string
+	var copyID string
+	var borrower string
+	var lentDate string
+	var dueDate string
+	var days int
+
+	flags := newFlagSet("out")
+	flags.StringVar(&id, "i", "", "Id of the book")
+	flags.StringVar(&copyID, "copy", "", "Id of the copy, the first copy that is in when empty")
+	flags.StringVar(&borrower, "to", "", "Who the book is lent to")
+	flags.StringVar(&lentDate, "date", "", "Day the book is lent (YYYY-MM-DD), today when empty")
+	flags.StringVar(&dueDate, "due", "", "Day the book is due back (YYYY-MM-DD)")
+	flags.IntVar(&days, "days", 0, "Number of days the book is lent for, instead of -due")
+	output := addOutputFlags(flags)
+
+	return &Subcommand{
+		name:        "out",
+		description: "Lend a copy of a book",
+		flags:       flags,
+		values:      map[string]flagValues{"i": {library: completeBookIDs}},
+		run: func(out io.Writer, args []string) error {
+			err := output.validate()
+			if err != nil {
+				return err
+			}
+			bookID, err := idFlag("i", id)
+			if err != nil {
+				return err
+			}
+			if bookID == nil {
+				return usageErrorf("no book chosen, set its id with -i")
+			}
+			copy, err := idFlag("copy", copyID)
+			if err != nil {
+				return err
+			}
+			if borrower == "" {
+				return usageErrorf("no borrower set, set who the book is lent to with -to")
+			}
+			if days != 0 {
+				if dueDate != "" {
+					return usageErrorf("set the due date with -due or -days, not both")
+				}
+				lent, err := SanitizeDate(&lentDate)
+				if err != nil {
+					return err
+				}
+				if lent == nil {
+					day := today()
+					lent = &day
+				}
+				dueDate = lent.AddDate(0, 0, days).Format("2006-01-02")
+			}
+
+			library, err := currentBackend()
+			if err != nil {
+				return err
+			}
+
+			loan, err := library.LendBook(LoanArgs{BookID: bookID, CopyID: copy, Borrower: &borrower, LentDate: optionalValue(lentDate), DueDate: optionalValue(dueDate)})
+			if err != nil {
+				return err
+			}
+			if output.format == "table" && !output.quiet {
+				message := fmt.Sprintf("Book %s lent to %s", loan.Title, loan.Borrower)
+				if loan.DueDate != nil {
+					message += " until " + loan.DueDate.Format("2006-01-02")
+				}
+				fmt.Fprintln(out, message)
+				return nil
+			}
+			return writeRecord(out, output, *loan, loanView)
+		},
+	}
+}
+
+func createLoanReturnCommand() *Subcommand {
+	var loanID string
+	var id string
+	var copyID string
+	var returnedDate string
+
+	flags := newFlagSet("return")
+	flags.StringVar(&loanID, "l", "", "Id of the loan")
+	flags.StringVar(&id, "i", "", "Id of the book, when a single copy of it is lent")
+	flags.StringVar(&copyID, "copy", "", "Id of the lent copy")
+	flags.StringVar(&returnedDate, "date", "", "Day the book came back (YYYY-MM-DD), today when empty")
+	output := addOutputFlags(flags)
+
+	return &Subcommand{
+		name:        "return",
+		description: "Record that a lent book came back",
+		flags:       flags,
+		values:      map[string]flagValues{"i": {library: completeBookIDs}},
+		run: func(out io.Writer, args []string) error {
+			err := output.validate()
+			if err != nil {
+				return err
+			}
+			loanArgs := LoanArgs{ReturnedDate: optionalValue(returnedDate)}
+			loanArgs.LoanID, err = idFlag("l", loanID)
+			if err != nil {
+				return err
+			}
+			loanArgs.BookID, err = idFlag("i", id)
+			if err != nil {
+				return err
+			}
+			loanArgs.CopyID, err = idFlag("copy", copyID)
+			if err != nil {
+				return err
+			}
+			if loanArgs.LoanID == nil && loanArgs.BookID == nil && loanArgs.CopyID == nil {
+				return usageErrorf("no loan chosen, set the loan with -l, or the book with -i")
+			}
+
+			library, err := currentBackend()
+			if err != nil {
+				return err
+			}
+
+			loan, err := library.ReturnBook(loanArgs)
+			if err != nil {
+				return err
+			}
+			if output.format == "table" && !output.quiet {
+				fmt.Fprintf(out, "Book %s returned by %s\n", loan.Title, loan.Borrower)
+				return nil
+			}
+			return writeRecord(out, output, *loan, loanView)
+		},
+	}
+}
+
+func createLoanListCommand() *Subcommand {
+	var id string
+	var borrower string
+	var overdue bool
+	var all bool
+
+	flags := newFlagSet("list")
+	flags.StringVar(&id, "i", "", "Id of the book")
+	flags.StringVar(&borrower, "to", "", "Borrower of the books")
+	flags.BoolVar(&overdue, "overdue", false, "List only the loans past their due date")
+	flags.BoolVar(&all, "all", false, "List the returned loans too")
+	output := addOutputFlags(flags)
+
+	return &Subcommand{
+		name:        "list",
+		description: "List the books that are lent",
+		flags:       flags,
+		values:      map[string]flagValues{"i": {library: completeBookIDs}},
+		run: func(out io.Writer, args []string) error {
+			err := output.validate()
+			if err != nil {
+				return err
+			}
+			bookID, err := idFlag("i", id)
+			if err != nil {
+				return err
+			}
+			loanArgs := LoanArgs{BookID: bookID, Borrower: optionalValue(borrower), Overdue: overdue}
+			if !all {
+				returned := false
+				loanArgs.Returned = &returned
+			}
+
+			library, err := currentBackend()
+			if err != nil {
+				return err
+			}
+
+			loans, err := library.ListLoans(loanArgs)
+			if err != nil {
+				return err
+			}
+			return writeRecords(out, output, loans, loanView)
+		},
+	}
+}
+
+func createWishCommands() *Command {
+	return &Command{
+		name:        "wish",
+		description: "Keep a wishlist of books to buy and acquire them",
+		subcommands: []*Subcommand{
+			createWishAddCommand(),
+			createWishListCommand(),
+			createWishEditCommand(),
+			createWishDeleteCommand(),
+			createWishAcquireCommand(),
+		},
+	}
+}
+
+func createWishAddCommand() *Subcommand {
+	var title string
+	var author string
+	var isbn string
+	var edition string
+	var priority string
+	var notes string
+
+	flags := newFlagSet("add")
+	flags.StringVar(&title, "t", "", "Title of the book")
+	flags.StringVar(&author, "a", "", "Name of the author")
+	flags.StringVar(&isbn, "isbn", "", "ISBN of the book")
+	flags.StringVar(&edition, "edition", "", "Edition wanted, such as \"first edition\" or \"hardcover\"")
+	flags.StringVar(&priority, "priority", "normal", "Priority of the wish: high, normal or low")
+	flags.StringVar(&notes, "notes", "", "Notes on the wish, such as who recommended the book")
+	output := addOutputFlags(flags)
+
+	return &Subcommand{
+		name:        "add",
+		description: "Add a book to the wishlist",
+		flags:       flags,
+		values:      map[string]flagValues{"a": {library: completeAuthors}, "priority": {words: wishPriorities}},
+		run: func(out io.Writer, args []string) error {
+			err := output.validate()
+			if err != nil {
+				return err
+			}
+			if title == "" {
+				return usageErrorf("no title set, set it with -t")
+			}
+
+			library, err := currentBackend()
+			if err != nil {
+				return err
+			}
+
+			wish, err := library.CreateWish(WishArgs{Title: &title, Author: optionalValue(author), ISBN: optionalValue(isbn), Edition: optionalValue(edition), Priority: &priority, Notes: optionalValue(notes)})
+			if err != nil {
+				return err
+			}
+			if output.format == "table" && !output.quiet {
+				fmt.Fprintf(out, "Added %s to the wishlist with ID %d\n", wish.Title, wish.WishID)
+				return nil
+			}
+			return writeRecord(out, output, *wish, wishView)
+		},
+	}
+}
+
+func createWishListCommand() *Subcommand {
+	var title string
+	var priority string
+
+	flags := newFlagSet("list")
+	flags.StringVar(&title, "t", "", "Text to search in the titles, ignoring case")
+	flags.StringVar(&priority, "priority", "", "Priority of the wishes: high, normal or low")
+	output := addOutputFlags(flags)
+
+	return &Subcommand{
+		name:        "list",
+		description: "List the wishlist, the high priority books first",
+		flags:       flags,
+		values:      map[string]flagValues{"priority": {words: wishPriorities}},
+		run: func(out io.Writer, args []string) error {
+			err := output.validate()
+			if err != nil {
+				return err
+			}
+
+			library, err := currentBackend()
+			if err != nil {
+				return err
+			}
+
+			wishes, err := library.ListWishes(WishArgs{Title: optionalValue(title), Priority: optionalValue(priority)})
+			if err != nil {
+				return err
+			}
+			return writeRecords(out, output, wishes, wishView)
+		},
+	}
+}
+
+func createWishEditCommand() *Subcommand {
+	var id string
+	var title string
+	var author string
+	var isbn string
+	var edition string
+	var priority string
+	var notes string
+
+	flags := newFlagSet("edit")
+	flags.StringVar(&id, "w", "", "Id of the wish")
+	flags.StringVar(&title, "t", "", "New title")
+	flags.StringVar(&author, "a", "", "New author")
+	flags.StringVar(&isbn, "isbn", "", "New ISBN, empty to clear it")
+	flags.StringVar(&edition, "edition", "", "New edition wanted, empty to clear it")
+	flags.StringVar(&priority, "priority", "", "New priority: high, normal or low")
+	flags.StringVar(&notes, "notes", "", "New notes, empty to clear them")
+	output := addOutputFlags(flags)
+
+	return &Subcommand{
+		name:        "edit",
+		description: "Change a wish, only the flags given are changed",
+		flags:       flags,
+		values:      map[string]flagValues{"a": {library: completeAuthors}, "priority": {words: wishPriorities}},
+		run: func(out io.Writer, args []string) error {
+			err := output.validate()
+			if err != nil {
+				return err
+			}
+			wishID, err := idFlag("w", id)
+			if err != nil {
+				return err
+			}
+			if wishID == nil {
+				return usageErrorf("no wish chosen, set its id with -w")
+			}
+
+			// the flags left out keep their value, set ones may be empty to clear a field
+			wishArgs := WishArgs{WishID: wishID}
+			flags.Visit(func(f *flag.Flag) {
+				switch f.Name {
+				case "t":
+					wishArgs.Title = &title
+				case "a":
+					wishArgs.Author = &author
+				case "isbn":
+					wishArgs.ISBN = &isbn
+				case "edition":
+					wishArgs.Edition = &edition
+				case "priority":
+					wishArgs.Priority = &priority
+				case "notes":
+					wishArgs.Notes = &notes
+				}
+			})
+
+			library, err := currentBackend()
+			if err != nil {
+				return err
+			}
+
+			wish, err := library.UpdateWish(wishArgs)
+			if err != nil {
+				return err
+			}
+			if output.format == "table" && !output.quiet {
+				fmt.Fprintf(out, "Wish %d for %s updated\n", wish.WishID, wish.Title)
+				return nil
+			}
+			return writeRecord(out, output, *wish, wishView)
+		},
+	}
+}
+
+func createWishDeleteCommand() *Subcommand {
+	var id string
+
+	flags := newFlagSet("delete")
+	flags.StringVar(&id, "w", "", "Id of the wish")
+
+	return &Subcommand{
+		name:        "delete",
+		description: "Remove a book from the wishlist",
+		flags:       flags,
+		run: func(out io.Writer, args []string) error {
+			wishID, err := idFlag("w", id)
+			if err != nil {
+				return err
+			}
+			if wishID == nil {
+				return usageErrorf("no wish chosen, set its id with -w")
+			}
+
+			library, err := currentBackend()
+			if err != nil {
+				return err
+			}
+
+			wish, err := library.DeleteWish(WishArgs{WishID: wishID})
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "Book %s removed from the wishlist\n", wish.Title)
+			return nil
+		},
+	}
+}
+
+// purchaseCurrency is the currency of the -currency flag, or of the BOOKISH_CURRENCY environment variable
+func purchaseCurrency(currency string) *string {
+	if currency == "" {
+		currency = os.Getenv("BOOKISH_CURRENCY")
+	}
+	return optionalValue(currency)
+}
+
+func createWishAcquireCommand() *Subcommand {
+	var id string
+	var format string
+	var location string
+	var store string
+	var price float64
+	var currency string
+	var date string
+
+	flags := newFlagSet("acquire")
+	flags.StringVar(&id, "w", "", "Id of the wish")
+	flags.StringVar(&format, "format", "", "Format of the copy bought: hardcover, paperback, ebook or audiobook")
+	flags.StringVar(&location, "loc", "", "Where the copy is put, such as a shelf, or the path of an ebook file")
+	flags.StringVar(&store, "store", "", "Store the book was bought at")
+	flags.Float64Var(&price, "price", 0, "Price paid for the book, records the purchase")
+	flags.StringVar(&currency, "currency", "", "Currency of the price, such as EUR, BOOKISH_CURRENCY when empty")
+	flags.StringVar(&date, "date", "", "Day the book was bought (YYYY-MM-DD), today when empty")
+	output := addOutputFlags(flags)
+
+	return &Subcommand{
+		name:        "acquire",
+		description: "Turn a wish into an owned book, with its copy and purchase",
+		flags:       flags,
+		values:      map[string]flagValues{"format": {words: copyFormats}},
+		run: func(out io.Writer, args []string) error {
+			err := output.validate()
+			if err != nil {
+				return err
+			}
+			wishID, err := idFlag("w", id)
+			if err != nil {
+				return err
+			}
+			if wishID == nil {
+				return usageErrorf("no wish chosen, set its id with -w")
+			}
+
+			acquireArgs := AcquireArgs{WishID: wishID, Format: optionalValue(format), Location: optionalValue(location), Date: optionalValue(date)}
+			flags.Visit(func(f *flag.Flag) {
+				if f.Name == "price" {
+					acquireArgs.Price = &price
+					acquireArgs.Store = optionalValue(store)
+					acquireArgs.Currency = purchaseCurrency(currency)
+				}
+			})
+			if acquireArgs.Price == nil && (store != "" || currency != "") {
+				return usageErrorf("no price set, set the price of the purchase with -price")
+			}
+
+			library, err := currentBackend()
+			if err != nil {
+				return err
+			}
+
+			acquisition, err := library.AcquireWish(acquireArgs)
+			if err != nil {
+				return err
+			}
+			if output.format == "table" && !output.quiet {
+				fmt.Fprintf(out, "Book %s acquired with ID %d\n", acquisition.Book.Title, acquisition.Book.BookID)
+				return nil
+			}
+			return writeRecord(out, output, acquisition.Book, bookView)
+		},
+	}
+}
+
+func createPurchaseCommands() *Command {
+	return &Command{
+		name:        "purchase",
+		description: "Record what books were bought for and report the spending",
+		subcommands: []*Subcommand{
+			createPurchaseAddCommand(),
+			createPurchaseListCommand(),
+			createPurchaseSpendingCommand(),
+		},
+	}
+}
+
+func createPurchaseAddCommand() *Subcommand {
+	var id string
+	var copyID string
+	var store string
+	var price float64
+	var currency string
+	var date string
+
+	flags := newFlagSet("add")
+	flags.StringVar(&id, "i", "", "Id of the book")
+	flags.StringVar(&copyID, "copy", "", "Id of the copy bought")
+	flags.StringVar(&store, "store", "", "Store the book was bought at")
+	flags.Float64Var(&price, "price", 0, "Price paid for the book")
+	flags.StringVar(&currency, "currency", "", "Currency of the price, such as EUR, BOOKISH_CURRENCY when empty")
+	flags.StringVar(&date, "date", "", "Day the book was bought (YYYY-MM-DD), today when empty")
+	output := addOutputFlags(flags)
+
+	return &Subcommand{
+		name:        "add",
+		description: "Record the purchase of a book",
+		flags:       flags,
+		values:      map[string]flagValues{"i": {library: completeBookIDs}},
+		run: func(out io.Writer, args []string) error {
+			err := output.validate()
+			if err != nil {
+				return err
+			}
+			bookID, err := idFlag("i", id)
+			if err != nil {
+				return err
+			}
+			if bookID == nil {
+				return usageErrorf("no book chosen, set its id with -i")
+			}
+			copy, err := idFlag("copy", copyID)
+			if err != nil {
+				return err
+			}
+			purchaseArgs := PurchaseArgs{BookID: bookID, CopyID: copy, Store: optionalValue(store), Currency: purchaseCurrency(currency), PurchaseDate: optionalValue(date)}
+			flags.Visit(func(f *flag.Flag) {
+				if f.Name == "price" {
+					purchaseArgs.Price = &price
+				}
+			})
+			if purchaseArgs.Price == nil {
+				return usageErrorf("no price set, set it with -price")
+			}
+			if purchaseArgs.Currency == nil {
+				return usageErrorf("no currency set, set it with -currency or BOOKISH_CURRENCY")
+			}
+
+			library, err := currentBackend()
+			if err != nil {
+				return err
+			}
+
+			purchase, err := library.RecordPurchase(purchaseArgs)
+			if err != nil {
+				return err
+			}
+			if output.format == "table" && !output.quiet {
+				fmt.Fprintf(out, "Purchase of %s for %s %s recorded\n", purchase.Title, outputPrice(&purchase.Price), purchase.Currency)
+				return nil
+			}
+			return writeRecord(out, output, *purchase, purchaseView)
+		},
+	}
+}
+
+func createPurchaseListCommand() *Subcommand {
+	var id string
+	var store string
+	var currency string
+	var from string
+	var to string
+
+	flags := newFlagSet("list")
+	flags.StringVar(&id, "i", "", "Id of the book")
+	flags.StringVar(&store, "store", "", "Store the books were bought at, ignoring case")
+	flags.StringVar(&currency, "currency", "", "Currency of the purchases")
+	flags.StringVar(&from, "from", "", "First day of the purchases (YYYY-MM-DD)")
+	flags.StringVar(&to, "to", "", "Last day of the purchases (YYYY-MM-DD)")
+	output := addOutputFlags(flags)
+
+	return &Subcommand{
+		name:        "list",
+		description: "List the purchases, the latest first",
+		flags:       flags,
+		values:      map[string]flagValues{"i": {library: completeBookIDs}},
+		run: func(out io.Writer, args []string) error {
+			err := output.validate()
+			if err != nil {
+				return err
+			}
+			bookID, err := idFlag("i", id)
+			if err != nil {
+				return err
+			}
+
+			library, err := currentBackend()
+			if err != nil {
+				return err
+			}
+
+			purchases, err := library.ListPurchases(PurchaseArgs{BookID: bookID, Store: optionalValue(store), Currency: optionalValue(currency), From: optionalValue(from), To: optionalValue(to)})
+			if err != nil {
+				return err
+			}
+			return writeRecords(out, output, purchases, purchaseView)
+		},
+	}
+}
+
+func createPurchaseSpendingCommand() *Subcommand {
+	var store string
+	var currency string
+	var from string
+	var to string
+
+	flags := newFlagSet("spending")
+	flags.StringVar(&store, "store", "", "Store the books were bought at, ignoring case")
+	flags.StringVar(&currency, "currency", "", "Currency of the purchases, every currency when empty")
+	flags.StringVar(&from, "from", "", "First day of the report (YYYY-MM-DD)")
+	flags.StringVar(&to, "to", "", "Last day of the report (YYYY-MM-DD)")
+	output := addOutputFlags(flags)
+
+	return &Subcommand{
+		name:        "spending",
+		description: "Report the money spent on books each month",
+		flags:       flags,
+		run: func(out io.Writer, args []string) error {
+			err := output.validate()
+			if err != nil {
+				return err
+			}
+			if output.quiet {
+				return usageErrorf("-quiet prints ids, the spending report has none")
+			}
+
+			library, err := currentBackend()
+			if err != nil {
+				return err
+			}
+
+			spending, err := library.SpendingReport(PurchaseArgs{Store: optionalValue(store), Currency: optionalValue(currency), From: optionalValue(from), To: optionalValue(to)})
+			if err != nil {
+				return err
+			}
+			return writeRecords(out, output, spending, spendingView)
+		},
+	}
+}
+
+func createTagCommands() *Command {
+	return &Command{
+		name:        "tag",
+		description: "Label books with genres, subjects, moods and other tags",
+		subcommands: []*Subcommand{
+			createTagCreateCommand(),
+			createTagListCommand(),
+			createTagEditCommand(),
+			createTagDeleteCommand(),
+			createTagApplyCommand(),
+			createTagRemoveCommand(),
+		},
+	}
+}
+
+func createTagCreateCommand() *Subcommand {
+	var name string
+	var kind string
+
+	flags := newFlagSet("create")
+	flags.StringVar(&name, "n", "", "Name of the tag")
+	flags.StringVar(&kind, "kind", "", "Kind of the tag: genre, subject or mood, none when empty")
+	output := addOutputFlags(flags)
+
+	return &Subcommand{
+		name:        "create",
+		description: "Create a tag",
+		flags:       flags,
+		values:      map[string]flagValues{"kind": {words: tagKinds}},
+		run: func(out io.Writer, args []string) error {
+			err := output.validate()
+			if err != nil {
+				return err
+			}
+			if name == "" {
+				return usageErrorf("no tag name set, set it with -n")
+			}
+
+			library, err := currentBackend()
+			if err != nil {
+				return err
+			}
+
+			tag, err := library.CreateTag(TagArgs{Name: &name, Kind: optionalValue(kind)})
+			if err != nil {
+				return err
+			}
+			if output.format == "table" && !output.quiet {
+				fmt.Fprintf(out, "Tag %s created with ID %d\n", tag.Name, tag.TagID)
+				return nil
+			}
+			return writeRecord(out, output, *tag, tagView)
+		},
+	}
+}
+
+func createTagListCommand() *Subcommand {
+	var kind string
+	var id string
+	var sort string
+
+	flags := newFlagSet("list")
+	flags.StringVar(&kind, "kind", "", "Kind of the tags: genre, subject or mood")
+	flags.StringVar(&id, "i", "", "Id of a book, to list its tags")
+	flags.StringVar(&sort, "sort", "name", "Order of the tags: name, or books for the most used first")
+	output := addOutputFlags(flags)
+
+	return &Subcommand{
+		name:        "list",
+		description: "List the tags with their number of books",
+		flags:       flags,
+		values:      map[string]flagValues{"kind": {words: tagKinds}, "i": {library: completeBookIDs}, "sort": {words: tagSorts}},
+		run: func(out io.Writer, args []string) error {
+			err := output.validate()
+			if err != nil {
+				return err
+			}
+			bookID, err := idFlag("i", id)
+			if err != nil {
+				return err
+			}
+
+			library, err := currentBackend()
+			if err != nil {
+				return err
+			}
+
+			tags, err := library.ListTags(TagArgs{Kind: optionalValue(kind), BookID: bookID, Sort: optionalValue(sort)})
+			if err != nil {
+				return err
+			}
+			return writeRecords(out, output, tags, tagView)
+		},
+	}
+}
+
+func createTagEditCommand() *Subcommand {
+	var id string
+	var name string
+	var kind string
+
+	flags := newFlagSet("edit")
+	flags.StringVar(&id, "g", "", "Id of the tag")
+	flags.StringVar(&name, "n", "", "New name of the tag")
+	flags.StringVar(&kind, "kind", "", "New kind: genre, subject or mood, empty to clear it")
+	output := addOutputFlags(flags)
+
+	return &Subcommand{
+		name:        "edit",
+		description: "Rename a tag or change its kind, only the flags given are changed",
+		flags:       flags,
+		values:      map[string]flagValues{"g": {library: completeTagIDs}, "kind": {words: tagKinds}},
+		run: func(out io.Writer, args []string) error {
+			err := output.validate()
+			if err != nil {
+				return err
+			}
+			tagID, err := idFlag("g", id)
+			if err != nil {
+				return err
+			}
+			if tagID == nil {
+				return usageErrorf("no tag chosen, set its id with -g")
+			}
+
+			// the flags left out keep their value, an empty kind clears it
+			tagArgs := TagArgs{TagID: tagID}
+			flags.Visit(func(f *flag.Flag) {
+				switch f.Name {
+				case "n":
+					tagArgs.Name = &name
+				case "kind":
+					tagArgs.Kind = &kind
+				}
+			})
+
+			library, err := currentBackend()
+			if err != nil {
+				return err
+			}
+
+			tag, err := library.UpdateTag(tagArgs)
+			if err != nil {
+				return err
+			}
+			if output.format == "table" && !output.quiet {
+				fmt.Fprintf(out, "Tag %d updated to %s\n", tag.TagID, tag.Name)
+				return nil
+			}
+			return writeRecord(out, output, *tag, tagView)
+		},
+	}
+}
+
+func createTagDeleteCommand() *Subcommand {
+	var id string
+
+	flags := newFlagSet("delete")
+	flags.StringVar(&id, "g", "", "Id of the tag")
+
+	return &Subcommand{
+		name:        "delete",
+		description: "Delete a tag and remove it from its books",
+		flags:       flags,
+		values:      map[string]flagValues{"g": {library: completeTagIDs}},
+		run: func(out io.Writer, args []string) error {
+			tagID, err := idFlag("g", id)
+			if err != nil {
+				return err
+			}
+			if tagID == nil {
+				return usageErrorf("no tag chosen, set its id with -g")
+			}
+
+			library, err := currentBackend()
+			if err != nil {
+				return err
+			}
+
+			tag, err := library.DeleteTag(TagArgs{TagID: tagID})
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "Tag %s deleted from %d books\n", tag.Name, tag.Books)
+			return nil
+		},
+	}
+}
+
+func createTagApplyCommand() *Subcommand {
+	var id string
+	var tags string
+
+	flags := newFlagSet("apply")
+	flags.StringVar(&id, "i", "", "Id of the book")
+	flags.StringVar(&tags, "tags", "", "Comma separated tags, the missing ones are created")
+	output := addOutputFlags(flags)
+
+	return &Subcommand{
+		name:        "apply",
+		description: "Add tags to a book",
+		flags:       flags,
+		values:      map[string]flagValues{"i": {library: completeBookIDs}, "tags": {library: completeTagNames}},
+		run: func(out io.Writer, args []string) error {
+			err := output.validate()
+			if err != nil {
+				return err
+			}
+			bookID, err := idFlag("i", id)
+			if err != nil {
+				return err
+			}
+			if bookID == nil {
+				return usageErrorf("no book chosen, set its id with -i")
+			}
+			if len(splitTags(tags)) == 0 {
+				return usageErrorf("no tags set, set them with -tags")
+			}
+
+			library, err := currentBackend()
+			if err != nil {
+				return err
+			}
+
+			book, err := library.TagBook(BookTagsArgs{BookID: bookID, Tags: splitTags(tags)})
+			if err != nil {
+				return err
+			}
+			if output.format == "table" && !output.quiet {
+				fmt.Fprintf(out, "Book %s tagged %s\n", book.Title, strings.Join(book.Tags, ", "))
+				return nil
+			}
+			return writeRecord(out, output, *book, bookView)
+		},
+	}
+}
+
+func createTagRemoveCommand() *Subcommand {
+	var id string
+	var tags string
+
+	flags := newFlagSet("remove")
+	flags.StringVar(&id, "i", "", "Id of the book")
+	flags.StringVar(&tags, "tags", "", "Comma separated tags to remove, the tags themselves are kept")
+	output := addOutputFlags(flags)
+
+	return &Subcommand{
+		name:        "remove",
+		description: "Remove tags from a book",
+		flags:       flags,
+		values:      map[string]flagValues{"i": {library: completeBookIDs}, "tags": {library: completeTagNames}},
+		run: func(out io.Writer, args []string) error {
+			err := output.validate()
+			if err != nil {
+				return err
+			}
+			bookID, err := idFlag("i", id)
+			if err != nil {
+				return err
+			}
+			if bookID == nil {
+				return usageErrorf("no book chosen, set its id with -i")
+			}
+			if len(splitTags(tags)) == 0 {
+				return usageErrorf("no tags set, set them with -tags")
+			}
+
+			library, err := currentBackend()
+			if err != nil {
+				return err
+			}
+
+			book, err := library.UntagBook(BookTagsArgs{BookID: bookID, Tags: splitTags(tags)})
+			if err != nil {
+				return err
+			}
+			if output.format == "table" && !output.quiet {
+				fmt.Fprintf(out, "Tags %s removed from %s\n", strings.Join(splitTags(tags), ", "), book.Title)
+				return nil
+			}
+			return writeRecord(out, output, *book, bookView)
+		},
+	}
+}
+
+func createCollectionCreateCommand() *Subcommand {
+	var name string
+
+	flags := newFlagSet("create")
+	flags.StringVar(&name, "n", "", "Name of the collection")
+	output := addOutputFlags(flags)
+
+	return &Subcommand{
+		name:        "create",
+		description: "Create a new collection",
+		flags:       flags,
+		run: func(out io.Writer, args []string) error {
+			err := output.validate()
+			if err != nil {
+				return err
+			}
+
+			library, err := currentBackend()
+			if err != nil {
+				return err
+			}
+
+			collection, err := library.CreateCollection(CollectionArgs{CollectionName: optionalValue(name)})
+			if err != nil {
+				return err
+			}
+			if output.format == "table" && !output.quiet {
+				fmt.Fprintf(out, "Creating collection with name %s\n", collection.CollectionName)
+				return nil
+			}
+			return writeRecord(out, output, *collection, collectionView)
+		},
+	}
+}
+
+func createCollectionListCommand() *Subcommand {
+	var name string
+	var id string
+
+	flags := newFlagSet("list")
+	flags.StringVar(&name, "n", "", "Name of the collection")
+	flags.StringVar(&id, "i", "", "Id of the collection")
+	output := addOutputFlags(flags)
+
+	return &Subcommand{
+		name:        "list",
+		description: "List all collections with their books",
+		flags:       flags,
+		values:      map[string]flagValues{"n": {library: completeCollectionNames}, "i": {library: completeCollectionIDs}},
+		run: func(out io.Writer, args []string) error {
+			err := output.validate()
+			if err != nil {
+				return err
+			}
+			collectionID, err := idFlag("i", id)
+			if err != nil {
+				return err
+			}
+
+			library, err := currentBackend()
+			if err != nil {
+				return err
+			}
+
+			collections, err := library.ListCollections(CollectionArgs{CollectionID: collectionID, CollectionName: optionalValue(name)})
+			if err != nil {
+				return err
+			}
+			return writeRecords(out, output, collections, collectionView)
+		},
+	}
+}
+
+func createCollectionAddCommand() *Subcommand {
+	var id string
+	var bookId string
+
+	flags := newFlagSet("add")
+	flags.StringVar(&id, "i", "", "Id of the collection")
+	flags.StringVar(&bookId, "bi", "", "Id of the book to be added")
+
+	return &Subcommand{
+		name:        "add",
+		description: "Add a book to a collection",
+		flags:       flags,
+		values:      map[string]flagValues{"i": {library: completeCollectionIDs}, "bi": {library: completeBookIDs}},
+		run: func(out io.Writer, args []string) error {
+			collectionID, err := idFlag("i", id)
+			if err != nil {
+				return err
+			}
+			bookID, err := idFlag("bi", bookId)
+			if err != nil {
+				return err
+			}
+
+			library, err := currentBackend()
+			if err != nil {
+				return err
+			}
+
+			collection, book, err := library.AddBookToCollection(AddBookToCollectionArgs{BookID: bookID, CollectionID: collectionID})
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "Book %s added to collection %s\n", book.Title, collection.CollectionName)
+			return nil
+		},
+	}
+}
+
+func createCollectionRemoveCommand() *Subcommand {
+	var id string
+	var bookId string
+
+	flags := newFlagSet("remove")
+	flags.StringVar(&id, "i", "", "Id of the collection")
+	flags.StringVar(&bookId, "bi", "", "Id of the book to be removed")
+
+	return &Subcommand{
+		name:        "remove",
+		description: "Remove a book from a collection, the book stays in the database",
+		flags:       flags,
+		values:      map[string]flagValues{"i": {library: completeCollectionIDs}, "bi": {library: completeBookIDs}},
+		run: func(out io.Writer, args []string) error {
+			collectionID, err := idFlag("i", id)
+			if err != nil {
+				return err
+			}
+			bookID, err := idFlag("bi", bookId)
+			if err != nil {
+				return err
+			}
+
+			library, err := currentBackend()
+			if err != nil {
+				return err
+			}
+
+			collection, book, err := library.RemoveBookFromCollection(AddBookToCollectionArgs{BookID: bookID, CollectionID: collectionID})
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "Book %s removed from collection %s\n", book.Title, collection.CollectionName)
+			return nil
+		},
+	}
+}
+
+func createCollectionExportCommand() *Subcommand {
+	var id string
+	var format string
+	var output string
+
+	flags := newFlagSet("export")
+	flags.StringVar(&id, "i", "", "Id of the collection")
+	flags.StringVar(&format, "f", "bibtex", "Citation format: bibtex or ris")
+	flags.StringVar(&output, "o", "", "Path of the output file, standard output when empty")
+
+	return &Subcommand{
+		name:        "export",
+		description: "Export the books of a collection as BibTeX or RIS citations",
+		flags:       flags,
+		values:      map[string]flagValues{"i": {library: completeCollectionIDs}, "f": {words: []string{"bibtex", "ris"}}, "o": {path: "file"}},
+		run: func(out io.Writer, args []string) error {
+			collectionID, err := idFlag("i", id)
+			if err != nil {
+				return err
+			}
+			if collectionID == nil {
+				return usageErrorf("no collection set, use -i <collection id>")
+			}
+
+			library, err := currentBackend()
+			if err != nil {
+				return err
+			}
+
+			w, closeOutput, err := outputFile(out, output)
+			if err != nil {
+				return err
+			}
+			defer closeOutput()
+
+			err = library.ExportCollectionCitations(w, *collectionID, format)
+			if err != nil {
+				return err
+			}
+			return closeOutput()
+		},
+	}
+}
+
+func createExportCommand() *Command {
+	var format string
+	var id string
+	var output string
+
+	flags := newFlagSet("export")
+	flags.StringVar(&format, "f", "csv", "Format of the export: csv, jsonl, md, marc or marcxml")
+	flags.StringVar(&id, "i", "", "Id of the collection to export, all books when empty")
+	flags.StringVar(&output, "o", "", "Path of the output file, standard output when empty")
+
+	return &Command{
+		name:        "export",
+		description: "Export the catalogue as csv, jsonl, md, marc or marcxml",
+		flags:       flags,
+		values:      map[string]flagValues{"f": {words: []string{"csv", "jsonl", "md", "marc", "marcxml"}}, "i": {library: completeCollectionIDs}, "o": {path: "file"}},
+		run: func(out io.Writer, args []string) error {
+			collectionID, err := idFlag("i", id)
+			if err != nil {
+				return err
+			}
+			_, err = ExportContentType(format)
+			if err != nil {
+				return usageError{message: err.Error()}
+			}
+
+			library, err := currentBackend()
+			if err != nil {
+				return err
+			}
+
+			w, closeOutput, err := outputFile(out, output)
+			if err != nil {
+				return err
+			}
+			defer closeOutput()
+
+			err = library.ExportCatalogue(w, ExportArgs{Format: format, CollectionID: collectionID})
+			if err != nil {
+				return err
+			}
+			return closeOutput()
+		},
+	}
+}
+
+func createBackupCommand() *Command {
+	var output string
+
+	flags := newFlagSet("backup")
+	flags.StringVar(&output, "o", "", "Path of the backup archive, bookish-backup-<date>.zip when empty")
+
+	return &Command{
+		name:        "backup",
+		description: "Write a backup archive of the database",
+		flags:       flags,
+		values:      map[string]flagValues{"o": {path: "file"}},
+		run: func(out io.Writer, args []string) error {
+			library, err := currentBackend()
+			if err != nil {
+				return err
+			}
+
+			fileName := output
+			if fileName == "" {
+				fileName = fmt.Sprintf("bookish-backup-%s.zip", time.Now().Format("20060102-150405"))
+			}
+			file, err := os.Create(fileName)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+
+			// a failed backup leaves no archive behind
+			manifest, err := library.Backup(file)
+			if err != nil {
+				file.Close()
+				os.Remove(fileName)
+				return err
+			}
+			err = file.Close()
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "Backup written to %s: %d authors, %d books, %d collections\n", fileName, manifest.Files[backupAuthorsFile].Records, manifest.Files[backupBooksFile].Records, manifest.Files[backupCollectionsFile].Records)
+			return nil
+		},
+	}
+}
+
+func createRestoreCommand() *Command {
+	var fileName string
+	var mode string
+
+	flags := newFlagSet("restore")
+	flags.StringVar(&fileName, "f", "", "Path of the backup archive")
+	flags.StringVar(&mode, "mode", "merge", "merge into the database, or replace everything in it")
+
+	return &Command{
+		name:        "restore",
+		description: "Restore a backup archive",
+		flags:       flags,
+		values:      map[string]flagValues{"f": {path: "file"}, "mode": {words: []string{"merge", "replace"}}},
+		run: func(out io.Writer, args []string) error {
+			if fileName == "" {
+				return usageErrorf("no backup archive set, use -f <path>")
+			}
+			if mode != "merge" && mode != "replace" {
+				return usageErrorf("invalid -mode %q, expected merge or replace", mode)
+			}
+
+			library, err := currentBackend()
+			if err != nil {
+				return err
+			}
+
+			file, err := os.Open(fileName)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			info, err := file.Stat()
+			if err != nil {
+				return err
+			}
+
+			report, err := library.Restore(file, info.Size(), RestoreArgs{Mode: mode})
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "Restored (%s) %d authors, %d books, %d collections, %d memberships, %d copies, %d users, %d reading statuses, %d reading sessions, %d reviews, %d notes, %d loans, %d wishes, %d purchases, %d tags and %d book tags\n", report.Mode, report.Authors, report.Books, report.Collections, report.Memberships, report.Copies, report.Users, report.Statuses, report.Sessions, report.Reviews, report.Notes, report.Loans, report.Wishes, report.Purchases, report.Tags, report.BookTags)
+			return nil
+		},
+	}
+}
+
+func createServeCommand() *Command {
+	var address string
+	var configFile string
+	var migrate bool
+
+	flags := newFlagSet("serve")
+	flags.StringVar(&address, "addr", "", "Address to listen on, the server address of the configuration file or :8080 when empty")
+	flags.StringVar(&configFile, "config", "", "Configuration file, the one of the global -config flag when empty")
+	flags.BoolVar(&migrate, "migrate", false, "Set up or update the database schema before serving")
+
+	return &Command{
+		name:        "serve",
+		description: "Serve the HTTP API and the OPDS catalog, with -migrate when no command is given",
+		flags:       flags,
+		values:      map[string]flagValues{"config": {path: "file"}},
+		run: func(out io.Writer, args []string) error {
+			if configFile == "" {
+				configFile = configPath
+			}
+			err := openDatabase(configFile)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+
+			if migrate {
+				err = CreateTables(db)
+			} else {
+				err = CheckSchema(db)
+			}
+			if err != nil {
+				return err
+			}
+
+			if address == "" {
+				address = config.Server.Address
+			}
+			if address == "" {
+				address = ":8080"
+			}
+			log.Printf("serving on %s", address)
+			return http.ListenAndServe(address, newRouter(config))
+		},
+	}
+}
+
+func createMigrateCommand() *Command {
+	return &Command{
+		name:        "migrate",
+		description: "Set up the database schema, or update the schema of an older database",
+		run: func(out io.Writer, args []string) error {
+			// the schema is always set up on the database, whatever the profile
+			err := openDatabase(configPath)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+
+			err = CreateTables(db)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(out, "Database schema is up to date")
+			return nil
+		},
+	}
+}
@@ -0,0 +1,597 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// flagValues tells the completion what the value of a flag can be: one of fixed words,
+// names or ids read from the library, or a path
+type flagValues struct {
+	words   []string
+	library string // one of the complete kinds below
+	path    string // "file" or "dir"
+}
+
+// kinds of values read from the library by the __complete command
+const (
+	completeBookIDs         = "book-ids"
+	completeCollectionIDs   = "collection-ids"
+	completeCollectionNames = "collection-names"
+	completeTitles          = "titles"
+	completeAuthors         = "authors"
+	completeTagIDs          = "tag-ids"
+	completeTagNames        = "tag-names"
+	completeProfiles        = "profiles"
+)
+
+// outputFormats are the values of the -output flag of addOutputFlags
+var outputFormats = []string{"table", "json", "jsonl", "csv", "yaml"}
+
+var completionShells = []string{"bash", "zsh", "fish"}
+
+// valuesOf returns how the value of a flag is completed, "" is for the positional arguments
+func valuesOf(values map[string]flagValues, name string) flagValues {
+	if name == "output" {
+		return flagValues{words: outputFormats}
+	}
+	return values[name]
+}
+
+// completionValue is a completion with the description shells such as fish and zsh show next to it
+type completionValue struct {
+	value       string
+	description string
+}
+
+// libraryValues reads the values of a kind of completion from the library
+func libraryValues(library backend, kind string) ([]completionValue, error) {
+	switch kind {
+	case completeBookIDs, completeTitles, completeAuthors:
+		books, err := library.ListBooks(BookArgs{})
+		if err != nil {
+			return nil, err
+		}
+		values := []completionValue{}
+		seen := map[string]bool{}
+		for _, book := range books {
+			switch {
+			case kind == completeBookIDs:
+				values = append(values, completionValue{value: strconv.Itoa(book.BookID), description: book.Title})
+			case kind == completeTitles && !seen[book.Title]:
+				seen[book.Title] = true
+				values = append(values, completionValue{value: book.Title, description: book.Author})
+			case kind == completeAuthors && !seen[book.Author]:
+				seen[book.Author] = true
+				values = append(values, completionValue{value: book.Author})
+			}
+		}
+		if kind != completeBookIDs {
+			sortValues(values)
+		}
+		return values, nil
+
+	case completeCollectionIDs, completeCollectionNames:
+		collections, err := library.ListCollections(CollectionArgs{})
+		if err != nil {
+			return nil, err
+		}
+		values := []completionValue{}
+		for _, collection := range collections {
+			if kind == completeCollectionIDs {
+				values = append(values, completionValue{value: strconv.Itoa(collection.CollectionID), description: collection.CollectionName})
+			} else {
+				values = append(values, completionValue{value: collection.CollectionName})
+			}
+		}
+		if kind == completeCollectionNames {
+			sortValues(values)
+		}
+		return values, nil
+
+	case completeTagIDs, completeTagNames:
+		tags, err := library.ListTags(TagArgs{})
+		if err != nil {
+			return nil, err
+		}
+		values := []completionValue{}
+		for _, tag := range tags {
+			if kind == completeTagIDs {
+				values = append(values, completionValue{value: strconv.Itoa(tag.TagID), description: tag.Name})
+			} else {
+				values = append(values, completionValue{value: tag.Name, description: tag.Kind})
+			}
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("unknown completion %q", kind)
+}
+
+func sortValues(values []completionValue) {
+	sort.Slice(values, func(i, j int) bool { return values[i].value < values[j].value })
+}
+
+// profileValues lists the profiles of the profile file, which needs no library
+func profileValues() ([]completionValue, error) {
+	profiles, _, err := loadProfileFile()
+	if errors.Is(err, os.ErrNotExist) {
+		return []completionValue{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	values := []completionValue{}
+	for name, profile := range profiles.Profiles {
+		values = append(values, completionValue{value: name, description: profile.URL})
+	}
+	sortValues(values)
+	return values, nil
+}
+
+// createCompleteCommand is run by the completion scripts to read values from the library
+func createCompleteCommand() *Command {
+	return &Command{
+		name:        "__complete",
+		description: "Print the values of a kind of completion, one per line with a tab before their description",
+		arguments:   "<kind>",
+		hidden:      true,
+		run: func(out io.Writer, args []string) error {
+			if len(args) != 1 {
+				return usageErrorf("choose the kind of values to complete")
+			}
+
+			var values []completionValue
+			var err error
+			if args[0] == completeProfiles {
+				values, err = profileValues()
+			} else {
+				var library backend
+				library, err = currentBackend()
+				if err != nil {
+					return err
+				}
+				values, err = libraryValues(library, args[0])
+			}
+			if err != nil {
+				return err
+			}
+
+			for _, value := range values {
+				if value.description == "" {
+					fmt.Fprintln(out, value.value)
+					continue
+				}
+				fmt.Fprintf(out, "%s\t%s\n", value.value, strings.NewReplacer("\t", " ", "\n", " ").Replace(value.description))
+			}
+			return nil
+		},
+	}
+}
+
+func createCompletionCommand() *Command {
+	return &Command{
+		name:        "completion",
+		description: "Print the completion script of a shell: bash, zsh or fish",
+		arguments:   "<shell>",
+		values:      map[string]flagValues{"": {words: completionShells}},
+		run: func(out io.Writer, args []string) error {
+			if len(args) != 1 {
+				return usageErrorf("choose the shell: bash, zsh or fish")
+			}
+			globals, _, _ := newGlobalFlags()
+			return writeCompletionScript(out, args[0], cliCommands(), globals)
+		},
+	}
+}
+
+// completionCommand is a command or subcommand as the script templates see it
+type completionCommand struct {
+	Name        string
+	Path        string // the command and subcommand separated by a slash, like bash and zsh match them
+	Words       string // the command and subcommand separated by a space
+	Description string
+	Flags       []completionFlag
+	Arguments   flagValues
+	Subcommands []completionCommand
+}
+
+type completionFlag struct {
+	Name   string
+	Usage  string
+	Bool   bool
+	Values flagValues
+}
+
+func (values flagValues) Words() string {
+	return strings.Join(values.words, " ")
+}
+
+func (values flagValues) Library() string {
+	return values.library
+}
+
+func (values flagValues) Path() string {
+	return values.path
+}
+
+// None is true for values that cannot be completed, such as a title being created
+func (values flagValues) None() bool {
+	return len(values.words) == 0 && values.library == "" && values.path == ""
+}
+
+func completionFlags(flags *flag.FlagSet, values map[string]flagValues) []completionFlag {
+	list := []completionFlag{}
+	if flags == nil {
+		return list
+	}
+	flags.VisitAll(func(f *flag.Flag) {
+		list = append(list, completionFlag{Name: f.Name, Usage: f.Usage, Bool: isBoolFlag(f), Values: valuesOf(values, f.Name)})
+	})
+	return list
+}
+
+// writeCompletionScript writes the completion script of a shell, generated from the
+// commands and their flags
+func writeCompletionScript(w io.Writer, shell string, commands []*Command, globals *flag.FlagSet) error {
+	script, ok := completionScripts[shell]
+	if !ok {
+		return usageErrorf("unknown shell %q, expected bash, zsh or fish", shell)
+	}
+
+	data := struct {
+		Commands []completionCommand
+		Globals  []completionFlag
+	}{Globals: completionFlags(globals, globalValues)}
+	for _, command := range commands {
+		if command.hidden {
+			continue
+		}
+		entry := completionCommand{
+			Name:        command.name,
+			Path:        command.name + "/",
+			Words:       command.name,
+			Description: command.description,
+			Flags:       completionFlags(command.flags, command.values),
+			Arguments:   command.values[""],
+		}
+		for _, subcommand := range command.subcommands {
+			entry.Subcommands = append(entry.Subcommands, completionCommand{
+				Name:        subcommand.name,
+				Path:        command.name + "/" + subcommand.name,
+				Words:       command.name + " " + subcommand.name,
+				Description: subcommand.description,
+				Flags:       completionFlags(subcommand.flags, subcommand.values),
+				Arguments:   subcommand.values[""],
+			})
+		}
+		data.Commands = append(data.Commands, entry)
+	}
+
+	return script.Execute(w, data)
+}
+
+var completionFuncs = template.FuncMap{
+	// quote makes a single quoted word of bash and zsh
+	"quote": func(s string) string {
+		return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+	},
+	// fishQuote makes a single quoted word of fish, where backslashes escape quotes
+	"fishQuote": func(s string) string {
+		return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s) + "'"
+	},
+	// describe is a value:description pair of zsh's _describe
+	"describe": func(value string, description string) string {
+		return strings.ReplaceAll(value, ":", `\:`) + ":" + description
+	},
+	// leaves are the commands and subcommands that take flags, in the order of the help
+	"leaves": func(commands []completionCommand) []completionCommand {
+		list := []completionCommand{}
+		for _, command := range commands {
+			if len(command.Subcommands) == 0 {
+				list = append(list, command)
+			}
+			list = append(list, command.Subcommands...)
+		}
+		return list
+	},
+	// valueFlags are the global flags followed by a value, joined for a case pattern
+	"valueFlags": func(flags []completionFlag, separator string) string {
+		names := []string{}
+		for _, f := range flags {
+			if !f.Bool {
+				names = append(names, "-"+f.Name)
+			}
+		}
+		return strings.Join(names, separator)
+	},
+	// takeValues is true when some of the flags are followed by a value
+	"takeValues": func(flags []completionFlag) bool {
+		for _, f := range flags {
+			if !f.Bool {
+				return true
+			}
+		}
+		return false
+	},
+	// parents are the commands with subcommands, as a case pattern
+	"parents": func(commands []completionCommand) string {
+		names := []string{}
+		for _, command := range commands {
+			if len(command.Subcommands) > 0 {
+				names = append(names, command.Name)
+			}
+		}
+		return strings.Join(names, "|")
+	},
+}
+
+var completionScripts = map[string]*template.Template{
+	"bash": template.Must(template.New("bash").Funcs(completionFuncs).Parse(bashCompletion)),
+	"zsh":  template.Must(template.New("zsh").Funcs(completionFuncs).Parse(zshCompletion)),
+	"fish": template.Must(template.New("fish").Funcs(completionFuncs).Parse(fishCompletion)),
+}
+
+const bashCompletion = `# bash completion of bookish, generated by: bookish completion bash
+# Load it with: source <(bookish completion bash)
+{{define "values"}}
+{{- if .Library}}_bookish_library {{.Library}}
+{{- else if eq .Path "file"}}compopt -o filenames; COMPREPLY=($(compgen -f -- "$cur"))
+{{- else if eq .Path "dir"}}compopt -o filenames; COMPREPLY=($(compgen -d -- "$cur"))
+{{- else if .Words}}COMPREPLY=($(compgen -W {{quote .Words}} -- "$cur"))
+{{- else}}:{{end}}
+{{- end}}
+# _bookish_library completes names and ids read from the library the command line works on
+_bookish_library() {
+    local IFS=$'\n' value
+    for value in $(bookish "${globals[@]}" __complete "$1" 2>/dev/null | cut -f1); do
+        if [[ $value == "$cur"* ]]; then
+            COMPREPLY+=("$(printf '%q' "$value")")
+        fi
+    done
+}
+
+_bookish() {
+    local cur=${COMP_WORDS[COMP_CWORD]} prev=${COMP_WORDS[COMP_CWORD-1]}
+    local command="" subcommand="" i=1
+    local -a globals=()
+    COMPREPLY=()
+
+    # the global flags come before the command, the subcommand right after it
+    while [[ $i -lt $COMP_CWORD ]]; do
+        case ${COMP_WORDS[i]} in
+            {{valueFlags .Globals "|"}}) globals+=("${COMP_WORDS[i]}" "${COMP_WORDS[i+1]}"); i=$((i + 2)) ;;
+            -*) globals+=("${COMP_WORDS[i]}"); i=$((i + 1)) ;;
+            *) break ;;
+        esac
+    done
+    if [[ $i -lt $COMP_CWORD ]]; then
+        command=${COMP_WORDS[i]}
+        i=$((i + 1))
+    fi
+    case $command in
+        {{parents .Commands}})
+            if [[ $i -lt $COMP_CWORD ]]; then
+                subcommand=${COMP_WORDS[i]}
+            fi ;;
+    esac
+
+    case "$command/$subcommand" in
+        /)
+            case $prev in
+{{- range .Globals}}{{if not .Bool}}
+                -{{.Name}}) {{template "values" .Values}}; return ;;
+{{- end}}{{end}}
+            esac
+            if [[ $cur == -* ]]; then
+                COMPREPLY=($(compgen -W '{{range $i, $f := .Globals}}{{if $i}} {{end}}-{{$f.Name}}{{end}}' -- "$cur"))
+            else
+                COMPREPLY=($(compgen -W '{{range .Commands}}{{.Name}} {{end}}help' -- "$cur"))
+            fi ;;
+        help/)
+            COMPREPLY=($(compgen -W '{{range $i, $c := .Commands}}{{if $i}} {{end}}{{$c.Name}}{{end}}' -- "$cur")) ;;
+{{- range .Commands}}{{if .Subcommands}}
+        {{.Path}})
+            COMPREPLY=($(compgen -W '{{range $i, $s := .Subcommands}}{{if $i}} {{end}}{{$s.Name}}{{end}}' -- "$cur")) ;;
+{{- end}}{{end}}
+{{- range leaves .Commands}}
+        {{.Path}})
+{{- if takeValues .Flags}}
+            case $prev in
+{{- range .Flags}}{{if not .Bool}}
+                -{{.Name}}) {{template "values" .Values}}; return ;;
+{{- end}}{{end}}
+            esac
+{{- end}}
+{{- if not .Arguments.None}}
+            if [[ $cur != -* ]]; then
+                {{template "values" .Arguments}}
+                return
+            fi
+{{- end}}
+{{- if .Flags}}
+            COMPREPLY=($(compgen -W '{{range $i, $f := .Flags}}{{if $i}} {{end}}-{{$f.Name}}{{end}}' -- "$cur"))
+{{- end}} ;;
+{{- end}}
+    esac
+}
+
+complete -F _bookish bookish
+`
+
+const zshCompletion = `#compdef bookish
+# zsh completion of bookish, generated by: bookish completion zsh
+# Load it with: source <(bookish completion zsh), or save it as _bookish in a directory of $fpath
+{{define "values"}}
+{{- if .Library}}_bookish_library {{.Library}}
+{{- else if eq .Path "file"}}_files
+{{- else if eq .Path "dir"}}_files -/
+{{- else if .Words}}compadd -- {{.Words}}
+{{- else}}:{{end}}
+{{- end}}
+# _bookish_library completes names and ids read from the library the command line works on
+_bookish_library() {
+    local -a values
+    local line
+    for line in "${(@f)$(bookish "${globals[@]}" __complete $1 2>/dev/null)}"; do
+        [[ -n $line ]] || continue
+        values+=("${${line%%$'\t'*}//:/\\:}:${line#*$'\t'}")
+    done
+    _describe -t $1 $1 values
+}
+
+_bookish() {
+    local cur=${words[CURRENT]} prev=${words[CURRENT-1]}
+    local command="" subcommand="" i=2
+    local -a globals described
+
+    # the global flags come before the command, the subcommand right after it
+    while (( i < CURRENT )); do
+        case ${words[i]} in
+            {{valueFlags .Globals "|"}}) globals+=(${words[i]} ${words[i+1]}); (( i += 2 )) ;;
+            -*) globals+=(${words[i]}); (( i += 1 )) ;;
+            *) break ;;
+        esac
+    done
+    if (( i < CURRENT )); then
+        command=${words[i]}
+        (( i += 1 ))
+    fi
+    case $command in
+        {{parents .Commands}})
+            if (( i < CURRENT )); then
+                subcommand=${words[i]}
+            fi ;;
+    esac
+
+    case "$command/$subcommand" in
+        /)
+            case $prev in
+{{- range .Globals}}{{if not .Bool}}
+                -{{.Name}}) {{template "values" .Values}}; return ;;
+{{- end}}{{end}}
+            esac
+            if [[ $cur == -* ]]; then
+                described=({{range $i, $f := .Globals}}{{if $i}} {{end}}{{quote (describe (print "-" $f.Name) $f.Usage)}}{{end}})
+                _describe -t flags flag described
+            else
+                described=({{range .Commands}}{{quote (describe .Name .Description)}} {{end}}'help:Show the help of a command')
+                _describe -t commands command described
+            fi ;;
+        help/)
+            compadd -- {{range $i, $c := .Commands}}{{if $i}} {{end}}{{$c.Name}}{{end}} ;;
+{{- range .Commands}}{{if .Subcommands}}
+        {{.Path}})
+            described=({{range $i, $s := .Subcommands}}{{if $i}} {{end}}{{quote (describe $s.Name $s.Description)}}{{end}})
+            _describe -t subcommands subcommand described ;;
+{{- end}}{{end}}
+{{- range leaves .Commands}}
+        {{.Path}})
+{{- if takeValues .Flags}}
+            case $prev in
+{{- range .Flags}}{{if not .Bool}}
+                -{{.Name}}) {{template "values" .Values}}; return ;;
+{{- end}}{{end}}
+            esac
+{{- end}}
+{{- if not .Arguments.None}}
+            if [[ $cur != -* ]]; then
+                {{template "values" .Arguments}}
+                return
+            fi
+{{- end}}
+{{- if .Flags}}
+            described=({{range $i, $f := .Flags}}{{if $i}} {{end}}{{quote (describe (print "-" $f.Name) $f.Usage)}}{{end}})
+            _describe -t flags flag described
+{{- end}} ;;
+{{- end}}
+    esac
+}
+
+if [[ $zsh_eval_context[-1] == loadautofunc ]]; then
+    _bookish "$@"
+else
+    compdef _bookish bookish
+fi
+`
+
+const fishCompletion = `# fish completion of bookish, generated by: bookish completion fish
+# Load it with: bookish completion fish | source, or save it as ~/.config/fish/completions/bookish.fish
+{{define "values"}}
+{{- if .Library}} -x -a '(__bookish_library {{.Library}})'
+{{- else if eq .Path "file"}} -r -F
+{{- else if eq .Path "dir"}} -x -a '(__fish_complete_directories)'
+{{- else if .Words}} -x -a {{fishQuote .Words}}
+{{- else}} -x{{end}}
+{{- end}}
+# __bookish_words prints the words typed from the command on, or the global flags before
+# it when its argument is globals
+function __bookish_words
+    set -l words (commandline -opc)
+    set -e words[1]
+    set -l globals
+    while set -q words[1]
+        switch $words[1]
+            case {{valueFlags .Globals " "}}
+                set -a globals $words[1..2]
+                set -e words[1..2]
+            case '-*'
+                set -a globals $words[1]
+                set -e words[1]
+            case '*'
+                break
+        end
+    end
+    if test "$argv[1]" = globals
+        printf '%s\n' $globals
+    else
+        printf '%s\n' $words
+    end
+end
+
+# __bookish_at is true when the words typed are exactly its arguments
+function __bookish_at
+    set -l words (__bookish_words)
+    test "$words" = "$argv"
+end
+
+# __bookish_in is true when the words typed start with its arguments
+function __bookish_in
+    set -l words (__bookish_words)
+    test (count $words) -ge (count $argv); and test "$words[1..(count $argv)]" = "$argv"
+end
+
+# __bookish_library completes names and ids read from the library the command line works on
+function __bookish_library
+    bookish (__bookish_words globals) __complete $argv[1] 2>/dev/null
+end
+
+complete -c bookish -f
+{{- range .Globals}}
+complete -c bookish -n __bookish_at -o {{.Name}}{{if not .Bool}}{{template "values" .Values}}{{end}} -d {{fishQuote .Usage}}
+{{- end}}
+{{- range .Commands}}
+complete -c bookish -n __bookish_at -a {{.Name}} -d {{fishQuote .Description}}
+{{- end}}
+complete -c bookish -n __bookish_at -a help -d 'Show the help of a command'
+complete -c bookish -n '__bookish_at help' -a '{{range $i, $c := .Commands}}{{if $i}} {{end}}{{$c.Name}}{{end}}'
+{{- range .Commands}}{{$command := .Name}}
+{{- range .Subcommands}}
+complete -c bookish -n '__bookish_at {{$command}}' -a {{.Name}} -d {{fishQuote .Description}}
+{{- end}}
+{{- end}}
+{{- range leaves .Commands}}{{$words := .Words}}
+{{- range .Flags}}
+complete -c bookish -n '__bookish_in {{$words}}' -o {{.Name}}{{if not .Bool}}{{template "values" .Values}}{{end}} -d {{fishQuote .Usage}}
+{{- end}}
+{{- if not .Arguments.None}}
+complete -c bookish -n '__bookish_in {{$words}}'{{template "values" .Arguments}}
+{{- end}}
+{{- end}}
+`
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteCompletionScript(t *testing.T) {
+	for shell, lines := range map[string][]string{
+		"bash": {
+			"        collection/add)",
+			"                -bi) _bookish_library book-ids; return ;;",
+			"                -format) COMPREPLY=($(compgen -W 'csv goodreads storygraph bibtex ris marc marcxml calibre' -- \"$cur\")); return ;;",
+			"complete -F _bookish bookish",
+		},
+		"zsh": {
+			"#compdef bookish",
+			"                -n) _bookish_library collection-names; return ;;",
+			"            described=('create:Create a new book' 'list:List all books'",
+		},
+		"fish": {
+			"complete -c bookish -n '__bookish_in collection add' -o bi -x -a '(__bookish_library book-ids)' -d 'Id of the book to be added'",
+			"complete -c bookish -n __bookish_at -o profile -x -a '(__bookish_library profiles)'",
+			"complete -c bookish -n '__bookish_in book scan' -x -a '(__fish_complete_directories)'",
+		},
+	} {
+		// Setup
+		var out bytes.Buffer
+		globals, _, _ := newGlobalFlags()
+
+		// Function to test
+		err := writeCompletionScript(&out, shell, cliCommands(), globals)
+
+		// Verification
+		require.NoError(t, err, shell)
+		for _, line := range lines {
+			assert.Contains(t, out.String(), line, shell)
+		}
+	}
+}
+
+func TestWriteCompletionScript_Syntax(t *testing.T) {
+	for _, shell := range completionShells {
+		path, err := exec.LookPath(shell)
+		if err != nil {
+			continue // the shell is not installed
+		}
+
+		// Setup
+		var out bytes.Buffer
+		globals, _, _ := newGlobalFlags()
+		require.NoError(t, writeCompletionScript(&out, shell, cliCommands(), globals))
+
+		// Function to test
+		check := exec.Command(path, "-n")
+		check.Stdin = &out
+		output, err := check.CombinedOutput()
+
+		// Verification
+		assert.NoError(t, err, "%s: %s", shell, output)
+	}
+}
+
+func TestWriteCompletionScript_UnknownShell(t *testing.T) {
+	// Function to test
+	err := writeCompletionScript(&bytes.Buffer{}, "tcsh", cliCommands(), nil)
+
+	// Verification
+	assert.EqualError(t, err, `unknown shell "tcsh", expected bash, zsh or fish`)
+}
+
+func TestCompleteCommand(t *testing.T) {
+	// Setup
+	cliBackend = testShelf()
+	defer func() { cliBackend = nil }()
+	var stdout, stderr bytes.Buffer
+
+	// Function to test
+	ids := runCLI(cliCommands(), nil, []string{"__complete", "book-ids"}, &stdout, &stderr)
+	idLines := stdout.String()
+	stdout.Reset()
+	authors := runCLI(cliCommands(), nil, []string{"__complete", "authors"}, &stdout, &stderr)
+
+	// Verification
+	assert.Equal(t, exitOK, ids, stderr.String())
+	assert.Equal(t, "3\tThe Hobbit\n4\tThe Silmarillion\n5\tMort\n", idLines)
+	assert.Equal(t, exitOK, authors, stderr.String())
+	assert.Equal(t, "J. R. R. Tolkien\nTerry Pratchett\n", stdout.String())
+
+	stdout.Reset()
+	runCLI(cliCommands(), nil, []string{"help"}, &stdout, &stderr)
+	assert.False(t, strings.Contains(stdout.String(), "__complete"), "the help lists the hidden command")
+}
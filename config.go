@@ -1,14 +1,17 @@
 package main
 
 import (
+	"fmt"
 	"os"
+	"path/filepath"
 
 	"gopkg.in/yaml.v2"
 )
 
-func LoadConfig() (*Config, error) {
+// LoadConfig reads the configuration file, config.yml unless another is chosen
+func LoadConfig(path string) (*Config, error) {
 	var config Config
-	configData, err := os.ReadFile("config.yml")
+	configData, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
@@ -30,4 +33,57 @@ func LoadTestConfig() (*Config, error) {
 		return nil, err
 	}
 	return &config, nil
-}
\ No newline at end of file
+}
+
+// ProfilePath is the file holding the CLI profiles: $BOOKISH_PROFILES, or
+// bookish/profiles.yml in the user configuration directory
+func ProfilePath() (string, error) {
+	if path := os.Getenv("BOOKISH_PROFILES"); path != "" {
+		return path, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "bookish", "profiles.yml"), nil
+}
+
+// LoadProfile reads a profile from the profile file, or its default profile when the
+// name is empty. It returns nil when no name is given and the file has no default.
+func LoadProfile(name string) (*Profile, error) {
+	profiles, path, err := loadProfileFile()
+	if err != nil {
+		return nil, err
+	}
+
+	if name == "" {
+		name = profiles.Default
+		if name == "" {
+			return nil, nil
+		}
+	}
+	profile, ok := profiles.Profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("no profile %s in %s", name, path)
+	}
+	profile.Name = name
+	return &profile, nil
+}
+
+// loadProfileFile reads the profile file and returns it with its path
+func loadProfileFile() (*ProfileFile, string, error) {
+	path, err := ProfilePath()
+	if err != nil {
+		return nil, "", err
+	}
+	var profiles ProfileFile
+	profileData, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", err
+	}
+	err = yaml.Unmarshal(profileData, &profiles)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid profile file %s: %w", path, err)
+	}
+	return &profiles, path, nil
+}
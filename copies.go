@@ -0,0 +1,354 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// copyFormats are the formats a copy can have, ebook copies are files
+var copyFormats = []string{"hardcover", "paperback", "ebook", "audiobook"}
+
+// copyConditions are the conditions of a copy, from the best to the worst
+var copyConditions = []string{"new", "like-new", "good", "fair", "poor"}
+
+func checkCopyFormat(format string) error {
+	for _, known := range copyFormats {
+		if format == known {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid format %s, expected hardcover, paperback, ebook or audiobook", format)
+}
+
+func checkCopyCondition(condition string) error {
+	for _, known := range copyConditions {
+		if condition == known {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid condition %s, expected new, like-new, good, fair or poor", condition)
+}
+
+// checkEbookLocation makes sure that the location of an ebook copy is a file under the
+// library root, the OPDS catalog serves it. The other copies are located by free text,
+// such as a shelf.
+func checkEbookLocation(format string, location *string) error {
+	if format != "ebook" || location == nil || *location == "" {
+		return nil
+	}
+	_, err := libraryFile(*location)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("the ebook file %s does not exist", *location)
+	}
+	return err
+}
+
+// copyError explains the unique violation of an ebook file recorded twice
+func copyError(err error, location *string) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" && location != nil {
+		return fmt.Errorf("the file %s is already recorded as an ebook copy", *location)
+	}
+	return err
+}
+
+// CreateCopy records a copy of a book that we own. The format is required; the
+// condition, the location, such as a shelf or the path of an ebook file under the library
+// root, the acquisition date and the price are optional. A price of 0 is kept, for gifts and free ebooks.
+func CreateCopy(db *sql.DB, c CopyArgs) (*Copy, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // no-op once the transaction is committed
+
+	copy, err := createCopy(tx, c)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return copy, nil
+}
+
+// createCopy inserts a copy using q, which is usually a transaction
+func createCopy(q querier, c CopyArgs) (*Copy, error) {
+	if c.BookID == nil {
+		return nil, errors.New("choose the book and insert its ID number")
+	}
+	if c.Format == nil || *c.Format == "" {
+		return nil, errors.New("no format set, copy not created")
+	}
+	err := checkCopyFormat(*c.Format)
+	if err != nil {
+		return nil, err
+	}
+	if c.Condition != nil && *c.Condition != "" {
+		err := checkCopyCondition(*c.Condition)
+		if err != nil {
+			return nil, err
+		}
+	}
+	acquiredDate, err := SanitizeDate(c.AcquiredDate)
+	if err != nil {
+		return nil, err
+	}
+	if c.Price != nil && *c.Price < 0 {
+		return nil, fmt.Errorf("invalid price %g, prices cannot be negative", *c.Price)
+	}
+	var location *string
+	if c.Location != nil {
+		location = optionalValue(*c.Location)
+	}
+	err = checkEbookLocation(*c.Format, location)
+	if err != nil {
+		return nil, err
+	}
+
+	// check if there is a book with the chosen ID
+	_, err = listBooks(q, BookArgs{BookID: c.BookID})
+	if err != nil {
+		return nil, err
+	}
+
+	var copyID int
+	err = q.QueryRow("INSERT INTO copies (book_id, format, condition, location, acquired_date, price) VALUES ($1, $2, NULLIF($3, ''), $4, $5, $6) RETURNING copy_id",
+		*c.BookID, *c.Format, c.Condition, location, acquiredDate, c.Price).Scan(&copyID)
+	if err != nil {
+		return nil, copyError(err, location)
+	}
+
+	copies, err := listCopies(q, CopyArgs{CopyID: &copyID})
+	if err != nil {
+		return nil, err
+	}
+	return &copies[0], nil
+}
+
+// UpdateCopy changes the fields of a copy that are set in c, the copy is chosen by its
+// ID. An empty condition, location or acquisition date clears them.
+func UpdateCopy(db *sql.DB, c CopyArgs) (*Copy, error) {
+	if c.CopyID == nil {
+		return nil, errors.New("choose the copy to update and insert its ID number")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // no-op once the transaction is committed
+
+	copies, err := listCopies(tx, CopyArgs{CopyID: c.CopyID})
+	if err != nil {
+		return nil, err
+	}
+	location := &copies[0].Location
+
+	sets := []string{}
+	params := []any{}
+	set := func(column string, value any) {
+		params = append(params, value)
+		sets = append(sets, fmt.Sprintf("%s = $%d", column, len(params)))
+	}
+	if c.Format != nil {
+		err := checkCopyFormat(*c.Format)
+		if err != nil {
+			return nil, err
+		}
+		if *c.Format == "ebook" && copies[0].Borrower != "" {
+			return nil, fmt.Errorf("copy %d of %s is lent to %s, it cannot become an ebook", *c.CopyID, copies[0].Title, copies[0].Borrower)
+		}
+		set("format", *c.Format)
+	}
+	if c.Condition != nil {
+		if *c.Condition == "" {
+			set("condition", nil)
+		} else {
+			err := checkCopyCondition(*c.Condition)
+			if err != nil {
+				return nil, err
+			}
+			set("condition", *c.Condition)
+		}
+	}
+	if c.Location != nil {
+		location = optionalValue(*c.Location)
+		set("location", location)
+	}
+	// a location kept as it was is checked when the copy becomes an ebook
+	if c.Location != nil || (c.Format != nil && copies[0].Format != "ebook") {
+		format := copies[0].Format
+		if c.Format != nil {
+			format = *c.Format
+		}
+		err := checkEbookLocation(format, location)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if c.AcquiredDate != nil {
+		acquiredDate, err := SanitizeDate(c.AcquiredDate)
+		if err != nil {
+			return nil, err
+		}
+		set("acquired_date", acquiredDate)
+	}
+	if c.Price != nil {
+		if *c.Price < 0 {
+			return nil, fmt.Errorf("invalid price %g, prices cannot be negative", *c.Price)
+		}
+		set("price", *c.Price)
+	}
+
+	if len(sets) > 0 {
+		params = append(params, *c.CopyID)
+		_, err = tx.Exec(fmt.Sprintf("UPDATE copies SET %s WHERE copy_id = $%d", strings.Join(sets, ", "), len(params)), params...)
+		if err != nil {
+			return nil, copyError(err, location)
+		}
+	}
+
+	copies, err = listCopies(tx, CopyArgs{CopyID: c.CopyID})
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return &copies[0], nil
+}
+
+// DeleteCopy removes the copy chosen by its ID and returns it. A lent copy must be
+// returned first, its past loans are kept as loans of the book.
+func DeleteCopy(db *sql.DB, c CopyArgs) (*Copy, error) {
+	if c.CopyID == nil {
+		return nil, errors.New("choose the copy to delete and insert its ID number")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // no-op once the transaction is committed
+
+	copies, err := listCopies(tx, CopyArgs{CopyID: c.CopyID})
+	if err != nil {
+		return nil, err
+	}
+	if copies[0].Borrower != "" {
+		return nil, fmt.Errorf("copy %d of %s is lent to %s, it must be returned first", *c.CopyID, copies[0].Title, copies[0].Borrower)
+	}
+	_, err = tx.Exec("DELETE FROM copies WHERE copy_id = $1", *c.CopyID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return &copies[0], nil
+}
+
+// ListCopies lists the copies of a book, of a format, or on a shelf, and finds where the
+// copies of a title are: the location of each copy, or who has it when it is lent.
+func ListCopies(db *sql.DB, c CopyArgs) ([]Copy, error) {
+	return listCopies(db, c)
+}
+
+func listCopies(q querier, c CopyArgs) ([]Copy, error) {
+	copies := []Copy{}
+
+	query := `
+		SELECT copies.copy_id, copies.book_id, books.title, copies.format, copies.condition,
+		       copies.location, copies.acquired_date, copies.price, loans.borrower, copies.creation_date
+		FROM copies
+		JOIN books ON copies.book_id = books.book_id
+		LEFT JOIN loans ON loans.copy_id = copies.copy_id AND loans.returned_date IS NULL
+		`
+
+	whereClauses := []string{}
+	params := []any{}
+	bind := func(value any) string {
+		params = append(params, value)
+		return fmt.Sprintf("$%d", len(params))
+	}
+	if c.CopyID != nil {
+		whereClauses = append(whereClauses, "copies.copy_id = "+bind(*c.CopyID))
+	}
+	if c.BookID != nil {
+		whereClauses = append(whereClauses, "copies.book_id = "+bind(*c.BookID))
+	}
+	if c.Title != nil && strings.TrimSpace(*c.Title) != "" {
+		whereClauses = append(whereClauses, "books.title ILIKE '%' || "+bind(likeEscaper.Replace(strings.TrimSpace(*c.Title)))+" || '%'")
+	}
+	if c.Format != nil {
+		err := checkCopyFormat(*c.Format)
+		if err != nil {
+			return nil, err
+		}
+		whereClauses = append(whereClauses, "copies.format = "+bind(*c.Format))
+	}
+	if c.Condition != nil {
+		err := checkCopyCondition(*c.Condition)
+		if err != nil {
+			return nil, err
+		}
+		whereClauses = append(whereClauses, "copies.condition = "+bind(*c.Condition))
+	}
+	if c.Location != nil && strings.TrimSpace(*c.Location) != "" {
+		whereClauses = append(whereClauses, "copies.location ILIKE '%' || "+bind(likeEscaper.Replace(strings.TrimSpace(*c.Location)))+" || '%'")
+	}
+	if len(whereClauses) > 0 {
+		query += "WHERE " + strings.Join(whereClauses, " AND ")
+	}
+	query += " ORDER BY books.title, copies.copy_id"
+
+	rows, err := q.Query(query, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var copy Copy
+		var condition, location, borrower sql.NullString
+		var acquiredDate sql.NullTime
+		var price sql.NullFloat64
+		err := rows.Scan(&copy.CopyID, &copy.BookID, &copy.Title, &copy.Format, &condition, &location, &acquiredDate, &price, &borrower, &copy.CreationDate)
+		if err != nil {
+			return nil, err
+		}
+		copy.Condition = condition.String
+		copy.Location = location.String
+		if acquiredDate.Valid {
+			copy.AcquiredDate = &acquiredDate.Time
+		}
+		if price.Valid {
+			copy.Price = &price.Float64
+		}
+		copy.Borrower = borrower.String
+		copies = append(copies, copy)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(copies) == 0 {
+		return nil, errors.New("no copies with the chosen specification")
+	}
+	return copies, nil
+}
@@ -6,27 +6,113 @@ import (
 	"fmt"
 	"strings"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
+var errNoBooks = errors.New("no books with the chosen specification")
+
+var errNoCollections = errors.New("no collections with the chosen specification")
+
+var errNotInCollection = errors.New("book is not in this collection")
+
+// querier is implemented by both *sql.DB and *sql.Tx, so lookups can run
+// either standalone or as part of a transaction.
+type querier interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// ConnectToDb opens the database and checks that it answers. It prints nothing, CLI
+// commands write their records to the standard output.
 func ConnectToDb(url string) (*sql.DB, error) {
 
 	db, err := sql.Open("postgres", url)
 	if err != nil {
 		return nil, err
-	} else {
-		fmt.Println("opened database")
 	}
 
 	if err := db.Ping(); err != nil {
 		return nil, err
-	} else {
-		fmt.Println("connected to database")
 	}
 
 	return db, nil
 }
 
+// addConstraint adds a named constraint to a table created before the constraint was,
+// the catalog is read first so existing databases are only checked once
+func addConstraint(db *sql.DB, table string, name string, constraint string) error {
+	_, err := db.Exec(fmt.Sprintf(`DO $$ BEGIN
+		IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conrelid = %s::regclass AND conname = %s) THEN
+			ALTER TABLE %s ADD CONSTRAINT %s %s;
+		END IF;
+	END $$;`, pq.QuoteLiteral(table), pq.QuoteLiteral(name), pq.QuoteIdentifier(table), pq.QuoteIdentifier(name), constraint))
+	return err
+}
+
+// schemaTables are the tables created by CreateTables
+var schemaTables = []string{"authors", "collections", "books", "book_in_collection", "copies", "users", "reading_status", "reading_sessions", "reviews", "notes", "loans", "wishlist", "purchases", "tags", "book_tags"}
+
+// schemaColumns are the columns CreateTables adds to the tables of older databases,
+// a database with the tables may still lack them
+var schemaColumns = map[string][]string{
+	"books":  {"isbn", "publisher", "page_count"},
+	"copies": {"condition", "acquired_date", "price"},
+}
+
+// CheckSchema reports the tables and the columns of CreateTables missing from the
+// database. It only reads the catalog, so it works for database users that cannot
+// create tables.
+func CheckSchema(db *sql.DB) error {
+	missing := []string{}
+	for _, table := range schemaTables {
+		var name sql.NullString
+		err := db.QueryRow(`SELECT to_regclass($1)::text`, table).Scan(&name)
+		if err != nil {
+			return err
+		}
+		if !name.Valid {
+			missing = append(missing, table)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("the database has no %s table, set up the schema with %s migrate", strings.Join(missing, ", "), cliName)
+	}
+
+	rows, err := db.Query(`SELECT table_name, column_name FROM information_schema.columns WHERE table_schema = current_schema()`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	columns := map[string]bool{}
+	for rows.Next() {
+		var table, column string
+		err := rows.Scan(&table, &column)
+		if err != nil {
+			return err
+		}
+		columns[table+"."+column] = true
+	}
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+
+	for _, table := range schemaTables {
+		for _, column := range schemaColumns[table] {
+			if !columns[table+"."+column] {
+				missing = append(missing, table+"."+column)
+			}
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("the database has no %s column, update the schema with %s migrate", strings.Join(missing, ", "), cliName)
+	}
+	return nil
+}
+
+// CreateTables sets up the schema, or updates the schema of an older database. It is
+// run by the migrate command, or by serve -migrate.
 func CreateTables(db *sql.DB) error {
 	// TODO: modify database to accept multiple authors in one book (add table BOOK_AUTHOR to represent this relationship, remove author_id from BOOKS, change methods accordingly)
 
@@ -56,6 +142,9 @@ func CreateTables(db *sql.DB) error {
         title VARCHAR(100) NOT NULL, CHECK (title <> ''),
 		published_date DATE,
 		edition_number INT,
+		isbn VARCHAR(13),
+		publisher VARCHAR(100),
+		page_count INT, CHECK (page_count > 0),
 		creation_date DATE DEFAULT CURRENT_DATE,
         author_id INT NOT NULL,
         FOREIGN KEY (author_id) REFERENCES authors(author_id),
@@ -65,6 +154,21 @@ func CreateTables(db *sql.DB) error {
 		return err
 	}
 
+	// databases created before books had an isbn and a publisher
+	_, err = db.Exec(`ALTER TABLE books ADD COLUMN IF NOT EXISTS isbn VARCHAR(13);`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`ALTER TABLE books ADD COLUMN IF NOT EXISTS publisher VARCHAR(100);`)
+	if err != nil {
+		return err
+	}
+	// and before they had a page count
+	_, err = db.Exec(`ALTER TABLE books ADD COLUMN IF NOT EXISTS page_count INT CHECK (page_count > 0);`)
+	if err != nil {
+		return err
+	}
+
 	// create book_in_collection table
 	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS book_in_collection (
 		book_id INT,
@@ -77,6 +181,222 @@ func CreateTables(db *sql.DB) error {
 		return err
 	}
 
+	// create copies table in its final form, physical copies are located by their shelf
+	// and ebook copies by the path of their file
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS copies (
+		copy_id SERIAL PRIMARY KEY,
+		book_id INT NOT NULL,
+		format VARCHAR(20) NOT NULL,
+		condition VARCHAR(20),
+		location VARCHAR(500),
+		acquired_date DATE,
+		price NUMERIC(10, 2),
+		creation_date DATE DEFAULT CURRENT_DATE,
+		CONSTRAINT copies_format_check CHECK (format IN ('hardcover', 'paperback', 'ebook', 'audiobook')),
+		CONSTRAINT copies_condition_check CHECK (condition IN ('new', 'like-new', 'good', 'fair', 'poor')),
+		CONSTRAINT copies_price_check CHECK (price >= 0),
+		FOREIGN KEY (book_id) REFERENCES books(book_id) ON DELETE CASCADE
+    );`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS copies_ebook_location ON copies (location) WHERE format = 'ebook';`)
+	if err != nil {
+		return err
+	}
+	// databases from before the copy inventory only hold the ebook files recorded by
+	// book scan, their copies have no condition, acquisition date or price
+	_, err = db.Exec(`ALTER TABLE copies
+		ADD COLUMN IF NOT EXISTS condition VARCHAR(20),
+		ADD COLUMN IF NOT EXISTS acquired_date DATE,
+		ADD COLUMN IF NOT EXISTS price NUMERIC(10, 2);`)
+	if err != nil {
+		return err
+	}
+	// nor the constraints on the formats, the conditions and the prices
+	for name, check := range map[string]string{
+		"copies_format_check":    `CHECK (format IN ('hardcover', 'paperback', 'ebook', 'audiobook'))`,
+		"copies_condition_check": `CHECK (condition IN ('new', 'like-new', 'good', 'fair', 'poor'))`,
+		"copies_price_check":     `CHECK (price >= 0)`,
+	} {
+		err = addConstraint(db, "copies", name, check)
+		if err != nil {
+			return err
+		}
+	}
+
+	// create users table, the people whose reading is tracked
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS users (
+		user_id SERIAL PRIMARY KEY,
+		name VARCHAR(100) UNIQUE NOT NULL, CHECK (name <> ''),
+		creation_date DATE DEFAULT CURRENT_DATE
+    );`)
+	if err != nil {
+		return err
+	}
+
+	// create reading_status table, one status per user and book
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS reading_status (
+		user_id INT NOT NULL,
+		book_id INT NOT NULL,
+		status VARCHAR(20) NOT NULL, CHECK (status IN ('want-to-read', 'reading', 'read', 'abandoned')),
+		started_date DATE,
+		finished_date DATE,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (user_id) REFERENCES users(user_id) ON DELETE CASCADE,
+		FOREIGN KEY (book_id) REFERENCES books(book_id) ON DELETE CASCADE,
+		PRIMARY KEY (user_id, book_id)
+    );`)
+	if err != nil {
+		return err
+	}
+
+	// create reading_sessions table, the page or percentage reached in a session and
+	// how many pages or minutes were read
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS reading_sessions (
+		session_id SERIAL PRIMARY KEY,
+		user_id INT NOT NULL,
+		book_id INT NOT NULL,
+		session_date DATE NOT NULL DEFAULT CURRENT_DATE,
+		page INT, CHECK (page >= 0),
+		percent NUMERIC(5, 2), CHECK (percent BETWEEN 0 AND 100),
+		pages INT, CHECK (pages >= 0),
+		minutes INT, CHECK (minutes >= 0),
+		FOREIGN KEY (user_id) REFERENCES users(user_id) ON DELETE CASCADE,
+		FOREIGN KEY (book_id) REFERENCES books(book_id) ON DELETE CASCADE
+    );`)
+	if err != nil {
+		return err
+	}
+
+	// create reviews table, one rating in half stars and markdown review per user and book
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS reviews (
+		review_id SERIAL PRIMARY KEY,
+		user_id INT NOT NULL,
+		book_id INT NOT NULL,
+		rating NUMERIC(2, 1), CHECK (rating BETWEEN 0.5 AND 5 AND rating * 2 = FLOOR(rating * 2)),
+		review TEXT,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		CHECK (rating IS NOT NULL OR review IS NOT NULL),
+		FOREIGN KEY (user_id) REFERENCES users(user_id) ON DELETE CASCADE,
+		FOREIGN KEY (book_id) REFERENCES books(book_id) ON DELETE CASCADE,
+		UNIQUE (user_id, book_id)
+    );`)
+	if err != nil {
+		return err
+	}
+
+	// create notes table, the notes, quotes and highlights of a book, the user is optional
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS notes (
+		note_id SERIAL PRIMARY KEY,
+		book_id INT NOT NULL,
+		user_id INT,
+		kind VARCHAR(20) NOT NULL DEFAULT 'note', CHECK (kind IN ('note', 'quote', 'highlight')),
+		text TEXT NOT NULL, CHECK (text <> ''),
+		page INT, CHECK (page > 0),
+		location VARCHAR(100),
+		tags TEXT[] NOT NULL DEFAULT '{}',
+		creation_date DATE DEFAULT CURRENT_DATE,
+		FOREIGN KEY (book_id) REFERENCES books(book_id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users(user_id) ON DELETE SET NULL
+    );`)
+	if err != nil {
+		return err
+	}
+
+	// create loans table, books without recorded copies are lent with no copy and the
+	// loans of a deleted copy are kept as loans of its book
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS loans (
+		loan_id SERIAL PRIMARY KEY,
+		book_id INT NOT NULL,
+		copy_id INT,
+		borrower VARCHAR(100) NOT NULL, CHECK (borrower <> ''),
+		lent_date DATE NOT NULL DEFAULT CURRENT_DATE,
+		due_date DATE, CHECK (due_date >= lent_date),
+		returned_date DATE, CHECK (returned_date >= lent_date),
+		FOREIGN KEY (book_id) REFERENCES books(book_id) ON DELETE CASCADE,
+		CONSTRAINT loans_copy_id_fkey FOREIGN KEY (copy_id) REFERENCES copies(copy_id) ON DELETE SET NULL
+    );`)
+	if err != nil {
+		return err
+	}
+	// databases from before deleted the loans along with their copy
+	_, err = db.Exec(`DO $$ BEGIN
+		IF EXISTS (SELECT 1 FROM pg_constraint WHERE conrelid = 'loans'::regclass AND conname = 'loans_copy_id_fkey' AND confdeltype = 'c') THEN
+			ALTER TABLE loans DROP CONSTRAINT loans_copy_id_fkey,
+				ADD CONSTRAINT loans_copy_id_fkey FOREIGN KEY (copy_id) REFERENCES copies(copy_id) ON DELETE SET NULL;
+		END IF;
+	END $$;`)
+	if err != nil {
+		return err
+	}
+	// a copy, or a book without copies, is lent to one borrower at a time
+	_, err = db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS loans_out_copy ON loans (copy_id) WHERE returned_date IS NULL AND copy_id IS NOT NULL;`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS loans_out_book ON loans (book_id) WHERE returned_date IS NULL AND copy_id IS NULL;`)
+	if err != nil {
+		return err
+	}
+
+
+	// create wishlist table, the books we would like to own, with the edition we want
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS wishlist (
+		wish_id SERIAL PRIMARY KEY,
+		title VARCHAR(100) NOT NULL, CHECK (title <> ''),
+		author VARCHAR(100) NOT NULL, CHECK (author <> ''),
+		isbn VARCHAR(13),
+		edition VARCHAR(100),
+		priority VARCHAR(10) NOT NULL DEFAULT 'normal', CHECK (priority IN ('high', 'normal', 'low')),
+		notes TEXT,
+		creation_date DATE DEFAULT CURRENT_DATE,
+		UNIQUE (title, author)
+    );`)
+	if err != nil {
+		return err
+	}
+
+	// create purchases table, the price of a book or of one of its copies in a currency
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS purchases (
+		purchase_id SERIAL PRIMARY KEY,
+		book_id INT NOT NULL,
+		copy_id INT,
+		store VARCHAR(100),
+		price NUMERIC(10, 2) NOT NULL, CHECK (price >= 0),
+		currency VARCHAR(3) NOT NULL, CHECK (currency ~ '^[A-Z]{3}$'),
+		purchase_date DATE NOT NULL DEFAULT CURRENT_DATE,
+		FOREIGN KEY (book_id) REFERENCES books(book_id) ON DELETE CASCADE,
+		FOREIGN KEY (copy_id) REFERENCES copies(copy_id) ON DELETE SET NULL
+    );`)
+	if err != nil {
+		return err
+	}
+
+	// create tags table, the genres, subjects, moods and other labels of books
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS tags (
+		tag_id SERIAL PRIMARY KEY,
+		name VARCHAR(50) UNIQUE NOT NULL, CHECK (name <> ''),
+		kind VARCHAR(20), CHECK (kind IN ('genre', 'subject', 'mood')),
+		creation_date DATE DEFAULT CURRENT_DATE
+    );`)
+	if err != nil {
+		return err
+	}
+
+	// create book_tags table, the tags of each book
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS book_tags (
+		book_id INT,
+		tag_id INT,
+		FOREIGN KEY (book_id) REFERENCES books(book_id) ON DELETE CASCADE,
+		FOREIGN KEY (tag_id) REFERENCES tags(tag_id) ON DELETE CASCADE,
+		PRIMARY KEY (book_id, tag_id)
+    );`)
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -94,7 +414,6 @@ func CreateAuthor(db *sql.DB, a AuthorArgs) (*Author, error){
         }
         return nil, err
     }
-	fmt.Printf("Author %s created with ID %d\n", author.Name, author.AuthorID)
 
 	return &author, nil
 }
@@ -130,33 +449,74 @@ func ListAuthors(db *sql.DB, a AuthorArgs) ([]Author, error) {
 	return authors, nil
 }
 
+// upsertAuthor returns the author with the given name, creating it if needed.
+// The conflict update is a no-op that makes RETURNING yield the existing row,
+// so concurrent calls for the same new author all get the same author back.
+func upsertAuthor(q querier, a AuthorArgs) (*Author, error) {
+	var author Author
+
+	// make sure author is not null(empty)
+	a.Name = SanitizeAuthorName(a.Name)
+
+	err := q.QueryRow("INSERT INTO authors (name) VALUES ($1) ON CONFLICT (name) DO UPDATE SET name = EXCLUDED.name RETURNING author_id, name, creation_date", a.Name).Scan(&author.AuthorID, &author.Name, &author.CreationDate)
+	if err != nil {
+		return nil, err
+	}
+
+	return &author, nil
+}
+
 func CreateBook(db *sql.DB, b BookArgs) (*Book, error){
-    var author *Author
-    var err error
+    // author and book are written in the same transaction, so a failed book insert
+    // does not leave an orphan author behind
+    tx, err := db.Begin()
+    if err != nil {
+        return nil, err
+    }
+    defer tx.Rollback() // no-op once the transaction is committed
+
+    book, err := createBook(tx, b)
+    if err != nil {
+        return nil, err
+    }
+
+    err = tx.Commit()
+    if err != nil {
+        return nil, err
+    }
 
+    return book, nil
+}
+
+// createBook inserts a book and its author using q, which is usually a transaction
+func createBook(q querier, b BookArgs) (*Book, error) {
     if b.Title == nil || *b.Title == "" {
         return nil, errors.New("no book title set, book not created") 
     }
 
-    // try to fetch said author, if there is no author no error returns
-    // it is just a heads up to the CreateBook function, so it creates a new author for the book
-    authors, err := ListAuthors(db, AuthorArgs{Name: b.Author})
-	if err != nil{
-		return nil, err
-	}
+    isbn, err := SanitizeISBN(b.ISBN)
+    if err != nil {
+        return nil, err
+    }
+    publishedDate, err := SanitizePublishedDate(b.PublishedDate)
+    if err != nil {
+        return nil, err
+    }
 
-    // create a new one in case the author is not in the db
-    if len(authors) == 0{
-        author, err = CreateAuthor(db, AuthorArgs{Name: b.Author})
-        if err != nil{
-            return nil, err
-        }
-    } else {
-        author = &authors[0]
+    author, err := upsertAuthor(q, AuthorArgs{Name: b.Author})
+    if err != nil {
+        return nil, err
+    }
+
+    if b.Edition != nil && *b.Edition < 1 {
+        return nil, fmt.Errorf("invalid edition %d, editions start at 1", *b.Edition)
+    }
+    if b.PageCount != nil && *b.PageCount < 1 {
+        return nil, fmt.Errorf("invalid page count %d, books have at least 1 page", *b.PageCount)
     }
 
     var book Book
-    err = db.QueryRow("INSERT INTO books (title, author_id) VALUES ($1, $2) ON CONFLICT DO NOTHING RETURNING book_id, title, creation_date", b.Title, author.AuthorID).Scan(&book.BookID, &book.Title, &book.CreationDate)
+    err = q.QueryRow("INSERT INTO books (title, author_id, isbn, published_date, edition_number, publisher, page_count) VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), $7) ON CONFLICT DO NOTHING RETURNING book_id, title, creation_date", b.Title, author.AuthorID, isbn, publishedDate, b.Edition, b.Publisher, b.PageCount).Scan(&book.BookID, &book.Title, &book.CreationDate)
     if err != nil {
         if err == sql.ErrNoRows{
             err = errors.New("book already exists in the database")
@@ -165,37 +525,176 @@ func CreateBook(db *sql.DB, b BookArgs) (*Book, error){
     }
 
     book.Author = author.Name
-    fmt.Printf("Book %s created with ID %d\n", book.Title, book.BookID)
+    if isbn != nil {
+        book.ISBN = *isbn
+    }
+    book.PublishedDate = publishedDate
+    book.Edition = b.Edition
+    book.PageCount = b.PageCount
+    if b.Publisher != nil {
+        book.Publisher = *b.Publisher
+    }
 
     return &book, nil
 }
 
+// UpdateBook changes the fields of a book that are set in b, the book is chosen by its
+// ID. Empty values clear the optional fields, as does an edition or page count of 0, and a new author
+// name moves the book to that author, who is created when needed.
+func UpdateBook(db *sql.DB, b BookArgs) (*Book, error) {
+    if b.BookID == nil {
+        return nil, errors.New("choose the book to update and insert its ID number")
+    }
+
+    tx, err := db.Begin()
+    if err != nil {
+        return nil, err
+    }
+    defer tx.Rollback() // no-op once the transaction is committed
+
+    // check if there is a book with the chosen ID
+    _, err = listBooks(tx, BookArgs{BookID: b.BookID})
+    if err != nil {
+        return nil, err
+    }
+
+    sets := []string{}
+    params := []any{}
+    set := func(column string, value any) {
+        params = append(params, value)
+        sets = append(sets, fmt.Sprintf("%s = $%d", column, len(params)))
+    }
+    if b.Title != nil {
+        if strings.TrimSpace(*b.Title) == "" {
+            return nil, errors.New("no book title set, book not updated")
+        }
+        set("title", *b.Title)
+    }
+    if b.Author != nil {
+        author, err := upsertAuthor(tx, AuthorArgs{Name: b.Author})
+        if err != nil {
+            return nil, err
+        }
+        set("author_id", author.AuthorID)
+    }
+    if b.ISBN != nil {
+        isbn, err := SanitizeISBN(b.ISBN)
+        if err != nil {
+            return nil, err
+        }
+        set("isbn", isbn)
+    }
+    if b.PublishedDate != nil {
+        publishedDate, err := SanitizePublishedDate(b.PublishedDate)
+        if err != nil {
+            return nil, err
+        }
+        set("published_date", publishedDate)
+    }
+    if b.Edition != nil {
+        switch {
+        case *b.Edition < 0:
+            return nil, fmt.Errorf("invalid edition %d, editions start at 1", *b.Edition)
+        case *b.Edition == 0:
+            set("edition_number", nil)
+        default:
+            set("edition_number", *b.Edition)
+        }
+    }
+    if b.Publisher != nil {
+        set("publisher", optionalValue(*b.Publisher))
+    }
+    if b.PageCount != nil {
+        switch {
+        case *b.PageCount < 0:
+            return nil, fmt.Errorf("invalid page count %d, books have at least 1 page", *b.PageCount)
+        case *b.PageCount == 0:
+            set("page_count", nil)
+        default:
+            set("page_count", *b.PageCount)
+        }
+    }
+
+    if len(sets) > 0 {
+        params = append(params, *b.BookID)
+        _, err = tx.Exec(fmt.Sprintf("UPDATE books SET %s WHERE book_id = $%d", strings.Join(sets, ", "), len(params)), params...)
+        var pqErr *pq.Error
+        if errors.As(err, &pqErr) && pqErr.Code == "23505" { // another book has this title and author
+            return nil, errors.New("book already exists in the database")
+        }
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    books, err := listBooks(tx, BookArgs{BookID: b.BookID})
+    if err != nil {
+        return nil, err
+    }
+
+    err = tx.Commit()
+    if err != nil {
+        return nil, err
+    }
+
+    return &books[0], nil
+}
+
 func ListBooks(db *sql.DB, b BookArgs) ([]Book, error) {
+    return listBooks(db, b)
+}
+
+func listBooks(q querier, b BookArgs) ([]Book, error) {
     var books []Book
 
     query := `
-        SELECT books.book_id, books.title, authors.name, books.creation_date
+        SELECT books.book_id, books.title, authors.name, books.creation_date, books.isbn, books.published_date,
+               books.edition_number, books.publisher, books.page_count, ratings.average_rating, ratings.ratings,
+               ARRAY(SELECT tags.name FROM book_tags JOIN tags ON book_tags.tag_id = tags.tag_id WHERE book_tags.book_id = books.book_id ORDER BY tags.name)
         FROM books
         JOIN authors ON books.author_id = authors.author_id
+        LEFT JOIN (
+            SELECT book_id, ROUND(AVG(rating), 2) AS average_rating, COUNT(rating) AS ratings
+            FROM reviews WHERE rating IS NOT NULL GROUP BY book_id
+        ) ratings ON books.book_id = ratings.book_id
         `
 
-	// add to the wehre clause if it was present in the request args
-    whereClauses := []string{}
-    if b.BookID != nil {
-        whereClauses = append(whereClauses, fmt.Sprintf("books.book_id = %d", *b.BookID))
-    }
-    if b.Title != nil {
-        whereClauses = append(whereClauses, fmt.Sprintf("books.title = '%s'", *b.Title))
+    params := []any{}
+    bind := func(value any) string {
+        params = append(params, value)
+        return fmt.Sprintf("$%d", len(params))
     }
-    if b.Author != nil {
-        whereClauses = append(whereClauses, fmt.Sprintf("authors.name = '%s'", *b.Author))
+    whereClauses, err := bookFilters(b, bind)
+    if err != nil {
+        return nil, err
     }
-
     if len(whereClauses) > 0 {
         query += "WHERE " + strings.Join(whereClauses, " AND ")
     }
 
-    rows, err := db.Query(query)
+    switch {
+    case b.Sort == nil || *b.Sort == "" || *b.Sort == "id":
+        query += " ORDER BY books.book_id"
+    case *b.Sort == "rating":
+        // the books nobody rated come last
+        query += " ORDER BY ratings.average_rating DESC NULLS LAST, ratings.ratings DESC NULLS LAST, books.book_id"
+    default:
+        return nil, fmt.Errorf("invalid sort %s, expected %s", *b.Sort, strings.Join(bookSorts, " or "))
+    }
+    if b.Limit != nil {
+        if *b.Limit < 0 {
+            return nil, fmt.Errorf("invalid limit %d, limits cannot be negative", *b.Limit)
+        }
+        query += " LIMIT " + bind(*b.Limit)
+    }
+    if b.Offset != nil {
+        if *b.Offset < 0 {
+            return nil, fmt.Errorf("invalid offset %d, offsets cannot be negative", *b.Offset)
+        }
+        query += " OFFSET " + bind(*b.Offset)
+    }
+
+    rows, err := q.Query(query, params...)
     if err != nil {
         return nil, err
     }
@@ -203,10 +702,34 @@ func ListBooks(db *sql.DB, b BookArgs) ([]Book, error) {
 
     for rows.Next() {
         var book Book
-        err := rows.Scan(&book.BookID, &book.Title, &book.Author, &book.CreationDate)
+        var isbn sql.NullString // books created before the isbn column have none
+        var publishedDate sql.NullTime
+        var edition sql.NullInt64
+        var publisher sql.NullString
+        var pageCount sql.NullInt64
+        var averageRating sql.NullFloat64
+        var ratings sql.NullInt64
+        err := rows.Scan(&book.BookID, &book.Title, &book.Author, &book.CreationDate, &isbn, &publishedDate, &edition, &publisher, &pageCount, &averageRating, &ratings, pq.Array(&book.Tags))
         if err != nil {
             return nil, err
         }
+        book.ISBN = isbn.String
+        if publishedDate.Valid {
+            book.PublishedDate = &publishedDate.Time
+        }
+        if edition.Valid {
+            editionNumber := int(edition.Int64)
+            book.Edition = &editionNumber
+        }
+        book.Publisher = publisher.String
+        if pageCount.Valid {
+            pages := int(pageCount.Int64)
+            book.PageCount = &pages
+        }
+        if averageRating.Valid {
+            book.AverageRating = &averageRating.Float64
+        }
+        book.Ratings = int(ratings.Int64)
         books = append(books, book)
     }
 
@@ -216,13 +739,94 @@ func ListBooks(db *sql.DB, b BookArgs) ([]Book, error) {
     }
 
 	if len(books) == 0{
-		err = errors.New("no books with the chosen specification")
-        return nil, err
+        return nil, errNoBooks
 	}
 
     return books, nil
 }
 
+// bookFilters are the WHERE clauses of listBooks and countBooks: each filter set in the
+// request args is added, values are bound as parameters so names with quotes are matched
+// as they are
+func bookFilters(b BookArgs, bind func(any) string) ([]string, error) {
+	whereClauses := []string{}
+	if b.BookID != nil {
+		whereClauses = append(whereClauses, "books.book_id = "+bind(*b.BookID))
+	}
+	if b.Title != nil {
+		whereClauses = append(whereClauses, "books.title = "+bind(*b.Title))
+	}
+	if b.Author != nil {
+		whereClauses = append(whereClauses, "authors.name = "+bind(*b.Author))
+	}
+	if b.ISBN != nil {
+		isbn, err := SanitizeISBN(b.ISBN)
+		if err != nil {
+			return nil, err
+		}
+		if isbn != nil {
+			whereClauses = append(whereClauses, "books.isbn = "+bind(*isbn))
+		}
+	}
+	if b.CollectionID != nil {
+		whereClauses = append(whereClauses, "books.book_id IN (SELECT book_id FROM book_in_collection WHERE collection_id = "+bind(*b.CollectionID)+")")
+	}
+	if b.Status != nil {
+		err := checkReadingStatus(*b.Status)
+		if err != nil {
+			return nil, err
+		}
+		statusFilter := "SELECT book_id FROM reading_status JOIN users ON reading_status.user_id = users.user_id WHERE status = " + bind(*b.Status)
+		if b.User != nil {
+			statusFilter += " AND users.name = " + bind(strings.TrimSpace(*b.User))
+		}
+		whereClauses = append(whereClauses, "books.book_id IN ("+statusFilter+")")
+	} else if b.User != nil {
+		whereClauses = append(whereClauses, "books.book_id IN (SELECT book_id FROM reading_status JOIN users ON reading_status.user_id = users.user_id WHERE users.name = "+bind(strings.TrimSpace(*b.User))+")")
+	}
+	if tags := SanitizeTags(b.Tags); len(tags) > 0 {
+		tagFilter := "SELECT book_tags.book_id FROM book_tags JOIN tags ON book_tags.tag_id = tags.tag_id WHERE tags.name = ANY(" + bind(pq.Array(tags)) + ")"
+		switch {
+		case b.TagMatch == nil || *b.TagMatch == "" || *b.TagMatch == "all":
+			// the books with every tag have one row for each of them
+			tagFilter += " GROUP BY book_tags.book_id HAVING COUNT(*) = " + bind(len(tags))
+		case *b.TagMatch == "any":
+		default:
+			return nil, fmt.Errorf("invalid tag match %s, expected all or any", *b.TagMatch)
+		}
+		whereClauses = append(whereClauses, "books.book_id IN ("+tagFilter+")")
+	}
+	// every word of a search is found in the title, the author or the ISBN, ignoring case
+	if b.Search != nil {
+		for _, word := range strings.Fields(*b.Search) {
+			whereClauses = append(whereClauses, "(books.title || ' ' || authors.name || ' ' || COALESCE(books.isbn, '')) ILIKE '%' || "+bind(likeEscaper.Replace(word))+" || '%'")
+		}
+	}
+	return whereClauses, nil
+}
+
+// countBooks counts the books listBooks lists with the same args, before any limit
+func countBooks(q querier, b BookArgs) (int, error) {
+	params := []any{}
+	bind := func(value any) string {
+		params = append(params, value)
+		return fmt.Sprintf("$%d", len(params))
+	}
+	whereClauses, err := bookFilters(b, bind)
+	if err != nil {
+		return 0, err
+	}
+
+	query := "SELECT COUNT(*) FROM books JOIN authors ON books.author_id = authors.author_id"
+	if len(whereClauses) > 0 {
+		query += " WHERE " + strings.Join(whereClauses, " AND ")
+	}
+
+	var count int
+	err = q.QueryRow(query, params...).Scan(&count)
+	return count, err
+}
+
 func CreateCollection(db *sql.DB, c CollectionArgs) (*Collection, error){
 	var collection Collection
 
@@ -237,12 +841,37 @@ func CreateCollection(db *sql.DB, c CollectionArgs) (*Collection, error){
         }
         return nil, err
 	}
-	fmt.Printf("Collection %s created with ID %d\n", collection.CollectionName, collection.CollectionID)
 
 	return &collection, nil
 }
 
+// upsertCollection returns the collection with the given name, creating it if needed
+func upsertCollection(q querier, c CollectionArgs) (*Collection, error) {
+	var collection Collection
+
+	if c.CollectionName == nil || *c.CollectionName == "" {
+		return nil, errors.New("no collection name set, collection not created")
+	}
+
+	err := q.QueryRow("INSERT INTO collections (collection_name) VALUES ($1) ON CONFLICT (collection_name) DO UPDATE SET collection_name = EXCLUDED.collection_name RETURNING collection_id, collection_name, creation_date", c.CollectionName).Scan(&collection.CollectionID, &collection.CollectionName, &collection.CreationDate)
+	if err != nil {
+		return nil, err
+	}
+
+	return &collection, nil
+}
+
+// linkBookToCollection adds a book to a collection, doing nothing if it is already there
+func linkBookToCollection(q querier, bookID int, collectionID int) error {
+	_, err := q.Exec("INSERT INTO book_in_collection (book_id, collection_id) VALUES ($1, $2) ON CONFLICT DO NOTHING", bookID, collectionID)
+	return err
+}
+
 func ListCollections(db *sql.DB, c CollectionArgs) ([]Collection, error) {
+    return listCollections(db, c)
+}
+
+func listCollections(q querier, c CollectionArgs) ([]Collection, error) {
     var collections []Collection
 
     query := `
@@ -256,20 +885,23 @@ func ListCollections(db *sql.DB, c CollectionArgs) ([]Collection, error) {
 
 	// add to the wehre clause if it was present in the request args
     whereClauses := []string{}
+    params := []any{}
     if c.CollectionID != nil {
-        whereClauses = append(whereClauses, fmt.Sprintf("collections.collection_id = %d", *c.CollectionID))
+        params = append(params, *c.CollectionID)
+        whereClauses = append(whereClauses, fmt.Sprintf("collections.collection_id = $%d", len(params)))
     }
     if c.CollectionName != nil {
-        whereClauses = append(whereClauses, fmt.Sprintf("collections.collection_name = '%s'", *c.CollectionName))
+        params = append(params, *c.CollectionName)
+        whereClauses = append(whereClauses, fmt.Sprintf("collections.collection_name = $%d", len(params)))
     }
 
     if len(whereClauses) > 0 {
         query += "WHERE " + strings.Join(whereClauses, " AND ")
     }
 
-    query += "ORDER BY collections.collection_id"
+    query += " ORDER BY collections.collection_id"
 
-    rows, err := db.Query(query)
+    rows, err := q.Query(query, params...)
     if err != nil {
         return nil, err
     }
@@ -325,8 +957,7 @@ func ListCollections(db *sql.DB, c CollectionArgs) ([]Collection, error) {
     }
 
 	if len(collections) == 0{
-        err = errors.New("no collections with the chosen specification")
-		return nil, err
+		return nil, errNoCollections
 	}
 
     return collections, nil
@@ -337,38 +968,94 @@ func AddBookToCollection(db *sql.DB, a AddBookToCollectionArgs) (*Collection, *B
     var book *Book
     var err error
 
-	// check if there is a book with the chosen ID
-    if a.BookID != nil {
-        books, err := ListBooks(db, BookArgs{BookID: a.BookID})
-		if err != nil{
-			return nil, nil, err
-		}
-        book = &books[0]
-    } else {
+    if a.BookID == nil {
         err = errors.New("choose the book to add to the collection and insert its ID number")
 		return nil, nil, err
     }
-
-	// check if there is a collection with the chosen ID
-    if a.CollectionID != nil {
-        collections, err := ListCollections(db, CollectionArgs{CollectionID: a.CollectionID})
-		if err != nil{
-			return nil, nil, err
-		}
-        collection = &collections[0]
-    } else {
+    if a.CollectionID == nil {
         err = errors.New("choose a collection to have the book added to its ID number")
 		return nil, nil, err
     }
 
-	err = db.QueryRow("INSERT INTO book_in_collection (book_id, collection_id) VALUES ($1, $2) ON CONFLICT DO NOTHING RETURNING book_id, collection_id", book.BookID, collection.CollectionID).Scan(&book.BookID, &collection.CollectionID) // errors are deferred until Row's Scan method is called
+	// lookups and insert run in one transaction, but nothing locks the rows: a book or
+	// collection deleted after being checked makes the insert fail on the foreign keys
+	// of book_in_collection
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback() // no-op once the transaction is committed
+
+	// check if there is a book with the chosen ID
+    books, err := listBooks(tx, BookArgs{BookID: a.BookID})
+	if err != nil{
+		return nil, nil, err
+	}
+    book = &books[0]
+
+	// check if there is a collection with the chosen ID
+    collections, err := listCollections(tx, CollectionArgs{CollectionID: a.CollectionID})
+	if err != nil{
+		return nil, nil, err
+	}
+    collection = &collections[0]
+
+	err = tx.QueryRow("INSERT INTO book_in_collection (book_id, collection_id) VALUES ($1, $2) ON CONFLICT DO NOTHING RETURNING book_id, collection_id", book.BookID, collection.CollectionID).Scan(&book.BookID, &collection.CollectionID) // errors are deferred until Row's Scan method is called
     if err != nil {
         if err == sql.ErrNoRows{
             err = errors.New("book already in this collection")
         }
         return nil, nil, err
 	}
-	fmt.Printf("Book %s added to collection %s\n", book.Title, collection.CollectionName)
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, nil, err
+	}
 
 	return collection, book, nil
 }
+
+// RemoveBookFromCollection takes a book out of a collection, the book itself is kept
+func RemoveBookFromCollection(db *sql.DB, a AddBookToCollectionArgs) (*Collection, *Book, error) {
+	if a.BookID == nil {
+		return nil, nil, errors.New("choose the book to remove from the collection and insert its ID number")
+	}
+	if a.CollectionID == nil {
+		return nil, nil, errors.New("choose a collection to have the book removed from its ID number")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback() // no-op once the transaction is committed
+
+	books, err := listBooks(tx, BookArgs{BookID: a.BookID})
+	if err != nil {
+		return nil, nil, err
+	}
+	collections, err := listCollections(tx, CollectionArgs{CollectionID: a.CollectionID})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	result, err := tx.Exec("DELETE FROM book_in_collection WHERE book_id = $1 AND collection_id = $2", *a.BookID, *a.CollectionID)
+	if err != nil {
+		return nil, nil, err
+	}
+	removed, err := result.RowsAffected()
+	if err != nil {
+		return nil, nil, err
+	}
+	if removed == 0 {
+		return nil, nil, errNotInCollection
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &collections[0], &books[0], nil
+}
@@ -1,7 +1,13 @@
 package main_test
 
 import (
+	"archive/zip"
+	"bytes"
 	"database/sql"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -31,7 +37,62 @@ func (suite *DbTestSuite) SetupTest() {
 }
 
 func (suite *DbTestSuite) TearDownTest() {
-    _, err := suite.db.Exec("DROP TABLE IF EXISTS book_in_collection")
+    _, err := suite.db.Exec("DROP TABLE IF EXISTS book_tags")
+    if err != nil {
+        suite.T().Fatal(err)
+    }
+
+    _, err = suite.db.Exec("DROP TABLE IF EXISTS tags")
+    if err != nil {
+        suite.T().Fatal(err)
+    }
+
+    _, err = suite.db.Exec("DROP TABLE IF EXISTS purchases")
+    if err != nil {
+        suite.T().Fatal(err)
+    }
+
+    _, err = suite.db.Exec("DROP TABLE IF EXISTS wishlist")
+    if err != nil {
+        suite.T().Fatal(err)
+    }
+
+    _, err = suite.db.Exec("DROP TABLE IF EXISTS loans")
+    if err != nil {
+        suite.T().Fatal(err)
+    }
+
+    _, err = suite.db.Exec("DROP TABLE IF EXISTS notes")
+    if err != nil {
+        suite.T().Fatal(err)
+    }
+
+    _, err = suite.db.Exec("DROP TABLE IF EXISTS reviews")
+    if err != nil {
+        suite.T().Fatal(err)
+    }
+
+    _, err = suite.db.Exec("DROP TABLE IF EXISTS reading_sessions")
+    if err != nil {
+        suite.T().Fatal(err)
+    }
+
+    _, err = suite.db.Exec("DROP TABLE IF EXISTS reading_status")
+    if err != nil {
+        suite.T().Fatal(err)
+    }
+
+    _, err = suite.db.Exec("DROP TABLE IF EXISTS users")
+    if err != nil {
+        suite.T().Fatal(err)
+    }
+
+    _, err = suite.db.Exec("DROP TABLE IF EXISTS copies")
+    if err != nil {
+        suite.T().Fatal(err)
+    }
+
+    _, err = suite.db.Exec("DROP TABLE IF EXISTS book_in_collection")
     if err != nil {
         suite.T().Fatal(err)
     }
@@ -207,6 +268,42 @@ func (suite *DbTestSuite) TestCreateBook_DuplicateBook() {
 	suite.Nil(duplicateBook)
 }
 
+func (suite *DbTestSuite) TestCreateBook_FailedInsertLeavesNoAuthor() {
+	// Setup
+	author := "J. R. R. Tolkien"
+	bookName := strings.Repeat("a", 101) // longer than the title column allows
+
+	// Function to test
+	book, err := main.CreateBook(suite.db, main.BookArgs{Title: &bookName, Author: &author})
+
+	// Verification
+	suite.Error(err)
+	suite.Nil(book)
+
+	authors, err := main.ListAuthors(suite.db, main.AuthorArgs{Name: &author})
+	suite.NoError(err)
+	suite.Empty(authors)
+}
+
+func (suite *DbTestSuite) TestCreateBook_ExistingAuthor() {
+	// Setup
+	author := "J. R. R. Tolkien"
+	_, err := main.CreateAuthor(suite.db, main.AuthorArgs{Name: &author})
+	suite.NoError(err)
+	bookName := "Book 1"
+
+	// Function to test
+	book, err := main.CreateBook(suite.db, main.BookArgs{Title: &bookName, Author: &author})
+
+	// Verification
+	suite.NoError(err)
+	suite.Equal(author, book.Author)
+
+	authors, err := main.ListAuthors(suite.db, main.AuthorArgs{})
+	suite.NoError(err)
+	suite.Len(authors, 1)
+}
+
 
 func (suite *DbTestSuite) TestListBooks(){
     // Setup
@@ -547,6 +644,1278 @@ func (suite *DbTestSuite) TestAddBookToCollection_NoCollectionExistsWithChosenID
 
 
 
+func (suite *DbTestSuite) TestUpdateBook() {
+	// Setup
+	_, err := suite.db.Exec("INSERT INTO authors (name) VALUES ('Octavia E. Butler')")
+	suite.NoError(err)
+	_, err = suite.db.Exec("INSERT INTO books (title, author_id, publisher) VALUES ('Kindred', 1, 'Doubleday')")
+	suite.NoError(err)
+
+	bookId := 1
+	title := "Parable of the Sower"
+	author := "Octavia Butler"
+	isbn := "978-0-446-67550-5"
+	publisher := ""
+	edition := 2
+
+	// Function to test
+	book, err := main.UpdateBook(suite.db, main.BookArgs{BookID: &bookId, Title: &title, Author: &author, ISBN: &isbn, Publisher: &publisher, Edition: &edition})
+
+	// Verification
+	suite.NoError(err)
+	suite.Equal(1, book.BookID)
+	suite.Equal("Parable of the Sower", book.Title)
+	suite.Equal("Octavia Butler", book.Author)
+	suite.Equal("9780446675505", book.ISBN)
+	suite.Equal("", book.Publisher)
+	suite.Equal(2, *book.Edition)
+}
+
+func (suite *DbTestSuite) TestUpdateBook_DuplicateBook() {
+	// Setup
+	_, err := suite.db.Exec("INSERT INTO authors (name) VALUES ('Octavia E. Butler')")
+	suite.NoError(err)
+	_, err = suite.db.Exec("INSERT INTO books (title, author_id) VALUES ('Kindred', 1), ('Dawn', 1)")
+	suite.NoError(err)
+
+	bookId := 2
+	title := "Kindred"
+
+	// Function to test
+	book, err := main.UpdateBook(suite.db, main.BookArgs{BookID: &bookId, Title: &title})
+
+	// Verification
+	suite.Nil(book)
+	suite.EqualError(err, "book already exists in the database")
+}
+
+func (suite *DbTestSuite) TestRemoveBookFromCollection() {
+	// Setup
+	_, err := suite.db.Exec("INSERT INTO collections (collection_name, creation_date) VALUES ($1, $2)", "My Collection 1", time.Now().UTC())
+	suite.NoError(err)
+	_, err = suite.db.Exec("INSERT INTO authors (name) VALUES ('Octavia E. Butler')")
+	suite.NoError(err)
+	_, err = suite.db.Exec("INSERT INTO books (title, author_id) VALUES ('Book 1', 1)")
+	suite.NoError(err)
+	_, err = suite.db.Exec("INSERT INTO book_in_collection (book_id, collection_id) VALUES (1, 1)")
+	suite.NoError(err)
+
+	bookId := 1
+	collectionId := 1
+	removeArgs := main.AddBookToCollectionArgs{BookID: &bookId, CollectionID: &collectionId}
+
+	// Function to test
+	collection, book, err := main.RemoveBookFromCollection(suite.db, removeArgs)
+	_, _, again := main.RemoveBookFromCollection(suite.db, removeArgs)
+
+	// Verification
+	suite.NoError(err)
+	suite.Equal("Book 1", book.Title)
+	suite.Equal("My Collection 1", collection.CollectionName)
+	suite.EqualError(again, "book is not in this collection")
+
+	books, err := main.ListBooks(suite.db, main.BookArgs{BookID: &bookId})
+	suite.NoError(err)
+	suite.Len(books, 1)
+}
+
+func (suite *DbTestSuite) TestSetReadingStatus() {
+	// Setup
+	_, err := suite.db.Exec("INSERT INTO authors (name) VALUES ('Octavia E. Butler')")
+	suite.NoError(err)
+	_, err = suite.db.Exec("INSERT INTO books (title, author_id) VALUES ('Kindred', 1)")
+	suite.NoError(err)
+
+	bookId := 1
+	user := "ana"
+	reading := "reading"
+	started := "2024-03-01"
+	read := "read"
+	finished := "2024-03-20"
+
+	// Function to test
+	_, err = main.SetReadingStatus(suite.db, main.ReadingStatusArgs{BookID: &bookId, User: &user, Status: &reading, StartedDate: &started})
+	suite.NoError(err)
+	status, err := main.SetReadingStatus(suite.db, main.ReadingStatusArgs{BookID: &bookId, User: &user, Status: &read, FinishedDate: &finished})
+
+	// Verification
+	suite.NoError(err)
+	suite.Equal("Kindred", status.Title)
+	suite.Equal("read", status.Status)
+	// the start of the reading is kept when the book is finished
+	suite.Equal("2024-03-01", status.StartedDate.Format("2006-01-02"))
+	suite.Equal("2024-03-20", status.FinishedDate.Format("2006-01-02"))
+
+	books, err := main.ListBooks(suite.db, main.BookArgs{Status: &read, User: &user})
+	suite.NoError(err)
+	suite.Len(books, 1)
+	_, err = main.ListBooks(suite.db, main.BookArgs{Status: &reading, User: &user})
+	suite.Error(err)
+}
+
+func (suite *DbTestSuite) TestSetReadingStatus_Invalid() {
+	// Setup
+	_, err := suite.db.Exec("INSERT INTO authors (name) VALUES ('Octavia E. Butler')")
+	suite.NoError(err)
+	_, err = suite.db.Exec("INSERT INTO books (title, author_id) VALUES ('Kindred', 1)")
+	suite.NoError(err)
+
+	bookId := 1
+	user := "ana"
+	finished := "finished"
+	read := "read"
+	started := "2024-03-20"
+	early := "2024-03-01"
+
+	// Function to test
+	_, unknown := main.SetReadingStatus(suite.db, main.ReadingStatusArgs{BookID: &bookId, User: &user, Status: &finished})
+	_, backwards := main.SetReadingStatus(suite.db, main.ReadingStatusArgs{BookID: &bookId, User: &user, Status: &read, StartedDate: &started, FinishedDate: &early})
+
+	// Verification
+	suite.EqualError(unknown, "invalid status finished, expected want-to-read, reading, read or abandoned")
+	suite.EqualError(backwards, "the finished date 2024-03-01 is before the started date 2024-03-20")
+}
+
+func (suite *DbTestSuite) TestLogReadingSession() {
+	// Setup
+	_, err := suite.db.Exec("INSERT INTO authors (name) VALUES ('Octavia E. Butler')")
+	suite.NoError(err)
+	_, err = suite.db.Exec("INSERT INTO books (title, author_id, page_count) VALUES ('Kindred', 1, 300)")
+	suite.NoError(err)
+
+	bookId := 1
+	user, paused := "ana", "ben"
+	today := time.Now() // the sessions are dated in local time
+	firstDay := today.AddDate(0, 0, -2).Format("2006-01-02")
+	firstPage := 50
+	minutes := 60
+	thirdDay := today.Format("2006-01-02")
+	percent := 50.0
+	monthAgo := today.AddDate(0, -1, 0).Format("2006-01-02")
+
+	// Function to test
+	_, err = main.LogReadingSession(suite.db, main.ReadingSessionArgs{BookID: &bookId, User: &user, Date: &firstDay, Page: &firstPage, Minutes: &minutes})
+	suite.NoError(err)
+	progress, err := main.LogReadingSession(suite.db, main.ReadingSessionArgs{BookID: &bookId, User: &user, Date: &thirdDay, Percent: &percent})
+	pausedProgress, pausedErr := main.LogReadingSession(suite.db, main.ReadingSessionArgs{BookID: &bookId, User: &paused, Date: &monthAgo, Page: &firstPage})
+
+	// Verification
+	suite.NoError(err)
+	suite.Len(progress.Sessions, 2)
+	suite.Equal(150, *progress.CurrentPage)
+	suite.Equal(50.0, *progress.Percent)
+	suite.Equal(150, progress.PagesRead)
+	// 150 pages over 3 days, the 150 pages left take 3 more days from today
+	suite.Equal(50.0, *progress.PagesPerDay)
+	suite.Equal(50.0, *progress.PagesPerHour)
+	suite.Equal(today.AddDate(0, 0, 3).Format("2006-01-02"), progress.EstimatedFinish.Format("2006-01-02"))
+
+	// nothing was read lately, so there is no pace to finish at
+	suite.NoError(pausedErr)
+	suite.Equal(50, pausedProgress.PagesRead)
+	suite.Nil(pausedProgress.PagesPerDay)
+	suite.Nil(pausedProgress.EstimatedFinish)
+
+	reading := "reading"
+	statuses, err := main.ListReadingStatuses(suite.db, main.ReadingStatusArgs{BookID: &bookId, User: &user, Status: &reading})
+	suite.NoError(err)
+	suite.Equal(firstDay, statuses[0].StartedDate.Format("2006-01-02"))
+}
+
+func (suite *DbTestSuite) TestLogReadingSession_PastLastPage() {
+	// Setup
+	_, err := suite.db.Exec("INSERT INTO authors (name) VALUES ('Octavia E. Butler')")
+	suite.NoError(err)
+	_, err = suite.db.Exec("INSERT INTO books (title, author_id, page_count) VALUES ('Kindred', 1, 300)")
+	suite.NoError(err)
+
+	bookId := 1
+	user := "ana"
+	page := 301
+
+	// Function to test
+	_, err = main.LogReadingSession(suite.db, main.ReadingSessionArgs{BookID: &bookId, User: &user, Page: &page})
+	_, noSessions := main.GetReadingProgress(suite.db, main.ReadingSessionArgs{BookID: &bookId, User: &user})
+
+	// Verification
+	suite.EqualError(err, "page 301 is past the last page 300 of the book")
+	suite.EqualError(noSessions, "no reading session with the chosen specification")
+}
+
+func (suite *DbTestSuite) TestReviews_AverageAndSort() {
+	// Setup
+	_, err := suite.db.Exec("INSERT INTO authors (name) VALUES ('Octavia E. Butler')")
+	suite.NoError(err)
+	_, err = suite.db.Exec("INSERT INTO books (title, author_id) VALUES ('Kindred', 1), ('Dawn', 1), ('Fledgling', 1)")
+	suite.NoError(err)
+
+	kindred, dawn := 1, 2
+	ana, ben := "ana", "ben"
+	five, four, three := 5.0, 4.0, 3.5
+	text := "# A classic\n\nRead it."
+
+	// Function to test
+	review, err := main.CreateReview(suite.db, main.ReviewArgs{BookID: &kindred, User: &ana, Rating: &four, Review: &text})
+	suite.NoError(err)
+	_, err = main.CreateReview(suite.db, main.ReviewArgs{BookID: &kindred, User: &ben, Rating: &five})
+	suite.NoError(err)
+	_, err = main.CreateReview(suite.db, main.ReviewArgs{BookID: &dawn, User: &ana, Rating: &three})
+	suite.NoError(err)
+	_, duplicate := main.CreateReview(suite.db, main.ReviewArgs{BookID: &dawn, User: &ana, Rating: &five})
+
+	// Verification
+	suite.Equal(text, review.Review)
+	suite.EqualError(duplicate, "review already exists in the database, edit it instead")
+
+	sort := "rating"
+	books, err := main.ListBooks(suite.db, main.BookArgs{Sort: &sort})
+	suite.NoError(err)
+	suite.Len(books, 3)
+	suite.Equal("Kindred", books[0].Title)
+	suite.Equal(4.5, *books[0].AverageRating)
+	suite.Equal(2, books[0].Ratings)
+	suite.Equal("Dawn", books[1].Title)
+	suite.Nil(books[2].AverageRating)
+}
+
+func (suite *DbTestSuite) TestUpdateReview() {
+	// Setup
+	_, err := suite.db.Exec("INSERT INTO authors (name) VALUES ('Octavia E. Butler')")
+	suite.NoError(err)
+	_, err = suite.db.Exec("INSERT INTO books (title, author_id) VALUES ('Kindred', 1)")
+	suite.NoError(err)
+
+	bookId := 1
+	user := "ana"
+	rating := 4.0
+	_, err = main.CreateReview(suite.db, main.ReviewArgs{BookID: &bookId, User: &user, Rating: &rating})
+	suite.NoError(err)
+
+	text := "Better the second time."
+	better := 4.5
+	quarter := 4.25
+	noRating := 0.0
+	noText := ""
+
+	// Function to test
+	review, err := main.UpdateReview(suite.db, main.ReviewArgs{BookID: &bookId, User: &user, Rating: &better, Review: &text})
+	_, invalid := main.UpdateReview(suite.db, main.ReviewArgs{BookID: &bookId, User: &user, Rating: &quarter})
+	_, empty := main.UpdateReview(suite.db, main.ReviewArgs{BookID: &bookId, User: &user, Rating: &noRating, Review: &noText})
+
+	// Verification
+	suite.NoError(err)
+	suite.Equal(4.5, *review.Rating)
+	suite.Equal(text, review.Review)
+	suite.EqualError(invalid, "invalid rating 4.25, expected 0.5 to 5 stars in half stars")
+	suite.EqualError(empty, "a review needs a rating or a text, both cannot be cleared")
+}
+
+func (suite *DbTestSuite) TestNotes_SearchAndTags() {
+	// Setup
+	_, err := suite.db.Exec("INSERT INTO authors (name) VALUES ('Octavia E. Butler')")
+	suite.NoError(err)
+	_, err = suite.db.Exec("INSERT INTO books (title, author_id) VALUES ('Parable of the Sower', 1)")
+	suite.NoError(err)
+
+	bookId := 1
+	quote := "quote"
+	godIsChange := "All that you touch You Change."
+	page := 3
+	noteText := "Lauren keeps a journal, 100% of the book"
+
+	// Function to test
+	note, err := main.CreateNote(suite.db, main.NoteArgs{BookID: &bookId, Kind: &quote, Text: &godIsChange, Page: &page, Tags: []string{"Earthseed", " change ", "earthseed"}})
+	suite.NoError(err)
+	_, err = main.CreateNote(suite.db, main.NoteArgs{BookID: &bookId, Text: &noteText})
+	suite.NoError(err)
+
+	// Verification
+	suite.Equal("quote", note.Kind)
+	suite.Equal([]string{"earthseed", "change"}, note.Tags)
+
+	search := "you change"
+	notes, err := main.ListNotes(suite.db, main.NoteArgs{Search: &search})
+	suite.NoError(err)
+	suite.Len(notes, 1)
+	suite.Equal(godIsChange, notes[0].Text)
+
+	// the percent sign is searched as it is, not as a wildcard
+	percent := "0%"
+	notes, err = main.ListNotes(suite.db, main.NoteArgs{Search: &percent})
+	suite.NoError(err)
+	suite.Len(notes, 1)
+	suite.Equal("note", notes[0].Kind)
+
+	notes, err = main.ListNotes(suite.db, main.NoteArgs{BookID: &bookId, Tags: []string{"earthseed"}})
+	suite.NoError(err)
+	suite.Len(notes, 1)
+
+	_, err = main.ListNotes(suite.db, main.NoteArgs{Tags: []string{"earthseed", "journal"}})
+	suite.EqualError(err, "no notes with the chosen specification")
+}
+
+func (suite *DbTestSuite) TestExportCatalogue_MarkdownNotes() {
+	// Setup
+	_, err := suite.db.Exec("INSERT INTO authors (name) VALUES ('Octavia E. Butler')")
+	suite.NoError(err)
+	_, err = suite.db.Exec("INSERT INTO books (title, author_id) VALUES ('Parable of the Sower', 1)")
+	suite.NoError(err)
+
+	bookId := 1
+	quote := "quote"
+	text := "All that you touch\nYou Change."
+	page := 3
+	_, err = main.CreateNote(suite.db, main.NoteArgs{BookID: &bookId, Kind: &quote, Text: &text, Page: &page, Tags: []string{"earthseed"}})
+	suite.NoError(err)
+
+	// Function to test
+	var out bytes.Buffer
+	err = main.ExportCatalogue(suite.db, &out, main.ExportArgs{Format: "md"})
+
+	// Verification
+	suite.NoError(err)
+	suite.Equal("## Other books\n\n- *Parable of the Sower* by Octavia E. Butler\n"+
+		"\n## Notes\n"+
+		"\n### *Parable of the Sower* by Octavia E. Butler\n"+
+		"\n> All that you touch\n> You Change.\n\n(p. 3; tags: earthseed)\n", out.String())
+}
+
+func (suite *DbTestSuite) TestCreateCopy() {
+	// Setup
+	_, err := suite.db.Exec("INSERT INTO authors (name) VALUES ('Octavia E. Butler')")
+	suite.NoError(err)
+	_, err = suite.db.Exec("INSERT INTO books (title, author_id) VALUES ('Kindred', 1), ('Parable of the Sower', 1)")
+	suite.NoError(err)
+
+	bookId := 1
+	paperback, audiobook, vinyl := "paperback", "audiobook", "vinyl"
+	good := "good"
+	shelf := "Living room, shelf 3"
+	acquired := "2023-05-01"
+	price, free := 12.5, 0.0
+
+	// Function to test
+	copy, err := main.CreateCopy(suite.db, main.CopyArgs{BookID: &bookId, Format: &paperback, Condition: &good, Location: &shelf, AcquiredDate: &acquired, Price: &price})
+	_, invalid := main.CreateCopy(suite.db, main.CopyArgs{BookID: &bookId, Format: &vinyl})
+	gift, giftErr := main.CreateCopy(suite.db, main.CopyArgs{BookID: &bookId, Format: &paperback, Price: &free})
+
+	// Verification
+	suite.NoError(err)
+	suite.Equal("Kindred", copy.Title)
+	suite.Equal("good", copy.Condition)
+	suite.Equal(shelf, copy.Location)
+	suite.Equal("2023-05-01", copy.AcquiredDate.Format("2006-01-02"))
+	suite.Equal(12.5, *copy.Price)
+	suite.EqualError(invalid, "invalid format vinyl, expected hardcover, paperback, ebook or audiobook")
+	suite.NoError(giftErr)
+	suite.Equal(0.0, *gift.Price) // a gift is free, its price is known
+
+	// clearing the condition and setting a price of 0 keeps the other fields
+	zero, empty := 0.0, ""
+	updated, err := main.UpdateCopy(suite.db, main.CopyArgs{CopyID: &copy.CopyID, Format: &audiobook, Condition: &empty, Price: &zero})
+	suite.NoError(err)
+	suite.Equal("audiobook", updated.Format)
+	suite.Equal("", updated.Condition)
+	suite.Equal(0.0, *updated.Price)
+	suite.Equal(shelf, updated.Location)
+}
+
+func (suite *DbTestSuite) TestListCopies_Where() {
+	// Setup
+	_, err := suite.db.Exec("INSERT INTO authors (name) VALUES ('Octavia E. Butler')")
+	suite.NoError(err)
+	_, err = suite.db.Exec("INSERT INTO books (title, author_id) VALUES ('Kindred', 1), ('Parable of the Sower', 1)")
+	suite.NoError(err)
+	_, err = suite.db.Exec("INSERT INTO copies (book_id, format, location) VALUES (1, 'paperback', 'Office, shelf 1'), (1, 'hardcover', 'Bedroom'), (2, 'paperback', 'Office, shelf 2')")
+	suite.NoError(err)
+	_, err = suite.db.Exec("INSERT INTO loans (book_id, copy_id, borrower) VALUES (1, 2, 'ana')")
+	suite.NoError(err)
+
+	title := "kindred"
+	office := "office"
+	copyId := 2
+
+	// Function to test
+	copies, err := main.ListCopies(suite.db, main.CopyArgs{Title: &title})
+
+	// Verification
+	suite.NoError(err)
+	suite.Len(copies, 2)
+	suite.Equal("Office, shelf 1", copies[0].Location)
+	suite.Equal("", copies[0].Borrower)
+	suite.Equal("ana", copies[1].Borrower)
+
+	shelved, err := main.ListCopies(suite.db, main.CopyArgs{Location: &office})
+	suite.NoError(err)
+	suite.Len(shelved, 2)
+
+	_, err = main.DeleteCopy(suite.db, main.CopyArgs{CopyID: &copyId})
+	suite.EqualError(err, "copy 2 of Kindred is lent to ana, it must be returned first")
+
+	// once returned, the copy is deleted and its loan kept as a loan of the book
+	_, err = suite.db.Exec("UPDATE loans SET returned_date = CURRENT_DATE")
+	suite.NoError(err)
+	_, err = main.DeleteCopy(suite.db, main.CopyArgs{CopyID: &copyId})
+	suite.NoError(err)
+	var loans int
+	err = suite.db.QueryRow("SELECT COUNT(*) FROM loans WHERE book_id = 1 AND copy_id IS NULL AND borrower = 'ana'").Scan(&loans)
+	suite.NoError(err)
+	suite.Equal(1, loans)
+}
+
+func (suite *DbTestSuite) TestLendBook_WithoutCopies() {
+	// Setup
+	_, err := suite.db.Exec("INSERT INTO authors (name) VALUES ('Octavia E. Butler')")
+	suite.NoError(err)
+	_, err = suite.db.Exec("INSERT INTO books (title, author_id) VALUES ('Kindred', 1)")
+	suite.NoError(err)
+
+	bookId := 1
+	ana, ben := "ana", "ben"
+	lent := "2024-03-01"
+	due := "2024-03-15"
+
+	// Function to test
+	loan, err := main.LendBook(suite.db, main.LoanArgs{BookID: &bookId, Borrower: &ana, LentDate: &lent, DueDate: &due})
+	_, again := main.LendBook(suite.db, main.LoanArgs{BookID: &bookId, Borrower: &ben})
+
+	// Verification
+	suite.NoError(err)
+	suite.Nil(loan.CopyID)
+	suite.Equal("ana", loan.Borrower)
+	suite.EqualError(again, "book Kindred is already lent to ana")
+
+	loans, err := main.ListLoans(suite.db, main.LoanArgs{Overdue: true})
+	suite.NoError(err)
+	suite.Len(loans, 1)
+	suite.True(loans[0].Overdue)
+
+	returned, err := main.ReturnBook(suite.db, main.LoanArgs{BookID: &bookId})
+	suite.NoError(err)
+	suite.NotNil(returned.ReturnedDate)
+	suite.False(returned.Overdue)
+
+	_, err = main.LendBook(suite.db, main.LoanArgs{BookID: &bookId, Borrower: &ben})
+	suite.NoError(err)
+}
+
+func (suite *DbTestSuite) TestLendBook_Copies() {
+	// Setup
+	_, err := suite.db.Exec("INSERT INTO authors (name) VALUES ('Octavia E. Butler')")
+	suite.NoError(err)
+	_, err = suite.db.Exec("INSERT INTO books (title, author_id) VALUES ('Kindred', 1)")
+	suite.NoError(err)
+	_, err = suite.db.Exec("INSERT INTO copies (book_id, format) VALUES (1, 'paperback'), (1, 'hardcover'), (1, 'ebook')")
+	suite.NoError(err)
+
+	bookId := 1
+	ana, ben, cleo := "ana", "ben", "cleo"
+	ebook := 3
+
+	// Function to test
+	first, err := main.LendBook(suite.db, main.LoanArgs{BookID: &bookId, Borrower: &ana})
+	suite.NoError(err)
+	second, err := main.LendBook(suite.db, main.LoanArgs{BookID: &bookId, Borrower: &ben})
+	suite.NoError(err)
+	_, noneLeft := main.LendBook(suite.db, main.LoanArgs{BookID: &bookId, Borrower: &cleo})
+	_, file := main.LendBook(suite.db, main.LoanArgs{BookID: &bookId, CopyID: &ebook, Borrower: &cleo})
+	_, ambiguous := main.ReturnBook(suite.db, main.LoanArgs{BookID: &bookId})
+
+	// Verification
+	suite.Equal(1, *first.CopyID)
+	suite.Equal(2, *second.CopyID)
+	suite.EqualError(noneLeft, "every copy of Kindred is already lent")
+	suite.EqualError(file, "ebook copies are files, they cannot be lent")
+	suite.EqualError(ambiguous, "2 copies of Kindred are lent, choose the loan or the copy to return")
+
+	returned, err := main.ReturnBook(suite.db, main.LoanArgs{CopyID: second.CopyID})
+	suite.NoError(err)
+	suite.Equal("ben", returned.Borrower)
+}
+
+func (suite *DbTestSuite) TestAcquireWish() {
+	// Setup
+	title, author, edition := "Kindred", "Octavia E. Butler", "2nd hardcover"
+	high := "high"
+	wish, err := main.CreateWish(suite.db, main.WishArgs{Title: &title, Author: &author, Edition: &edition, Priority: &high})
+	suite.NoError(err)
+	_, again := main.CreateWish(suite.db, main.WishArgs{Title: &title, Author: &author})
+
+	hardcover, store, currency, date := "hardcover", "Corner Books", "eur", "2024-03-02"
+	price := 18.9
+
+	// Function to test
+	acquisition, err := main.AcquireWish(suite.db, main.AcquireArgs{WishID: &wish.WishID, Format: &hardcover, Store: &store, Price: &price, Currency: &currency, Date: &date})
+
+	// Verification
+	suite.EqualError(again, "book is already on the wishlist")
+	suite.NoError(err)
+	suite.Equal("Kindred", acquisition.Book.Title)
+	suite.Equal("Octavia E. Butler", acquisition.Book.Author)
+	suite.Equal(2, *acquisition.Book.Edition)
+	suite.Equal("hardcover", acquisition.Copy.Format)
+	suite.Equal("2024-03-02", acquisition.Copy.AcquiredDate.Format("2006-01-02"))
+	suite.Equal(acquisition.Copy.CopyID, *acquisition.Purchase.CopyID)
+	suite.Equal("EUR", acquisition.Purchase.Currency)
+	suite.Equal(18.9, acquisition.Purchase.Price)
+
+	_, err = main.ListWishes(suite.db, main.WishArgs{})
+	suite.EqualError(err, "no wishes with the chosen specification")
+}
+
+func (suite *DbTestSuite) TestSpendingReport() {
+	// Setup
+	_, err := suite.db.Exec("INSERT INTO authors (name) VALUES ('Octavia E. Butler')")
+	suite.NoError(err)
+	_, err = suite.db.Exec("INSERT INTO books (title, author_id) VALUES ('Kindred', 1), ('Parable of the Sower', 1), ('Fledgling', 1)")
+	suite.NoError(err)
+
+	first, second, third := 1, 2, 3
+	eur, usd := "EUR", "USD"
+	march, marchAgain, april := "2024-03-02", "2024-03-20", "2024-04-05"
+	twelve, eight, ten := 12.5, 8.0, 10.0
+	for _, purchase := range []main.PurchaseArgs{
+		{BookID: &first, Price: &twelve, Currency: &eur, PurchaseDate: &march},
+		{BookID: &second, Price: &eight, Currency: &eur, PurchaseDate: &marchAgain},
+		{BookID: &third, Price: &ten, Currency: &usd, PurchaseDate: &april},
+	} {
+		_, err = main.RecordPurchase(suite.db, purchase)
+		suite.NoError(err)
+	}
+
+	// Function to test
+	spending, err := main.SpendingReport(suite.db, main.PurchaseArgs{})
+
+	// Verification
+	suite.NoError(err)
+	suite.Equal([]main.MonthlySpending{
+		{Month: "2024-03", Currency: "EUR", Purchases: 2, Total: 20.5},
+		{Month: "2024-04", Currency: "USD", Purchases: 1, Total: 10},
+	}, spending)
+
+	_, err = main.SpendingReport(suite.db, main.PurchaseArgs{From: &april, To: &march})
+	suite.EqualError(err, "the end date 2024-03-02 is before the start date 2024-04-05")
+}
+
+func (suite *DbTestSuite) TestTagBook_ListBooksByTags() {
+	// Setup
+	_, err := suite.db.Exec("INSERT INTO authors (name) VALUES ('Ursula K. Le Guin')")
+	suite.NoError(err)
+	_, err = suite.db.Exec("INSERT INTO books (title, author_id) VALUES ('The Dispossessed', 1), ('A Wizard of Earthsea', 1), ('The Lathe of Heaven', 1)")
+	suite.NoError(err)
+
+	first, second, third := 1, 2, 3
+	for _, tagging := range []main.BookTagsArgs{
+		{BookID: &first, Tags: []string{"Science Fiction", "utopia"}},
+		{BookID: &second, Tags: []string{"fantasy"}},
+		{BookID: &third, Tags: []string{"science fiction"}},
+	} {
+		_, err = main.TagBook(suite.db, tagging)
+		suite.NoError(err)
+	}
+
+	// Function to test
+	book, err := main.TagBook(suite.db, main.BookTagsArgs{BookID: &first, Tags: []string{"utopia", "classic"}})
+	all, allErr := main.ListBooks(suite.db, main.BookArgs{Tags: []string{"science fiction", "utopia"}})
+	anyMatch := "any"
+	anyBooks, anyErr := main.ListBooks(suite.db, main.BookArgs{Tags: []string{"utopia", "fantasy"}, TagMatch: &anyMatch})
+
+	// Verification
+	suite.NoError(err)
+	suite.Equal([]string{"classic", "science fiction", "utopia"}, book.Tags)
+
+	suite.NoError(allErr)
+	suite.Len(all, 1)
+	suite.Equal("The Dispossessed", all[0].Title)
+
+	suite.NoError(anyErr)
+	suite.Len(anyBooks, 2)
+	suite.Equal("The Dispossessed", anyBooks[0].Title)
+	suite.Equal("A Wizard of Earthsea", anyBooks[1].Title)
+
+	book, err = main.UntagBook(suite.db, main.BookTagsArgs{BookID: &first, Tags: []string{"classic"}})
+	suite.NoError(err)
+	suite.Equal([]string{"science fiction", "utopia"}, book.Tags)
+
+	_, err = main.UntagBook(suite.db, main.BookTagsArgs{BookID: &second, Tags: []string{"utopia"}})
+	suite.EqualError(err, "book A Wizard of Earthsea has none of the tags utopia")
+
+	wrongMatch := "some"
+	_, err = main.ListBooks(suite.db, main.BookArgs{Tags: []string{"utopia"}, TagMatch: &wrongMatch})
+	suite.EqualError(err, "invalid tag match some, expected all or any")
+}
+
+func (suite *DbTestSuite) TestListTags_Counts() {
+	// Setup
+	_, err := suite.db.Exec("INSERT INTO authors (name) VALUES ('Terry Pratchett')")
+	suite.NoError(err)
+	_, err = suite.db.Exec("INSERT INTO books (title, author_id) VALUES ('Mort', 1), ('Small Gods', 1)")
+	suite.NoError(err)
+
+	genre, mood := "genre", "mood"
+	fantasy, funny, unused := "Fantasy", "funny", "unused"
+	_, err = main.CreateTag(suite.db, main.TagArgs{Name: &fantasy, Kind: &genre})
+	suite.NoError(err)
+	_, err = main.CreateTag(suite.db, main.TagArgs{Name: &funny, Kind: &mood})
+	suite.NoError(err)
+	_, err = main.CreateTag(suite.db, main.TagArgs{Name: &unused})
+	suite.NoError(err)
+	first, second := 1, 2
+	_, err = main.TagBook(suite.db, main.BookTagsArgs{BookID: &first, Tags: []string{"fantasy", "funny"}})
+	suite.NoError(err)
+	_, err = main.TagBook(suite.db, main.BookTagsArgs{BookID: &second, Tags: []string{"fantasy"}})
+	suite.NoError(err)
+
+	// Function to test
+	sort := "books"
+	tags, err := main.ListTags(suite.db, main.TagArgs{Sort: &sort})
+	genres, genresErr := main.ListTags(suite.db, main.TagArgs{Kind: &genre})
+
+	// Verification
+	suite.NoError(err)
+	suite.Len(tags, 3)
+	suite.Equal("fantasy", tags[0].Name)
+	suite.Equal(2, tags[0].Books)
+	suite.Equal("funny", tags[1].Name)
+	suite.Equal(1, tags[1].Books)
+	suite.Equal("unused", tags[2].Name)
+	suite.Equal(0, tags[2].Books)
+
+	suite.NoError(genresErr)
+	suite.Len(genres, 1)
+	suite.Equal("genre", genres[0].Kind)
+
+	_, err = main.CreateTag(suite.db, main.TagArgs{Name: &fantasy})
+	suite.EqualError(err, "tag already exists in the database")
+
+	deleted, err := main.DeleteTag(suite.db, main.TagArgs{TagID: &tags[0].TagID})
+	suite.NoError(err)
+	suite.Equal(2, deleted.Books)
+	books, err := main.ListBooks(suite.db, main.BookArgs{BookID: &second})
+	suite.NoError(err)
+	suite.Empty(books[0].Tags)
+}
+
+func (suite *DbTestSuite) TestImportBooksCSV() {
+	// Setup
+	file := strings.NewReader(`title,author,isbn,published_date,collections
+The Hobbit,J. R. R. Tolkien,978-0-261-10221-7,1937-09-21,Fantasy;Classics
+Kindred,Octavia E. Butler,,1979,Classics
+`)
+
+	// Function to test
+	report, err := main.ImportBooksCSV(suite.db, file, main.ImportArgs{})
+
+	// Verification
+	suite.NoError(err)
+	suite.Equal(2, report.Rows)
+	suite.Equal(2, report.Created)
+	suite.Empty(report.Errors)
+
+	books, err := main.ListBooks(suite.db, main.BookArgs{})
+	suite.NoError(err)
+	suite.Len(books, 2)
+	suite.Equal("9780261102217", books[0].ISBN)
+	suite.Equal("1937-09-21", books[0].PublishedDate.Format("2006-01-02"))
+
+	classics := "Classics"
+	collections, err := main.ListCollections(suite.db, main.CollectionArgs{CollectionName: &classics})
+	suite.NoError(err)
+	suite.Len(collections[0].CollectionBooks, 2)
+}
+
+func (suite *DbTestSuite) TestImportBooksCSV_ColumnMapping() {
+	// Setup
+	file := strings.NewReader(`Book Title,Written By
+The Hobbit,J. R. R. Tolkien
+`)
+	columns, err := main.ParseColumnMapping("title=Book Title,author=Written By")
+	suite.NoError(err)
+
+	// Function to test
+	report, err := main.ImportBooksCSV(suite.db, file, main.ImportArgs{Columns: columns})
+
+	// Verification
+	suite.NoError(err)
+	suite.Equal(1, report.Created)
+
+	books, err := main.ListBooks(suite.db, main.BookArgs{})
+	suite.NoError(err)
+	suite.Equal("J. R. R. Tolkien", books[0].Author)
+}
+
+func (suite *DbTestSuite) TestImportBooksCSV_InvalidRows() {
+	// Setup
+	file := strings.NewReader(`title,author,isbn
+The Hobbit,J. R. R. Tolkien,
+,Octavia E. Butler,
+Kindred,Octavia E. Butler,123
+The Hobbit,J. R. R. Tolkien,
+`)
+
+	// Function to test
+	report, err := main.ImportBooksCSV(suite.db, file, main.ImportArgs{BatchSize: 2})
+
+	// Verification
+	suite.NoError(err)
+	suite.Equal(4, report.Rows)
+	suite.Equal(1, report.Created)
+	suite.Equal(3, report.Failed)
+	suite.Equal([]main.ImportRowError{
+		{Row: 3, Message: "no book title set, book not created"},
+		{Row: 4, Message: "invalid ISBN 123"},
+		{Row: 5, Message: "book already exists in the database"},
+	}, report.Errors)
+
+	books, err := main.ListBooks(suite.db, main.BookArgs{})
+	suite.NoError(err)
+	suite.Len(books, 1)
+}
+
+func (suite *DbTestSuite) TestImportBooksCSV_DryRun() {
+	// Setup
+	file := strings.NewReader(`title,author
+The Hobbit,J. R. R. Tolkien
+The Hobbit,J. R. R. Tolkien
+`)
+
+	// Function to test
+	report, err := main.ImportBooksCSV(suite.db, file, main.ImportArgs{DryRun: true})
+
+	// Verification
+	suite.NoError(err)
+	suite.True(report.DryRun)
+	suite.Equal(1, report.Created)
+	suite.Equal(1, report.Failed)
+
+	books, err := main.ListBooks(suite.db, main.BookArgs{})
+	suite.Error(err)
+	suite.Empty(books)
+}
+
+func (suite *DbTestSuite) TestImportShelvesCSV_Goodreads() {
+	// Setup
+	hobbit := "The Hobbit"
+	tolkien := "J. R. R. Tolkien"
+	isbn := "9780261102217"
+	_, err := main.CreateBook(suite.db, main.BookArgs{Title: &hobbit, Author: &tolkien, ISBN: &isbn})
+	suite.NoError(err)
+	fellowship := "The Fellowship of the Ring"
+	_, err = main.CreateBook(suite.db, main.BookArgs{Title: &fellowship, Author: &tolkien})
+	suite.NoError(err)
+
+	file := strings.NewReader(`Book Id,Title,Author,Additional Authors,ISBN,ISBN13,Year Published,Original Publication Year,Bookshelves,Exclusive Shelf
+1,The Hobbit or There and Back Again,J.R.R. Tolkien,,"=""0261102214""","=""9780261102217""",1991,1937,favorites,read
+2,"The Fellowship of the Ring (The Lord of the Rings, #1)",J. R. R. Tolkien,,"=""""","=""""",2004,1954,"favorites, fantasy",read
+3,Good Omens,Terry Pratchett,Neil Gaiman,"=""""","=""""",2006,1990,,to-read
+4,,Nobody,,"=""""","=""""",,,,to-read
+`)
+
+	// Function to test
+	report, err := main.ImportShelvesCSV(suite.db, file, "")
+
+	// Verification
+	suite.NoError(err)
+	suite.Equal("goodreads", report.Format)
+	suite.Len(report.Matched, 2)
+	suite.Len(report.Created, 1)
+	suite.Len(report.Skipped, 1)
+	suite.Equal("Terry Pratchett & Neil Gaiman", report.Created[0].Author)
+	suite.Equal(5, report.Skipped[0].Row)
+
+	books, err := main.ListBooks(suite.db, main.BookArgs{})
+	suite.NoError(err)
+	suite.Len(books, 3)
+
+	favorites := "favorites"
+	collections, err := main.ListCollections(suite.db, main.CollectionArgs{CollectionName: &favorites})
+	suite.NoError(err)
+	suite.Len(collections[0].CollectionBooks, 2)
+}
+
+func (suite *DbTestSuite) TestImportShelvesCSV_StoryGraph() {
+	// Setup
+	file := strings.NewReader(`Title,Authors,Contributors,ISBN/UID,Format,Read Status,Date Added,Tags
+Kindred,Octavia E. Butler,,9780807083697,paperback,read,2023/01/02,"classics, sci-fi"
+Kindred,Octavia E. Butler,,9780807083697,paperback,read,2023/01/02,
+`)
+
+	// Function to test
+	report, err := main.ImportShelvesCSV(suite.db, file, "storygraph")
+
+	// Verification
+	suite.NoError(err)
+	suite.Len(report.Created, 1)
+	suite.Len(report.Matched, 1)
+	suite.Equal([]string{"classics", "sci-fi", "read"}, report.Created[0].Collections)
+
+	collections, err := main.ListCollections(suite.db, main.CollectionArgs{})
+	suite.NoError(err)
+	suite.Len(collections, 3)
+}
+
+func (suite *DbTestSuite) TestExportCatalogue_CSV() {
+	// Setup
+	_, err := main.ImportBooksCSV(suite.db, strings.NewReader(`title,author,isbn,published_date,collections
+The Hobbit,J. R. R. Tolkien,9780261102217,1937-09-21,Fantasy;Classics
+Kindred,Octavia E. Butler,,,
+`), main.ImportArgs{})
+	suite.NoError(err)
+	var output strings.Builder
+
+	// Function to test
+	err = main.ExportCatalogue(suite.db, &output, main.ExportArgs{Format: "csv"})
+
+	// Verification
+	suite.NoError(err)
+	today := time.Now().Format("2006-01-02")
+	suite.Equal("book_id,title,author,isbn,published_date,edition,publisher,collections,creation_date\n"+
+		"1,The Hobbit,J. R. R. Tolkien,9780261102217,1937-09-21,,,Classics;Fantasy,"+today+"\n"+
+		"2,Kindred,Octavia E. Butler,,,,,,"+today+"\n", output.String())
+}
+
+func (suite *DbTestSuite) TestExportCatalogue_MarkdownCollection() {
+	// Setup
+	_, err := main.ImportBooksCSV(suite.db, strings.NewReader(`title,author,published_date,collections
+The Hobbit,J. R. R. Tolkien,1937,Fantasy
+Kindred,Octavia E. Butler,,Classics
+`), main.ImportArgs{})
+	suite.NoError(err)
+	var output strings.Builder
+	collectionID := 1
+
+	// Function to test
+	err = main.ExportCatalogue(suite.db, &output, main.ExportArgs{Format: "md", CollectionID: &collectionID})
+
+	// Verification
+	suite.NoError(err)
+	suite.Equal("## Fantasy\n\n- *The Hobbit* by J. R. R. Tolkien (1937)\n", output.String())
+}
+
+func (suite *DbTestSuite) TestExportCatalogue_JSONLines() {
+	// Setup
+	_, err := main.ImportBooksCSV(suite.db, strings.NewReader(`title,author,collections
+The Hobbit,J. R. R. Tolkien,Fantasy
+`), main.ImportArgs{})
+	suite.NoError(err)
+	var output strings.Builder
+
+	// Function to test
+	err = main.ExportCatalogue(suite.db, &output, main.ExportArgs{Format: "jsonl"})
+
+	// Verification
+	suite.NoError(err)
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	suite.Len(lines, 3)
+	suite.Contains(lines[0], `"type":"author"`)
+	suite.Contains(lines[1], `"type":"collection"`)
+	suite.Contains(lines[2], `"collections":["Fantasy"]`)
+}
+
+func (suite *DbTestSuite) TestExportCatalogue_UnknownFormat() {
+	// Setup
+	var output strings.Builder
+
+	// Function to test
+	err := main.ExportCatalogue(suite.db, &output, main.ExportArgs{Format: "xlsx"})
+
+	// Verification
+	suite.Error(err)
+	suite.Equal("unknown export format xlsx, expected csv, jsonl or md", err.Error())
+	suite.Empty(output.String())
+}
+
+func (suite *DbTestSuite) importBackupFixture() {
+	_, err := main.ImportBooksCSV(suite.db, strings.NewReader(`title,author,isbn,published_date,collections
+The Hobbit,J. R. R. Tolkien,9780261102217,1937-09-21,Fantasy;Classics
+Kindred,Octavia E. Butler,,1979,Classics
+Parable of the Sower,Octavia E. Butler,,,
+`), main.ImportArgs{})
+	suite.NoError(err)
+}
+
+func (suite *DbTestSuite) TestBackupRestore_Replace() {
+	// Setup
+	suite.importBackupFixture()
+	expectedBooks, err := main.ListBooks(suite.db, main.BookArgs{})
+	suite.NoError(err)
+	expectedCollections, err := main.ListCollections(suite.db, main.CollectionArgs{})
+	suite.NoError(err)
+
+	var archive bytes.Buffer
+	manifest, err := main.Backup(suite.db, &archive)
+	suite.NoError(err)
+	suite.Equal(3, manifest.Files["books.json"].Records)
+
+	// something that the restore must remove
+	extra := "Extra"
+	_, err = main.CreateCollection(suite.db, main.CollectionArgs{CollectionName: &extra})
+	suite.NoError(err)
+
+	// Function to test
+	report, err := main.Restore(suite.db, bytes.NewReader(archive.Bytes()), int64(archive.Len()), main.RestoreArgs{Mode: "replace"})
+
+	// Verification
+	suite.NoError(err)
+	suite.Equal(main.RestoreReport{Mode: "replace", Authors: 2, Books: 3, Collections: 2, Memberships: 3}, *report)
+
+	books, err := main.ListBooks(suite.db, main.BookArgs{})
+	suite.NoError(err)
+	suite.Equal(expectedBooks, books)
+
+	collections, err := main.ListCollections(suite.db, main.CollectionArgs{})
+	suite.NoError(err)
+	suite.Equal(expectedCollections, collections)
+}
+
+func (suite *DbTestSuite) TestBackupRestore_MergeRemapsIds() {
+	// Setup
+	suite.importBackupFixture()
+	var archive bytes.Buffer
+	_, err := main.Backup(suite.db, &archive)
+	suite.NoError(err)
+
+	_, err = suite.db.Exec("TRUNCATE book_in_collection, books, collections, authors RESTART IDENTITY")
+	suite.NoError(err)
+	_, err = main.ImportBooksCSV(suite.db, strings.NewReader(`title,author,collections
+Good Omens,Terry Pratchett,Classics
+Kindred,Octavia E. Butler,
+`), main.ImportArgs{})
+	suite.NoError(err)
+
+	// Function to test
+	_, err = main.Restore(suite.db, bytes.NewReader(archive.Bytes()), int64(archive.Len()), main.RestoreArgs{Mode: "merge"})
+
+	// Verification
+	suite.NoError(err)
+
+	books, err := main.ListBooks(suite.db, main.BookArgs{})
+	suite.NoError(err)
+	suite.Len(books, 4)
+
+	classics := "Classics"
+	collections, err := main.ListCollections(suite.db, main.CollectionArgs{CollectionName: &classics})
+	suite.NoError(err)
+	titles := []string{}
+	for _, book := range collections[0].CollectionBooks {
+		titles = append(titles, book.Title)
+	}
+	suite.ElementsMatch([]string{"Good Omens", "Kindred", "The Hobbit"}, titles)
+}
+
+func (suite *DbTestSuite) TestRestore_ChecksumMismatch() {
+	// Setup
+	suite.importBackupFixture()
+	var archive bytes.Buffer
+	_, err := main.Backup(suite.db, &archive)
+	suite.NoError(err)
+
+	// copy the archive, tampering with the books
+	original, err := zip.NewReader(bytes.NewReader(archive.Bytes()), int64(archive.Len()))
+	suite.NoError(err)
+	var tampered bytes.Buffer
+	writer := zip.NewWriter(&tampered)
+	for _, file := range original.File {
+		reader, err := file.Open()
+		suite.NoError(err)
+		content, err := io.ReadAll(reader)
+		suite.NoError(err)
+		if file.Name == "books.json" {
+			content = bytes.Replace(content, []byte("Kindred"), []byte("Kindling"), 1)
+		}
+		entry, err := writer.Create(file.Name)
+		suite.NoError(err)
+		_, err = entry.Write(content)
+		suite.NoError(err)
+	}
+	suite.NoError(writer.Close())
+
+	// Function to test
+	report, err := main.Restore(suite.db, bytes.NewReader(tampered.Bytes()), int64(tampered.Len()), main.RestoreArgs{Mode: "replace"})
+
+	// Verification
+	suite.Error(err)
+	suite.Equal("checksum mismatch for books.json, the backup is corrupted", err.Error())
+	suite.Nil(report)
+
+	books, err := main.ListBooks(suite.db, main.BookArgs{})
+	suite.NoError(err)
+	suite.Len(books, 3)
+}
+
+func (suite *DbTestSuite) TestExportCollectionCitations_BibTeX() {
+	// Setup
+	_, err := main.ImportBooksCSV(suite.db, strings.NewReader(`title,author,isbn,published_date,edition,publisher,collections
+The Hobbit,J. R. R. Tolkien,9780261102217,1937-09-21,2nd,Allen & Unwin,Fantasy
+The Hobbit,Douglas A. Anderson,,1937,,,Fantasy
+Kindred,Octavia E. Butler,,,,,Classics
+`), main.ImportArgs{})
+	suite.NoError(err)
+	var output strings.Builder
+
+	// Function to test
+	err = main.ExportCollectionCitations(suite.db, &output, 1, "bibtex")
+
+	// Verification
+	suite.NoError(err)
+	suite.Equal(`@book{tolkien1937hobbit-1,
+  author = {J. R. R. Tolkien},
+  title = {The Hobbit},
+  edition = {2},
+  year = {1937},
+  date = {1937-09-21},
+  publisher = {Allen \& Unwin},
+  isbn = {9780261102217},
+}
+
+@book{anderson1937hobbit-2,
+  author = {Douglas A. Anderson},
+  title = {The Hobbit},
+  year = {1937},
+  date = {1937-01-01},
+}
+
+`, output.String())
+}
+
+func (suite *DbTestSuite) TestExportCollectionCitations_NoCollection() {
+	// Setup
+	var output strings.Builder
+
+	// Function to test
+	err := main.ExportCollectionCitations(suite.db, &output, 1, "ris")
+
+	// Verification
+	suite.Error(err)
+	suite.Equal("no collections with the chosen specification", err.Error())
+}
+
+func (suite *DbTestSuite) TestImportCitations_RIS() {
+	// Setup
+	file := strings.NewReader(`TY  - BOOK
+AU  - Pratchett, Terry
+AU  - Gaiman, Neil
+TI  - Good Omens
+ET  - 1st
+PY  - 1990///
+PB  - Gollancz
+SN  - 0-575-04800-X
+ER  - 
+
+TY  - BOOK
+AU  - Nobody
+ER  - 
+`)
+
+	// Function to test
+	report, err := main.ImportCitations(suite.db, file, "ris")
+
+	// Verification
+	suite.NoError(err)
+	suite.Equal(2, report.Rows)
+	suite.Equal(1, report.Created)
+	suite.Equal([]main.ImportRowError{{Row: 11, Message: "no book title set, book not created"}}, report.Errors)
+
+	books, err := main.ListBooks(suite.db, main.BookArgs{})
+	suite.NoError(err)
+	suite.Equal("Pratchett, Terry & Gaiman, Neil", books[0].Author)
+	suite.Equal("057504800X", books[0].ISBN)
+	suite.Equal("Gollancz", books[0].Publisher)
+	suite.Equal(1, *books[0].Edition)
+}
+
+func (suite *DbTestSuite) TestImportCitations_BibTeXWordEdition() {
+	// Setup
+	file := strings.NewReader(`@book{pratchett1990omens,
+  author = {Pratchett, Terry and Gaiman, Neil},
+  title = {Good Omens},
+  edition = {Second},
+  year = {1990},
+}
+`)
+
+	// Function to test
+	report, err := main.ImportCitations(suite.db, file, "bibtex")
+
+	// Verification
+	suite.NoError(err)
+	suite.Equal(1, report.Created)
+	suite.Empty(report.Errors)
+
+	books, err := main.ListBooks(suite.db, main.BookArgs{})
+	suite.NoError(err)
+	suite.Equal("Good Omens", books[0].Title)
+	suite.Nil(books[0].Edition) // only numbered editions are kept
+}
+
+func (suite *DbTestSuite) TestImportMARC_ExportRoundTrip() {
+	// Setup
+	file, err := os.Open("testdata/marc21.mrc")
+	suite.Require().NoError(err)
+	defer file.Close()
+
+	// Function to test
+	report, err := main.ImportMARC(suite.db, file, "marc")
+	suite.NoError(err)
+	var exported bytes.Buffer
+	exportErr := main.ExportCatalogue(suite.db, &exported, main.ExportArgs{Format: "marcxml"})
+
+	// Verification
+	suite.Equal(2, report.Rows)
+	suite.Equal(2, report.Created)
+	suite.Empty(report.Errors)
+
+	suite.NoError(exportErr)
+	records, err := main.ReadMARCXML(&exported)
+	suite.NoError(err)
+	suite.Len(records, 2)
+	book, err := main.MARCToBook(records[1])
+	suite.NoError(err)
+	suite.Equal("Good omens: the nice and accurate prophecies of Agnes Nutter, witch", *book.Title)
+	suite.Equal("Pratchett, Terry & Gaiman, Neil", *book.Author)
+	suite.Equal("Gollancz", *book.Publisher)
+	suite.Equal("1990-01-01", *book.PublishedDate)
+}
+
+func (suite *DbTestSuite) TestScanBooks_MatchesAndRecordsCopies() {
+	// Setup
+	dir := suite.T().TempDir()
+	err := os.WriteFile(filepath.Join(dir, "hobbit.epub"), writeTestEPUB(suite.T(), testPackageDocument), 0o644)
+	suite.Require().NoError(err)
+	err = os.MkdirAll(filepath.Join(dir, "pdf"), 0o755)
+	suite.Require().NoError(err)
+	err = os.WriteFile(filepath.Join(dir, "pdf", "omens.pdf"), []byte(testPDF), 0o644)
+	suite.Require().NoError(err)
+	err = os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not a book"), 0o644)
+	suite.Require().NoError(err)
+
+	title, isbn := "The Hobbit", "9780261102217"
+	existing, err := main.CreateBook(suite.db, main.BookArgs{Title: &title, ISBN: &isbn})
+	suite.Require().NoError(err)
+
+	// the first scan is given a relative path
+	wd, err := os.Getwd()
+	suite.Require().NoError(err)
+	relative, err := filepath.Rel(wd, dir)
+	suite.Require().NoError(err)
+
+	// Function to test
+	report, err := main.ScanBooks(suite.db, relative, main.ScanArgs{RecordCopy: true})
+	suite.NoError(err)
+	rescan, rescanErr := main.ScanBooks(suite.db, dir, main.ScanArgs{RecordCopy: true})
+
+	// Verification
+	suite.Len(report.Matched, 1)
+	suite.Equal(existing.BookID, report.Matched[0].BookID)
+	suite.Len(report.Created, 1)
+	suite.Equal("Good Omens (Hardcover)", report.Created[0].Metadata.Title)
+	suite.Empty(report.Skipped)
+
+	books, err := main.ListBooks(suite.db, main.BookArgs{Title: &report.Created[0].Metadata.Title})
+	suite.NoError(err)
+	suite.Equal("Terry Pratchett & Neil Gaiman", books[0].Author)
+
+	// scanning again matches both books and finds the copies already recorded
+	suite.NoError(rescanErr)
+	suite.Len(rescan.Matched, 2)
+	suite.Equal(report.Matched[0].CopyID, rescan.Matched[0].CopyID)
+	var copies int
+	err = suite.db.QueryRow("SELECT COUNT(*) FROM copies WHERE format = 'ebook'").Scan(&copies)
+	suite.NoError(err)
+	suite.Equal(2, copies)
+	var location string
+	err = suite.db.QueryRow("SELECT location FROM copies WHERE copy_id = $1", report.Matched[0].CopyID).Scan(&location)
+	suite.NoError(err)
+	suite.Equal(filepath.Join(dir, "hobbit.epub"), location)
+}
+
+func (suite *DbTestSuite) TestImportCalibreLibrary() {
+	// Setup
+	title, author, isbn := "The Colour of Magic", "Terry Pratchett", "0552124753"
+	existing, err := main.CreateBook(suite.db, main.BookArgs{Title: &title, Author: &author, ISBN: &isbn})
+	suite.Require().NoError(err)
+
+	// Function to test
+	report, err := main.ImportCalibreLibrary(suite.db, "testdata/calibre")
+
+	// Verification
+	suite.NoError(err)
+	suite.Equal("calibre", report.Format)
+	suite.Require().Len(report.Matched, 1)
+	suite.Equal(existing.BookID, report.Matched[0].BookID)
+	suite.Equal([]string{"Discworld", "Fantasy", "Humour", "Rated 4 stars"}, report.Matched[0].Collections)
+	suite.Require().Len(report.Created, 1)
+	suite.Equal("Good Omens", report.Created[0].Title)
+	suite.Equal("Terry Pratchett & Neil Gaiman", report.Created[0].Author)
+	suite.Empty(report.Skipped)
+
+	discworld := "Discworld"
+	collections, err := main.ListCollections(suite.db, main.CollectionArgs{CollectionName: &discworld})
+	suite.NoError(err)
+	suite.Len(collections[0].CollectionBooks, 1)
+}
+
+func (suite *DbTestSuite) TestCreateTables_UpgradesEbookCopies() {
+	// Setup
+	// the copies table as book scan created it before the copy inventory
+	_, err := suite.db.Exec("DROP TABLE copies CASCADE")
+	suite.Require().NoError(err)
+	_, err = suite.db.Exec(`CREATE TABLE copies (
+		copy_id SERIAL PRIMARY KEY,
+		book_id INT NOT NULL,
+		format VARCHAR(20) NOT NULL,
+		location VARCHAR(500),
+		creation_date DATE DEFAULT CURRENT_DATE,
+		FOREIGN KEY (book_id) REFERENCES books(book_id) ON DELETE CASCADE
+	)`)
+	suite.Require().NoError(err)
+	title := "Mort"
+	book, err := main.CreateBook(suite.db, main.BookArgs{Title: &title})
+	suite.Require().NoError(err)
+
+	// Function to test
+	err = main.CreateTables(suite.db)
+	suite.NoError(err)
+	err = main.CreateTables(suite.db)
+	suite.NoError(err)
+
+	// Verification
+	for _, values := range []string{"'scroll', NULL, NULL", "'ebook', 'mint', NULL", "'ebook', NULL, -1"} {
+		_, err = suite.db.Exec("INSERT INTO copies (book_id, format, condition, price) VALUES ($1, "+values+")", book.BookID)
+		suite.ErrorContains(err, "violates check constraint", values)
+	}
+	_, err = suite.db.Exec("INSERT INTO copies (book_id, format, condition, price) VALUES ($1, 'paperback', 'good', 0)", book.BookID)
+	suite.NoError(err)
+}
+
+func (suite *DbTestSuite) TestCheckSchema() {
+	// Function to test
+	err := main.CheckSchema(suite.db)
+
+	// Verification
+	suite.NoError(err)
+
+	// Setup
+	_, err = suite.db.Exec("ALTER TABLE books DROP COLUMN page_count")
+	suite.Require().NoError(err)
+
+	// Function to test
+	err = main.CheckSchema(suite.db)
+
+	// Verification
+	suite.ErrorContains(err, "no books.page_count column")
+
+	// Setup
+	_, err = suite.db.Exec("DROP TABLE copies CASCADE")
+	suite.Require().NoError(err)
+
+	// Function to test
+	err = main.CheckSchema(suite.db)
+
+	// Verification
+	suite.ErrorContains(err, "no copies table")
+}
+
 func TestDbTestSuite(t *testing.T) {
     suite.Run(t, new(DbTestSuite))
 }
\ No newline at end of file
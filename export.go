@@ -0,0 +1,411 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// exportFormat writes the catalogue in one file format, reading it row by row
+type exportFormat struct {
+	contentType string
+	write       func(q querier, w io.Writer, args ExportArgs) error
+}
+
+var exportFormats = map[string]exportFormat{
+	"csv":   {contentType: "text/csv; charset=utf-8", write: exportCSV},
+	"jsonl": {contentType: "application/x-ndjson", write: exportJSONL},
+	"md":    {contentType: "text/markdown; charset=utf-8", write: exportMarkdown},
+	// MARC records are built from whole books, see marc.go
+	"marc":    {contentType: "application/marc", write: exportMARC},
+	"marcxml": {contentType: "application/marcxml+xml", write: exportMARC},
+}
+
+// ExportContentType returns the media type of an export format, or an error if it is unknown
+func ExportContentType(format string) (string, error) {
+	exportFormat, ok := exportFormats[format]
+	if !ok {
+		return "", fmt.Errorf("unknown export format %s, expected csv, jsonl, md, marc or marcxml", format)
+	}
+	return exportFormat.contentType, nil
+}
+
+// ExportCatalogue streams all books, authors and collections, or those of a single
+// collection, to w. Rows are written as they are read, so the catalogue is never held in memory.
+// Nothing is written when the arguments are invalid.
+func ExportCatalogue(db *sql.DB, w io.Writer, args ExportArgs) error {
+	_, err := ExportContentType(args.Format)
+	if err != nil {
+		return err
+	}
+
+	if args.CollectionID != nil {
+		var name string
+		err = db.QueryRow("SELECT collection_name FROM collections WHERE collection_id = $1", *args.CollectionID).Scan(&name)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				err = errNoCollections
+			}
+			return err
+		}
+	}
+
+	return exportFormats[args.Format].write(db, w, args)
+}
+
+// exportBookFilter restricts a books query to the exported collection, if any
+func exportBookFilter(args ExportArgs) (string, []any) {
+	if args.CollectionID == nil {
+		return "", nil
+	}
+	return "WHERE books.book_id IN (SELECT book_id FROM book_in_collection WHERE collection_id = $1)", []any{*args.CollectionID}
+}
+
+// eachExportBook calls fn for every exported book along with the names of its collections
+func eachExportBook(q querier, args ExportArgs, fn func(book Book, collections []string) error) error {
+	filter, params := exportBookFilter(args)
+	rows, err := q.Query(`
+		SELECT books.book_id, books.title, authors.name, books.isbn, books.published_date, books.edition_number, books.publisher,
+		       books.creation_date, COALESCE(string_agg(collections.collection_name, ';' ORDER BY collections.collection_name), '')
+		FROM books
+		JOIN authors ON books.author_id = authors.author_id
+		LEFT JOIN book_in_collection ON books.book_id = book_in_collection.book_id
+		LEFT JOIN collections ON book_in_collection.collection_id = collections.collection_id
+		`+filter+`
+		GROUP BY books.book_id, authors.name
+		ORDER BY books.book_id`, params...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var book Book
+		var isbn sql.NullString
+		var publishedDate sql.NullTime
+		var edition sql.NullInt64
+		var publisher sql.NullString
+		var collections string
+		err := rows.Scan(&book.BookID, &book.Title, &book.Author, &isbn, &publishedDate, &edition, &publisher, &book.CreationDate, &collections)
+		if err != nil {
+			return err
+		}
+		book.ISBN = isbn.String
+		if publishedDate.Valid {
+			book.PublishedDate = &publishedDate.Time
+		}
+		if edition.Valid {
+			editionNumber := int(edition.Int64)
+			book.Edition = &editionNumber
+		}
+		book.Publisher = publisher.String
+
+		err = fn(book, splitImportList(collections))
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// eachExportNote calls fn for every note of the exported books along with the author of
+// the book, in the order of the books
+func eachExportNote(q querier, args ExportArgs, fn func(note Note, author string) error) error {
+	filter, params := exportBookFilter(args)
+	rows, err := q.Query(`
+		SELECT notes.note_id, notes.book_id, books.title, authors.name, users.name, notes.kind, notes.text,
+		       notes.page, notes.location, notes.tags, notes.creation_date
+		FROM notes
+		JOIN books ON notes.book_id = books.book_id
+		JOIN authors ON books.author_id = authors.author_id
+		LEFT JOIN users ON notes.user_id = users.user_id
+		`+filter+`
+		ORDER BY books.book_id, notes.page NULLS LAST, notes.note_id`, params...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var note Note
+		var author string
+		var user, location sql.NullString
+		var page sql.NullInt64
+		err := rows.Scan(&note.NoteID, &note.BookID, &note.Title, &author, &user, &note.Kind, &note.Text, &page, &location, pq.Array(&note.Tags), &note.CreationDate)
+		if err != nil {
+			return err
+		}
+		note.User = user.String
+		if page.Valid {
+			notePage := int(page.Int64)
+			note.Page = &notePage
+		}
+		note.Location = location.String
+		if note.Tags == nil {
+			note.Tags = []string{}
+		}
+
+		err = fn(note, author)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+func formatPublishedDate(book Book) string {
+	if book.PublishedDate == nil {
+		return ""
+	}
+	return book.PublishedDate.Format("2006-01-02")
+}
+
+// exportCSV writes one row per book, with the same columns "book import" reads. Notes
+// are left to the jsonl and md exports.
+func exportCSV(q querier, w io.Writer, args ExportArgs) error {
+	writer := csv.NewWriter(w)
+
+	err := writer.Write([]string{"book_id", "title", "author", "isbn", "published_date", "edition", "publisher", "collections", "creation_date"})
+	if err != nil {
+		return err
+	}
+
+	err = eachExportBook(q, args, func(book Book, collections []string) error {
+		edition := ""
+		if book.Edition != nil {
+			edition = strconv.Itoa(*book.Edition)
+		}
+		return writer.Write([]string{
+			strconv.Itoa(book.BookID),
+			book.Title,
+			book.Author,
+			book.ISBN,
+			formatPublishedDate(book),
+			edition,
+			book.Publisher,
+			strings.Join(collections, ";"),
+			book.CreationDate.Format("2006-01-02"),
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+// exportRecord is a line of a JSON Lines export, its type tells which field is set
+type exportRecord struct {
+	Type       string            `json:"type"`
+	Author     *Author           `json:"author,omitempty"`
+	Collection *exportCollection `json:"collection,omitempty"`
+	Book       *exportBook       `json:"book,omitempty"`
+	Note       *Note             `json:"note,omitempty"`
+}
+
+type exportCollection struct {
+	CollectionID   int       `json:"collection_id"`
+	CollectionName string    `json:"collection_name"`
+	CreationDate   time.Time `json:"creation_date"`
+}
+
+type exportBook struct {
+	Book
+	Collections []string `json:"collections"`
+}
+
+// exportJSONL writes authors, then collections, then books, then notes, one JSON object per line
+func exportJSONL(q querier, w io.Writer, args ExportArgs) error {
+	encoder := json.NewEncoder(w)
+
+	authorQuery := "SELECT author_id, name, creation_date FROM authors"
+	collectionQuery := "SELECT collection_id, collection_name, creation_date FROM collections"
+	params := []any{}
+	if args.CollectionID != nil {
+		authorQuery += " WHERE author_id IN (SELECT books.author_id FROM books JOIN book_in_collection ON books.book_id = book_in_collection.book_id WHERE book_in_collection.collection_id = $1)"
+		collectionQuery += " WHERE collection_id = $1"
+		params = append(params, *args.CollectionID)
+	}
+
+	rows, err := q.Query(authorQuery+" ORDER BY author_id", params...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var author Author
+		err := rows.Scan(&author.AuthorID, &author.Name, &author.CreationDate)
+		if err != nil {
+			return err
+		}
+		err = encoder.Encode(exportRecord{Type: "author", Author: &author})
+		if err != nil {
+			return err
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+	rows.Close()
+
+	rows, err = q.Query(collectionQuery+" ORDER BY collection_id", params...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var collection exportCollection
+		err := rows.Scan(&collection.CollectionID, &collection.CollectionName, &collection.CreationDate)
+		if err != nil {
+			return err
+		}
+		err = encoder.Encode(exportRecord{Type: "collection", Collection: &collection})
+		if err != nil {
+			return err
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+	rows.Close()
+
+	err = eachExportBook(q, args, func(book Book, collections []string) error {
+		return encoder.Encode(exportRecord{Type: "book", Book: &exportBook{Book: book, Collections: collections}})
+	})
+	if err != nil {
+		return err
+	}
+
+	return eachExportNote(q, args, func(note Note, author string) error {
+		return encoder.Encode(exportRecord{Type: "note", Note: &note})
+	})
+}
+
+// exportMarkdown writes a reading list per collection, books outside every collection come
+// last, followed by the notes of the books
+func exportMarkdown(q querier, w io.Writer, args ExportArgs) error {
+	query := `
+		SELECT collections.collection_name, books.title, authors.name, books.published_date
+		FROM books
+		JOIN authors ON books.author_id = authors.author_id
+		LEFT JOIN book_in_collection ON books.book_id = book_in_collection.book_id
+		LEFT JOIN collections ON book_in_collection.collection_id = collections.collection_id
+		`
+	params := []any{}
+	if args.CollectionID != nil {
+		query += "WHERE collections.collection_id = $1 "
+		params = append(params, *args.CollectionID)
+	}
+
+	rows, err := q.Query(query+"ORDER BY collections.collection_name NULLS LAST, books.title", params...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	first := true
+	var currentCollection sql.NullString
+	for rows.Next() {
+		var collection sql.NullString // null for books that are in no collection
+		var book Book
+		var publishedDate sql.NullTime
+		err := rows.Scan(&collection, &book.Title, &book.Author, &publishedDate)
+		if err != nil {
+			return err
+		}
+
+		// start a new section whenever the collection changes
+		if first || collection != currentCollection {
+			heading := "Other books"
+			if collection.Valid {
+				heading = collection.String
+			}
+			if !first {
+				heading = "\n" + heading
+			}
+			_, err = fmt.Fprintf(w, "## %s\n\n", escapeMarkdown(heading))
+			if err != nil {
+				return err
+			}
+			first = false
+			currentCollection = collection
+		}
+
+		line := fmt.Sprintf("- *%s* by %s", escapeMarkdown(book.Title), escapeMarkdown(book.Author))
+		if publishedDate.Valid {
+			line += fmt.Sprintf(" (%d)", publishedDate.Time.Year())
+		}
+		_, err = fmt.Fprintln(w, line)
+		if err != nil {
+			return err
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+	rows.Close()
+
+	return exportMarkdownNotes(q, w, args)
+}
+
+// exportMarkdownNotes writes a section with the notes of each book. Quotes and highlights
+// are block quotes; notes are kept as they are written, as they may well be markdown.
+func exportMarkdownNotes(q querier, w io.Writer, args ExportArgs) error {
+	currentBook := 0
+	return eachExportNote(q, args, func(note Note, author string) error {
+		if currentBook == 0 {
+			_, err := fmt.Fprint(w, "\n## Notes\n")
+			if err != nil {
+				return err
+			}
+		}
+		if note.BookID != currentBook {
+			_, err := fmt.Fprintf(w, "\n### *%s* by %s\n", escapeMarkdown(note.Title), escapeMarkdown(author))
+			if err != nil {
+				return err
+			}
+			currentBook = note.BookID
+		}
+
+		text := note.Text
+		if note.Kind != "note" {
+			text = "> " + strings.ReplaceAll(text, "\n", "\n> ")
+		}
+		where := []string{}
+		if note.Page != nil {
+			where = append(where, fmt.Sprintf("p. %d", *note.Page))
+		}
+		if note.Location != "" {
+			where = append(where, escapeMarkdown(note.Location))
+		}
+		if len(note.Tags) > 0 {
+			where = append(where, "tags: "+escapeMarkdown(strings.Join(note.Tags, ", ")))
+		}
+		if len(where) > 0 {
+			text += "\n\n(" + strings.Join(where, "; ") + ")"
+		}
+		_, err := fmt.Fprintf(w, "\n%s\n", text)
+		return err
+	})
+}
+
+var markdownEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `_`, `\_`, "`", "\\`", `[`, `\[`, `]`, `\]`)
+
+func escapeMarkdown(text string) string {
+	return markdownEscaper.Replace(text)
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/xml"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/suite"
+)
+
+type HandlersTestSuite struct {
+	suite.Suite
+}
+
+func (suite *HandlersTestSuite) SetupTest() {
+	// Connect to the test db, the handlers use the package level connection
+	testConfig, err := LoadTestConfig()
+	if err != nil {
+		suite.T().Fatal(err)
+	}
+	db, err = sql.Open("postgres", testConfig.Database.URL)
+	if err != nil {
+		suite.T().Fatal(err)
+	}
+
+	CreateTables(db)
+}
+
+func (suite *HandlersTestSuite) TearDownTest() {
+	for _, table := range []string{"book_tags", "tags", "purchases", "wishlist", "loans", "notes", "reviews", "reading_sessions", "reading_status", "users", "copies", "book_in_collection", "collections", "books", "authors"} {
+		_, err := db.Exec("DROP TABLE IF EXISTS " + table)
+		if err != nil {
+			suite.T().Fatal(err)
+		}
+	}
+
+	db.Close()
+}
+
+// postBooksConcurrently fires one CreateBookHandler request per body at the same time
+// and returns the status code of each response
+func postBooksConcurrently(bodies []string) []int {
+	codes := make([]int, len(bodies))
+	start := make(chan struct{})
+
+	var wg sync.WaitGroup
+	for index, body := range bodies {
+		wg.Add(1)
+		go func(index int, body string) {
+			defer wg.Done()
+			<-start
+
+			request := httptest.NewRequest(http.MethodPost, "/books", bytes.NewBufferString(body))
+			recorder := httptest.NewRecorder()
+			CreateBookHandler(recorder, request)
+			codes[index] = recorder.Code
+		}(index, body)
+	}
+
+	close(start)
+	wg.Wait()
+
+	return codes
+}
+
+func (suite *HandlersTestSuite) countRows(table string) int {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&count)
+	suite.NoError(err)
+	return count
+}
+
+func (suite *HandlersTestSuite) TestCreateBookHandler_ConcurrentNewAuthor() {
+	// Setup
+	bodies := []string{}
+	for i := 1; i <= 20; i++ {
+		bodies = append(bodies, fmt.Sprintf(`{"title": "Book %d", "author": "Ursula K. Le Guin"}`, i))
+	}
+
+	// Function to test
+	codes := postBooksConcurrently(bodies)
+
+	// Verification
+	for _, code := range codes {
+		suite.Equal(http.StatusCreated, code)
+	}
+	suite.Equal(1, suite.countRows("authors"))
+	suite.Equal(20, suite.countRows("books"))
+}
+
+func (suite *HandlersTestSuite) TestCreateBookHandler_ConcurrentDuplicateBook() {
+	// Setup
+	bodies := []string{}
+	for i := 1; i <= 20; i++ {
+		bodies = append(bodies, `{"title": "The Dispossessed", "author": "Ursula K. Le Guin"}`)
+	}
+
+	// Function to test
+	codes := postBooksConcurrently(bodies)
+
+	// Verification
+	created := 0
+	for _, code := range codes {
+		if code == http.StatusCreated {
+			created++
+		}
+	}
+	suite.Equal(1, created)
+	suite.Equal(1, suite.countRows("authors"))
+	suite.Equal(1, suite.countRows("books"))
+}
+
+func (suite *HandlersTestSuite) TestOPDSAuthorBooksHandler_Pagination() {
+	// Setup
+	author := "Flann O'Brien" // quoted names must not break the author filter
+	for i := 1; i <= 30; i++ {
+		title := fmt.Sprintf("Book %02d", i)
+		_, err := CreateBook(db, BookArgs{Title: &title, Author: &author})
+		suite.NoError(err)
+	}
+	request := httptest.NewRequest(http.MethodGet, "/opds/authors/1?page=2", nil)
+	request = mux.SetURLVars(request, map[string]string{"author_id": "1"})
+	recorder := httptest.NewRecorder()
+
+	// Function to test
+	OPDSAuthorBooksHandler(recorder, request)
+
+	// Verification
+	suite.Equal(http.StatusOK, recorder.Code)
+	suite.Equal(opdsAcquisitionType, recorder.Header().Get("Content-Type"))
+
+	var feed opdsFeed
+	err := xml.Unmarshal(recorder.Body.Bytes(), &feed)
+	suite.NoError(err)
+	suite.Equal(author, feed.Title)
+	suite.Len(feed.Entries, 5)
+	suite.Equal("Book 26", feed.Entries[0].Title)
+	// prefixed elements are written but not read back by encoding/xml
+	suite.Contains(recorder.Body.String(), "<opensearch:totalResults>30</opensearch:totalResults>")
+	suite.Contains(recorder.Body.String(), "<opensearch:startIndex>26</opensearch:startIndex>")
+
+	rels := []string{}
+	for _, link := range feed.Links {
+		rels = append(rels, link.Rel)
+	}
+	suite.Contains(rels, "previous")
+	suite.NotContains(rels, "next")
+}
+
+// setLibraryRoot configures the directory of the ebook files for the running test
+func (suite *HandlersTestSuite) setLibraryRoot(root string) {
+	config = &Config{}
+	config.Server.LibraryRoot = root
+	suite.T().Cleanup(func() { config = nil })
+}
+
+func (suite *HandlersTestSuite) TestOPDSBooksHandler_Acquisition() {
+	// Setup
+	root := suite.T().TempDir()
+	suite.setLibraryRoot(root)
+	path := filepath.Join(root, "mort.epub")
+	err := os.WriteFile(path, []byte("epub content"), 0o644)
+	suite.NoError(err)
+	title, author, format := "Mort", "Terry Pratchett", "ebook"
+	book, err := CreateBook(db, BookArgs{Title: &title, Author: &author})
+	suite.NoError(err)
+	ebook, err := CreateCopy(db, CopyArgs{BookID: &book.BookID, Format: &format, Location: &path})
+	suite.NoError(err)
+	request := httptest.NewRequest(http.MethodGet, "/opds/books", nil)
+	recorder := httptest.NewRecorder()
+
+	// Function to test
+	OPDSBooksHandler(recorder, request)
+
+	// Verification
+	suite.Equal(http.StatusOK, recorder.Code)
+	var feed opdsFeed
+	err = xml.Unmarshal(recorder.Body.Bytes(), &feed)
+	suite.NoError(err)
+	suite.Require().Len(feed.Entries, 1)
+	href := fmt.Sprintf("/opds/copies/%d/file", ebook.CopyID)
+	suite.Equal([]opdsLink{{Rel: opdsAcquisitionRel, Href: href, Type: "application/epub+zip", Title: "mort.epub"}}, feed.Entries[0].Links)
+
+	request = httptest.NewRequest(http.MethodGet, href, nil)
+	request = mux.SetURLVars(request, map[string]string{"copy_id": strconv.Itoa(ebook.CopyID)})
+	recorder = httptest.NewRecorder()
+	OPDSCopyFileHandler(recorder, request)
+	suite.Equal(http.StatusOK, recorder.Code)
+	suite.Equal("application/epub+zip", recorder.Header().Get("Content-Type"))
+	suite.Equal("epub content", recorder.Body.String())
+}
+
+func (suite *HandlersTestSuite) TestOPDSCopyFileHandler_OutsideLibrary() {
+	// Setup
+	root, elsewhere := suite.T().TempDir(), suite.T().TempDir()
+	suite.setLibraryRoot(root)
+	secret := filepath.Join(elsewhere, "config.yml")
+	err := os.WriteFile(secret, []byte("database password"), 0o600)
+	suite.NoError(err)
+	err = os.Symlink(secret, filepath.Join(root, "link.epub"))
+	suite.NoError(err)
+	title := "Mort"
+	book, err := CreateBook(db, BookArgs{Title: &title})
+	suite.NoError(err)
+
+	// copies recorded before the locations were checked
+	for _, location := range []string{secret, filepath.Join(root, "..", filepath.Base(elsewhere), "config.yml"), filepath.Join(root, "link.epub"), "config.yml", root} {
+		var copyID int
+		err := db.QueryRow("INSERT INTO copies (book_id, format, location) VALUES ($1, 'ebook', $2) RETURNING copy_id", book.BookID, location).Scan(&copyID)
+		suite.NoError(err)
+		request := httptest.NewRequest(http.MethodGet, "/opds/copies/"+strconv.Itoa(copyID)+"/file", nil)
+		request = mux.SetURLVars(request, map[string]string{"copy_id": strconv.Itoa(copyID)})
+		recorder := httptest.NewRecorder()
+
+		// Function to test
+		OPDSCopyFileHandler(recorder, request)
+
+		// Verification
+		suite.Equal(http.StatusNotFound, recorder.Code, location)
+		suite.NotContains(recorder.Body.String(), "database password", location)
+	}
+
+	// nor are the files offered in the feeds
+	request := httptest.NewRequest(http.MethodGet, "/opds/books", nil)
+	recorder := httptest.NewRecorder()
+	OPDSBooksHandler(recorder, request)
+	var feed opdsFeed
+	err = xml.Unmarshal(recorder.Body.Bytes(), &feed)
+	suite.NoError(err)
+	suite.Require().Len(feed.Entries, 1)
+	suite.Empty(feed.Entries[0].Links)
+}
+
+func (suite *HandlersTestSuite) TestCopyHandlers_EbookLocations() {
+	// Setup
+	root := suite.T().TempDir()
+	suite.setLibraryRoot(root)
+	inside := filepath.Join(root, "mort.epub")
+	err := os.WriteFile(inside, []byte("epub content"), 0o644)
+	suite.NoError(err)
+	title := "Mort"
+	book, err := CreateBook(db, BookArgs{Title: &title})
+	suite.NoError(err)
+	bookVars := map[string]string{"book_id": strconv.Itoa(book.BookID)}
+	shelf, paperback := "Shelf 3", "paperback"
+	copy, err := CreateCopy(db, CopyArgs{BookID: &book.BookID, Format: &paperback, Location: &shelf})
+	suite.NoError(err)
+	copyVars := map[string]string{"copy_id": strconv.Itoa(copy.CopyID)}
+
+	for _, test := range []struct {
+		handler http.HandlerFunc
+		body    string
+		vars    map[string]string
+		code    int
+	}{
+		{CreateCopyHandler, fmt.Sprintf(`{"format": "ebook", "location": %q}`, inside), bookVars, http.StatusCreated},
+		{CreateCopyHandler, `{"format": "ebook", "location": "/etc/passwd"}`, bookVars, http.StatusInternalServerError},
+		{CreateCopyHandler, fmt.Sprintf(`{"format": "ebook", "location": %q}`, filepath.Join(root, "..", "config.yml")), bookVars, http.StatusInternalServerError},
+		{CreateCopyHandler, `{"format": "ebook", "location": "config.yml"}`, bookVars, http.StatusInternalServerError},
+		{CreateCopyHandler, `{"format": "paperback", "location": "/etc/passwd"}`, bookVars, http.StatusCreated},
+		{UpdateCopyHandler, `{"location": "/etc/passwd"}`, copyVars, http.StatusOK},
+		{UpdateCopyHandler, `{"format": "ebook"}`, copyVars, http.StatusInternalServerError},
+	} {
+		request := httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString(test.body))
+		request = mux.SetURLVars(request, test.vars)
+		recorder := httptest.NewRecorder()
+
+		// Function to test
+		test.handler(recorder, request)
+
+		// Verification
+		suite.Equal(test.code, recorder.Code, test.body)
+	}
+	suite.Equal(1, suite.countRows("copies WHERE format = 'ebook'"))
+}
+
+func (suite *HandlersTestSuite) TestImportBooksHandler_InvalidFiles() {
+	for _, test := range []struct {
+		format  string
+		content string
+		message string
+	}{
+		{"mobi", "title\nMort\n", "unknown import format mobi, expected csv, goodreads, storygraph, bibtex, ris, marc, marcxml"},
+		{"bibtex", "@book{mort,\n  title = {Mort", "line 2: unbalanced {"},
+		{"marc", "00000nam", "record 1: record is shorter than its leader"},
+		{"csv", "", "empty csv file, no books imported"},
+		{"", "", "empty csv file, no books imported"},
+	} {
+		// Setup
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		form.WriteField("format", test.format)
+		part, err := form.CreateFormFile("file", "books")
+		suite.NoError(err)
+		part.Write([]byte(test.content))
+		form.Close()
+		request := httptest.NewRequest(http.MethodPost, "/import/books", &body)
+		request.Header.Set("Content-Type", form.FormDataContentType())
+		recorder := httptest.NewRecorder()
+
+		// Function to test
+		ImportBooksHandler(recorder, request)
+
+		// Verification
+		suite.Equal(http.StatusBadRequest, recorder.Code, test.format)
+		suite.Equal(test.message+"\n", recorder.Body.String(), test.format)
+	}
+}
+
+func (suite *HandlersTestSuite) TestExportHandler_MissingCollection() {
+	// Setup
+	request := httptest.NewRequest(http.MethodGet, "/export?format=jsonl&collection_id=7", nil)
+	recorder := httptest.NewRecorder()
+
+	// Function to test
+	ExportHandler(recorder, request)
+
+	// Verification
+	suite.Equal(http.StatusNotFound, recorder.Code)
+	suite.Equal("no collections with the chosen specification\n", recorder.Body.String())
+}
+
+func (suite *HandlersTestSuite) TestExportCollectionCitationsHandler_MissingCollection() {
+	// Setup
+	request := httptest.NewRequest(http.MethodGet, "/collections/7/export?format=ris", nil)
+	request = mux.SetURLVars(request, map[string]string{"collection_id": "7"})
+	recorder := httptest.NewRecorder()
+
+	// Function to test
+	ExportCollectionCitationsHandler(recorder, request)
+
+	// Verification
+	suite.Equal(http.StatusNotFound, recorder.Code)
+	suite.Equal("no collections with the chosen specification\n", recorder.Body.String())
+}
+
+func (suite *HandlersTestSuite) TestBookHandlers_UnknownIDs() {
+	// Setup
+	title, author, name := "Mort", "Terry Pratchett", "Discworld"
+	book, err := CreateBook(db, BookArgs{Title: &title, Author: &author})
+	suite.NoError(err)
+	collection, err := CreateCollection(db, CollectionArgs{CollectionName: &name})
+	suite.NoError(err)
+
+	for _, test := range []struct {
+		handler http.HandlerFunc
+		method  string
+		body    string
+		vars    map[string]string
+		message string
+	}{
+		{UpdateBookHandler, http.MethodPatch, `{"title": "Small Gods"}`, map[string]string{"book_id": "99"}, "no books with the chosen specification"},
+		{RemoveBookFromCollectionHandler, http.MethodDelete, "", map[string]string{"collection_id": strconv.Itoa(collection.CollectionID), "book_id": "99"}, "no books with the chosen specification"},
+		{RemoveBookFromCollectionHandler, http.MethodDelete, "", map[string]string{"collection_id": "99", "book_id": strconv.Itoa(book.BookID)}, "no collections with the chosen specification"},
+		{RemoveBookFromCollectionHandler, http.MethodDelete, "", map[string]string{"collection_id": strconv.Itoa(collection.CollectionID), "book_id": strconv.Itoa(book.BookID)}, "book is not in this collection"},
+	} {
+		request := httptest.NewRequest(test.method, "/", bytes.NewBufferString(test.body))
+		request = mux.SetURLVars(request, test.vars)
+		recorder := httptest.NewRecorder()
+
+		// Function to test
+		test.handler(recorder, request)
+
+		// Verification
+		suite.Equal(http.StatusNotFound, recorder.Code, test.message)
+		suite.Equal(test.message+"\n", recorder.Body.String())
+	}
+}
+
+func TestHandlersTestSuite(t *testing.T) {
+	suite.Run(t, new(HandlersTestSuite))
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// book fields that can be read from a CSV import, also their default header names
+var importFields = []string{"title", "author", "isbn", "published_date", "edition", "publisher", "collections"}
+
+const defaultImportBatchSize = 100
+
+// importFormats are the formats of the files POST /import/books reads
+var importFormats = []string{"csv", "goodreads", "storygraph", "bibtex", "ris", "marc", "marcxml"}
+
+// importFileError is an import file that cannot be read at all, unlike a row that fails
+type importFileError struct {
+	err error
+}
+
+func (e importFileError) Error() string {
+	return e.err.Error()
+}
+
+func (e importFileError) Unwrap() error {
+	return e.err
+}
+
+// importRow is a parsed CSV row waiting to be written to the database
+type importRow struct {
+	line        int
+	book        BookArgs
+	collections []string
+}
+
+// ParseColumnMapping reads a mapping like "title=Book Title,author=Written By"
+// into a book field -> CSV header map
+func ParseColumnMapping(mapping string) (map[string]string, error) {
+	columns := map[string]string{}
+	if strings.TrimSpace(mapping) == "" {
+		return columns, nil
+	}
+
+	for _, pair := range strings.Split(mapping, ",") {
+		field, header, found := strings.Cut(pair, "=")
+		field = strings.TrimSpace(field)
+		if !found || field == "" || strings.TrimSpace(header) == "" {
+			return nil, fmt.Errorf("invalid column mapping %s, expected field=header", pair)
+		}
+		if !isImportField(field) {
+			return nil, fmt.Errorf("unknown book field %s, expected one of %s", field, strings.Join(importFields, ", "))
+		}
+		columns[field] = strings.TrimSpace(header)
+	}
+
+	return columns, nil
+}
+
+// formatColumnMapping writes a mapping back in the form ParseColumnMapping reads
+func formatColumnMapping(columns map[string]string) string {
+	pairs := []string{}
+	for _, field := range importFields {
+		if header, ok := columns[field]; ok {
+			pairs = append(pairs, field+"="+header)
+		}
+	}
+	return strings.Join(pairs, ",")
+}
+
+func isImportField(field string) bool {
+	for _, importField := range importFields {
+		if field == importField {
+			return true
+		}
+	}
+	return false
+}
+
+// ImportBooksCSV creates a book for every row of a CSV file, along with its author
+// and collections. Rows are written in batches, one transaction per batch, and each
+// row is guarded by a savepoint so a failing row is reported without affecting the others.
+// In dry-run mode everything runs in a single transaction that is rolled back at the end.
+func ImportBooksCSV(db *sql.DB, r io.Reader, args ImportArgs) (*ImportReport, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1 // short rows are reported per row instead of failing the import
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		if err == io.EOF {
+			err = errors.New("empty csv file, no books imported")
+		}
+		return nil, importFileError{err}
+	}
+
+	positions, err := importColumnPositions(header, args.Columns)
+	if err != nil {
+		return nil, importFileError{err}
+	}
+
+	batchSize := args.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultImportBatchSize
+	}
+
+	report := &ImportReport{DryRun: args.DryRun, Errors: []ImportRowError{}}
+
+	// dry runs share one transaction so later rows see what earlier rows would have created
+	var dryRunTx *sql.Tx
+	if args.DryRun {
+		dryRunTx, err = db.Begin()
+		if err != nil {
+			return nil, err
+		}
+		defer dryRunTx.Rollback()
+	}
+
+	var batch []importRow
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		defer func() { batch = nil }()
+
+		if dryRunTx != nil {
+			report.Created += importBatch(dryRunTx, batch, report)
+			return nil
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback() // no-op once the transaction is committed
+
+		created := importBatch(tx, batch, report)
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+		report.Created += created
+		return nil
+	}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		report.Rows++
+
+		if err != nil {
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				report.addError(parseErr.StartLine, parseErr.Err)
+				continue
+			}
+			return report, err
+		}
+		line, _ := reader.FieldPos(0)
+
+		row, err := parseImportRow(record, positions)
+		if err != nil {
+			report.addError(line, err)
+			continue
+		}
+		row.line = line
+
+		batch = append(batch, row)
+		if len(batch) >= batchSize {
+			err = flush()
+			if err != nil {
+				return report, err
+			}
+		}
+	}
+
+	err = flush()
+	if err != nil {
+		return report, err
+	}
+
+	return report, nil
+}
+
+func (report *ImportReport) addError(line int, err error) {
+	report.Failed++
+	report.Errors = append(report.Errors, ImportRowError{Row: line, Message: err.Error()})
+}
+
+// importColumnPositions finds the index of each book field in the CSV header
+func importColumnPositions(header []string, columns map[string]string) (map[string]int, error) {
+	indexes := map[string]int{}
+	for index, name := range header {
+		indexes[strings.ToLower(strings.TrimSpace(name))] = index
+	}
+
+	positions := map[string]int{}
+	for _, field := range importFields {
+		name := field
+		if mapped, ok := columns[field]; ok {
+			name = mapped
+		}
+
+		index, ok := indexes[strings.ToLower(name)]
+		if !ok {
+			if field == "title" {
+				return nil, fmt.Errorf("no %s column in the csv header, books not imported", name)
+			}
+			continue
+		}
+		positions[field] = index
+	}
+
+	return positions, nil
+}
+
+// parseImportRow validates a CSV record and turns it into book arguments
+func parseImportRow(record []string, positions map[string]int) (importRow, error) {
+	var row importRow
+
+	value := func(field string) *string {
+		index, ok := positions[field]
+		if !ok || index >= len(record) || strings.TrimSpace(record[index]) == "" {
+			return nil
+		}
+		v := strings.TrimSpace(record[index])
+		return &v
+	}
+
+	row.book = BookArgs{Title: value("title"), ISBN: value("isbn"), PublishedDate: value("published_date"), Publisher: value("publisher")}
+	if row.book.Title == nil {
+		return row, errors.New("no book title set, book not created")
+	}
+
+	// the schema holds a single author per book, so co-authors share one author entry
+	if authors := value("author"); authors != nil {
+		author := strings.Join(splitImportList(*authors), " & ")
+		row.book.Author = &author
+	}
+
+	_, err := SanitizeISBN(row.book.ISBN)
+	if err != nil {
+		return row, err
+	}
+	_, err = SanitizePublishedDate(row.book.PublishedDate)
+	if err != nil {
+		return row, err
+	}
+	row.book.Edition, err = SanitizeEdition(value("edition"))
+	if err != nil {
+		return row, err
+	}
+
+	if collections := value("collections"); collections != nil {
+		row.collections = splitImportList(*collections)
+	}
+
+	return row, nil
+}
+
+// splitImportList splits multi-valued cells, which use semicolons since names often contain commas
+func splitImportList(cell string) []string {
+	values := []string{}
+	for _, value := range strings.Split(cell, ";") {
+		value = strings.TrimSpace(value)
+		if value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// importBatch writes the rows using tx and returns how many books were created
+func importBatch(tx *sql.Tx, batch []importRow, report *ImportReport) int {
+	created := 0
+	for _, row := range batch {
+		err := importBook(tx, row)
+		if err != nil {
+			report.addError(row.line, err)
+			continue
+		}
+		created++
+	}
+	return created
+}
+
+// importBook creates a single book and its collections, undoing all of it on failure
+func importBook(tx *sql.Tx, row importRow) error {
+	_, err := tx.Exec("SAVEPOINT import_row")
+	if err != nil {
+		return err
+	}
+
+	err = func() error {
+		book, err := createBook(tx, row.book)
+		if err != nil {
+			return err
+		}
+
+		for _, name := range row.collections {
+			collection, err := upsertCollection(tx, CollectionArgs{CollectionName: &name})
+			if err != nil {
+				return err
+			}
+			err = linkBookToCollection(tx, book.BookID, collection.CollectionID)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}()
+	if err != nil {
+		_, rollbackErr := tx.Exec("ROLLBACK TO SAVEPOINT import_row")
+		if rollbackErr != nil {
+			return rollbackErr
+		}
+		return err
+	}
+
+	_, err = tx.Exec("RELEASE SAVEPOINT import_row")
+	return err
+}
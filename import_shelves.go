@@ -0,0 +1,361 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// shelfEntry is a book read from a reading tracker export, with the shelves it sits on
+type shelfEntry struct {
+	line    int
+	book    BookArgs
+	shelves []string
+}
+
+// shelfFormat describes the CSV export of a reading tracker
+type shelfFormat struct {
+	name   string
+	marker string // header only this format has, used to detect it
+	parse  func(row map[string]string) shelfEntry
+}
+
+var shelfFormats = []shelfFormat{
+	{name: "goodreads", marker: "exclusive shelf", parse: parseGoodreadsRow},
+	{name: "storygraph", marker: "read status", parse: parseStoryGraphRow},
+}
+
+// Goodreads exports columns such as
+// Title, Author, Additional Authors, ISBN, ISBN13, Original Publication Year, Bookshelves, Exclusive Shelf
+func parseGoodreadsRow(row map[string]string) shelfEntry {
+	var entry shelfEntry
+
+	entry.book.Title = optionalValue(row["title"])
+	entry.book.Author = joinAuthors(append([]string{row["author"]}, strings.Split(row["additional authors"], ",")...))
+
+	// ISBNs are written as ="0261102214" so spreadsheets keep the leading zeros
+	for _, column := range []string{"isbn13", "isbn"} {
+		isbn := strings.Trim(row[column], `="`)
+		if _, err := SanitizeISBN(&isbn); err == nil && isbn != "" {
+			entry.book.ISBN = &isbn
+			break
+		}
+	}
+
+	for _, column := range []string{"original publication year", "year published"} {
+		if year := optionalValue(row[column]); year != nil {
+			entry.book.PublishedDate = year
+			break
+		}
+	}
+
+	entry.shelves = uniqueShelves(append(strings.Split(row["bookshelves"], ","), row["exclusive shelf"]))
+
+	return entry
+}
+
+// StoryGraph exports columns such as Title, Authors, ISBN/UID, Read Status, Tags
+func parseStoryGraphRow(row map[string]string) shelfEntry {
+	var entry shelfEntry
+
+	entry.book.Title = optionalValue(row["title"])
+	entry.book.Author = joinAuthors(strings.Split(row["authors"], ","))
+
+	// the UID is StoryGraph's own identifier when the edition has no ISBN
+	if isbn := row["isbn/uid"]; isbn != "" {
+		if _, err := SanitizeISBN(&isbn); err == nil {
+			entry.book.ISBN = &isbn
+		}
+	}
+
+	entry.shelves = uniqueShelves(append(strings.Split(row["tags"], ","), row["read status"]))
+
+	return entry
+}
+
+func optionalValue(value string) *string {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil
+	}
+	return &value
+}
+
+// joinAuthors keeps the non empty names, co-authors share one author entry like in CSV imports
+func joinAuthors(names []string) *string {
+	authors := []string{}
+	for _, name := range names {
+		if name = strings.TrimSpace(name); name != "" {
+			authors = append(authors, name)
+		}
+	}
+	if len(authors) == 0 {
+		return nil
+	}
+	author := strings.Join(authors, " & ")
+	return &author
+}
+
+func uniqueShelves(names []string) []string {
+	shelves := []string{}
+	seen := map[string]bool{}
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		shelves = append(shelves, name)
+	}
+	return shelves
+}
+
+var seriesSuffix = regexp.MustCompile(`\s*\([^()]*#[^()]*\)\s*$`)
+
+// normalizeBookKey builds the key used to match books by title and first author,
+// ignoring case, punctuation and the "(Series, #1)" suffix Goodreads adds to titles
+func normalizeBookKey(title string, author string) string {
+	normalize := func(text string) string {
+		words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+		return strings.Join(words, " ")
+	}
+
+	firstAuthor, _, _ := strings.Cut(author, " & ")
+	return normalize(seriesSuffix.ReplaceAllString(title, "")) + "|" + normalize(firstAuthor)
+}
+
+// bookIndex finds books already in the database by ISBN or by normalized title and author
+type bookIndex struct {
+	byISBN map[string]int
+	byKey  map[string]int
+}
+
+func loadBookIndex(q querier) (*bookIndex, error) {
+	index := &bookIndex{byISBN: map[string]int{}, byKey: map[string]int{}}
+
+	rows, err := q.Query(`
+		SELECT books.book_id, books.title, authors.name, books.isbn
+		FROM books
+		JOIN authors ON books.author_id = authors.author_id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var bookID int
+		var title, author string
+		var isbn sql.NullString
+		err := rows.Scan(&bookID, &title, &author, &isbn)
+		if err != nil {
+			return nil, err
+		}
+		index.add(bookID, title, author, isbn.String)
+	}
+
+	return index, rows.Err()
+}
+
+func (index *bookIndex) add(bookID int, title string, author string, isbn string) {
+	if isbn != "" {
+		index.byISBN[isbn] = bookID
+	}
+	index.byKey[normalizeBookKey(title, author)] = bookID
+}
+
+func (index *bookIndex) find(book BookArgs) (int, bool) {
+	if isbn, _ := SanitizeISBN(book.ISBN); isbn != nil {
+		if bookID, ok := index.byISBN[*isbn]; ok {
+			return bookID, true
+		}
+	}
+
+	author := SanitizeAuthorName(book.Author)
+	bookID, ok := index.byKey[normalizeBookKey(*book.Title, *author)]
+	return bookID, ok
+}
+
+// ImportShelvesCSV imports a Goodreads or StoryGraph export. Books already in the
+// database are matched by ISBN or by title and author instead of being created again,
+// and every shelf (or tag and read status) becomes a collection holding its books.
+// The format is detected from the header when it is empty.
+func ImportShelvesCSV(db *sql.DB, r io.Reader, format string) (*ShelfImportReport, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	reader.LazyQuotes = true // hand edited exports often lose the quoting of ="isbn" cells
+
+	header, err := reader.Read()
+	if err != nil {
+		if err == io.EOF {
+			err = errors.New("empty csv file, no books imported")
+		}
+		return nil, importFileError{err}
+	}
+	for index := range header {
+		header[index] = strings.ToLower(strings.TrimSpace(header[index]))
+	}
+
+	shelfFormat, err := findShelfFormat(format, header)
+	if err != nil {
+		return nil, importFileError{err}
+	}
+
+	// the whole export is imported in one transaction, each entry guarded by a savepoint
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // no-op once the transaction is committed
+
+	index, err := loadBookIndex(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ShelfImportReport{
+		Format:  shelfFormat.name,
+		Created: []ShelfImportEntry{},
+		Matched: []ShelfImportEntry{},
+		Skipped: []ShelfImportEntry{},
+	}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				report.Skipped = append(report.Skipped, ShelfImportEntry{Row: parseErr.StartLine, Reason: parseErr.Err.Error()})
+				continue
+			}
+			return nil, err
+		}
+
+		row := map[string]string{}
+		for column, value := range record {
+			if column < len(header) {
+				row[header[column]] = value
+			}
+		}
+		entry := shelfFormat.parse(row)
+		entry.line, _ = reader.FieldPos(0)
+
+		err = importShelfEntry(tx, index, entry, report)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+func findShelfFormat(format string, header []string) (*shelfFormat, error) {
+	names := []string{}
+	for index := range shelfFormats {
+		shelfFormat := &shelfFormats[index]
+		names = append(names, shelfFormat.name)
+
+		if format == shelfFormat.name {
+			return shelfFormat, nil
+		}
+		if format == "" {
+			for _, column := range header {
+				if column == shelfFormat.marker {
+					return shelfFormat, nil
+				}
+			}
+		}
+	}
+
+	if format == "" {
+		return nil, fmt.Errorf("unrecognized export, expected a %s csv", strings.Join(names, " or "))
+	}
+	return nil, fmt.Errorf("unknown export format %s, expected %s", format, strings.Join(names, " or "))
+}
+
+// importShelfEntry creates or matches the book of an entry and adds it to its shelves.
+// An entry that fails is skipped, the error returned is one of the savepoint, after
+// which the transaction cannot go on.
+func importShelfEntry(tx *sql.Tx, index *bookIndex, entry shelfEntry, report *ShelfImportReport) error {
+	reportEntry := ShelfImportEntry{Row: entry.line, Collections: entry.shelves}
+	if entry.book.Title == nil {
+		reportEntry.Reason = "no book title set, book not created"
+		report.Skipped = append(report.Skipped, reportEntry)
+		return nil
+	}
+	reportEntry.Title = *entry.book.Title
+	reportEntry.Author = *SanitizeAuthorName(entry.book.Author)
+
+	bookID, matched := index.find(entry.book)
+	reportEntry.BookID = bookID
+
+	_, err := tx.Exec("SAVEPOINT import_row")
+	if err != nil {
+		return err
+	}
+	err = func() error {
+		if !matched {
+			book, err := createBook(tx, entry.book)
+			if err != nil {
+				return err
+			}
+			reportEntry.BookID = book.BookID
+		}
+
+		for _, name := range entry.shelves {
+			collection, err := upsertCollection(tx, CollectionArgs{CollectionName: &name})
+			if err != nil {
+				return err
+			}
+			err = linkBookToCollection(tx, reportEntry.BookID, collection.CollectionID)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}()
+	if err != nil {
+		_, rollbackErr := tx.Exec("ROLLBACK TO SAVEPOINT import_row")
+		if rollbackErr != nil {
+			return rollbackErr
+		}
+	} else {
+		_, releaseErr := tx.Exec("RELEASE SAVEPOINT import_row")
+		if releaseErr != nil {
+			return releaseErr
+		}
+	}
+
+	switch {
+	case err != nil:
+		reportEntry.BookID = 0
+		reportEntry.Reason = err.Error()
+		report.Skipped = append(report.Skipped, reportEntry)
+	case matched:
+		report.Matched = append(report.Matched, reportEntry)
+	default:
+		isbn, _ := SanitizeISBN(entry.book.ISBN)
+		if isbn == nil {
+			isbn = new(string)
+		}
+		index.add(reportEntry.BookID, reportEntry.Title, reportEntry.Author, *isbn)
+		report.Created = append(report.Created, reportEntry)
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package main_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"bookish"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// the failing savepoints are simulated, so these tests run outside the suite
+
+func TestImportShelvesCSV_RollbackFails(t *testing.T) {
+	// Setup
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT books.book_id").WillReturnRows(sqlmock.NewRows([]string{"book_id", "title", "name", "isbn"}))
+	mock.ExpectExec("SAVEPOINT import_row").WillReturnResult(sqlmock.NewResult(0, 0))
+	// creating the book fails as its queries are not expected, then so does the rollback
+	mock.ExpectExec("ROLLBACK TO SAVEPOINT import_row").WillReturnError(errors.New("connection lost"))
+	mock.ExpectRollback()
+
+	file := strings.NewReader("title,author,exclusive shelf\nMort,Terry Pratchett,read\nSmall Gods,Terry Pratchett,read\n")
+
+	// Function to test
+	report, err := main.ImportShelvesCSV(db, file, "")
+
+	// Verification
+	assert.Nil(t, report)
+	assert.EqualError(t, err, "connection lost")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var errNoLoans = errors.New("no loans with the chosen specification")
+
+// LendBook lends a copy of a book to a borrower. A book with physical copies lends the
+// chosen copy, or the first one that is in; a book without recorded copies is lent as a
+// single copy. The lent date defaults to today, the due date is optional.
+func LendBook(db *sql.DB, l LoanArgs) (*Loan, error) {
+	if l.BookID == nil {
+		return nil, errors.New("choose the book to lend and insert its ID number")
+	}
+	if l.Borrower == nil || strings.TrimSpace(*l.Borrower) == "" {
+		return nil, errors.New("no borrower set, choose who the book is lent to")
+	}
+	lentDate, err := SanitizeDate(l.LentDate)
+	if err != nil {
+		return nil, err
+	}
+	if lentDate == nil {
+		day := today()
+		lentDate = &day
+	}
+	dueDate, err := SanitizeDate(l.DueDate)
+	if err != nil {
+		return nil, err
+	}
+	if dueDate != nil && dueDate.Before(*lentDate) {
+		return nil, fmt.Errorf("the due date %s is before the lent date %s", dueDate.Format("2006-01-02"), lentDate.Format("2006-01-02"))
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // no-op once the transaction is committed
+
+	books, err := listBooks(tx, BookArgs{BookID: l.BookID})
+	if err != nil {
+		return nil, err
+	}
+	copyID, err := lendableCopy(tx, books[0], l.CopyID)
+	if err != nil {
+		return nil, err
+	}
+
+	var loanID int
+	err = tx.QueryRow("INSERT INTO loans (book_id, copy_id, borrower, lent_date, due_date) VALUES ($1, $2, $3, $4, $5) RETURNING loan_id",
+		*l.BookID, copyID, strings.TrimSpace(*l.Borrower), *lentDate, dueDate).Scan(&loanID)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" { // the copy was lent at the same time
+		return nil, fmt.Errorf("book %s is already lent, it must be returned first", books[0].Title)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	loans, err := listLoans(tx, LoanArgs{LoanID: &loanID})
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return &loans[0], nil
+}
+
+// lendableCopy returns the copy of the book to lend, nil for a book without physical
+// copies, or an error when the copy is already out
+func lendableCopy(q querier, book Book, copyID *int) (*int, error) {
+	if copyID != nil {
+		var format string
+		var borrower sql.NullString
+		err := q.QueryRow(`SELECT copies.format, loans.borrower FROM copies
+			LEFT JOIN loans ON loans.copy_id = copies.copy_id AND loans.returned_date IS NULL
+			WHERE copies.copy_id = $1 AND copies.book_id = $2`, *copyID, book.BookID).Scan(&format, &borrower)
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("book %s has no copy %d", book.Title, *copyID)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if format == "ebook" {
+			return nil, errors.New("ebook copies are files, they cannot be lent")
+		}
+		if borrower.Valid {
+			return nil, fmt.Errorf("copy %d of %s is already lent to %s", *copyID, book.Title, borrower.String)
+		}
+		return copyID, nil
+	}
+
+	var copies, available int
+	var firstAvailable sql.NullInt64
+	err := q.QueryRow(`SELECT COUNT(*), COUNT(*) FILTER (WHERE loans.loan_id IS NULL), MIN(copies.copy_id) FILTER (WHERE loans.loan_id IS NULL)
+		FROM copies
+		LEFT JOIN loans ON loans.copy_id = copies.copy_id AND loans.returned_date IS NULL
+		WHERE copies.book_id = $1 AND copies.format <> 'ebook'`, book.BookID).Scan(&copies, &available, &firstAvailable)
+	if err != nil {
+		return nil, err
+	}
+	if copies > 0 {
+		if available == 0 {
+			return nil, fmt.Errorf("every copy of %s is already lent", book.Title)
+		}
+		id := int(firstAvailable.Int64)
+		return &id, nil
+	}
+
+	var borrower string
+	err = q.QueryRow("SELECT borrower FROM loans WHERE book_id = $1 AND copy_id IS NULL AND returned_date IS NULL", book.BookID).Scan(&borrower)
+	if err == nil {
+		return nil, fmt.Errorf("book %s is already lent to %s", book.Title, borrower)
+	}
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// ReturnBook ends a loan, chosen by its ID, by its copy, or by its book when only one
+// copy of the book is out. The returned date defaults to today.
+func ReturnBook(db *sql.DB, l LoanArgs) (*Loan, error) {
+	if l.LoanID == nil && l.BookID == nil && l.CopyID == nil {
+		return nil, errors.New("choose the loan, the copy or the book to return and insert its ID number")
+	}
+	returnedDate, err := SanitizeDate(l.ReturnedDate)
+	if err != nil {
+		return nil, err
+	}
+	if returnedDate == nil {
+		day := today()
+		returnedDate = &day
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // no-op once the transaction is committed
+
+	returned := false
+	loans, err := listLoans(tx, LoanArgs{LoanID: l.LoanID, BookID: l.BookID, CopyID: l.CopyID, Returned: &returned})
+	if err == errNoLoans {
+		return nil, errors.New("no open loan with the chosen specification, the book is not lent")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(loans) > 1 {
+		return nil, fmt.Errorf("%d copies of %s are lent, choose the loan or the copy to return", len(loans), loans[0].Title)
+	}
+	loan := loans[0]
+	if returnedDate.Before(loan.LentDate) {
+		return nil, fmt.Errorf("the returned date %s is before the lent date %s", returnedDate.Format("2006-01-02"), loan.LentDate.Format("2006-01-02"))
+	}
+
+	_, err = tx.Exec("UPDATE loans SET returned_date = $1 WHERE loan_id = $2", *returnedDate, loan.LoanID)
+	if err != nil {
+		return nil, err
+	}
+
+	loans, err = listLoans(tx, LoanArgs{LoanID: &loan.LoanID})
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return &loans[0], nil
+}
+
+// ListLoans lists the loans of a book, a copy or a borrower, those still out or
+// returned, and those overdue: still out after their due date.
+func ListLoans(db *sql.DB, l LoanArgs) ([]Loan, error) {
+	return listLoans(db, l)
+}
+
+func listLoans(q querier, l LoanArgs) ([]Loan, error) {
+	loans := []Loan{}
+
+	query := `
+		SELECT loans.loan_id, loans.book_id, books.title, loans.copy_id, loans.borrower,
+		       loans.lent_date, loans.due_date, loans.returned_date
+		FROM loans
+		JOIN books ON loans.book_id = books.book_id
+		`
+
+	whereClauses := []string{}
+	params := []any{}
+	bind := func(value any) string {
+		params = append(params, value)
+		return fmt.Sprintf("$%d", len(params))
+	}
+	if l.LoanID != nil {
+		whereClauses = append(whereClauses, "loans.loan_id = "+bind(*l.LoanID))
+	}
+	if l.BookID != nil {
+		whereClauses = append(whereClauses, "loans.book_id = "+bind(*l.BookID))
+	}
+	if l.CopyID != nil {
+		whereClauses = append(whereClauses, "loans.copy_id = "+bind(*l.CopyID))
+	}
+	if l.Borrower != nil {
+		whereClauses = append(whereClauses, "loans.borrower = "+bind(strings.TrimSpace(*l.Borrower)))
+	}
+	if l.Returned != nil {
+		if *l.Returned {
+			whereClauses = append(whereClauses, "loans.returned_date IS NOT NULL")
+		} else {
+			whereClauses = append(whereClauses, "loans.returned_date IS NULL")
+		}
+	}
+	if l.Overdue {
+		whereClauses = append(whereClauses, "loans.returned_date IS NULL AND loans.due_date < "+bind(today()))
+	}
+	if len(whereClauses) > 0 {
+		query += "WHERE " + strings.Join(whereClauses, " AND ")
+	}
+	query += " ORDER BY loans.returned_date DESC NULLS FIRST, loans.due_date NULLS LAST, loans.loan_id"
+
+	rows, err := q.Query(query, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	now := today()
+	for rows.Next() {
+		var loan Loan
+		var copyID sql.NullInt64
+		var dueDate, returnedDate sql.NullTime
+		err := rows.Scan(&loan.LoanID, &loan.BookID, &loan.Title, &copyID, &loan.Borrower, &loan.LentDate, &dueDate, &returnedDate)
+		if err != nil {
+			return nil, err
+		}
+		if copyID.Valid {
+			id := int(copyID.Int64)
+			loan.CopyID = &id
+		}
+		if dueDate.Valid {
+			loan.DueDate = &dueDate.Time
+		}
+		if returnedDate.Valid {
+			loan.ReturnedDate = &returnedDate.Time
+		}
+		loan.Overdue = loanOverdue(loan, now)
+		loans = append(loans, loan)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(loans) == 0 {
+		return nil, errNoLoans
+	}
+	return loans, nil
+}
+
+// loanOverdue tells whether a loan is still out after its due date
+func loanOverdue(loan Loan, day time.Time) bool {
+	return loan.ReturnedDate == nil && loan.DueDate != nil && loan.DueDate.Before(day)
+}
@@ -1,13 +1,15 @@
 package main
 
 import (
+	"bytes"
+	"crypto/subtle"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
 	"net/http"
-	"os"
+	"strconv"
+	"strings"
 
 	"github.com/gorilla/mux"
 	_ "github.com/lib/pq"
@@ -18,44 +20,92 @@ var db *sql.DB
 var err error
 
 func main() {
+	// the server is the serve command, also run when no command is given, everything
+	// else is a CLI command
+	CLIcommands()
+}
 
-	// configs
-	config, err = LoadConfig()
-	if err != nil{
-		fmt.Println(err)
-		os.Exit(1)
-	}
-
-	// connect to db
-	db, err = ConnectToDb(config.Database.URL)
-	if err != nil{
-		fmt.Println(err)
-		os.Exit(1)
-	}
-	defer db.Close()
+func newRouter(config *Config) *mux.Router {
+	r := mux.NewRouter()
+	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "Welcome to the Books Database")
+	})
+	r.HandleFunc("/books", CreateBookHandler).Methods("POST")
+	r.HandleFunc("/books", ListBookHandler).Methods("GET")
+	r.HandleFunc("/books/from-file", CreateBookFromFileHandler).Methods("POST")
+	r.HandleFunc("/books/{book_id}", UpdateBookHandler).Methods("PATCH")
+	r.HandleFunc("/books/{book_id}/status", SetReadingStatusHandler).Methods("PUT")
+	r.HandleFunc("/books/{book_id}/status", ListReadingStatusHandler).Methods("GET")
+	r.HandleFunc("/books/{book_id}/sessions", LogReadingSessionHandler).Methods("POST")
+	r.HandleFunc("/books/{book_id}/progress", ReadingProgressHandler).Methods("GET")
+	r.HandleFunc("/books/{book_id}/reviews", CreateReviewHandler).Methods("POST")
+	r.HandleFunc("/books/{book_id}/reviews", UpdateReviewHandler).Methods("PATCH")
+	r.HandleFunc("/books/{book_id}/reviews", ListReviewHandler).Methods("GET")
+	r.HandleFunc("/reviews", ListReviewHandler).Methods("GET")
+	r.HandleFunc("/books/{book_id}/notes", CreateNoteHandler).Methods("POST")
+	r.HandleFunc("/books/{book_id}/notes", ListNoteHandler).Methods("GET")
+	r.HandleFunc("/notes", ListNoteHandler).Methods("GET")
+	r.HandleFunc("/notes/{note_id}", UpdateNoteHandler).Methods("PATCH")
+	r.HandleFunc("/notes/{note_id}", DeleteNoteHandler).Methods("DELETE")
+	r.HandleFunc("/books/{book_id}/copies", CreateCopyHandler).Methods("POST")
+	r.HandleFunc("/books/{book_id}/copies", ListCopyHandler).Methods("GET")
+	r.HandleFunc("/copies", ListCopyHandler).Methods("GET")
+	r.HandleFunc("/copies/{copy_id}", UpdateCopyHandler).Methods("PATCH")
+	r.HandleFunc("/copies/{copy_id}", DeleteCopyHandler).Methods("DELETE")
+	r.HandleFunc("/wishlist", CreateWishHandler).Methods("POST")
+	r.HandleFunc("/wishlist", ListWishHandler).Methods("GET")
+	r.HandleFunc("/wishlist/{wish_id}", UpdateWishHandler).Methods("PATCH")
+	r.HandleFunc("/wishlist/{wish_id}", DeleteWishHandler).Methods("DELETE")
+	r.HandleFunc("/wishlist/{wish_id}/acquire", AcquireWishHandler).Methods("POST")
+	r.HandleFunc("/books/{book_id}/purchases", RecordPurchaseHandler).Methods("POST")
+	r.HandleFunc("/purchases", ListPurchaseHandler).Methods("GET")
+	r.HandleFunc("/purchases/spending", SpendingReportHandler).Methods("GET")
+	r.HandleFunc("/tags", CreateTagHandler).Methods("POST")
+	r.HandleFunc("/tags", ListTagHandler).Methods("GET")
+	r.HandleFunc("/tags/{tag_id}", UpdateTagHandler).Methods("PATCH")
+	r.HandleFunc("/tags/{tag_id}", DeleteTagHandler).Methods("DELETE")
+	r.HandleFunc("/books/{book_id}/tags", TagBookHandler).Methods("POST")
+	r.HandleFunc("/books/{book_id}/tags", UntagBookHandler).Methods("DELETE")
+	r.HandleFunc("/loans", LendBookHandler).Methods("POST")
+	r.HandleFunc("/loans", ListLoanHandler).Methods("GET")
+	r.HandleFunc("/loans/return", ReturnBookHandler).Methods("POST")
+	r.HandleFunc("/collections", ListCollectionHandler).Methods("GET")
+	r.HandleFunc("/collections", CreateCollectionHandler).Methods("POST")
+	r.HandleFunc("/collections/{collection_id}", AddBookToCollectionHandler).Methods("POST")
+	r.HandleFunc("/collections/{collection_id}/books/{book_id}", RemoveBookFromCollectionHandler).Methods("DELETE")
+	r.HandleFunc("/collections/{collection_id}/export", ExportCollectionCitationsHandler).Methods("GET")
+	r.HandleFunc("/import/books", ImportBooksHandler).Methods("POST")
+	r.HandleFunc("/export", ExportHandler).Methods("GET")
+	r.HandleFunc("/opds", OPDSRootHandler).Methods("GET")
+	r.HandleFunc("/opds/books", OPDSBooksHandler).Methods("GET")
+	r.HandleFunc("/opds/collections", OPDSCollectionsHandler).Methods("GET")
+	r.HandleFunc("/opds/collections/{collection_id}", OPDSCollectionBooksHandler).Methods("GET")
+	r.HandleFunc("/opds/authors", OPDSAuthorsHandler).Methods("GET")
+	r.HandleFunc("/opds/authors/{author_id}", OPDSAuthorBooksHandler).Methods("GET")
+	r.HandleFunc("/opds/search", OPDSSearchHandler).Methods("GET")
+	r.HandleFunc("/opds/copies/{copy_id}/file", OPDSCopyFileHandler).Methods("GET")
+	r.HandleFunc("/opds/opensearch.xml", OPDSSearchDescriptionHandler).Methods("GET")
 
-	// create tables
-	err = CreateTables(db)
-	if err != nil{
-		fmt.Println(err)
-		os.Exit(1)
+	if config.Server.APIToken != "" {
+		r.Use(requireAPIToken(config.Server.APIToken))
 	}
+	return r
+}
 
-	if len(os.Args) > 1 {
-		CLIcommands()
-	} else {
-		r := mux.NewRouter()
-		r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-			fmt.Fprintln(w, "Welcome to the Books Database")
+// requireAPIToken rejects the requests that do not carry the API token of the server
+// configuration as a bearer token, like the CLI does with a profile
+func requireAPIToken(token string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authorization := r.Header.Get("Authorization")
+			given := strings.TrimPrefix(authorization, "Bearer ")
+			if given == authorization || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="bookish"`)
+				http.Error(w, "invalid or missing API token", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
 		})
-		r.HandleFunc("/books", CreateBookHandler).Methods("POST")
-		r.HandleFunc("/books", ListBookHandler).Methods("GET")
-		r.HandleFunc("/collections", ListCollectionHandler).Methods("GET")
-		r.HandleFunc("/collections", CreateCollectionHandler).Methods("POST")
-		r.HandleFunc("/collections/{collection_id}", AddBookToCollectionHandler).Methods("POST")
-
-
-		log.Fatal(http.ListenAndServe(":8080", r))
 	}
 }
 
@@ -90,7 +140,7 @@ func ListBookHandler(w http.ResponseWriter, r *http.Request) {
 
 	// decode request into arguments to function
 	if r.ContentLength != 0 {
-		err = json.NewDecoder(r.Body).Decode(bookArgs)
+		err := json.NewDecoder(r.Body).Decode(bookArgs)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			
@@ -139,7 +189,7 @@ func ListCollectionHandler(w http.ResponseWriter, r *http.Request) {
 
 	// decode request into arguments to function
 	if r.ContentLength != 0 {
-		err = json.NewDecoder(r.Body).Decode(collectionArgs)
+		err := json.NewDecoder(r.Body).Decode(collectionArgs)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			
@@ -161,7 +211,7 @@ func AddBookToCollectionHandler(w http.ResponseWriter, r *http.Request) {
 	addArgs := &AddBookToCollectionArgs{}
   
 	// decode request into arguments to function
-	err = json.NewDecoder(r.Body).Decode(addArgs)
+	err := json.NewDecoder(r.Body).Decode(addArgs)
 	if err != nil {
 		if err.Error() == "EOF" {
 			err = errors.New("no book chosen, book could not be added")
@@ -191,3 +241,1171 @@ func AddBookToCollectionHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(message))
 }
+
+func RemoveBookFromCollectionHandler(w http.ResponseWriter, r *http.Request) {
+	removeArgs := AddBookToCollectionArgs{}
+	var err error
+
+	// Extract collection_id and book_id from URL path
+	vars := mux.Vars(r)
+	collectionIDStr := vars["collection_id"]
+	removeArgs.CollectionID, err = SanitizeIdNumber(&collectionIDStr)
+	if err != nil {
+		http.Error(w, "Invalid collection ID", http.StatusBadRequest)
+		return
+	}
+	bookIDStr := vars["book_id"]
+	removeArgs.BookID, err = SanitizeIdNumber(&bookIDStr)
+	if err != nil {
+		http.Error(w, "Invalid book ID", http.StatusBadRequest)
+		return
+	}
+
+	collection, book, err := RemoveBookFromCollection(db, removeArgs)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	message := fmt.Sprintf("Book %s removed from collection %s\n", book.Title, collection.CollectionName)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(message))
+}
+
+// UpdateBookHandler changes the fields of the book that are set in the request
+func UpdateBookHandler(w http.ResponseWriter, r *http.Request) {
+	bookArgs := BookArgs{}
+
+	err := json.NewDecoder(r.Body).Decode(&bookArgs)
+	if err != nil {
+		if err.Error() == "EOF" {
+			err = errors.New("nothing to update, set the fields to change")
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// the book is the one of the URL, whatever the body says
+	vars := mux.Vars(r)
+	bookIDStr := vars["book_id"]
+	bookArgs.BookID, err = SanitizeIdNumber(&bookIDStr)
+	if err != nil {
+		http.Error(w, "Invalid book ID", http.StatusBadRequest)
+		return
+	}
+
+	book, err := UpdateBook(db, bookArgs)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(book)
+}
+
+// SetReadingStatusHandler records the status of the book for the user of the request
+func SetReadingStatusHandler(w http.ResponseWriter, r *http.Request) {
+	statusArgs := ReadingStatusArgs{}
+
+	err := json.NewDecoder(r.Body).Decode(&statusArgs)
+	if err != nil {
+		if err.Error() == "EOF" {
+			err = errors.New("no status set, expected want-to-read, reading, read or abandoned")
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	vars := mux.Vars(r)
+	bookIDStr := vars["book_id"]
+	statusArgs.BookID, err = SanitizeIdNumber(&bookIDStr)
+	if err != nil {
+		http.Error(w, "Invalid book ID", http.StatusBadRequest)
+		return
+	}
+
+	status, err := SetReadingStatus(db, statusArgs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(status)
+}
+
+// ListReadingStatusHandler lists the statuses of the book, for one user or status when the request sets them
+func ListReadingStatusHandler(w http.ResponseWriter, r *http.Request) {
+	statusArgs := ReadingStatusArgs{}
+
+	if r.ContentLength != 0 {
+		err := json.NewDecoder(r.Body).Decode(&statusArgs)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	vars := mux.Vars(r)
+	bookIDStr := vars["book_id"]
+	bookID, err := SanitizeIdNumber(&bookIDStr)
+	if err != nil {
+		http.Error(w, "Invalid book ID", http.StatusBadRequest)
+		return
+	}
+	statusArgs.BookID = bookID
+
+	statuses, err := ListReadingStatuses(db, statusArgs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(statuses)
+}
+
+// LogReadingSessionHandler records a reading session of the book and answers with the progress it makes
+func LogReadingSessionHandler(w http.ResponseWriter, r *http.Request) {
+	sessionArgs := ReadingSessionArgs{}
+
+	err := json.NewDecoder(r.Body).Decode(&sessionArgs)
+	if err != nil {
+		if err.Error() == "EOF" {
+			err = errors.New("nothing to log, set the page or percentage reached, or the pages or minutes read")
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	vars := mux.Vars(r)
+	bookIDStr := vars["book_id"]
+	sessionArgs.BookID, err = SanitizeIdNumber(&bookIDStr)
+	if err != nil {
+		http.Error(w, "Invalid book ID", http.StatusBadRequest)
+		return
+	}
+
+	progress, err := LogReadingSession(db, sessionArgs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(progress)
+}
+
+// CreateReviewHandler records the rating and review of the user of the request for the book
+func CreateReviewHandler(w http.ResponseWriter, r *http.Request) {
+	reviewArgs := ReviewArgs{}
+
+	err := json.NewDecoder(r.Body).Decode(&reviewArgs)
+	if err != nil {
+		if err.Error() == "EOF" {
+			err = errors.New("no rating or review set, review not created")
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	vars := mux.Vars(r)
+	bookIDStr := vars["book_id"]
+	reviewArgs.BookID, err = SanitizeIdNumber(&bookIDStr)
+	if err != nil {
+		http.Error(w, "Invalid book ID", http.StatusBadRequest)
+		return
+	}
+
+	review, err := CreateReview(db, reviewArgs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	message := fmt.Sprintf("Review of %s by %s created with ID %d\n", review.Title, review.User, review.ReviewID)
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(message))
+	json.NewEncoder(w).Encode(review)
+}
+
+// UpdateReviewHandler changes the rating or review of the user of the request for the book
+func UpdateReviewHandler(w http.ResponseWriter, r *http.Request) {
+	reviewArgs := ReviewArgs{}
+
+	err := json.NewDecoder(r.Body).Decode(&reviewArgs)
+	if err != nil {
+		if err.Error() == "EOF" {
+			err = errors.New("no user set, choose whose review this is")
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	vars := mux.Vars(r)
+	bookIDStr := vars["book_id"]
+	reviewArgs.BookID, err = SanitizeIdNumber(&bookIDStr)
+	if err != nil {
+		http.Error(w, "Invalid book ID", http.StatusBadRequest)
+		return
+	}
+
+	review, err := UpdateReview(db, reviewArgs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(review)
+}
+
+// ListReviewHandler lists the reviews of the book in the path, or those chosen by the request
+func ListReviewHandler(w http.ResponseWriter, r *http.Request) {
+	reviewArgs := ReviewArgs{}
+
+	if r.ContentLength != 0 {
+		err := json.NewDecoder(r.Body).Decode(&reviewArgs)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	vars := mux.Vars(r)
+	if bookIDStr, ok := vars["book_id"]; ok {
+		bookID, err := SanitizeIdNumber(&bookIDStr)
+		if err != nil {
+			http.Error(w, "Invalid book ID", http.StatusBadRequest)
+			return
+		}
+		reviewArgs.BookID = bookID
+	}
+
+	reviews, err := ListReviews(db, reviewArgs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(reviews)
+}
+
+// CreateNoteHandler attaches a note, quote or highlight to the book
+func CreateNoteHandler(w http.ResponseWriter, r *http.Request) {
+	noteArgs := NoteArgs{}
+
+	err := json.NewDecoder(r.Body).Decode(&noteArgs)
+	if err != nil {
+		if err.Error() == "EOF" {
+			err = errors.New("no note text set, note not created")
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	vars := mux.Vars(r)
+	bookIDStr := vars["book_id"]
+	noteArgs.BookID, err = SanitizeIdNumber(&bookIDStr)
+	if err != nil {
+		http.Error(w, "Invalid book ID", http.StatusBadRequest)
+		return
+	}
+
+	note, err := CreateNote(db, noteArgs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	message := fmt.Sprintf("Note on %s created with ID %d\n", note.Title, note.NoteID)
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(message))
+	json.NewEncoder(w).Encode(note)
+}
+
+// ListNoteHandler lists the notes of the book in the path, or searches all notes, with the filters of the request
+func ListNoteHandler(w http.ResponseWriter, r *http.Request) {
+	noteArgs := NoteArgs{}
+
+	if r.ContentLength != 0 {
+		err := json.NewDecoder(r.Body).Decode(&noteArgs)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	vars := mux.Vars(r)
+	if bookIDStr, ok := vars["book_id"]; ok {
+		bookID, err := SanitizeIdNumber(&bookIDStr)
+		if err != nil {
+			http.Error(w, "Invalid book ID", http.StatusBadRequest)
+			return
+		}
+		noteArgs.BookID = bookID
+	}
+
+	notes, err := ListNotes(db, noteArgs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(notes)
+}
+
+// UpdateNoteHandler changes the fields of the note that are set in the request
+func UpdateNoteHandler(w http.ResponseWriter, r *http.Request) {
+	noteArgs := NoteArgs{}
+
+	err := json.NewDecoder(r.Body).Decode(&noteArgs)
+	if err != nil {
+		if err.Error() == "EOF" {
+			err = errors.New("nothing to update, set the fields to change")
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	vars := mux.Vars(r)
+	noteIDStr := vars["note_id"]
+	noteArgs.NoteID, err = SanitizeIdNumber(&noteIDStr)
+	if err != nil {
+		http.Error(w, "Invalid note ID", http.StatusBadRequest)
+		return
+	}
+
+	note, err := UpdateNote(db, noteArgs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(note)
+}
+
+// DeleteNoteHandler removes the note and answers with it
+func DeleteNoteHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+	noteArgs := NoteArgs{}
+
+	vars := mux.Vars(r)
+	noteIDStr := vars["note_id"]
+	noteArgs.NoteID, err = SanitizeIdNumber(&noteIDStr)
+	if err != nil {
+		http.Error(w, "Invalid note ID", http.StatusBadRequest)
+		return
+	}
+
+	note, err := DeleteNote(db, noteArgs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(note)
+}
+
+// CreateCopyHandler records a copy of the book that we own
+func CreateCopyHandler(w http.ResponseWriter, r *http.Request) {
+	copyArgs := CopyArgs{}
+
+	err := json.NewDecoder(r.Body).Decode(&copyArgs)
+	if err != nil {
+		if err.Error() == "EOF" {
+			err = errors.New("no format set, copy not created")
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	vars := mux.Vars(r)
+	bookIDStr := vars["book_id"]
+	copyArgs.BookID, err = SanitizeIdNumber(&bookIDStr)
+	if err != nil {
+		http.Error(w, "Invalid book ID", http.StatusBadRequest)
+		return
+	}
+
+	copy, err := CreateCopy(db, copyArgs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	message := fmt.Sprintf("Copy of %s created with ID %d\n", copy.Title, copy.CopyID)
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(message))
+	json.NewEncoder(w).Encode(copy)
+}
+
+// ListCopyHandler lists the copies of the book in the path, or searches all copies, with the filters of the request
+func ListCopyHandler(w http.ResponseWriter, r *http.Request) {
+	copyArgs := CopyArgs{}
+
+	if r.ContentLength != 0 {
+		err := json.NewDecoder(r.Body).Decode(&copyArgs)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	vars := mux.Vars(r)
+	if bookIDStr, ok := vars["book_id"]; ok {
+		bookID, err := SanitizeIdNumber(&bookIDStr)
+		if err != nil {
+			http.Error(w, "Invalid book ID", http.StatusBadRequest)
+			return
+		}
+		copyArgs.BookID = bookID
+	}
+
+	copies, err := ListCopies(db, copyArgs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(copies)
+}
+
+// UpdateCopyHandler changes the fields of the copy that are set in the request
+func UpdateCopyHandler(w http.ResponseWriter, r *http.Request) {
+	copyArgs := CopyArgs{}
+
+	err := json.NewDecoder(r.Body).Decode(&copyArgs)
+	if err != nil {
+		if err.Error() == "EOF" {
+			err = errors.New("nothing to update, set the fields to change")
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	vars := mux.Vars(r)
+	copyIDStr := vars["copy_id"]
+	copyArgs.CopyID, err = SanitizeIdNumber(&copyIDStr)
+	if err != nil {
+		http.Error(w, "Invalid copy ID", http.StatusBadRequest)
+		return
+	}
+
+	copy, err := UpdateCopy(db, copyArgs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(copy)
+}
+
+// DeleteCopyHandler removes the copy and answers with it
+func DeleteCopyHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+	copyArgs := CopyArgs{}
+
+	vars := mux.Vars(r)
+	copyIDStr := vars["copy_id"]
+	copyArgs.CopyID, err = SanitizeIdNumber(&copyIDStr)
+	if err != nil {
+		http.Error(w, "Invalid copy ID", http.StatusBadRequest)
+		return
+	}
+
+	copy, err := DeleteCopy(db, copyArgs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(copy)
+}
+
+// CreateWishHandler adds the book of the request to the wishlist
+func CreateWishHandler(w http.ResponseWriter, r *http.Request) {
+	wishArgs := WishArgs{}
+
+	err := json.NewDecoder(r.Body).Decode(&wishArgs)
+	if err != nil {
+		if err.Error() == "EOF" {
+			err = errors.New("no book title set, wish not created")
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	wish, err := CreateWish(db, wishArgs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	message := fmt.Sprintf("Book %s added to the wishlist with ID %d\n", wish.Title, wish.WishID)
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(message))
+	json.NewEncoder(w).Encode(wish)
+}
+
+// ListWishHandler lists the wishlist with the filters of the request
+func ListWishHandler(w http.ResponseWriter, r *http.Request) {
+	wishArgs := WishArgs{}
+
+	if r.ContentLength != 0 {
+		err := json.NewDecoder(r.Body).Decode(&wishArgs)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	wishes, err := ListWishes(db, wishArgs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(wishes)
+}
+
+// UpdateWishHandler changes the fields of the wish that are set in the request
+func UpdateWishHandler(w http.ResponseWriter, r *http.Request) {
+	wishArgs := WishArgs{}
+
+	err := json.NewDecoder(r.Body).Decode(&wishArgs)
+	if err != nil {
+		if err.Error() == "EOF" {
+			err = errors.New("nothing to update, set the fields to change")
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	vars := mux.Vars(r)
+	wishIDStr := vars["wish_id"]
+	wishArgs.WishID, err = SanitizeIdNumber(&wishIDStr)
+	if err != nil {
+		http.Error(w, "Invalid wish ID", http.StatusBadRequest)
+		return
+	}
+
+	wish, err := UpdateWish(db, wishArgs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(wish)
+}
+
+// DeleteWishHandler removes the wish and answers with it
+func DeleteWishHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+	wishArgs := WishArgs{}
+
+	vars := mux.Vars(r)
+	wishIDStr := vars["wish_id"]
+	wishArgs.WishID, err = SanitizeIdNumber(&wishIDStr)
+	if err != nil {
+		http.Error(w, "Invalid wish ID", http.StatusBadRequest)
+		return
+	}
+
+	wish, err := DeleteWish(db, wishArgs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(wish)
+}
+
+// AcquireWishHandler turns the wish into an owned book, with the copy and the purchase of the request
+func AcquireWishHandler(w http.ResponseWriter, r *http.Request) {
+	acquireArgs := AcquireArgs{}
+
+	if r.ContentLength != 0 {
+		err := json.NewDecoder(r.Body).Decode(&acquireArgs)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	vars := mux.Vars(r)
+	wishIDStr := vars["wish_id"]
+	wishID, err := SanitizeIdNumber(&wishIDStr)
+	if err != nil {
+		http.Error(w, "Invalid wish ID", http.StatusBadRequest)
+		return
+	}
+	acquireArgs.WishID = wishID
+
+	acquisition, err := AcquireWish(db, acquireArgs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	message := fmt.Sprintf("Book %s acquired with ID %d\n", acquisition.Book.Title, acquisition.Book.BookID)
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(message))
+	json.NewEncoder(w).Encode(acquisition)
+}
+
+// RecordPurchaseHandler records what the book was bought for
+func RecordPurchaseHandler(w http.ResponseWriter, r *http.Request) {
+	purchaseArgs := PurchaseArgs{}
+
+	err := json.NewDecoder(r.Body).Decode(&purchaseArgs)
+	if err != nil {
+		if err.Error() == "EOF" {
+			err = errors.New("no price set, purchase not recorded")
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	vars := mux.Vars(r)
+	bookIDStr := vars["book_id"]
+	purchaseArgs.BookID, err = SanitizeIdNumber(&bookIDStr)
+	if err != nil {
+		http.Error(w, "Invalid book ID", http.StatusBadRequest)
+		return
+	}
+
+	purchase, err := RecordPurchase(db, purchaseArgs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	message := fmt.Sprintf("Purchase of %s recorded with ID %d\n", purchase.Title, purchase.PurchaseID)
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(message))
+	json.NewEncoder(w).Encode(purchase)
+}
+
+// ListPurchaseHandler lists the purchases with the filters of the request
+func ListPurchaseHandler(w http.ResponseWriter, r *http.Request) {
+	purchaseArgs := PurchaseArgs{}
+
+	if r.ContentLength != 0 {
+		err := json.NewDecoder(r.Body).Decode(&purchaseArgs)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	purchases, err := ListPurchases(db, purchaseArgs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(purchases)
+}
+
+// SpendingReportHandler answers with the monthly spending of the purchases chosen by the request
+func SpendingReportHandler(w http.ResponseWriter, r *http.Request) {
+	purchaseArgs := PurchaseArgs{}
+
+	if r.ContentLength != 0 {
+		err := json.NewDecoder(r.Body).Decode(&purchaseArgs)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	spending, err := SpendingReport(db, purchaseArgs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(spending)
+}
+
+// CreateTagHandler creates the tag of the request
+func CreateTagHandler(w http.ResponseWriter, r *http.Request) {
+	tagArgs := TagArgs{}
+
+	err := json.NewDecoder(r.Body).Decode(&tagArgs)
+	if err != nil {
+		if err.Error() == "EOF" {
+			err = errors.New("no tag name set, tag not created")
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tag, err := CreateTag(db, tagArgs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	message := fmt.Sprintf("Tag %s created with ID %d\n", tag.Name, tag.TagID)
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(message))
+	json.NewEncoder(w).Encode(tag)
+}
+
+// ListTagHandler lists the tags and their number of books with the filters of the request
+func ListTagHandler(w http.ResponseWriter, r *http.Request) {
+	tagArgs := TagArgs{}
+
+	if r.ContentLength != 0 {
+		err := json.NewDecoder(r.Body).Decode(&tagArgs)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	tags, err := ListTags(db, tagArgs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(tags)
+}
+
+// UpdateTagHandler renames the tag or changes its kind
+func UpdateTagHandler(w http.ResponseWriter, r *http.Request) {
+	tagArgs := TagArgs{}
+
+	err := json.NewDecoder(r.Body).Decode(&tagArgs)
+	if err != nil {
+		if err.Error() == "EOF" {
+			err = errors.New("nothing to update, set the fields to change")
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	vars := mux.Vars(r)
+	tagIDStr := vars["tag_id"]
+	tagArgs.TagID, err = SanitizeIdNumber(&tagIDStr)
+	if err != nil {
+		http.Error(w, "Invalid tag ID", http.StatusBadRequest)
+		return
+	}
+
+	tag, err := UpdateTag(db, tagArgs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(tag)
+}
+
+// DeleteTagHandler removes the tag from the database and its books, and answers with it
+func DeleteTagHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+	tagArgs := TagArgs{}
+
+	vars := mux.Vars(r)
+	tagIDStr := vars["tag_id"]
+	tagArgs.TagID, err = SanitizeIdNumber(&tagIDStr)
+	if err != nil {
+		http.Error(w, "Invalid tag ID", http.StatusBadRequest)
+		return
+	}
+
+	tag, err := DeleteTag(db, tagArgs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(tag)
+}
+
+// TagBookHandler adds the tags of the request to the book and answers with the book
+func TagBookHandler(w http.ResponseWriter, r *http.Request) {
+	tagsArgs := BookTagsArgs{}
+
+	err := json.NewDecoder(r.Body).Decode(&tagsArgs)
+	if err != nil {
+		if err.Error() == "EOF" {
+			err = errors.New("no tags set, choose the tags of the book")
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	vars := mux.Vars(r)
+	bookIDStr := vars["book_id"]
+	tagsArgs.BookID, err = SanitizeIdNumber(&bookIDStr)
+	if err != nil {
+		http.Error(w, "Invalid book ID", http.StatusBadRequest)
+		return
+	}
+
+	book, err := TagBook(db, tagsArgs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(book)
+}
+
+// UntagBookHandler removes the tags of the request from the book and answers with the book
+func UntagBookHandler(w http.ResponseWriter, r *http.Request) {
+	tagsArgs := BookTagsArgs{}
+
+	err := json.NewDecoder(r.Body).Decode(&tagsArgs)
+	if err != nil {
+		if err.Error() == "EOF" {
+			err = errors.New("no tags set, choose the tags to remove from the book")
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	vars := mux.Vars(r)
+	bookIDStr := vars["book_id"]
+	tagsArgs.BookID, err = SanitizeIdNumber(&bookIDStr)
+	if err != nil {
+		http.Error(w, "Invalid book ID", http.StatusBadRequest)
+		return
+	}
+
+	book, err := UntagBook(db, tagsArgs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(book)
+}
+
+// LendBookHandler lends a copy of the book of the request to its borrower
+func LendBookHandler(w http.ResponseWriter, r *http.Request) {
+	loanArgs := LoanArgs{}
+
+	err := json.NewDecoder(r.Body).Decode(&loanArgs)
+	if err != nil {
+		if err.Error() == "EOF" {
+			err = errors.New("choose the book to lend and insert its ID number")
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	loan, err := LendBook(db, loanArgs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	message := fmt.Sprintf("Book %s lent to %s with loan ID %d\n", loan.Title, loan.Borrower, loan.LoanID)
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(message))
+	json.NewEncoder(w).Encode(loan)
+}
+
+// ReturnBookHandler ends the loan chosen by the request
+func ReturnBookHandler(w http.ResponseWriter, r *http.Request) {
+	loanArgs := LoanArgs{}
+
+	err := json.NewDecoder(r.Body).Decode(&loanArgs)
+	if err != nil {
+		if err.Error() == "EOF" {
+			err = errors.New("choose the loan, the copy or the book to return and insert its ID number")
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	loan, err := ReturnBook(db, loanArgs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(loan)
+}
+
+// ListLoanHandler lists the loans chosen by the request, the overdue ones only with ?overdue=true
+func ListLoanHandler(w http.ResponseWriter, r *http.Request) {
+	loanArgs := LoanArgs{}
+
+	if r.ContentLength != 0 {
+		err := json.NewDecoder(r.Body).Decode(&loanArgs)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if overdue := r.URL.Query().Get("overdue"); overdue != "" {
+		var err error
+		loanArgs.Overdue, err = strconv.ParseBool(overdue)
+		if err != nil {
+			http.Error(w, "Invalid overdue filter, expected true or false", http.StatusBadRequest)
+			return
+		}
+	}
+
+	loans, err := ListLoans(db, loanArgs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(loans)
+}
+
+// ReadingProgressHandler answers with the progress of the user of the request with the book
+func ReadingProgressHandler(w http.ResponseWriter, r *http.Request) {
+	sessionArgs := ReadingSessionArgs{}
+
+	if r.ContentLength != 0 {
+		err := json.NewDecoder(r.Body).Decode(&sessionArgs)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	vars := mux.Vars(r)
+	bookIDStr := vars["book_id"]
+	bookID, err := SanitizeIdNumber(&bookIDStr)
+	if err != nil {
+		http.Error(w, "Invalid book ID", http.StatusBadRequest)
+		return
+	}
+	sessionArgs.BookID = bookID
+
+	progress, err := GetReadingProgress(db, sessionArgs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(progress)
+}
+
+func CreateBookFromFileHandler(w http.ResponseWriter, r *http.Request) {
+	// the ebook comes as the "file" part of a multipart upload, its extension selects the format
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "no epub or pdf file uploaded, book not created", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	report, err := AddBookFromFile(db, header.Filename, file, header.Size)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(report.Skipped) > 0 {
+		http.Error(w, report.Skipped[0].Reason, http.StatusBadRequest)
+		return
+	}
+
+	status := http.StatusCreated
+	if len(report.Matched) > 0 {
+		status = http.StatusOK
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
+
+func ImportBooksHandler(w http.ResponseWriter, r *http.Request) {
+	importArgs := ImportArgs{}
+
+	// the csv comes as the "file" part of a multipart upload, options as form values
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "no csv file uploaded, books not imported", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	format := r.FormValue("format")
+	if format == "" {
+		format = "csv"
+	}
+	known := false
+	for _, importFormat := range importFormats {
+		known = known || format == importFormat
+	}
+	if !known {
+		http.Error(w, fmt.Sprintf("unknown import format %s, expected %s", format, strings.Join(importFormats, ", ")), http.StatusBadRequest)
+		return
+	}
+
+	// citation files are not tabular, they are read entry by entry
+	if format == "bibtex" || format == "ris" {
+		report, err := ImportCitations(db, file, format)
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(report)
+		return
+	}
+
+	// MARC records are binary or XML, not rows
+	if format == "marc" || format == "marcxml" {
+		report, err := ImportMARC(db, file, format)
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(report)
+		return
+	}
+
+	// reading tracker exports have their own columns and report
+	if format != "csv" {
+		report, err := ImportShelvesCSV(db, file, format)
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(report)
+		return
+	}
+
+	if dryRun := r.FormValue("dry_run"); dryRun != "" {
+		importArgs.DryRun, err = strconv.ParseBool(dryRun)
+		if err != nil {
+			http.Error(w, "Invalid dry_run value", http.StatusBadRequest)
+			return
+		}
+	}
+	if batchSize := r.FormValue("batch_size"); batchSize != "" {
+		size, err := SanitizeIdNumber(&batchSize)
+		if err != nil {
+			http.Error(w, "Invalid batch_size value", http.StatusBadRequest)
+			return
+		}
+		importArgs.BatchSize = *size
+	}
+	importArgs.Columns, err = ParseColumnMapping(r.FormValue("map"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	report, err := ImportBooksCSV(db, file, importArgs)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(report)
+}
+
+// errorStatus is the status of a failed request: not found for the records that do not
+// exist, bad request for the import files that cannot be read, an internal error otherwise
+func errorStatus(err error) int {
+	if errors.Is(err, errNoBooks) || errors.Is(err, errNoCollections) || errors.Is(err, errNotInCollection) {
+		return http.StatusNotFound
+	}
+	if errors.As(err, &importFileError{}) {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+func ExportHandler(w http.ResponseWriter, r *http.Request) {
+	exportArgs := ExportArgs{Format: r.URL.Query().Get("format")}
+	if exportArgs.Format == "" {
+		exportArgs.Format = "csv"
+	}
+
+	if collectionIDStr := r.URL.Query().Get("collection_id"); collectionIDStr != "" {
+		collectionID, err := SanitizeIdNumber(&collectionIDStr)
+		if err != nil {
+			http.Error(w, "Invalid collection ID", http.StatusBadRequest)
+			return
+		}
+		exportArgs.CollectionID = collectionID
+	}
+
+	contentType, err := ExportContentType(exportArgs.Format)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+
+	// the export is streamed, so an error can only be reported if nothing was written yet
+	err = ExportCatalogue(db, w, exportArgs)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+}
+
+func ExportCollectionCitationsHandler(w http.ResponseWriter, r *http.Request) {
+	// Extract collection_id from URL path
+	vars := mux.Vars(r)
+	collectionIDStr := vars["collection_id"]
+	collectionID, err := SanitizeIdNumber(&collectionIDStr)
+	if err != nil {
+		http.Error(w, "Invalid collection ID", http.StatusBadRequest)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "bibtex"
+	}
+	contentType, err := CitationContentType(format)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// render first, so a missing collection is reported with a proper status
+	var citations bytes.Buffer
+	err = ExportCollectionCitations(db, &citations, *collectionID, format)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	w.Write(citations.Bytes())
+}
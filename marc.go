@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ISO 2709 delimiters used by MARC21 binary records
+const (
+	marcSubfieldDelimiter = 0x1F
+	marcFieldTerminator   = 0x1E
+	marcRecordTerminator  = 0x1D
+	marcXMLNamespace      = "http://www.loc.gov/MARC21/slim"
+)
+
+// new records are Unicode (position 9 = 'a') language material monographs
+const marcDefaultLeader = "00000nam a2200000 i 4500"
+
+// ReadMARC21 reads binary MARC21 records. Only Unicode (UTF-8) records are supported.
+func ReadMARC21(r io.Reader) ([]MARCRecord, error) {
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	records := []MARCRecord{}
+	for index, data := range bytes.Split(content, []byte{marcRecordTerminator}) {
+		if len(bytes.TrimSpace(data)) == 0 {
+			continue
+		}
+		record, err := readMARC21Record(data)
+		if err != nil {
+			return nil, fmt.Errorf("record %d: %w", index+1, err)
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+func readMARC21Record(data []byte) (MARCRecord, error) {
+	var record MARCRecord
+	if len(data) < 25 {
+		return record, errors.New("record is shorter than its leader")
+	}
+	record.Leader = string(data[:24])
+
+	baseAddress, err := strconv.Atoi(string(data[12:17]))
+	if err != nil || baseAddress < 25 || baseAddress > len(data) {
+		return record, errors.New("invalid base address in leader")
+	}
+
+	// the directory has a 12 byte entry per field: tag, length and starting position
+	directory := data[24 : baseAddress-1]
+	if len(directory)%12 != 0 {
+		return record, errors.New("invalid directory length")
+	}
+	for entry := 0; entry < len(directory); entry += 12 {
+		tag := string(directory[entry : entry+3])
+		length, lengthErr := strconv.Atoi(string(directory[entry+3 : entry+7]))
+		start, startErr := strconv.Atoi(string(directory[entry+7 : entry+12]))
+		// the entries come from uploaded files, so they are checked before slicing
+		if lengthErr != nil || startErr != nil || length < 0 || start < 0 || baseAddress+start+length > len(data) {
+			return record, fmt.Errorf("invalid directory entry for field %s", tag)
+		}
+		value := bytes.TrimSuffix(data[baseAddress+start:baseAddress+start+length], []byte{marcFieldTerminator})
+
+		if isMARCControlTag(tag) {
+			record.Fields = append(record.Fields, MARCField{Tag: tag, Value: string(value)})
+			continue
+		}
+
+		if len(value) < 2 {
+			return record, fmt.Errorf("field %s has no indicators", tag)
+		}
+		field := MARCField{Tag: tag, Indicator1: string(value[0]), Indicator2: string(value[1])}
+		for _, subfield := range bytes.Split(value[2:], []byte{marcSubfieldDelimiter}) {
+			if len(subfield) == 0 {
+				continue
+			}
+			field.Subfields = append(field.Subfields, MARCSubfield{Code: string(subfield[0]), Value: string(subfield[1:])})
+		}
+		record.Fields = append(record.Fields, field)
+	}
+
+	return record, nil
+}
+
+// WriteMARC21 writes binary MARC21 records, computing the record length,
+// base address and directory from the fields
+func WriteMARC21(w io.Writer, records []MARCRecord) error {
+	for _, record := range records {
+		var directory, fields bytes.Buffer
+		for _, field := range record.Fields {
+			start := fields.Len()
+			if isMARCControlTag(field.Tag) {
+				fields.WriteString(field.Value)
+			} else {
+				fields.WriteString(marcIndicator(field.Indicator1))
+				fields.WriteString(marcIndicator(field.Indicator2))
+				for _, subfield := range field.Subfields {
+					fields.WriteByte(marcSubfieldDelimiter)
+					fields.WriteString(subfield.Code)
+					fields.WriteString(subfield.Value)
+				}
+			}
+			fields.WriteByte(marcFieldTerminator)
+
+			if len(field.Tag) != 3 || fields.Len()-start > 9999 || start > 99999 {
+				return fmt.Errorf("field %s cannot be written as MARC21", field.Tag)
+			}
+			fmt.Fprintf(&directory, "%s%04d%05d", field.Tag, fields.Len()-start, start)
+		}
+		directory.WriteByte(marcFieldTerminator)
+
+		baseAddress := 24 + directory.Len()
+		length := baseAddress + fields.Len() + 1
+		if length > 99999 {
+			return errors.New("record is longer than MARC21 allows")
+		}
+
+		leader := record.Leader
+		if len(leader) != 24 {
+			leader = marcDefaultLeader
+		}
+		leader = fmt.Sprintf("%05d", length) + leader[5:12] + fmt.Sprintf("%05d", baseAddress) + leader[17:]
+
+		_, err := io.WriteString(w, leader)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(append(directory.Bytes(), fields.Bytes()...), marcRecordTerminator))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isMARCControlTag(tag string) bool {
+	return strings.HasPrefix(tag, "00")
+}
+
+// marcIndicator keeps indicators to one character, blank when unset
+func marcIndicator(indicator string) string {
+	if len(indicator) != 1 {
+		return " "
+	}
+	return indicator
+}
+
+type marcXMLCollection struct {
+	XMLName xml.Name        `xml:"http://www.loc.gov/MARC21/slim collection"`
+	Records []marcXMLRecord `xml:"record"`
+}
+
+type marcXMLRecord struct {
+	XMLName       xml.Name              `xml:"record"`
+	Leader        string                `xml:"leader"`
+	ControlFields []marcXMLControlField `xml:"controlfield"`
+	DataFields    []marcXMLDataField    `xml:"datafield"`
+}
+
+type marcXMLControlField struct {
+	Tag   string `xml:"tag,attr"`
+	Value string `xml:",chardata"`
+}
+
+type marcXMLDataField struct {
+	Tag        string            `xml:"tag,attr"`
+	Indicator1 string            `xml:"ind1,attr"`
+	Indicator2 string            `xml:"ind2,attr"`
+	Subfields  []marcXMLSubfield `xml:"subfield"`
+}
+
+type marcXMLSubfield struct {
+	Code  string `xml:"code,attr"`
+	Value string `xml:",chardata"`
+}
+
+// ReadMARCXML reads a MARCXML collection, or a single record document
+func ReadMARCXML(r io.Reader) ([]MARCRecord, error) {
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var collection marcXMLCollection
+	err = xml.Unmarshal(content, &collection)
+	if err != nil {
+		var record marcXMLRecord
+		if xml.Unmarshal(content, &record) != nil {
+			return nil, fmt.Errorf("invalid MARCXML: %w", err)
+		}
+		collection.Records = []marcXMLRecord{record}
+	}
+
+	records := []MARCRecord{}
+	for _, xmlRecord := range collection.Records {
+		record := MARCRecord{Leader: xmlRecord.Leader}
+		for _, controlField := range xmlRecord.ControlFields {
+			record.Fields = append(record.Fields, MARCField{Tag: controlField.Tag, Value: controlField.Value})
+		}
+		for _, dataField := range xmlRecord.DataFields {
+			field := MARCField{Tag: dataField.Tag, Indicator1: dataField.Indicator1, Indicator2: dataField.Indicator2}
+			for _, subfield := range dataField.Subfields {
+				field.Subfields = append(field.Subfields, MARCSubfield{Code: subfield.Code, Value: subfield.Value})
+			}
+			record.Fields = append(record.Fields, field)
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// WriteMARCXML writes the records as a MARCXML collection
+func WriteMARCXML(w io.Writer, records []MARCRecord) error {
+	collection := marcXMLCollection{Records: []marcXMLRecord{}}
+	for _, record := range records {
+		xmlRecord := marcXMLRecord{Leader: record.Leader}
+		for _, field := range record.Fields {
+			if isMARCControlTag(field.Tag) {
+				xmlRecord.ControlFields = append(xmlRecord.ControlFields, marcXMLControlField{Tag: field.Tag, Value: field.Value})
+				continue
+			}
+			dataField := marcXMLDataField{Tag: field.Tag, Indicator1: marcIndicator(field.Indicator1), Indicator2: marcIndicator(field.Indicator2)}
+			for _, subfield := range field.Subfields {
+				dataField.Subfields = append(dataField.Subfields, marcXMLSubfield{Code: subfield.Code, Value: subfield.Value})
+			}
+			xmlRecord.DataFields = append(xmlRecord.DataFields, dataField)
+		}
+		collection.Records = append(collection.Records, xmlRecord)
+	}
+
+	_, err := io.WriteString(w, xml.Header)
+	if err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	err = encoder.Encode(collection)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "\n")
+	return err
+}
+
+// BookToMARC maps a book onto a MARC21 bibliographic record: 001 book id, 008 dates,
+// 020 ISBN, 100/700 authors, 245 title, 250 edition and 264 publication
+func BookToMARC(book Book) MARCRecord {
+	record := MARCRecord{Leader: marcDefaultLeader}
+
+	// a detailed date (e) keeps the month and day in 008/11-14, as 264 $c only holds the year
+	dateType, dates := "n", "        "
+	if book.PublishedDate != nil {
+		dateType, dates = "e", book.PublishedDate.Format("20060102")
+	}
+	record.Fields = append(record.Fields,
+		MARCField{Tag: "001", Value: strconv.Itoa(book.BookID)},
+		MARCField{Tag: "003", Value: "bookish"},
+		MARCField{Tag: "008", Value: book.CreationDate.Format("060102") + dateType + dates + "xx " + strings.Repeat("|", 17) + "und d"},
+	)
+
+	if book.ISBN != "" {
+		record.Fields = append(record.Fields, MARCField{Tag: "020", Indicator1: " ", Indicator2: " ", Subfields: []MARCSubfield{{Code: "a", Value: book.ISBN}}})
+	}
+
+	authors := bookAuthors(book)
+	record.Fields = append(record.Fields, MARCField{Tag: "100", Indicator1: "1", Indicator2: " ", Subfields: []MARCSubfield{{Code: "a", Value: authors[0]}}})
+
+	// 245 first indicator tells whether a 1XX author exists
+	record.Fields = append(record.Fields, MARCField{Tag: "245", Indicator1: "1", Indicator2: "0", Subfields: []MARCSubfield{{Code: "a", Value: book.Title}}})
+
+	if book.Edition != nil {
+		record.Fields = append(record.Fields, MARCField{Tag: "250", Indicator1: " ", Indicator2: " ", Subfields: []MARCSubfield{{Code: "a", Value: strconv.Itoa(*book.Edition) + " ed."}}})
+	}
+
+	if book.Publisher != "" || book.PublishedDate != nil {
+		publication := MARCField{Tag: "264", Indicator1: " ", Indicator2: "1"}
+		if book.Publisher != "" {
+			publication.Subfields = append(publication.Subfields, MARCSubfield{Code: "b", Value: book.Publisher})
+		}
+		if book.PublishedDate != nil {
+			publication.Subfields = append(publication.Subfields, MARCSubfield{Code: "c", Value: fmt.Sprintf("%04d", book.PublishedDate.Year())})
+		}
+		record.Fields = append(record.Fields, publication)
+	}
+
+	for _, author := range authors[1:] {
+		record.Fields = append(record.Fields, MARCField{Tag: "700", Indicator1: "1", Indicator2: " ", Subfields: []MARCSubfield{{Code: "a", Value: author}}})
+	}
+
+	return record
+}
+
+var (
+	marcYear     = regexp.MustCompile(`\d{4}`)
+	marcFullDate = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}$`)
+	marcMonthDay = regexp.MustCompile(`^(0[1-9]|1[0-2])(0[1-9]|[12]\d|3[01])$`)
+	marcInitial  = regexp.MustCompile(`(^|[\s.])\p{Lu}\.$`)
+)
+
+// MARCToBook reads the book arguments of a MARC21 record, accepting 260 when there is no 264
+func MARCToBook(record MARCRecord) (BookArgs, error) {
+	var book BookArgs
+
+	title := record.subfield("245", "a")
+	if subtitle := record.subfield("245", "b"); subtitle != "" {
+		title = cleanMARCValue(title) + ": " + subtitle
+	}
+	if title = cleanMARCValue(title); title != "" {
+		book.Title = &title
+	} else {
+		return book, errors.New("no book title set, book not created")
+	}
+
+	authors := []string{record.subfield("100", "a")}
+	for _, field := range record.fields("700") {
+		authors = append(authors, field.subfield("a"))
+	}
+	for index := range authors {
+		authors[index] = cleanMARCValue(authors[index])
+	}
+	book.Author = joinAuthors(authors)
+
+	// 020 $a may carry a qualifier, as in "9780261102217 (paperback)", a blank one is skipped
+	if fields := strings.Fields(record.subfield("020", "a")); len(fields) > 0 {
+		isbn := fields[0]
+		sanitized, err := SanitizeISBN(&isbn)
+		if err != nil {
+			return book, err
+		}
+		book.ISBN = sanitized
+	}
+
+	if edition := record.subfield("250", "a"); edition != "" {
+		// editions are often spelled out, as in "First edition", so only numbers are kept
+		book.Edition, _ = SanitizeEdition(&edition)
+	}
+
+	publication := "264"
+	if len(record.fields("264")) == 0 {
+		publication = "260"
+	}
+	if publisher := cleanMARCValue(record.subfield(publication, "b")); publisher != "" {
+		book.Publisher = &publisher
+	}
+	date := cleanMARCValue(record.subfield(publication, "c"))
+	if !marcFullDate.MatchString(date) {
+		date = marcYear.FindString(date)
+	}
+	if fixed := record.controlField("008"); len(fixed) >= 15 && !marcFullDate.MatchString(date) {
+		// 008/07-10 holds the first publication year, and 008/11-14 its month and day for detailed dates
+		if year := marcYear.FindString(fixed[7:11]); year != "" && (date == "" || date == year) {
+			date = year
+			if fixed[6] == 'e' && marcMonthDay.MatchString(fixed[11:15]) {
+				date = year + "-" + fixed[11:13] + "-" + fixed[13:15]
+			}
+		}
+	}
+	if date != "" {
+		book.PublishedDate = &date
+	}
+
+	return book, nil
+}
+
+func (record MARCRecord) fields(tag string) []MARCField {
+	fields := []MARCField{}
+	for _, field := range record.Fields {
+		if field.Tag == tag {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+func (record MARCRecord) controlField(tag string) string {
+	for _, field := range record.fields(tag) {
+		return field.Value
+	}
+	return ""
+}
+
+// subfield returns the first subfield with the code in the first field with the tag
+func (record MARCRecord) subfield(tag string, code string) string {
+	for _, field := range record.fields(tag) {
+		return field.subfield(code)
+	}
+	return ""
+}
+
+func (field MARCField) subfield(code string) string {
+	for _, subfield := range field.Subfields {
+		if subfield.Code == code {
+			return subfield.Value
+		}
+	}
+	return ""
+}
+
+// cleanMARCValue removes the ISBD punctuation that ends subfields, such as "The hobbit /"
+// or "Tolkien, J. R. R.,", keeping the period of initials
+func cleanMARCValue(value string) string {
+	value = strings.TrimSpace(value)
+	for {
+		trimmed := strings.TrimSpace(strings.TrimRight(value, "/:;,="))
+		if strings.HasSuffix(trimmed, ".") && !marcInitial.MatchString(trimmed) {
+			trimmed = strings.TrimSuffix(trimmed, ".")
+		}
+		trimmed = strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(trimmed, "["), "]"))
+		if trimmed == value {
+			return value
+		}
+		value = trimmed
+	}
+}
+
+// marcCodecs reads and writes each MARC serialization
+var marcCodecs = map[string]struct {
+	read  func(r io.Reader) ([]MARCRecord, error)
+	write func(w io.Writer, records []MARCRecord) error
+}{
+	"marc":    {read: ReadMARC21, write: WriteMARC21},
+	"marcxml": {read: ReadMARCXML, write: WriteMARCXML},
+}
+
+// exportMARC writes the exported books as MARC21 records, in the codec of args.Format
+func exportMARC(q querier, w io.Writer, args ExportArgs) error {
+	books, err := listBooks(q, BookArgs{CollectionID: args.CollectionID})
+	if err != nil && !errors.Is(err, errNoBooks) {
+		return err
+	}
+
+	records := []MARCRecord{}
+	for _, book := range books {
+		records = append(records, BookToMARC(book))
+	}
+	return marcCodecs[args.Format].write(w, records)
+}
+
+// ImportMARC creates a book for every record of a MARC21 or MARCXML file, in one
+// transaction where each record is guarded by a savepoint like in CSV imports.
+// Rows in the report are record numbers.
+func ImportMARC(db *sql.DB, r io.Reader, format string) (*ImportReport, error) {
+	codec, ok := marcCodecs[format]
+	if !ok {
+		return nil, fmt.Errorf("unknown MARC format %s, expected marc or marcxml", format)
+	}
+
+	records, err := codec.read(r)
+	if err != nil {
+		return nil, importFileError{err}
+	}
+
+	report := &ImportReport{Errors: []ImportRowError{}}
+	rows := []importRow{}
+	for index, record := range records {
+		report.Rows++
+		book, err := MARCToBook(record)
+		if err != nil {
+			report.addError(index+1, err)
+			continue
+		}
+		rows = append(rows, importRow{line: index + 1, book: book})
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // no-op once the transaction is committed
+
+	created := importBatch(tx, rows, report)
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	report.Created = created
+
+	return report, nil
+}
@@ -0,0 +1,155 @@
+package main_test
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"bookish"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// the MARC codec needs no database, so these tests run outside the suite
+
+func TestMARC21_RoundTrip(t *testing.T) {
+	// Setup
+	fixture, err := os.ReadFile("testdata/marc21.mrc")
+	require.NoError(t, err)
+
+	// Function to test
+	records, err := main.ReadMARC21(bytes.NewReader(fixture))
+	require.NoError(t, err)
+	var written bytes.Buffer
+	err = main.WriteMARC21(&written, records)
+
+	// Verification
+	require.NoError(t, err)
+	assert.Len(t, records, 2)
+	assert.Equal(t, fixture, written.Bytes())
+}
+
+func TestMARCXML_RoundTrip(t *testing.T) {
+	// Setup
+	fixture, err := os.ReadFile("testdata/marcxml.xml")
+	require.NoError(t, err)
+	binary, err := os.ReadFile("testdata/marc21.mrc")
+	require.NoError(t, err)
+	binaryRecords, err := main.ReadMARC21(bytes.NewReader(binary))
+	require.NoError(t, err)
+
+	// Function to test
+	records, err := main.ReadMARCXML(bytes.NewReader(fixture))
+	require.NoError(t, err)
+	var written bytes.Buffer
+	err = main.WriteMARCXML(&written, records)
+	require.NoError(t, err)
+	rereadRecords, err := main.ReadMARCXML(&written)
+
+	// Verification
+	require.NoError(t, err)
+	assert.Equal(t, records, rereadRecords)
+	// both fixtures hold the same records, only the lengths in the leaders differ
+	require.Len(t, records, len(binaryRecords))
+	for index := range records {
+		assert.Equal(t, binaryRecords[index].Fields, records[index].Fields)
+	}
+}
+
+func TestMARCToBook(t *testing.T) {
+	// Setup
+	fixture, err := os.ReadFile("testdata/marcxml.xml")
+	require.NoError(t, err)
+	records, err := main.ReadMARCXML(bytes.NewReader(fixture))
+	require.NoError(t, err)
+
+	// Function to test
+	hobbit, hobbitErr := main.MARCToBook(records[0])
+	omens, omensErr := main.MARCToBook(records[1])
+
+	// Verification
+	require.NoError(t, hobbitErr)
+	assert.Equal(t, "The hobbit, or, There and back again", *hobbit.Title)
+	assert.Equal(t, "Tolkien, J. R. R.", *hobbit.Author)
+	assert.Equal(t, "9780261102217", *hobbit.ISBN)
+	assert.Equal(t, 4, *hobbit.Edition)
+	assert.Equal(t, "George Allen & Unwin", *hobbit.Publisher)
+	assert.Equal(t, "1937", *hobbit.PublishedDate)
+
+	require.NoError(t, omensErr)
+	assert.Equal(t, "Good omens: the nice and accurate prophecies of Agnes Nutter, witch", *omens.Title)
+	assert.Equal(t, "Pratchett, Terry & Gaiman, Neil", *omens.Author)
+	assert.Equal(t, "057504800X", *omens.ISBN)
+	assert.Nil(t, omens.Edition) // "First edition" is not numbered
+	assert.Equal(t, "Gollancz", *omens.Publisher)
+	assert.Equal(t, "1990", *omens.PublishedDate)
+}
+
+func TestReadMARC21_InvalidDirectory(t *testing.T) {
+	// Setup
+	leader := "00000nam a2200037   4500"
+	for _, entry := range []string{"245-00100000", "2450001-0001", "245009900000"} {
+		record := leader + entry + "\x1e00ab\x1e\x1d"
+
+		// Function to test
+		_, err := main.ReadMARC21(strings.NewReader(record))
+
+		// Verification
+		assert.EqualError(t, err, "record 1: invalid directory entry for field 245", entry)
+	}
+}
+
+func TestMARCToBook_BlankISBN(t *testing.T) {
+	// Setup
+	record := main.MARCRecord{Fields: []main.MARCField{
+		{Tag: "020", Indicator1: " ", Indicator2: " ", Subfields: []main.MARCSubfield{{Code: "a", Value: " "}}},
+		{Tag: "245", Indicator1: "1", Indicator2: "0", Subfields: []main.MARCSubfield{{Code: "a", Value: "Mort"}}},
+	}}
+
+	// Function to test
+	book, err := main.MARCToBook(record)
+
+	// Verification
+	require.NoError(t, err)
+	assert.Equal(t, "Mort", *book.Title)
+	assert.Nil(t, book.ISBN)
+}
+
+func TestBookToMARC_RoundTrip(t *testing.T) {
+	// Setup
+	publishedDate := time.Date(1937, 9, 21, 0, 0, 0, 0, time.UTC)
+	edition := 2
+	book := main.Book{
+		BookID:        7,
+		Title:         "The Hobbit",
+		Author:        "Tolkien, J. R. R. & Anderson, Douglas A.",
+		ISBN:          "9780261102217",
+		PublishedDate: &publishedDate,
+		Edition:       &edition,
+		Publisher:     "George Allen & Unwin",
+		CreationDate:  time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC),
+	}
+
+	// Function to test
+	var written bytes.Buffer
+	err := main.WriteMARC21(&written, []main.MARCRecord{main.BookToMARC(book)})
+	require.NoError(t, err)
+	records, err := main.ReadMARC21(bytes.NewReader(written.Bytes()))
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	bookArgs, err := main.MARCToBook(records[0])
+
+	// Verification
+	require.NoError(t, err)
+	assert.Contains(t, written.String(), "\x1fbGeorge Allen & Unwin\x1fc1937\x1e")
+	assert.Equal(t, book.Title, *bookArgs.Title)
+	assert.Equal(t, book.Author, *bookArgs.Author)
+	assert.Equal(t, book.ISBN, *bookArgs.ISBN)
+	// 264 $c only holds the year, the month and day come back from 008
+	assert.Equal(t, "1937-09-21", *bookArgs.PublishedDate)
+	assert.Equal(t, edition, *bookArgs.Edition)
+	assert.Equal(t, book.Publisher, *bookArgs.Publisher)
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"flag"
+	"io"
 	"time"
 )
 
@@ -9,6 +10,24 @@ type Config struct {
 	Database struct {
 		URL string `yaml:"url"`
 	} `yaml:"database"`
+	Server struct {
+		Address     string `yaml:"address"`
+		APIToken    string `yaml:"api_token"`    // required from clients as a bearer token when set
+		LibraryRoot string `yaml:"library_root"` // only the ebook files under it are served
+	} `yaml:"server"`
+}
+
+// Profile is a bookish server that the CLI works with instead of the database.
+type Profile struct {
+	Name  string `yaml:"-"`
+	URL   string `yaml:"url"`
+	Token string `yaml:"token"`
+}
+
+// ProfileFile holds the profiles of the CLI and the one used when none is chosen.
+type ProfileFile struct {
+	Default  string             `yaml:"default"`
+	Profiles map[string]Profile `yaml:"profiles"`
 }
 
 type AuthorArgs struct {
@@ -25,12 +44,34 @@ type BookArgs struct {
 	BookID  *int    `json:"book_id"`
 	Title    *string `json:"title"`
 	Author *string `json:"author"`
+	ISBN          *string `json:"isbn"`
+	PublishedDate *string `json:"published_date"`
+	Edition       *int    `json:"edition"`
+	Publisher     *string `json:"publisher"`
+	PageCount     *int    `json:"page_count"`
+	CollectionID  *int    `json:"collection_id"`
+	Status        *string `json:"status"` // books with this reading status, for the user when one is set
+	User          *string `json:"user"`
+	Sort          *string `json:"sort"` // id, the default, or rating for the best rated books first
+	Tags          []string `json:"tags"`
+	TagMatch      *string  `json:"tag_match"` // all, the default, for the books with every tag, or any for those with one of them
+	Search        *string  `json:"search"`    // words found in the title, author or ISBN, ignoring case
+	Limit         *int     `json:"limit"`     // the most books listed, for pages of books
+	Offset        *int     `json:"offset"`    // the books skipped before the page
 }
 
 type Book struct {
 	BookID      int       `json:"book_id"`
 	Title        string    `json:"title"`
 	Author     string    `json:"author"`
+	ISBN          string     `json:"isbn,omitempty"`
+	PublishedDate *time.Time `json:"published_date,omitempty"`
+	Edition       *int       `json:"edition,omitempty"`
+	Publisher     string     `json:"publisher,omitempty"`
+	PageCount     *int       `json:"page_count,omitempty"`
+	AverageRating *float64   `json:"average_rating,omitempty"`
+	Ratings       int        `json:"ratings,omitempty"`
+	Tags          []string   `json:"tags,omitempty"`
 	CreationDate time.Time `json:"creation_date"`
 }
 
@@ -51,16 +92,451 @@ type AddBookToCollectionArgs struct {
 	CollectionID *int `json:"collection_id"`
 }
 
-// Command represents a command with its subcommands and associated flags.
+// ImportArgs holds the options of a CSV book import.
+type ImportArgs struct {
+	Columns   map[string]string // book field -> CSV header, unmapped fields use their own name
+	DryRun    bool
+	BatchSize int
+}
+
+// ImportRowError reports why a CSV row was not imported.
+type ImportRowError struct {
+	Row     int    `json:"row"`
+	Message string `json:"message"`
+}
+
+// ImportReport summarizes a CSV book import.
+type ImportReport struct {
+	DryRun  bool             `json:"dry_run"`
+	Rows    int              `json:"rows"`
+	Created int              `json:"created"`
+	Failed  int              `json:"failed"`
+	Errors  []ImportRowError `json:"errors"`
+}
+
+// ShelfImportEntry is a book of a Goodreads or StoryGraph export and what the import did with it.
+type ShelfImportEntry struct {
+	Row         int      `json:"row"`
+	BookID      int      `json:"book_id,omitempty"`
+	Title       string   `json:"title,omitempty"`
+	Author      string   `json:"author,omitempty"`
+	Collections []string `json:"collections,omitempty"`
+	Reason      string   `json:"reason,omitempty"`
+}
+
+// ShelfImportReport lists the books created, matched to existing books, or skipped by a shelf import.
+type ShelfImportReport struct {
+	Format  string             `json:"format"`
+	Created []ShelfImportEntry `json:"created"`
+	Matched []ShelfImportEntry `json:"matched"`
+	Skipped []ShelfImportEntry `json:"skipped"`
+}
+
+// ExportArgs selects the format of an export and optionally limits it to one collection.
+type ExportArgs struct {
+	Format       string
+	CollectionID *int
+}
+
+// BackupFile is the manifest entry of a file in a backup archive.
+type BackupFile struct {
+	SHA256  string `json:"sha256"`
+	Records int    `json:"records"`
+}
+
+// BackupManifest describes a backup archive and lets restore verify it.
+type BackupManifest struct {
+	Format    string                `json:"format"`
+	Version   int                   `json:"version"`
+	CreatedAt time.Time             `json:"created_at"`
+	Files     map[string]BackupFile `json:"files"`
+}
+
+// RestoreArgs selects whether a restore merges into or replaces the database.
+type RestoreArgs struct {
+	Mode string
+}
+
+// RestoreReport counts the records loaded by a restore.
+type RestoreReport struct {
+	Mode        string `json:"mode"`
+	Authors     int    `json:"authors"`
+	Books       int    `json:"books"`
+	Collections int    `json:"collections"`
+	Memberships int    `json:"memberships"`
+	Copies      int    `json:"copies"`
+	Users       int    `json:"users"`
+	Statuses    int    `json:"reading_statuses"`
+	Sessions    int    `json:"reading_sessions"`
+	Reviews     int    `json:"reviews"`
+	Notes       int    `json:"notes"`
+	Loans       int    `json:"loans"`
+	Wishes      int    `json:"wishes"`
+	Purchases   int    `json:"purchases"`
+	Tags        int    `json:"tags"`
+	BookTags    int    `json:"book_tags"`
+}
+
+// ReadingStatus is where a user is with a book: want-to-read, reading, read or abandoned.
+type ReadingStatus struct {
+	BookID       int        `json:"book_id"`
+	Title        string     `json:"title"`
+	User         string     `json:"user"`
+	Status       string     `json:"status"`
+	StartedDate  *time.Time `json:"started_date,omitempty"`
+	FinishedDate *time.Time `json:"finished_date,omitempty"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+}
+
+// ReadingStatusArgs sets or selects reading statuses, dates are written YYYY-MM-DD.
+type ReadingStatusArgs struct {
+	BookID       *int    `json:"book_id"`
+	User         *string `json:"user"`
+	Status       *string `json:"status"`
+	StartedDate  *string `json:"started_date"`
+	FinishedDate *string `json:"finished_date"`
+}
+
+// ReadingSession is a sitting with a book: the page or percentage reached, and how
+// many pages or minutes were read.
+type ReadingSession struct {
+	SessionID int       `json:"session_id"`
+	BookID    int       `json:"book_id"`
+	User      string    `json:"user"`
+	Date      time.Time `json:"date"`
+	Page      *int      `json:"page,omitempty"`
+	Percent   *float64  `json:"percent,omitempty"`
+	Pages     *int      `json:"pages,omitempty"`
+	Minutes   *int      `json:"minutes,omitempty"`
+}
+
+// ReadingSessionArgs logs a reading session, or selects the progress of a user with a
+// book. The date is written YYYY-MM-DD.
+type ReadingSessionArgs struct {
+	BookID  *int     `json:"book_id"`
+	User    *string  `json:"user"`
+	Date    *string  `json:"date"`
+	Page    *int     `json:"page"`
+	Percent *float64 `json:"percent"`
+	Pages   *int     `json:"pages"`
+	Minutes *int     `json:"minutes"`
+}
+
+// ReadingProgress is how far a user is with a book, with the pace of the sessions and
+// the day the book would be finished at that pace.
+type ReadingProgress struct {
+	BookID          int              `json:"book_id"`
+	Title           string           `json:"title"`
+	User            string           `json:"user"`
+	PageCount       *int             `json:"page_count,omitempty"`
+	CurrentPage     *int             `json:"current_page,omitempty"`
+	Percent         *float64         `json:"percent,omitempty"`
+	PagesRead       int              `json:"pages_read"`
+	MinutesRead     int              `json:"minutes_read"`
+	PagesPerDay     *float64         `json:"pages_per_day,omitempty"`
+	PagesPerHour    *float64         `json:"pages_per_hour,omitempty"`
+	EstimatedFinish *time.Time       `json:"estimated_finish,omitempty"`
+	Sessions        []ReadingSession `json:"sessions"`
+}
+
+// Review is the rating of a user for a book, in half stars, and what they wrote about
+// it in markdown. Either may be empty.
+type Review struct {
+	ReviewID  int       `json:"review_id"`
+	BookID    int       `json:"book_id"`
+	Title     string    `json:"title"`
+	User      string    `json:"user"`
+	Rating    *float64  `json:"rating,omitempty"`
+	Review    string    `json:"review,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// ReviewArgs writes or selects reviews, a user has one review per book.
+type ReviewArgs struct {
+	ReviewID *int     `json:"review_id"`
+	BookID   *int     `json:"book_id"`
+	User     *string  `json:"user"`
+	Rating   *float64 `json:"rating"`
+	Review   *string  `json:"review"`
+}
+
+// Note is a note, quote or highlight of a book, with where it is in the book and its tags.
+type Note struct {
+	NoteID       int       `json:"note_id"`
+	BookID       int       `json:"book_id"`
+	Title        string    `json:"title"`
+	User         string    `json:"user,omitempty"`
+	Kind         string    `json:"kind"`
+	Text         string    `json:"text"`
+	Page         *int      `json:"page,omitempty"`
+	Location     string    `json:"location,omitempty"`
+	Tags         []string  `json:"tags"`
+	CreationDate time.Time `json:"creation_date"`
+}
+
+// NoteArgs writes or selects notes. Selected notes have all the tags, and the search
+// text somewhere in their text.
+type NoteArgs struct {
+	NoteID   *int     `json:"note_id"`
+	BookID   *int     `json:"book_id"`
+	User     *string  `json:"user"`
+	Kind     *string  `json:"kind"`
+	Text     *string  `json:"text"`
+	Page     *int     `json:"page"`
+	Location *string  `json:"location"`
+	Tags     []string `json:"tags"`
+	Search   *string  `json:"search"`
+}
+
+// Copy is a copy of a book that we own. Physical copies are located by their shelf, ebook
+// copies by the path of their file. Borrower is who has the copy when it is lent.
+type Copy struct {
+	CopyID       int        `json:"copy_id"`
+	BookID       int        `json:"book_id"`
+	Title        string     `json:"title,omitempty"`
+	Format       string     `json:"format"`
+	Condition    string     `json:"condition,omitempty"`
+	Location     string     `json:"location"`
+	AcquiredDate *time.Time `json:"acquired_date,omitempty"`
+	Price        *float64   `json:"price,omitempty"`
+	Borrower     string     `json:"borrower,omitempty"`
+	CreationDate time.Time  `json:"creation_date"`
+}
+
+// CopyArgs creates, changes or selects copies, the acquired date is written YYYY-MM-DD.
+type CopyArgs struct {
+	CopyID       *int     `json:"copy_id"`
+	BookID       *int     `json:"book_id"`
+	Title        *string  `json:"title"` // copies of the books whose title has this text, ignoring case
+	Format       *string  `json:"format"`
+	Condition    *string  `json:"condition"`
+	Location     *string  `json:"location"`
+	AcquiredDate *string  `json:"acquired_date"`
+	Price        *float64 `json:"price"`
+}
+
+// Wish is a book on the wishlist, one we do not own yet. Edition is the edition we would
+// like, such as "first edition" or "hardcover".
+type Wish struct {
+	WishID       int       `json:"wish_id"`
+	Title        string    `json:"title"`
+	Author       string    `json:"author"`
+	ISBN         string    `json:"isbn,omitempty"`
+	Edition      string    `json:"edition,omitempty"`
+	Priority     string    `json:"priority"`
+	Notes        string    `json:"notes,omitempty"`
+	CreationDate time.Time `json:"creation_date"`
+}
+
+// WishArgs creates, changes or selects wishes.
+type WishArgs struct {
+	WishID   *int    `json:"wish_id"`
+	Title    *string `json:"title"`
+	Author   *string `json:"author"`
+	ISBN     *string `json:"isbn"`
+	Edition  *string `json:"edition"`
+	Priority *string `json:"priority"`
+	Notes    *string `json:"notes"`
+}
+
+// AcquireArgs turn a wish into an owned book: the format and location of the copy bought,
+// and where, when and for how much it was bought. The date is written YYYY-MM-DD.
+type AcquireArgs struct {
+	WishID   *int     `json:"wish_id"`
+	Format   *string  `json:"format"`
+	Location *string  `json:"location"`
+	Store    *string  `json:"store"`
+	Price    *float64 `json:"price"`
+	Currency *string  `json:"currency"`
+	Date     *string  `json:"date"`
+}
+
+// Acquisition is the book a wish became, with its copy when a format was set and its
+// purchase when a price was set.
+type Acquisition struct {
+	Book     Book      `json:"book"`
+	Copy     *Copy     `json:"copy,omitempty"`
+	Purchase *Purchase `json:"purchase,omitempty"`
+}
+
+// Purchase is what a book, or one of its copies, was bought for. Currency is an ISO 4217
+// code such as EUR.
+type Purchase struct {
+	PurchaseID   int       `json:"purchase_id"`
+	BookID       int       `json:"book_id"`
+	Title        string    `json:"title"`
+	CopyID       *int      `json:"copy_id,omitempty"`
+	Store        string    `json:"store,omitempty"`
+	Price        float64   `json:"price"`
+	Currency     string    `json:"currency"`
+	PurchaseDate time.Time `json:"purchase_date"`
+}
+
+// PurchaseArgs records or selects purchases, dates are written YYYY-MM-DD. From and To
+// select the purchases made between the two days, both included.
+type PurchaseArgs struct {
+	PurchaseID   *int     `json:"purchase_id"`
+	BookID       *int     `json:"book_id"`
+	CopyID       *int     `json:"copy_id"`
+	Store        *string  `json:"store"`
+	Price        *float64 `json:"price"`
+	Currency     *string  `json:"currency"`
+	PurchaseDate *string  `json:"purchase_date"`
+	From         *string  `json:"from"`
+	To           *string  `json:"to"`
+}
+
+// MonthlySpending is what was spent on books in a month, YYYY-MM, in one currency.
+type MonthlySpending struct {
+	Month     string  `json:"month"`
+	Currency  string  `json:"currency"`
+	Purchases int     `json:"purchases"`
+	Total     float64 `json:"total"`
+}
+
+// Tag is a lightweight label of books, such as a genre, a subject or a mood. Kind tells
+// which one it is when it was set, Books counts the books that have the tag.
+type Tag struct {
+	TagID        int       `json:"tag_id"`
+	Name         string    `json:"name"`
+	Kind         string    `json:"kind,omitempty"`
+	Books        int       `json:"books"`
+	CreationDate time.Time `json:"creation_date"`
+}
+
+// TagArgs creates, changes or selects tags.
+type TagArgs struct {
+	TagID  *int    `json:"tag_id"`
+	Name   *string `json:"name"`
+	Kind   *string `json:"kind"`
+	BookID *int    `json:"book_id"` // the tags of this book
+	Sort   *string `json:"sort"`    // name, the default, or books for the most used tags first
+}
+
+// BookTagsArgs adds tags to a book or removes them, missing tags are created when added.
+type BookTagsArgs struct {
+	BookID *int     `json:"book_id"`
+	Tags   []string `json:"tags"`
+}
+
+// Loan is a copy of a book lent to a borrower. Books without recorded copies are lent
+// as a whole, with no copy.
+type Loan struct {
+	LoanID       int        `json:"loan_id"`
+	BookID       int        `json:"book_id"`
+	Title        string     `json:"title"`
+	CopyID       *int       `json:"copy_id,omitempty"`
+	Borrower     string     `json:"borrower"`
+	LentDate     time.Time  `json:"lent_date"`
+	DueDate      *time.Time `json:"due_date,omitempty"`
+	ReturnedDate *time.Time `json:"returned_date,omitempty"`
+	Overdue      bool       `json:"overdue"`
+}
+
+// LoanArgs lends, returns or selects loans, dates are written YYYY-MM-DD.
+type LoanArgs struct {
+	LoanID       *int    `json:"loan_id"`
+	BookID       *int    `json:"book_id"`
+	CopyID       *int    `json:"copy_id"`
+	Borrower     *string `json:"borrower"`
+	LentDate     *string `json:"lent_date"`
+	DueDate      *string `json:"due_date"`
+	ReturnedDate *string `json:"returned_date"`
+	Returned     *bool   `json:"returned"` // the returned loans, or those still out when false
+	Overdue      bool    `json:"overdue"`
+}
+
+// FileMetadata is the metadata read from an EPUB package document or a PDF information dictionary.
+type FileMetadata struct {
+	Path        string   `json:"path"`
+	Format      string   `json:"format"`
+	Title       string   `json:"title"`
+	Authors     []string `json:"authors"`
+	Identifiers []string `json:"identifiers"`
+	ISBN        string   `json:"isbn,omitempty"`
+	Language    string   `json:"language,omitempty"`
+	Publisher   string   `json:"publisher,omitempty"`
+	Date        string   `json:"date,omitempty"`
+}
+
+// ScanArgs tells whether scanned files are recorded as ebook copies of their books.
+type ScanArgs struct {
+	RecordCopy bool
+}
+
+// ScanEntry is a scanned file and the book it was created as or matched to.
+type ScanEntry struct {
+	Path     string        `json:"path"`
+	BookID   int           `json:"book_id,omitempty"`
+	CopyID   int           `json:"copy_id,omitempty"`
+	Metadata *FileMetadata `json:"metadata,omitempty"`
+	Reason   string        `json:"reason,omitempty"`
+}
+
+// ScanReport lists the files whose books were created, matched to existing books, or skipped.
+type ScanReport struct {
+	Created []ScanEntry `json:"created"`
+	Matched []ScanEntry `json:"matched"`
+	Skipped []ScanEntry `json:"skipped"`
+}
+
+// CalibreBook is a book of a Calibre library, with its rating in stars out of five.
+type CalibreBook struct {
+	ID            int               `json:"id"`
+	Title         string            `json:"title"`
+	Authors       []string          `json:"authors"`
+	Series        string            `json:"series,omitempty"`
+	SeriesIndex   float64           `json:"series_index,omitempty"`
+	Tags          []string          `json:"tags"`
+	Identifiers   map[string]string `json:"identifiers"`
+	Rating        int               `json:"rating,omitempty"`
+	Publisher     string            `json:"publisher,omitempty"`
+	PublishedDate string            `json:"published_date,omitempty"`
+	Path          string            `json:"path"`
+}
+
+// MARCRecord is a MARC21 bibliographic record, read from or written to binary MARC or MARCXML.
+type MARCRecord struct {
+	Leader string
+	Fields []MARCField
+}
+
+// MARCField is a control field (tags 001 to 009) with a value, or a data field with indicators and subfields.
+type MARCField struct {
+	Tag        string
+	Value      string
+	Indicator1 string
+	Indicator2 string
+	Subfields  []MARCSubfield
+}
+
+// MARCSubfield is a coded part of a data field, such as $a.
+type MARCSubfield struct {
+	Code  string
+	Value string
+}
+
+// Command is a command of the CLI. It groups subcommands, or runs on its own with its
+// flags when it has none, like export.
 type Command struct {
 	name        string
 	description string
 	subcommands []*Subcommand
+	flags       *flag.FlagSet
+	arguments   string // positional arguments shown in the usage, such as "<dir>"
+	values      map[string]flagValues // how flag values are completed, "" for the arguments
+	hidden      bool                  // left out of the help, for commands run by scripts
+	run         func(out io.Writer, args []string) error
 }
 
-// Subcommand represents a subcommand with its associated flags.
+// Subcommand represents a subcommand with its associated flags. Its run function gets
+// the positional arguments left after the flags.
 type Subcommand struct {
 	name        string
 	description string
 	flags       *flag.FlagSet
+	arguments   string
+	values      map[string]flagValues
+	run         func(out io.Writer, args []string) error
 }
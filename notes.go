@@ -0,0 +1,276 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// noteKinds are what a note can be: a note of the reader, a quote of the book, or a highlight
+var noteKinds = []string{"note", "quote", "highlight"}
+
+func checkNoteKind(kind string) error {
+	for _, known := range noteKinds {
+		if kind == known {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid kind %s, expected note, quote or highlight", kind)
+}
+
+// likeEscaper escapes the wildcards of a LIKE pattern, so searched text is matched as it is
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// CreateNote attaches a note, quote or highlight to a book. The page, the location, such
+// as a chapter or an ebook position, the user and the tags are optional.
+func CreateNote(db *sql.DB, n NoteArgs) (*Note, error) {
+	if n.BookID == nil {
+		return nil, errors.New("choose the book and insert its ID number")
+	}
+	if n.Text == nil || strings.TrimSpace(*n.Text) == "" {
+		return nil, errors.New("no note text set, note not created")
+	}
+	kind := "note"
+	if n.Kind != nil && *n.Kind != "" {
+		kind = *n.Kind
+	}
+	err := checkNoteKind(kind)
+	if err != nil {
+		return nil, err
+	}
+	if n.Page != nil && *n.Page < 1 {
+		return nil, fmt.Errorf("invalid page %d, pages start at 1", *n.Page)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // no-op once the transaction is committed
+
+	// check if there is a book with the chosen ID
+	_, err = listBooks(tx, BookArgs{BookID: n.BookID})
+	if err != nil {
+		return nil, err
+	}
+	var userID *int
+	if n.User != nil && strings.TrimSpace(*n.User) != "" {
+		id, err := upsertUser(tx, n.User)
+		if err != nil {
+			return nil, err
+		}
+		userID = &id
+	}
+
+	var noteID int
+	err = tx.QueryRow("INSERT INTO notes (book_id, user_id, kind, text, page, location, tags) VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), $7) RETURNING note_id",
+		*n.BookID, userID, kind, strings.TrimSpace(*n.Text), n.Page, n.Location, pq.Array(SanitizeTags(n.Tags))).Scan(&noteID)
+	if err != nil {
+		return nil, err
+	}
+
+	notes, err := listNotes(tx, NoteArgs{NoteID: &noteID})
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return &notes[0], nil
+}
+
+// UpdateNote changes the fields of a note that are set in n, the note is chosen by its
+// ID. A page of 0 or an empty location clears them, and tags replace the tags of the note.
+func UpdateNote(db *sql.DB, n NoteArgs) (*Note, error) {
+	if n.NoteID == nil {
+		return nil, errors.New("choose the note to update and insert its ID number")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // no-op once the transaction is committed
+
+	// check if there is a note with the chosen ID
+	_, err = listNotes(tx, NoteArgs{NoteID: n.NoteID})
+	if err != nil {
+		return nil, err
+	}
+
+	sets := []string{}
+	params := []any{}
+	set := func(column string, value any) {
+		params = append(params, value)
+		sets = append(sets, fmt.Sprintf("%s = $%d", column, len(params)))
+	}
+	if n.Text != nil {
+		if strings.TrimSpace(*n.Text) == "" {
+			return nil, errors.New("no note text set, note not updated")
+		}
+		set("text", strings.TrimSpace(*n.Text))
+	}
+	if n.Kind != nil {
+		err := checkNoteKind(*n.Kind)
+		if err != nil {
+			return nil, err
+		}
+		set("kind", *n.Kind)
+	}
+	if n.Page != nil {
+		switch {
+		case *n.Page < 0:
+			return nil, fmt.Errorf("invalid page %d, pages start at 1", *n.Page)
+		case *n.Page == 0:
+			set("page", nil)
+		default:
+			set("page", *n.Page)
+		}
+	}
+	if n.Location != nil {
+		set("location", optionalValue(*n.Location))
+	}
+	if n.Tags != nil {
+		set("tags", pq.Array(SanitizeTags(n.Tags)))
+	}
+
+	if len(sets) > 0 {
+		params = append(params, *n.NoteID)
+		_, err = tx.Exec(fmt.Sprintf("UPDATE notes SET %s WHERE note_id = $%d", strings.Join(sets, ", "), len(params)), params...)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	notes, err := listNotes(tx, NoteArgs{NoteID: n.NoteID})
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return &notes[0], nil
+}
+
+// DeleteNote removes the note chosen by its ID and returns it
+func DeleteNote(db *sql.DB, n NoteArgs) (*Note, error) {
+	if n.NoteID == nil {
+		return nil, errors.New("choose the note to delete and insert its ID number")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // no-op once the transaction is committed
+
+	notes, err := listNotes(tx, NoteArgs{NoteID: n.NoteID})
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec("DELETE FROM notes WHERE note_id = $1", *n.NoteID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return &notes[0], nil
+}
+
+// ListNotes lists the notes of a book, a user, a kind or a tag, and those with the
+// searched text, ignoring case. Notes are in the order of the book.
+func ListNotes(db *sql.DB, n NoteArgs) ([]Note, error) {
+	return listNotes(db, n)
+}
+
+func listNotes(q querier, n NoteArgs) ([]Note, error) {
+	notes := []Note{}
+
+	query := `
+		SELECT notes.note_id, notes.book_id, books.title, users.name, notes.kind, notes.text,
+		       notes.page, notes.location, notes.tags, notes.creation_date
+		FROM notes
+		JOIN books ON notes.book_id = books.book_id
+		LEFT JOIN users ON notes.user_id = users.user_id
+		`
+
+	whereClauses := []string{}
+	params := []any{}
+	bind := func(value any) string {
+		params = append(params, value)
+		return fmt.Sprintf("$%d", len(params))
+	}
+	if n.NoteID != nil {
+		whereClauses = append(whereClauses, "notes.note_id = "+bind(*n.NoteID))
+	}
+	if n.BookID != nil {
+		whereClauses = append(whereClauses, "notes.book_id = "+bind(*n.BookID))
+	}
+	if n.User != nil {
+		whereClauses = append(whereClauses, "users.name = "+bind(strings.TrimSpace(*n.User)))
+	}
+	if n.Kind != nil {
+		err := checkNoteKind(*n.Kind)
+		if err != nil {
+			return nil, err
+		}
+		whereClauses = append(whereClauses, "notes.kind = "+bind(*n.Kind))
+	}
+	for _, tag := range SanitizeTags(n.Tags) {
+		whereClauses = append(whereClauses, bind(tag)+" = ANY(notes.tags)")
+	}
+	if n.Search != nil && strings.TrimSpace(*n.Search) != "" {
+		whereClauses = append(whereClauses, "notes.text ILIKE '%' || "+bind(likeEscaper.Replace(strings.TrimSpace(*n.Search)))+" || '%'")
+	}
+	if len(whereClauses) > 0 {
+		query += "WHERE " + strings.Join(whereClauses, " AND ")
+	}
+	query += " ORDER BY notes.book_id, notes.page NULLS LAST, notes.note_id"
+
+	rows, err := q.Query(query, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var note Note
+		var user, location sql.NullString
+		var page sql.NullInt64
+		err := rows.Scan(&note.NoteID, &note.BookID, &note.Title, &user, &note.Kind, &note.Text, &page, &location, pq.Array(&note.Tags), &note.CreationDate)
+		if err != nil {
+			return nil, err
+		}
+		note.User = user.String
+		if page.Valid {
+			notePage := int(page.Int64)
+			note.Page = &notePage
+		}
+		note.Location = location.String
+		if note.Tags == nil {
+			note.Tags = []string{}
+		}
+		notes = append(notes, note)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(notes) == 0 {
+		return nil, errors.New("no notes with the chosen specification")
+	}
+	return notes, nil
+}
@@ -0,0 +1,590 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// OPDS 1.2 catalog, an Atom feed e-reader apps can browse. The root and the collection
+// and author lists are navigation feeds, the lists of books are paginated acquisition feeds
+// where each ebook copy of a book can be downloaded.
+const (
+	opdsNavigationType  = "application/atom+xml;profile=opds-catalog;kind=navigation"
+	opdsAcquisitionType = "application/atom+xml;profile=opds-catalog;kind=acquisition"
+	opdsSearchType      = "application/opensearchdescription+xml"
+	opdsAcquisitionRel  = "http://opds-spec.org/acquisition"
+	opdsPageSize        = 25
+)
+
+// opdsFileTypes are the media types of the ebook files offered for download
+var opdsFileTypes = map[string]string{
+	".epub": "application/epub+zip",
+	".pdf":  "application/pdf",
+}
+
+// opdsFileType is the media type of an ebook file, read from its extension
+func opdsFileType(location string) string {
+	if fileType, ok := opdsFileTypes[strings.ToLower(filepath.Ext(location))]; ok {
+		return fileType
+	}
+	return "application/octet-stream"
+}
+
+type opdsFeed struct {
+	XMLName         xml.Name    `xml:"feed"`
+	Xmlns           string      `xml:"xmlns,attr"`
+	XmlnsDC         string      `xml:"xmlns:dc,attr"`
+	XmlnsOPDS       string      `xml:"xmlns:opds,attr"`
+	XmlnsOpenSearch string      `xml:"xmlns:opensearch,attr"`
+	ID              string      `xml:"id"`
+	Title           string      `xml:"title"`
+	Updated         string      `xml:"updated"`
+	Author          opdsAuthor  `xml:"author"`
+	Links           []opdsLink  `xml:"link"`
+	TotalResults    *int        `xml:"opensearch:totalResults,omitempty"`
+	ItemsPerPage    *int        `xml:"opensearch:itemsPerPage,omitempty"`
+	StartIndex      *int        `xml:"opensearch:startIndex,omitempty"`
+	Entries         []opdsEntry `xml:"entry"`
+}
+
+type opdsAuthor struct {
+	Name string `xml:"name"`
+}
+
+type opdsLink struct {
+	Rel   string `xml:"rel,attr,omitempty"`
+	Href  string `xml:"href,attr"`
+	Type  string `xml:"type,attr,omitempty"`
+	Title string `xml:"title,attr,omitempty"`
+}
+
+type opdsContent struct {
+	Type string `xml:"type,attr"`
+	Text string `xml:",chardata"`
+}
+
+type opdsEntry struct {
+	Title      string       `xml:"title"`
+	ID         string       `xml:"id"`
+	Updated    string       `xml:"updated"`
+	Authors    []opdsAuthor `xml:"author"`
+	Identifier string       `xml:"dc:identifier,omitempty"`
+	Publisher  string       `xml:"dc:publisher,omitempty"`
+	Issued     string       `xml:"dc:issued,omitempty"`
+	Content    *opdsContent `xml:"content"`
+	Links      []opdsLink   `xml:"link"`
+}
+
+type opdsSearchDescription struct {
+	XMLName     xml.Name      `xml:"http://a9.com/-/spec/opensearch/1.1/ OpenSearchDescription"`
+	ShortName   string        `xml:"ShortName"`
+	Description string        `xml:"Description"`
+	URL         opdsSearchURL `xml:"Url"`
+}
+
+type opdsSearchURL struct {
+	Type     string `xml:"type,attr"`
+	Template string `xml:"template,attr"`
+}
+
+func newOPDSFeed(id string, title string, self string, kind string) *opdsFeed {
+	return &opdsFeed{
+		Xmlns:           "http://www.w3.org/2005/Atom",
+		XmlnsDC:         "http://purl.org/dc/terms/",
+		XmlnsOPDS:       "http://opds-spec.org/2010/catalog",
+		XmlnsOpenSearch: "http://a9.com/-/spec/opensearch/1.1/",
+		ID:              "urn:bookish:" + id,
+		Title:           title,
+		Updated:         opdsTime(time.Now()),
+		Author:          opdsAuthor{Name: "Bookish"},
+		Links: []opdsLink{
+			{Rel: "self", Href: self, Type: kind},
+			{Rel: "start", Href: "/opds", Type: opdsNavigationType},
+			{Rel: "search", Href: "/opds/opensearch.xml", Type: opdsSearchType},
+		},
+		Entries: []opdsEntry{},
+	}
+}
+
+func opdsTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// navigationEntry links to another feed of the catalog
+func navigationEntry(id string, title string, content string, href string, kind string, updated time.Time) opdsEntry {
+	return opdsEntry{
+		Title:   title,
+		ID:      "urn:bookish:" + id,
+		Updated: opdsTime(updated),
+		Content: &opdsContent{Type: "text", Text: content},
+		Links:   []opdsLink{{Rel: "subsection", Href: href, Type: kind}},
+	}
+}
+
+// bookEntry describes a book with Atom and Dublin Core elements, co-authors are listed
+// separately. Each ebook copy is an acquisition link to its file.
+func bookEntry(book Book, ebooks []Copy) opdsEntry {
+	entry := opdsEntry{
+		Title:     book.Title,
+		ID:        fmt.Sprintf("urn:bookish:book:%d", book.BookID),
+		Updated:   opdsTime(book.CreationDate),
+		Publisher: book.Publisher,
+		Issued:    formatPublishedDate(book),
+		Links:     []opdsLink{},
+	}
+	for _, author := range bookAuthors(book) {
+		entry.Authors = append(entry.Authors, opdsAuthor{Name: author})
+	}
+	if book.ISBN != "" {
+		entry.Identifier = "urn:isbn:" + book.ISBN
+	}
+	if book.Edition != nil {
+		entry.Content = &opdsContent{Type: "text", Text: fmt.Sprintf("Edition %d", *book.Edition)}
+	}
+	for _, ebook := range ebooks {
+		entry.Links = append(entry.Links, opdsLink{
+			Rel:   opdsAcquisitionRel,
+			Href:  fmt.Sprintf("/opds/copies/%d/file", ebook.CopyID),
+			Type:  opdsFileType(ebook.Location),
+			Title: filepath.Base(ebook.Location),
+		})
+	}
+	return entry
+}
+
+// opdsPage is the page number of the request, the first page when none is set
+func opdsPage(r *http.Request) (int, error) {
+	value := r.URL.Query().Get("page")
+	if value == "" {
+		return 1, nil
+	}
+	page, err := strconv.Atoi(value)
+	if err != nil || page < 1 {
+		return 0, errors.New("invalid page number")
+	}
+	return page, nil
+}
+
+// pageLinks adds the OpenSearch counts of a feed of total entries and the links to the
+// first, last and neighbouring pages, it returns the offset of the entries of the page
+func (feed *opdsFeed) pageLinks(r *http.Request, page int, total int, kind string) int {
+	lastPage := (total + opdsPageSize - 1) / opdsPageSize
+	if lastPage == 0 {
+		lastPage = 1
+	}
+
+	pageLink := func(rel string, number int) opdsLink {
+		query := r.URL.Query()
+		query.Set("page", strconv.Itoa(number))
+		return opdsLink{Rel: rel, Href: r.URL.Path + "?" + query.Encode(), Type: kind}
+	}
+	feed.Links = append(feed.Links, pageLink("first", 1), pageLink("last", lastPage))
+	if page > 1 {
+		feed.Links = append(feed.Links, pageLink("previous", page-1))
+	}
+	if page < lastPage {
+		feed.Links = append(feed.Links, pageLink("next", page+1))
+	}
+
+	offset := (page - 1) * opdsPageSize
+	itemsPerPage, startIndex := opdsPageSize, offset+1
+	feed.TotalResults, feed.ItemsPerPage, feed.StartIndex = &total, &itemsPerPage, &startIndex
+	return offset
+}
+
+// paginate adds the entries of a page of the books selected by args to an acquisition
+// feed, only the books of the page are read from the database
+func (feed *opdsFeed) paginate(r *http.Request, page int, args BookArgs) error {
+	total, err := countBooks(db, args)
+	if err != nil {
+		return err
+	}
+	offset := feed.pageLinks(r, page, total, opdsAcquisitionType)
+
+	limit := opdsPageSize
+	args.Limit, args.Offset = &limit, &offset
+	books, err := opdsBooks(args)
+	if err != nil {
+		return err
+	}
+	ebooks, err := opdsEbooks(books)
+	if err != nil {
+		return err
+	}
+	for _, book := range books {
+		feed.Entries = append(feed.Entries, bookEntry(book, ebooks[book.BookID]))
+	}
+	return nil
+}
+
+func writeOPDS(w http.ResponseWriter, contentType string, document any) {
+	content, err := xml.MarshalIndent(document, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(xml.Header))
+	w.Write(content)
+}
+
+// opdsBooks lists the books of a feed, an empty catalog is an empty feed rather than an error
+func opdsBooks(args BookArgs) ([]Book, error) {
+	books, err := ListBooks(db, args)
+	if errors.Is(err, errNoBooks) {
+		return []Book{}, nil
+	}
+	return books, err
+}
+
+// libraryFile resolves the location of an ebook copy to its file under the library root
+// of the configuration. Symbolic links are followed before the file is checked to be
+// under the root, so neither ".." nor a link can reach other files of the server.
+func libraryFile(location string) (string, error) {
+	if config == nil || config.Server.LibraryRoot == "" {
+		return "", errors.New("no library root is set for ebook files")
+	}
+	if !filepath.IsAbs(location) {
+		return "", fmt.Errorf("the ebook file %s is not an absolute path", location)
+	}
+	root, err := filepath.Abs(config.Server.LibraryRoot)
+	if err != nil {
+		return "", err
+	}
+	root, err = filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	path, err := filepath.EvalSymlinks(filepath.Clean(location))
+	if err != nil {
+		return "", err
+	}
+
+	relative, err := filepath.Rel(root, path)
+	if err != nil || relative == ".." || strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("the ebook file %s is outside the library root", location)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("the ebook file %s is not a file", location)
+	}
+	return path, nil
+}
+
+// opdsEbooks reads the ebook copies of the books that have a file in the library, by book
+func opdsEbooks(books []Book) (map[int][]Copy, error) {
+	ebooks := map[int][]Copy{}
+	if len(books) == 0 {
+		return ebooks, nil
+	}
+	bookIDs := []int64{}
+	for _, book := range books {
+		bookIDs = append(bookIDs, int64(book.BookID))
+	}
+
+	rows, err := db.Query("SELECT copy_id, book_id, location FROM copies WHERE format = 'ebook' AND location IS NOT NULL AND book_id = ANY($1) ORDER BY copy_id", pq.Array(bookIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		ebook := Copy{Format: "ebook"}
+		err := rows.Scan(&ebook.CopyID, &ebook.BookID, &ebook.Location)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := libraryFile(ebook.Location); err != nil {
+			continue
+		}
+		ebooks[ebook.BookID] = append(ebooks[ebook.BookID], ebook)
+	}
+	return ebooks, rows.Err()
+}
+
+// opdsAuthorBooks is an author of the authors feed along with the number of their books
+type opdsAuthorBooks struct {
+	Author
+	Books int
+}
+
+// opdsAuthors reads a page of the authors who have books, sorted by name, and the number
+// of such authors
+func opdsAuthors(limit int, offset int) ([]opdsAuthorBooks, int, error) {
+	var total int
+	err := db.QueryRow("SELECT COUNT(DISTINCT author_id) FROM books").Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := db.Query(`
+		SELECT authors.author_id, authors.name, authors.creation_date, COUNT(*)
+		FROM authors
+		JOIN books ON books.author_id = authors.author_id
+		GROUP BY authors.author_id
+		ORDER BY LOWER(authors.name), authors.author_id
+		LIMIT $1 OFFSET $2`, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	authors := []opdsAuthorBooks{}
+	for rows.Next() {
+		var author opdsAuthorBooks
+		err := rows.Scan(&author.AuthorID, &author.Name, &author.CreationDate, &author.Books)
+		if err != nil {
+			return nil, 0, err
+		}
+		authors = append(authors, author)
+	}
+	return authors, total, rows.Err()
+}
+
+func OPDSRootHandler(w http.ResponseWriter, r *http.Request) {
+	feed := newOPDSFeed("root", "Bookish catalog", "/opds", opdsNavigationType)
+	now := time.Now()
+	feed.Entries = append(feed.Entries,
+		navigationEntry("books", "All books", "Every book of the catalog", "/opds/books", opdsAcquisitionType, now),
+		navigationEntry("collections", "Collections", "Books by collection", "/opds/collections", opdsNavigationType, now),
+		navigationEntry("authors", "Authors", "Books by author", "/opds/authors", opdsNavigationType, now),
+	)
+
+	writeOPDS(w, opdsNavigationType, feed)
+}
+
+func OPDSBooksHandler(w http.ResponseWriter, r *http.Request) {
+	page, err := opdsPage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	feed := newOPDSFeed("books", "All books", r.URL.RequestURI(), opdsAcquisitionType)
+	feed.Links = append(feed.Links, opdsLink{Rel: "up", Href: "/opds", Type: opdsNavigationType})
+	err = feed.paginate(r, page, BookArgs{})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeOPDS(w, opdsAcquisitionType, feed)
+}
+
+func OPDSCollectionsHandler(w http.ResponseWriter, r *http.Request) {
+	feed := newOPDSFeed("collections", "Collections", "/opds/collections", opdsNavigationType)
+	feed.Links = append(feed.Links, opdsLink{Rel: "up", Href: "/opds", Type: opdsNavigationType})
+
+	collections, err := ListCollections(db, CollectionArgs{})
+	if err != nil && !errors.Is(err, errNoCollections) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, collection := range collections {
+		feed.Entries = append(feed.Entries, navigationEntry(
+			fmt.Sprintf("collection:%d", collection.CollectionID),
+			collection.CollectionName,
+			fmt.Sprintf("%d books", len(collection.CollectionBooks)),
+			fmt.Sprintf("/opds/collections/%d", collection.CollectionID),
+			opdsAcquisitionType,
+			collection.CreationDate,
+		))
+	}
+
+	writeOPDS(w, opdsNavigationType, feed)
+}
+
+func OPDSCollectionBooksHandler(w http.ResponseWriter, r *http.Request) {
+	collectionIDStr := mux.Vars(r)["collection_id"]
+	collectionID, err := SanitizeIdNumber(&collectionIDStr)
+	if err != nil {
+		http.Error(w, "Invalid collection ID", http.StatusBadRequest)
+		return
+	}
+	page, err := opdsPage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	collections, err := ListCollections(db, CollectionArgs{CollectionID: collectionID})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	feed := newOPDSFeed(fmt.Sprintf("collection:%d", *collectionID), collections[0].CollectionName, r.URL.RequestURI(), opdsAcquisitionType)
+	feed.Links = append(feed.Links, opdsLink{Rel: "up", Href: "/opds/collections", Type: opdsNavigationType})
+	err = feed.paginate(r, page, BookArgs{CollectionID: collectionID})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeOPDS(w, opdsAcquisitionType, feed)
+}
+
+func OPDSAuthorsHandler(w http.ResponseWriter, r *http.Request) {
+	page, err := opdsPage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	feed := newOPDSFeed("authors", "Authors", r.URL.RequestURI(), opdsNavigationType)
+	feed.Links = append(feed.Links, opdsLink{Rel: "up", Href: "/opds", Type: opdsNavigationType})
+
+	// only authors with books are listed, sorted by name
+	authors, total, err := opdsAuthors(opdsPageSize, (page-1)*opdsPageSize)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	feed.pageLinks(r, page, total, opdsNavigationType)
+	for _, author := range authors {
+		feed.Entries = append(feed.Entries, navigationEntry(
+			fmt.Sprintf("author:%d", author.AuthorID),
+			author.Name,
+			fmt.Sprintf("%d books", author.Books),
+			fmt.Sprintf("/opds/authors/%d", author.AuthorID),
+			opdsAcquisitionType,
+			author.CreationDate,
+		))
+	}
+
+	writeOPDS(w, opdsNavigationType, feed)
+}
+
+func OPDSAuthorBooksHandler(w http.ResponseWriter, r *http.Request) {
+	authorIDStr := mux.Vars(r)["author_id"]
+	authorID, err := SanitizeIdNumber(&authorIDStr)
+	if err != nil {
+		http.Error(w, "Invalid author ID", http.StatusBadRequest)
+		return
+	}
+	page, err := opdsPage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var name string
+	err = db.QueryRow("SELECT name FROM authors WHERE author_id = $1", *authorID).Scan(&name)
+	if err == sql.ErrNoRows {
+		http.Error(w, "no authors with the chosen specification", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	feed := newOPDSFeed(fmt.Sprintf("author:%d", *authorID), name, r.URL.RequestURI(), opdsAcquisitionType)
+	feed.Links = append(feed.Links, opdsLink{Rel: "up", Href: "/opds/authors", Type: opdsNavigationType})
+	err = feed.paginate(r, page, BookArgs{Author: &name})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeOPDS(w, opdsAcquisitionType, feed)
+}
+
+// OPDSSearchHandler matches the terms against titles, authors and ISBNs, ignoring case
+func OPDSSearchHandler(w http.ResponseWriter, r *http.Request) {
+	terms := r.URL.Query().Get("q")
+	page, err := opdsPage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	feed := newOPDSFeed("search:"+url.QueryEscape(terms), "Search results", r.URL.RequestURI(), opdsAcquisitionType)
+	feed.Links = append(feed.Links, opdsLink{Rel: "up", Href: "/opds", Type: opdsNavigationType})
+	// a search without terms finds nothing rather than every book
+	if strings.TrimSpace(terms) == "" {
+		feed.pageLinks(r, page, 0, opdsAcquisitionType)
+	} else {
+		err = feed.paginate(r, page, BookArgs{Search: &terms})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	writeOPDS(w, opdsAcquisitionType, feed)
+}
+
+func OPDSSearchDescriptionHandler(w http.ResponseWriter, r *http.Request) {
+	writeOPDS(w, opdsSearchType, opdsSearchDescription{
+		ShortName:   "Bookish",
+		Description: "Search the books of the catalog by title, author or ISBN",
+		URL:         opdsSearchURL{Type: opdsAcquisitionType, Template: "/opds/search?q={searchTerms}"},
+	})
+}
+
+// OPDSCopyFileHandler sends the file of an ebook copy, the acquisition links of the
+// catalog point here
+func OPDSCopyFileHandler(w http.ResponseWriter, r *http.Request) {
+	copyIDStr := mux.Vars(r)["copy_id"]
+	copyID, err := SanitizeIdNumber(&copyIDStr)
+	if err != nil {
+		http.Error(w, "Invalid copy ID", http.StatusBadRequest)
+		return
+	}
+
+	copies, err := listCopies(db, CopyArgs{CopyID: copyID})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	ebook := copies[0]
+	if ebook.Format != "ebook" || ebook.Location == "" {
+		http.Error(w, fmt.Sprintf("copy %d of %s has no ebook file", ebook.CopyID, ebook.Title), http.StatusNotFound)
+		return
+	}
+
+	// the location is only opened when it is a file of the library
+	path, err := libraryFile(ebook.Location)
+	if errors.Is(err, os.ErrNotExist) {
+		http.Error(w, fmt.Sprintf("the file %s of copy %d is missing", filepath.Base(ebook.Location), ebook.CopyID), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("copy %d of %s has no ebook file in the library", ebook.CopyID, ebook.Title), http.StatusNotFound)
+		return
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", opdsFileType(ebook.Location))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filepath.Base(ebook.Location)}))
+	http.ServeContent(w, r, filepath.Base(ebook.Location), info.ModTime(), file)
+}
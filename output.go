@@ -0,0 +1,510 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// outputOptions are the -output and -quiet flags of a command that prints records
+type outputOptions struct {
+	format string
+	quiet  bool
+}
+
+func addOutputFlags(flags *flag.FlagSet) *outputOptions {
+	options := &outputOptions{}
+	flags.StringVar(&options.format, "output", "table", "Output format: table, json, jsonl, csv or yaml")
+	flags.BoolVar(&options.quiet, "quiet", false, "Print only the ids, one per line")
+	return options
+}
+
+// validate is called before a command changes anything, so a wrong format is not
+// noticed after a book was created
+func (options *outputOptions) validate() error {
+	switch options.format {
+	case "table", "json", "jsonl", "csv", "yaml":
+		return nil
+	}
+	return usageErrorf("invalid -output %q, expected table, json, jsonl, csv or yaml", options.format)
+}
+
+// outputView tells the output layer how to print a kind of record in tables and CSV.
+// Columns are named like the JSON fields; tables print them in upper case.
+type outputView[T any] struct {
+	columns []string
+	id      func(T) int
+	row     func(T) []string
+
+	// records holding other records, such as the books of a collection, list them in
+	// a table under their row, and in one CSV row each
+	nestedColumns []string
+	nested        func(T) [][]string
+}
+
+var bookView = outputView[Book]{
+	columns: []string{"book_id", "title", "author", "isbn", "published_date", "edition", "publisher", "pages", "rating", "tags"},
+	id:      func(book Book) int { return book.BookID },
+	row:     bookRow,
+}
+
+var collectionView = outputView[Collection]{
+	columns: []string{"collection_id", "collection_name", "books", "creation_date"},
+	id:      func(collection Collection) int { return collection.CollectionID },
+	row: func(collection Collection) []string {
+		return []string{
+			strconv.Itoa(collection.CollectionID),
+			collection.CollectionName,
+			strconv.Itoa(len(collection.CollectionBooks)),
+			collection.CreationDate.Format("2006-01-02"),
+		}
+	},
+	nestedColumns: []string{"book_id", "title", "author"},
+	nested: func(collection Collection) [][]string {
+		rows := [][]string{}
+		for _, book := range collection.CollectionBooks {
+			rows = append(rows, bookRow(book)[:3])
+		}
+		return rows
+	},
+}
+
+var readingStatusView = outputView[ReadingStatus]{
+	columns: []string{"book_id", "title", "user", "status", "started_date", "finished_date"},
+	id:      func(status ReadingStatus) int { return status.BookID },
+	row: func(status ReadingStatus) []string {
+		return []string{
+			strconv.Itoa(status.BookID),
+			status.Title,
+			status.User,
+			status.Status,
+			outputDate(status.StartedDate),
+			outputDate(status.FinishedDate),
+		}
+	},
+}
+
+var readingProgressView = outputView[ReadingProgress]{
+	columns: []string{"book_id", "title", "user", "page", "percent", "pages_read", "minutes_read", "pages_per_day", "estimated_finish"},
+	id:      func(progress ReadingProgress) int { return progress.BookID },
+	row: func(progress ReadingProgress) []string {
+		page := outputInt(progress.CurrentPage)
+		if page != "" && progress.PageCount != nil {
+			page += "/" + strconv.Itoa(*progress.PageCount)
+		}
+		return []string{
+			strconv.Itoa(progress.BookID),
+			progress.Title,
+			progress.User,
+			page,
+			outputFloat(progress.Percent),
+			strconv.Itoa(progress.PagesRead),
+			strconv.Itoa(progress.MinutesRead),
+			outputFloat(progress.PagesPerDay),
+			outputDate(progress.EstimatedFinish),
+		}
+	},
+}
+
+var readingSessionView = outputView[ReadingSession]{
+	columns: []string{"session_id", "date", "page", "percent", "pages", "minutes"},
+	id:      func(session ReadingSession) int { return session.SessionID },
+	row: func(session ReadingSession) []string {
+		return []string{
+			strconv.Itoa(session.SessionID),
+			outputDate(&session.Date),
+			outputInt(session.Page),
+			outputFloat(session.Percent),
+			outputInt(session.Pages),
+			outputInt(session.Minutes),
+		}
+	},
+}
+
+var reviewView = outputView[Review]{
+	columns: []string{"review_id", "book_id", "title", "user", "rating", "review"},
+	id:      func(review Review) int { return review.ReviewID },
+	row: func(review Review) []string {
+		return []string{
+			strconv.Itoa(review.ReviewID),
+			strconv.Itoa(review.BookID),
+			review.Title,
+			review.User,
+			outputFloat(review.Rating),
+			textSummary(review.Review),
+		}
+	},
+}
+
+var noteView = outputView[Note]{
+	columns: []string{"note_id", "book_id", "title", "kind", "page", "location", "tags", "text"},
+	id:      func(note Note) int { return note.NoteID },
+	row: func(note Note) []string {
+		return []string{
+			strconv.Itoa(note.NoteID),
+			strconv.Itoa(note.BookID),
+			note.Title,
+			note.Kind,
+			outputInt(note.Page),
+			note.Location,
+			strings.Join(note.Tags, ","),
+			textSummary(note.Text),
+		}
+	},
+}
+
+var copyView = outputView[Copy]{
+	columns: []string{"copy_id", "book_id", "title", "format", "condition", "location", "acquired_date", "price", "borrower"},
+	id:      func(copy Copy) int { return copy.CopyID },
+	row: func(copy Copy) []string {
+		return []string{
+			strconv.Itoa(copy.CopyID),
+			strconv.Itoa(copy.BookID),
+			copy.Title,
+			copy.Format,
+			copy.Condition,
+			copy.Location,
+			outputDate(copy.AcquiredDate),
+			outputPrice(copy.Price),
+			copy.Borrower,
+		}
+	},
+}
+
+var wishView = outputView[Wish]{
+	columns: []string{"wish_id", "title", "author", "isbn", "edition", "priority", "notes"},
+	id:      func(wish Wish) int { return wish.WishID },
+	row: func(wish Wish) []string {
+		return []string{
+			strconv.Itoa(wish.WishID),
+			wish.Title,
+			wish.Author,
+			wish.ISBN,
+			wish.Edition,
+			wish.Priority,
+			textSummary(wish.Notes),
+		}
+	},
+}
+
+var purchaseView = outputView[Purchase]{
+	columns: []string{"purchase_id", "book_id", "title", "copy_id", "store", "price", "currency", "purchase_date"},
+	id:      func(purchase Purchase) int { return purchase.PurchaseID },
+	row: func(purchase Purchase) []string {
+		return []string{
+			strconv.Itoa(purchase.PurchaseID),
+			strconv.Itoa(purchase.BookID),
+			purchase.Title,
+			outputInt(purchase.CopyID),
+			purchase.Store,
+			outputPrice(&purchase.Price),
+			purchase.Currency,
+			outputDate(&purchase.PurchaseDate),
+		}
+	},
+}
+
+// spendingView has no ids, the spending command does not take -quiet
+var spendingView = outputView[MonthlySpending]{
+	columns: []string{"month", "currency", "purchases", "total"},
+	row: func(month MonthlySpending) []string {
+		return []string{
+			month.Month,
+			month.Currency,
+			strconv.Itoa(month.Purchases),
+			outputPrice(&month.Total),
+		}
+	},
+}
+
+var tagView = outputView[Tag]{
+	columns: []string{"tag_id", "name", "kind", "books"},
+	id:      func(tag Tag) int { return tag.TagID },
+	row: func(tag Tag) []string {
+		return []string{
+			strconv.Itoa(tag.TagID),
+			tag.Name,
+			tag.Kind,
+			strconv.Itoa(tag.Books),
+		}
+	},
+}
+
+var loanView = outputView[Loan]{
+	columns: []string{"loan_id", "book_id", "title", "copy_id", "borrower", "lent_date", "due_date", "returned_date", "overdue"},
+	id:      func(loan Loan) int { return loan.LoanID },
+	row: func(loan Loan) []string {
+		overdue := ""
+		if loan.Overdue {
+			overdue = "yes"
+		}
+		return []string{
+			strconv.Itoa(loan.LoanID),
+			strconv.Itoa(loan.BookID),
+			loan.Title,
+			outputInt(loan.CopyID),
+			loan.Borrower,
+			outputDate(&loan.LentDate),
+			outputDate(loan.DueDate),
+			outputDate(loan.ReturnedDate),
+			overdue,
+		}
+	},
+}
+
+// textSummary is the first line of a text, short enough for a table column
+func textSummary(text string) string {
+	summary := strings.TrimSpace(text)
+	if end := strings.IndexByte(summary, '\n'); end >= 0 {
+		summary = strings.TrimSpace(summary[:end]) + " …"
+	}
+	if characters := []rune(summary); len(characters) > 60 {
+		summary = string(characters[:59]) + "…"
+	}
+	return summary
+}
+
+func bookRow(book Book) []string {
+	return []string{
+		strconv.Itoa(book.BookID),
+		book.Title,
+		book.Author,
+		book.ISBN,
+		outputDate(book.PublishedDate),
+		outputInt(book.Edition),
+		book.Publisher,
+		outputInt(book.PageCount),
+		outputFloat(book.AverageRating),
+		strings.Join(book.Tags, ","),
+	}
+}
+
+func outputDate(date *time.Time) string {
+	if date == nil {
+		return ""
+	}
+	return date.Format("2006-01-02")
+}
+
+func outputInt(value *int) string {
+	if value == nil {
+		return ""
+	}
+	return strconv.Itoa(*value)
+}
+
+func outputFloat(value *float64) string {
+	if value == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*value, 'f', -1, 64)
+}
+
+// outputPrice prints prices with their cents
+func outputPrice(value *float64) string {
+	if value == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*value, 'f', 2, 64)
+}
+
+// writeRecords prints records in the format of the options, or only their ids when quiet
+func writeRecords[T any](out io.Writer, options *outputOptions, records []T, view outputView[T]) error {
+	if records == nil {
+		records = []T{}
+	}
+	if options.quiet {
+		for _, record := range records {
+			fmt.Fprintln(out, view.id(record))
+		}
+		return nil
+	}
+
+	switch options.format {
+	case "json":
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(records)
+	case "jsonl":
+		encoder := json.NewEncoder(out)
+		for _, record := range records {
+			err := encoder.Encode(record)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case "yaml":
+		return writeYAML(out, records)
+	case "csv":
+		return writeCSV(out, records, view)
+	case "table":
+		return writeTable(out, records, view)
+	}
+	return options.validate()
+}
+
+// writeRecord prints a single record, JSON and YAML print it as an object rather than a list
+func writeRecord[T any](out io.Writer, options *outputOptions, record T, view outputView[T]) error {
+	if options.quiet {
+		return writeRecords(out, options, []T{record}, view)
+	}
+	switch options.format {
+	case "json":
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(record)
+	case "yaml":
+		return writeYAML(out, record)
+	}
+	return writeRecords(out, options, []T{record}, view)
+}
+
+func writeCSV[T any](out io.Writer, records []T, view outputView[T]) error {
+	w := csv.NewWriter(out)
+	w.Write(append(append([]string{}, view.columns...), view.nestedColumns...))
+	for _, record := range records {
+		row := view.row(record)
+		if view.nested == nil {
+			w.Write(row)
+			continue
+		}
+
+		// one row for each nested record, or one with empty nested columns when there are none
+		nested := view.nested(record)
+		if len(nested) == 0 {
+			nested = [][]string{make([]string, len(view.nestedColumns))}
+		}
+		for _, nestedRow := range nested {
+			w.Write(append(append([]string{}, row...), nestedRow...))
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+func writeTable[T any](out io.Writer, records []T, view outputView[T]) error {
+	if view.nested == nil {
+		table := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		writeTableRow(table, "", tableHeader(view.columns))
+		for _, record := range records {
+			writeTableRow(table, "", view.row(record))
+		}
+		return table.Flush()
+	}
+
+	// every record gets its own table, followed by the indented table of its nested records
+	for index, record := range records {
+		if index > 0 {
+			fmt.Fprintln(out)
+		}
+		table := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		writeTableRow(table, "", tableHeader(view.columns))
+		writeTableRow(table, "", view.row(record))
+		err := table.Flush()
+		if err != nil {
+			return err
+		}
+
+		nested := view.nested(record)
+		if len(nested) == 0 {
+			continue
+		}
+		table = tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		writeTableRow(table, "  ", tableHeader(view.nestedColumns))
+		for _, row := range nested {
+			writeTableRow(table, "  ", row)
+		}
+		err = table.Flush()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func tableHeader(columns []string) []string {
+	header := []string{}
+	for _, column := range columns {
+		header = append(header, strings.ToUpper(strings.ReplaceAll(column, "_", " ")))
+	}
+	return header
+}
+
+// writeTableRow keeps every cell on one line, a tab or newline in a title would break the alignment
+func writeTableRow(table io.Writer, indent string, cells []string) {
+	clean := strings.NewReplacer("\t", " ", "\n", " ", "\r", "")
+	line := []string{}
+	for _, cell := range cells {
+		line = append(line, clean.Replace(cell))
+	}
+	fmt.Fprintf(table, "%s%s\n", indent, strings.Join(line, "\t"))
+}
+
+// writeYAML prints a value with the keys and key order of its JSON encoding, so both
+// formats name the fields alike
+func writeYAML(out io.Writer, value any) error {
+	content, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	document, err := orderedJSON(decoder)
+	if err != nil {
+		return err
+	}
+	content, err = yaml.Marshal(document)
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(content)
+	return err
+}
+
+// orderedJSON decodes the next JSON value, objects become yaml.MapSlice to keep their key order
+func orderedJSON(decoder *json.Decoder) (any, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch token {
+	case json.Delim('{'):
+		object := yaml.MapSlice{}
+		for decoder.More() {
+			key, err := decoder.Token()
+			if err != nil {
+				return nil, err
+			}
+			value, err := orderedJSON(decoder)
+			if err != nil {
+				return nil, err
+			}
+			object = append(object, yaml.MapItem{Key: key, Value: value})
+		}
+		_, err = decoder.Token() // the closing brace
+		return object, err
+
+	case json.Delim('['):
+		list := []any{}
+		for decoder.More() {
+			value, err := orderedJSON(decoder)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, value)
+		}
+		_, err = decoder.Token() // the closing bracket
+		return list, err
+	}
+	return token, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testCollections() []Collection {
+	edition := 2
+	published := time.Date(1937, time.September, 21, 0, 0, 0, 0, time.UTC)
+	created := time.Date(2024, time.March, 1, 10, 0, 0, 0, time.UTC)
+	return []Collection{
+		{
+			CollectionID:   1,
+			CollectionName: "Fantasy",
+			CreationDate:   created,
+			CollectionBooks: []Book{
+				{BookID: 3, Title: "The Hobbit", Author: "J. R. R. Tolkien", ISBN: "9780261102217", PublishedDate: &published, Edition: &edition, Tags: []string{"classic", "fantasy"}, CreationDate: created},
+				{BookID: 4, Title: "Mort", Author: "Terry Pratchett", CreationDate: created},
+			},
+		},
+		{CollectionID: 2, CollectionName: "To read", CreationDate: created},
+	}
+}
+
+func TestWriteRecords_Table(t *testing.T) {
+	// Setup
+	var out bytes.Buffer
+	books := testCollections()[0].CollectionBooks
+
+	// Function to test
+	err := writeRecords(&out, &outputOptions{format: "table"}, books, bookView)
+
+	// Verification
+	require.NoError(t, err)
+	assert.Equal(t, ""+
+		"BOOK ID  TITLE       AUTHOR            ISBN           PUBLISHED DATE  EDITION  PUBLISHER  PAGES  RATING  TAGS\n"+
+		"3        The Hobbit  J. R. R. Tolkien  9780261102217  1937-09-21      2                                  classic,fantasy\n"+
+		"4        Mort        Terry Pratchett                                                                     \n", out.String())
+}
+
+func TestWriteRecords_NestedTable(t *testing.T) {
+	// Setup
+	var out bytes.Buffer
+
+	// Function to test
+	err := writeRecords(&out, &outputOptions{format: "table"}, testCollections(), collectionView)
+
+	// Verification
+	require.NoError(t, err)
+	assert.Equal(t, ""+
+		"COLLECTION ID  COLLECTION NAME  BOOKS  CREATION DATE\n"+
+		"1              Fantasy          2      2024-03-01\n"+
+		"  BOOK ID  TITLE       AUTHOR\n"+
+		"  3        The Hobbit  J. R. R. Tolkien\n"+
+		"  4        Mort        Terry Pratchett\n"+
+		"\n"+
+		"COLLECTION ID  COLLECTION NAME  BOOKS  CREATION DATE\n"+
+		"2              To read          0      2024-03-01\n", out.String())
+}
+
+func TestWriteRecords_CSV(t *testing.T) {
+	// Setup
+	var out bytes.Buffer
+
+	// Function to test
+	err := writeRecords(&out, &outputOptions{format: "csv"}, testCollections(), collectionView)
+
+	// Verification
+	require.NoError(t, err)
+	assert.Equal(t, ""+
+		"collection_id,collection_name,books,creation_date,book_id,title,author\n"+
+		"1,Fantasy,2,2024-03-01,3,The Hobbit,J. R. R. Tolkien\n"+
+		"1,Fantasy,2,2024-03-01,4,Mort,Terry Pratchett\n"+
+		"2,To read,0,2024-03-01,,,\n", out.String())
+}
+
+func TestWriteRecords_JSONLAndQuiet(t *testing.T) {
+	// Setup
+	var jsonl, quiet bytes.Buffer
+	books := testCollections()[0].CollectionBooks
+
+	// Function to test
+	err := writeRecords(&jsonl, &outputOptions{format: "jsonl"}, books, bookView)
+	require.NoError(t, err)
+	err = writeRecords(&quiet, &outputOptions{format: "json", quiet: true}, books, bookView)
+	require.NoError(t, err)
+
+	// Verification
+	assert.Equal(t, 2, bytes.Count(jsonl.Bytes(), []byte("\n")))
+	assert.Contains(t, jsonl.String(), `{"book_id":4,"title":"Mort","author":"Terry Pratchett",`)
+	assert.Equal(t, "3\n4\n", quiet.String())
+}
+
+func TestWriteRecord_YAML(t *testing.T) {
+	// Setup
+	var out bytes.Buffer
+	book := testCollections()[0].CollectionBooks[1]
+
+	// Function to test
+	err := writeRecord(&out, &outputOptions{format: "yaml"}, book, bookView)
+
+	// Verification
+	require.NoError(t, err)
+	assert.Equal(t, "book_id: 4\ntitle: Mort\nauthor: Terry Pratchett\ncreation_date: \"2024-03-01T10:00:00Z\"\n", out.String())
+}
+
+func TestWriteRecords_EmptyJSON(t *testing.T) {
+	// Setup
+	var out bytes.Buffer
+
+	// Function to test
+	err := writeRecords(&out, &outputOptions{format: "json"}, []Book(nil), bookView)
+
+	// Verification
+	require.NoError(t, err)
+	assert.Equal(t, "[]\n", out.String())
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// RecordPurchase records what a book was bought for, where and when. The copy bought is
+// optional, the purchase date defaults to today.
+func RecordPurchase(db *sql.DB, p PurchaseArgs) (*Purchase, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // no-op once the transaction is committed
+
+	purchase, err := recordPurchase(tx, p)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return purchase, nil
+}
+
+// recordPurchase inserts a purchase using q, which is usually a transaction
+func recordPurchase(q querier, p PurchaseArgs) (*Purchase, error) {
+	if p.BookID == nil {
+		return nil, errors.New("choose the book and insert its ID number")
+	}
+	if p.Price == nil {
+		return nil, errors.New("no price set, purchase not recorded")
+	}
+	if *p.Price < 0 {
+		return nil, fmt.Errorf("invalid price %g, prices cannot be negative", *p.Price)
+	}
+	currency, err := SanitizeCurrency(p.Currency)
+	if err != nil {
+		return nil, err
+	}
+	purchaseDate, err := SanitizeDate(p.PurchaseDate)
+	if err != nil {
+		return nil, err
+	}
+	if purchaseDate == nil {
+		day := today()
+		purchaseDate = &day
+	}
+
+	// check if there is a book with the chosen ID, and that the copy is one of its copies
+	books, err := listBooks(q, BookArgs{BookID: p.BookID})
+	if err != nil {
+		return nil, err
+	}
+	if p.CopyID != nil {
+		var bookID int
+		err := q.QueryRow("SELECT book_id FROM copies WHERE copy_id = $1", *p.CopyID).Scan(&bookID)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+		if err == sql.ErrNoRows || bookID != *p.BookID {
+			return nil, fmt.Errorf("book %s has no copy %d", books[0].Title, *p.CopyID)
+		}
+	}
+
+	var store *string
+	if p.Store != nil {
+		store = optionalValue(*p.Store)
+	}
+
+	var purchaseID int
+	err = q.QueryRow("INSERT INTO purchases (book_id, copy_id, store, price, currency, purchase_date) VALUES ($1, $2, $3, $4, $5, $6) RETURNING purchase_id",
+		*p.BookID, p.CopyID, store, *p.Price, currency, *purchaseDate).Scan(&purchaseID)
+	if err != nil {
+		return nil, err
+	}
+
+	purchases, err := listPurchases(q, PurchaseArgs{PurchaseID: &purchaseID})
+	if err != nil {
+		return nil, err
+	}
+	return &purchases[0], nil
+}
+
+// purchaseFilters are the WHERE clauses shared by the purchase list and the spending report
+func purchaseFilters(p PurchaseArgs, bind func(any) string) ([]string, error) {
+	whereClauses := []string{}
+	if p.PurchaseID != nil {
+		whereClauses = append(whereClauses, "purchases.purchase_id = "+bind(*p.PurchaseID))
+	}
+	if p.BookID != nil {
+		whereClauses = append(whereClauses, "purchases.book_id = "+bind(*p.BookID))
+	}
+	if p.CopyID != nil {
+		whereClauses = append(whereClauses, "purchases.copy_id = "+bind(*p.CopyID))
+	}
+	if p.Store != nil && strings.TrimSpace(*p.Store) != "" {
+		whereClauses = append(whereClauses, "purchases.store ILIKE "+bind(likeEscaper.Replace(strings.TrimSpace(*p.Store))))
+	}
+	if p.Currency != nil && strings.TrimSpace(*p.Currency) != "" {
+		currency, err := SanitizeCurrency(p.Currency)
+		if err != nil {
+			return nil, err
+		}
+		whereClauses = append(whereClauses, "purchases.currency = "+bind(currency))
+	}
+	from, err := SanitizeDate(p.From)
+	if err != nil {
+		return nil, err
+	}
+	if from != nil {
+		whereClauses = append(whereClauses, "purchases.purchase_date >= "+bind(*from))
+	}
+	to, err := SanitizeDate(p.To)
+	if err != nil {
+		return nil, err
+	}
+	if to != nil {
+		whereClauses = append(whereClauses, "purchases.purchase_date <= "+bind(*to))
+	}
+	if from != nil && to != nil && to.Before(*from) {
+		return nil, fmt.Errorf("the end date %s is before the start date %s", to.Format("2006-01-02"), from.Format("2006-01-02"))
+	}
+	return whereClauses, nil
+}
+
+// ListPurchases lists the purchases of a book, a copy, a store or a currency, made
+// between two days, the latest first.
+func ListPurchases(db *sql.DB, p PurchaseArgs) ([]Purchase, error) {
+	return listPurchases(db, p)
+}
+
+func listPurchases(q querier, p PurchaseArgs) ([]Purchase, error) {
+	purchases := []Purchase{}
+
+	query := `
+		SELECT purchases.purchase_id, purchases.book_id, books.title, purchases.copy_id, purchases.store,
+		       purchases.price, purchases.currency, purchases.purchase_date
+		FROM purchases
+		JOIN books ON purchases.book_id = books.book_id
+		`
+
+	params := []any{}
+	bind := func(value any) string {
+		params = append(params, value)
+		return fmt.Sprintf("$%d", len(params))
+	}
+	whereClauses, err := purchaseFilters(p, bind)
+	if err != nil {
+		return nil, err
+	}
+	if len(whereClauses) > 0 {
+		query += "WHERE " + strings.Join(whereClauses, " AND ")
+	}
+	query += " ORDER BY purchases.purchase_date DESC, purchases.purchase_id DESC"
+
+	rows, err := q.Query(query, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var purchase Purchase
+		var copyID sql.NullInt64
+		var store sql.NullString
+		err := rows.Scan(&purchase.PurchaseID, &purchase.BookID, &purchase.Title, &copyID, &store, &purchase.Price, &purchase.Currency, &purchase.PurchaseDate)
+		if err != nil {
+			return nil, err
+		}
+		if copyID.Valid {
+			id := int(copyID.Int64)
+			purchase.CopyID = &id
+		}
+		purchase.Store = store.String
+		purchases = append(purchases, purchase)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(purchases) == 0 {
+		return nil, errors.New("no purchases with the chosen specification")
+	}
+	return purchases, nil
+}
+
+// SpendingReport totals the purchases of each month, with one total per currency since
+// prices in different currencies cannot be added. It takes the filters of ListPurchases.
+func SpendingReport(db *sql.DB, p PurchaseArgs) ([]MonthlySpending, error) {
+	spending := []MonthlySpending{}
+
+	query := `
+		SELECT TO_CHAR(purchases.purchase_date, 'YYYY-MM') AS month, purchases.currency,
+		       COUNT(*), SUM(purchases.price)
+		FROM purchases
+		`
+
+	params := []any{}
+	bind := func(value any) string {
+		params = append(params, value)
+		return fmt.Sprintf("$%d", len(params))
+	}
+	whereClauses, err := purchaseFilters(p, bind)
+	if err != nil {
+		return nil, err
+	}
+	if len(whereClauses) > 0 {
+		query += "WHERE " + strings.Join(whereClauses, " AND ")
+	}
+	query += " GROUP BY month, purchases.currency ORDER BY month, purchases.currency"
+
+	rows, err := db.Query(query, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var month MonthlySpending
+		err := rows.Scan(&month.Month, &month.Currency, &month.Purchases, &month.Total)
+		if err != nil {
+			return nil, err
+		}
+		spending = append(spending, month)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(spending) == 0 {
+		return nil, errors.New("no purchases with the chosen specification")
+	}
+	return spending, nil
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// readingStatuses are the states of a book for a user, in the order they usually go
+var readingStatuses = []string{"want-to-read", "reading", "read", "abandoned"}
+
+func checkReadingStatus(status string) error {
+	for _, known := range readingStatuses {
+		if status == known {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid status %s, expected want-to-read, reading, read or abandoned", status)
+}
+
+// upsertUser returns the id of the user with this name, creating the user when needed
+func upsertUser(q querier, name *string) (int, error) {
+	if name == nil || strings.TrimSpace(*name) == "" {
+		return 0, errors.New("no user set, choose whose reading this is")
+	}
+
+	var userID int
+	err := q.QueryRow("INSERT INTO users (name) VALUES ($1) ON CONFLICT (name) DO UPDATE SET name = EXCLUDED.name RETURNING user_id", strings.TrimSpace(*name)).Scan(&userID)
+	if err != nil {
+		return 0, err
+	}
+	return userID, nil
+}
+
+// today is the current date, the default start and finish of a reading
+func today() time.Time {
+	now := time.Now()
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// SetReadingStatus records where a user is with a book. A book being read starts today
+// unless a started date is given, and keeps its start while it is read; a book read or
+// abandoned finishes today unless a finished date is given.
+func SetReadingStatus(db *sql.DB, r ReadingStatusArgs) (*ReadingStatus, error) {
+	if r.BookID == nil {
+		return nil, errors.New("choose the book and insert its ID number")
+	}
+	if r.Status == nil {
+		return nil, errors.New("no status set, expected want-to-read, reading, read or abandoned")
+	}
+	err := checkReadingStatus(*r.Status)
+	if err != nil {
+		return nil, err
+	}
+	startedDate, err := SanitizeDate(r.StartedDate)
+	if err != nil {
+		return nil, err
+	}
+	finishedDate, err := SanitizeDate(r.FinishedDate)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // no-op once the transaction is committed
+
+	// check if there is a book with the chosen ID
+	_, err = listBooks(tx, BookArgs{BookID: r.BookID})
+	if err != nil {
+		return nil, err
+	}
+	userID, err := upsertUser(tx, r.User)
+	if err != nil {
+		return nil, err
+	}
+
+	var previousStatus sql.NullString
+	var previousStart sql.NullTime
+	err = tx.QueryRow("SELECT status, started_date FROM reading_status WHERE user_id = $1 AND book_id = $2", userID, *r.BookID).Scan(&previousStatus, &previousStart)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	switch *r.Status {
+	case "reading":
+		if finishedDate != nil {
+			return nil, errors.New("a book being read has no finished date")
+		}
+		if startedDate == nil && previousStatus.String == "reading" && previousStart.Valid {
+			startedDate = &previousStart.Time
+		}
+		if startedDate == nil {
+			start := today()
+			startedDate = &start
+		}
+	case "read", "abandoned":
+		if startedDate == nil && previousStatus.String == "reading" && previousStart.Valid {
+			startedDate = &previousStart.Time
+		}
+		if finishedDate == nil {
+			finish := today()
+			finishedDate = &finish
+		}
+	}
+	if startedDate != nil && finishedDate != nil && finishedDate.Before(*startedDate) {
+		return nil, fmt.Errorf("the finished date %s is before the started date %s", finishedDate.Format("2006-01-02"), startedDate.Format("2006-01-02"))
+	}
+
+	_, err = tx.Exec(`INSERT INTO reading_status (user_id, book_id, status, started_date, finished_date, updated_at) VALUES ($1, $2, $3, $4, $5, CURRENT_TIMESTAMP)
+		ON CONFLICT (user_id, book_id) DO UPDATE SET status = EXCLUDED.status, started_date = EXCLUDED.started_date, finished_date = EXCLUDED.finished_date, updated_at = EXCLUDED.updated_at`,
+		userID, *r.BookID, *r.Status, startedDate, finishedDate)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses, err := listReadingStatuses(tx, ReadingStatusArgs{BookID: r.BookID, User: r.User})
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return &statuses[0], nil
+}
+
+// ListReadingStatuses lists the reading statuses of a book, a user or a status
+func ListReadingStatuses(db *sql.DB, r ReadingStatusArgs) ([]ReadingStatus, error) {
+	return listReadingStatuses(db, r)
+}
+
+func listReadingStatuses(q querier, r ReadingStatusArgs) ([]ReadingStatus, error) {
+	statuses := []ReadingStatus{}
+
+	query := `
+		SELECT reading_status.book_id, books.title, users.name, reading_status.status,
+		       reading_status.started_date, reading_status.finished_date, reading_status.updated_at
+		FROM reading_status
+		JOIN books ON reading_status.book_id = books.book_id
+		JOIN users ON reading_status.user_id = users.user_id
+		`
+
+	whereClauses := []string{}
+	params := []any{}
+	bind := func(value any) string {
+		params = append(params, value)
+		return fmt.Sprintf("$%d", len(params))
+	}
+	if r.BookID != nil {
+		whereClauses = append(whereClauses, "reading_status.book_id = "+bind(*r.BookID))
+	}
+	if r.User != nil {
+		whereClauses = append(whereClauses, "users.name = "+bind(strings.TrimSpace(*r.User)))
+	}
+	if r.Status != nil {
+		err := checkReadingStatus(*r.Status)
+		if err != nil {
+			return nil, err
+		}
+		whereClauses = append(whereClauses, "reading_status.status = "+bind(*r.Status))
+	}
+	if len(whereClauses) > 0 {
+		query += "WHERE " + strings.Join(whereClauses, " AND ")
+	}
+	query += " ORDER BY reading_status.book_id, users.name"
+
+	rows, err := q.Query(query, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var status ReadingStatus
+		var startedDate, finishedDate sql.NullTime
+		err := rows.Scan(&status.BookID, &status.Title, &status.User, &status.Status, &startedDate, &finishedDate, &status.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		if startedDate.Valid {
+			status.StartedDate = &startedDate.Time
+		}
+		if finishedDate.Valid {
+			status.FinishedDate = &finishedDate.Time
+		}
+		statuses = append(statuses, status)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(statuses) == 0 {
+		return nil, errors.New("no reading status with the chosen specification")
+	}
+	return statuses, nil
+}
+
+// LogReadingSession records a reading session of a user with a book. The page reached
+// and the percentage are worked out from each other when the book has a page count, and
+// the pages read default to the pages since the page of the previous session, or since
+// the first page for the first session. A book the user did not read yet starts being read.
+func LogReadingSession(db *sql.DB, r ReadingSessionArgs) (*ReadingProgress, error) {
+	if r.BookID == nil {
+		return nil, errors.New("choose the book and insert its ID number")
+	}
+	if r.Page == nil && r.Percent == nil && r.Pages == nil && r.Minutes == nil {
+		return nil, errors.New("nothing to log, set the page or percentage reached, or the pages or minutes read")
+	}
+	for name, value := range map[string]*int{"page": r.Page, "pages read": r.Pages, "minutes read": r.Minutes} {
+		if value != nil && *value < 0 {
+			return nil, fmt.Errorf("invalid %s %d, it cannot be negative", name, *value)
+		}
+	}
+	if r.Percent != nil && (*r.Percent < 0 || *r.Percent > 100) {
+		return nil, fmt.Errorf("invalid percentage %g, expected a number from 0 to 100", *r.Percent)
+	}
+	date, err := SanitizeDate(r.Date)
+	if err != nil {
+		return nil, err
+	}
+	if date == nil {
+		day := today()
+		date = &day
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // no-op once the transaction is committed
+
+	books, err := listBooks(tx, BookArgs{BookID: r.BookID})
+	if err != nil {
+		return nil, err
+	}
+	book := books[0]
+	userID, err := upsertUser(tx, r.User)
+	if err != nil {
+		return nil, err
+	}
+
+	page, percent, pages := r.Page, r.Percent, r.Pages
+	if book.PageCount != nil {
+		if page != nil && *page > *book.PageCount {
+			return nil, fmt.Errorf("page %d is past the last page %d of the book", *page, *book.PageCount)
+		}
+		if page == nil && percent != nil {
+			reached := int(math.Round(*percent * float64(*book.PageCount) / 100))
+			page = &reached
+		}
+		if percent == nil && page != nil {
+			reached := pagePercent(*page, *book.PageCount)
+			percent = &reached
+		}
+	}
+	if pages == nil && page != nil {
+		var previousPage sql.NullInt64
+		err = tx.QueryRow("SELECT page FROM reading_sessions WHERE user_id = $1 AND book_id = $2 AND page IS NOT NULL AND session_date <= $3 ORDER BY session_date DESC, session_id DESC LIMIT 1", userID, *r.BookID, *date).Scan(&previousPage)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+		// going back to an earlier page, to read it again, reads nothing new
+		read := *page - int(previousPage.Int64)
+		if read < 0 {
+			read = 0
+		}
+		pages = &read
+	}
+
+	_, err = tx.Exec("INSERT INTO reading_sessions (user_id, book_id, session_date, page, percent, pages, minutes) VALUES ($1, $2, $3, $4, $5, $6, $7)", userID, *r.BookID, *date, page, percent, pages, r.Minutes)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(`INSERT INTO reading_status (user_id, book_id, status, started_date, updated_at) VALUES ($1, $2, 'reading', $3, CURRENT_TIMESTAMP)
+		ON CONFLICT (user_id, book_id) DO UPDATE SET status = EXCLUDED.status, started_date = EXCLUDED.started_date, finished_date = NULL, updated_at = EXCLUDED.updated_at
+		WHERE reading_status.status = 'want-to-read'`, userID, *r.BookID, *date)
+	if err != nil {
+		return nil, err
+	}
+
+	progress, err := readingProgress(tx, ReadingSessionArgs{BookID: r.BookID, User: r.User})
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return progress, nil
+}
+
+// GetReadingProgress sums up the reading sessions of a user with a book
+func GetReadingProgress(db *sql.DB, r ReadingSessionArgs) (*ReadingProgress, error) {
+	return readingProgress(db, r)
+}
+
+// paceDays is how many days, up to today, the pace in pages per day is worked out over.
+// Only the recent sessions count, a pause or a change of pace shows in the estimate.
+const paceDays = 14
+
+// readingProgress works out the pace of the sessions in pages per day, over the last
+// paceDays days or since the first session, and in pages per hour over the sessions
+// that were timed. The estimated finish is the day the last page is reached when
+// reading on from today at that pace, there is none when nothing was read lately.
+func readingProgress(q querier, r ReadingSessionArgs) (*ReadingProgress, error) {
+	if r.BookID == nil {
+		return nil, errors.New("choose the book and insert its ID number")
+	}
+	if r.User == nil || strings.TrimSpace(*r.User) == "" {
+		return nil, errors.New("no user set, choose whose reading this is")
+	}
+
+	books, err := listBooks(q, BookArgs{BookID: r.BookID})
+	if err != nil {
+		return nil, err
+	}
+	progress := &ReadingProgress{BookID: books[0].BookID, Title: books[0].Title, User: strings.TrimSpace(*r.User), PageCount: books[0].PageCount, Sessions: []ReadingSession{}}
+
+	rows, err := q.Query(`
+		SELECT reading_sessions.session_id, reading_sessions.session_date, reading_sessions.page,
+		       reading_sessions.percent, reading_sessions.pages, reading_sessions.minutes
+		FROM reading_sessions
+		JOIN users ON reading_sessions.user_id = users.user_id
+		WHERE reading_sessions.book_id = $1 AND users.name = $2
+		ORDER BY reading_sessions.session_date, reading_sessions.session_id`, *r.BookID, progress.User)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	timedPages, timedMinutes := 0, 0
+	for rows.Next() {
+		session := ReadingSession{BookID: progress.BookID, User: progress.User}
+		var page, pages, minutes sql.NullInt64
+		var percent sql.NullFloat64
+		err := rows.Scan(&session.SessionID, &session.Date, &page, &percent, &pages, &minutes)
+		if err != nil {
+			return nil, err
+		}
+		if page.Valid {
+			reached := int(page.Int64)
+			session.Page = &reached
+			progress.CurrentPage = &reached
+		}
+		if percent.Valid {
+			session.Percent = &percent.Float64
+			progress.Percent = &percent.Float64
+		}
+		if pages.Valid {
+			read := int(pages.Int64)
+			session.Pages = &read
+			progress.PagesRead += read
+		}
+		if minutes.Valid {
+			spent := int(minutes.Int64)
+			session.Minutes = &spent
+			progress.MinutesRead += spent
+		}
+		if pages.Valid && minutes.Valid {
+			timedPages += int(pages.Int64)
+			timedMinutes += int(minutes.Int64)
+		}
+		progress.Sessions = append(progress.Sessions, session)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(progress.Sessions) == 0 {
+		return nil, errors.New("no reading session with the chosen specification")
+	}
+
+	// the page count may have been set after the sessions were logged
+	if progress.PageCount != nil && progress.CurrentPage != nil {
+		percent := pagePercent(*progress.CurrentPage, *progress.PageCount)
+		progress.Percent = &percent
+	}
+
+	now := today()
+	start := now.AddDate(0, 0, 1-paceDays)
+	if first := progress.Sessions[0].Date; first.After(start) {
+		start = first
+	}
+	days := int(now.Sub(start).Hours()/24) + 1
+	if days < 1 {
+		days = 1 // sessions logged ahead of time
+	}
+	recentPages := 0
+	for _, session := range progress.Sessions {
+		if session.Pages != nil && !session.Date.Before(start) {
+			recentPages += *session.Pages
+		}
+	}
+	var pagesPerDay float64
+	if recentPages > 0 {
+		pagesPerDay = float64(recentPages) / float64(days)
+		pace := roundTenth(pagesPerDay)
+		progress.PagesPerDay = &pace
+	}
+	if timedPages > 0 && timedMinutes > 0 {
+		pace := roundTenth(float64(timedPages) / float64(timedMinutes) * 60)
+		progress.PagesPerHour = &pace
+	}
+	if progress.PagesPerDay != nil && progress.PageCount != nil && progress.CurrentPage != nil && *progress.CurrentPage < *progress.PageCount {
+		left := float64(*progress.PageCount - *progress.CurrentPage)
+		finish := now.AddDate(0, 0, int(math.Ceil(left/pagesPerDay)))
+		progress.EstimatedFinish = &finish
+	}
+
+	return progress, nil
+}
+
+// pagePercent is how far into the book a page is, to two decimals
+func pagePercent(page, pageCount int) float64 {
+	return math.Round(float64(page)/float64(pageCount)*10000) / 100
+}
+
+func roundTenth(value float64) float64 {
+	return math.Round(value*10) / 10
+}
@@ -0,0 +1,739 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// remoteBackend runs the CLI commands through the HTTP API of a bookish server, so
+// the CLI needs no database credentials
+type remoteBackend struct {
+	baseURL string
+	token   string
+	client  *http.Client
+}
+
+func newRemoteBackend(profile Profile) remoteBackend {
+	return remoteBackend{
+		baseURL: strings.TrimRight(profile.URL, "/"),
+		token:   profile.Token,
+		client:  &http.Client{Timeout: 5 * time.Minute}, // imports and exports can be long
+	}
+}
+
+// remoteError is an error answered by the server, the handlers write their message as plain text
+type remoteError struct {
+	status  int
+	message string
+}
+
+func (err remoteError) Error() string {
+	if err.message == "" {
+		return fmt.Sprintf("server answered %d %s", err.status, http.StatusText(err.status))
+	}
+	return err.message
+}
+
+// directOnly is the error of the commands the HTTP API has no endpoint for
+func directOnly(command string) error {
+	return fmt.Errorf("%s needs a direct database connection, run it with -direct", command)
+}
+
+// do sends a request and returns the response when it succeeded, its body must be closed
+func (b remoteBackend) do(method string, path string, contentType string, body io.Reader) (*http.Response, error) {
+	request, err := http.NewRequest(method, b.baseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+	if b.token != "" {
+		request.Header.Set("Authorization", "Bearer "+b.token)
+	}
+
+	response, err := b.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode >= 300 {
+		defer response.Body.Close()
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 4096))
+		return nil, remoteError{status: response.StatusCode, message: strings.TrimSpace(string(message))}
+	}
+	return response, nil
+}
+
+// doJSON sends args as JSON and decodes the JSON answer into result
+func (b remoteBackend) doJSON(method string, path string, args any, result any) error {
+	body, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+	response, err := b.do(method, path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	return json.NewDecoder(response.Body).Decode(result)
+}
+
+// doCreate is doJSON for the create handlers, which write a line of text before the JSON of the new record
+func (b remoteBackend) doCreate(path string, args any, result any) error {
+	body, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+	response, err := b.do(http.MethodPost, path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	reader := bufio.NewReader(response.Body)
+	_, err = reader.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("unexpected answer from the server: %w", err)
+	}
+	return json.NewDecoder(reader).Decode(result)
+}
+
+// upload posts a file as the "file" part of a multipart form, along with form values
+func (b remoteBackend) upload(path string, fileName string, r io.Reader, values map[string]string, result any) error {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for name, value := range values {
+		err := form.WriteField(name, value)
+		if err != nil {
+			return err
+		}
+	}
+	part, err := form.CreateFormFile("file", fileName)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(part, r)
+	if err != nil {
+		return err
+	}
+	err = form.Close()
+	if err != nil {
+		return err
+	}
+
+	response, err := b.do(http.MethodPost, path, form.FormDataContentType(), &body)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	return json.NewDecoder(response.Body).Decode(result)
+}
+
+// download copies the answer of a GET request to w
+func (b remoteBackend) download(path string, w io.Writer) error {
+	response, err := b.do(http.MethodGet, path, "", nil)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	_, err = io.Copy(w, response.Body)
+	return err
+}
+
+func (b remoteBackend) CreateBook(args BookArgs) (*Book, error) {
+	book := &Book{}
+	err := b.doCreate("/books", args, book)
+	if err != nil {
+		return nil, err
+	}
+	return book, nil
+}
+
+func (b remoteBackend) ListBooks(args BookArgs) ([]Book, error) {
+	books := []Book{}
+	err := b.doJSON(http.MethodGet, "/books", args, &books)
+	if err != nil {
+		return nil, err
+	}
+	return books, nil
+}
+
+func (b remoteBackend) CreateCollection(args CollectionArgs) (*Collection, error) {
+	collection := &Collection{}
+	err := b.doCreate("/collections", args, collection)
+	if err != nil {
+		return nil, err
+	}
+	return collection, nil
+}
+
+func (b remoteBackend) ListCollections(args CollectionArgs) ([]Collection, error) {
+	collections := []Collection{}
+	err := b.doJSON(http.MethodGet, "/collections", args, &collections)
+	if err != nil {
+		return nil, err
+	}
+	return collections, nil
+}
+
+// AddBookToCollection lists the collection afterwards, the handler only answers with a message
+func (b remoteBackend) AddBookToCollection(args AddBookToCollectionArgs) (*Collection, *Book, error) {
+	if args.CollectionID == nil {
+		return nil, nil, errors.New("no collection chosen, book could not be added")
+	}
+
+	body, err := json.Marshal(AddBookToCollectionArgs{BookID: args.BookID})
+	if err != nil {
+		return nil, nil, err
+	}
+	response, err := b.do(http.MethodPost, fmt.Sprintf("/collections/%d", *args.CollectionID), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	response.Body.Close()
+
+	collections, err := b.ListCollections(CollectionArgs{CollectionID: args.CollectionID})
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(collections) == 0 {
+		return nil, nil, fmt.Errorf("collection %d not found", *args.CollectionID)
+	}
+	for _, book := range collections[0].CollectionBooks {
+		if args.BookID != nil && book.BookID == *args.BookID {
+			return &collections[0], &book, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("book was not added to collection %d", *args.CollectionID)
+}
+
+func (b remoteBackend) UpdateBook(args BookArgs) (*Book, error) {
+	if args.BookID == nil {
+		return nil, errors.New("choose the book to update and insert its ID number")
+	}
+	book := &Book{}
+	err := b.doJSON(http.MethodPatch, fmt.Sprintf("/books/%d", *args.BookID), args, book)
+	if err != nil {
+		return nil, err
+	}
+	return book, nil
+}
+
+// RemoveBookFromCollection reads the book and the collection first, the handler only answers with a message
+func (b remoteBackend) RemoveBookFromCollection(args AddBookToCollectionArgs) (*Collection, *Book, error) {
+	if args.BookID == nil || args.CollectionID == nil {
+		return nil, nil, errors.New("choose the book and the collection and insert their ID numbers")
+	}
+
+	books, err := b.ListBooks(BookArgs{BookID: args.BookID})
+	if err != nil {
+		return nil, nil, err
+	}
+	collections, err := b.ListCollections(CollectionArgs{CollectionID: args.CollectionID})
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(books) == 0 || len(collections) == 0 {
+		return nil, nil, errors.New("book or collection not found")
+	}
+
+	response, err := b.do(http.MethodDelete, fmt.Sprintf("/collections/%d/books/%d", *args.CollectionID, *args.BookID), "", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	response.Body.Close()
+	return &collections[0], &books[0], nil
+}
+
+func (b remoteBackend) SetReadingStatus(args ReadingStatusArgs) (*ReadingStatus, error) {
+	if args.BookID == nil {
+		return nil, errors.New("choose the book and insert its ID number")
+	}
+	status := &ReadingStatus{}
+	err := b.doJSON(http.MethodPut, fmt.Sprintf("/books/%d/status", *args.BookID), args, status)
+	if err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// ListReadingStatuses lists the statuses of one book, the API has them under the book
+func (b remoteBackend) ListReadingStatuses(args ReadingStatusArgs) ([]ReadingStatus, error) {
+	if args.BookID == nil {
+		return nil, errors.New("choose the book and insert its ID number")
+	}
+	statuses := []ReadingStatus{}
+	err := b.doJSON(http.MethodGet, fmt.Sprintf("/books/%d/status", *args.BookID), args, &statuses)
+	if err != nil {
+		return nil, err
+	}
+	return statuses, nil
+}
+
+func (b remoteBackend) LogReadingSession(args ReadingSessionArgs) (*ReadingProgress, error) {
+	if args.BookID == nil {
+		return nil, errors.New("choose the book and insert its ID number")
+	}
+	progress := &ReadingProgress{}
+	err := b.doJSON(http.MethodPost, fmt.Sprintf("/books/%d/sessions", *args.BookID), args, progress)
+	if err != nil {
+		return nil, err
+	}
+	return progress, nil
+}
+
+func (b remoteBackend) GetReadingProgress(args ReadingSessionArgs) (*ReadingProgress, error) {
+	if args.BookID == nil {
+		return nil, errors.New("choose the book and insert its ID number")
+	}
+	progress := &ReadingProgress{}
+	err := b.doJSON(http.MethodGet, fmt.Sprintf("/books/%d/progress", *args.BookID), args, progress)
+	if err != nil {
+		return nil, err
+	}
+	return progress, nil
+}
+
+func (b remoteBackend) CreateReview(args ReviewArgs) (*Review, error) {
+	if args.BookID == nil {
+		return nil, errors.New("choose the book and insert its ID number")
+	}
+	review := &Review{}
+	err := b.doCreate(fmt.Sprintf("/books/%d/reviews", *args.BookID), args, review)
+	if err != nil {
+		return nil, err
+	}
+	return review, nil
+}
+
+func (b remoteBackend) UpdateReview(args ReviewArgs) (*Review, error) {
+	if args.BookID == nil {
+		return nil, errors.New("choose the book and insert its ID number")
+	}
+	review := &Review{}
+	err := b.doJSON(http.MethodPatch, fmt.Sprintf("/books/%d/reviews", *args.BookID), args, review)
+	if err != nil {
+		return nil, err
+	}
+	return review, nil
+}
+
+func (b remoteBackend) ListReviews(args ReviewArgs) ([]Review, error) {
+	reviews := []Review{}
+	err := b.doJSON(http.MethodGet, "/reviews", args, &reviews)
+	if err != nil {
+		return nil, err
+	}
+	return reviews, nil
+}
+
+func (b remoteBackend) CreateNote(args NoteArgs) (*Note, error) {
+	if args.BookID == nil {
+		return nil, errors.New("choose the book and insert its ID number")
+	}
+	note := &Note{}
+	err := b.doCreate(fmt.Sprintf("/books/%d/notes", *args.BookID), args, note)
+	if err != nil {
+		return nil, err
+	}
+	return note, nil
+}
+
+func (b remoteBackend) UpdateNote(args NoteArgs) (*Note, error) {
+	if args.NoteID == nil {
+		return nil, errors.New("choose the note to update and insert its ID number")
+	}
+	note := &Note{}
+	err := b.doJSON(http.MethodPatch, fmt.Sprintf("/notes/%d", *args.NoteID), args, note)
+	if err != nil {
+		return nil, err
+	}
+	return note, nil
+}
+
+func (b remoteBackend) DeleteNote(args NoteArgs) (*Note, error) {
+	if args.NoteID == nil {
+		return nil, errors.New("choose the note to delete and insert its ID number")
+	}
+	note := &Note{}
+	err := b.doJSON(http.MethodDelete, fmt.Sprintf("/notes/%d", *args.NoteID), args, note)
+	if err != nil {
+		return nil, err
+	}
+	return note, nil
+}
+
+// ListNotes lists the notes of a book under the book, like the API, and searches all notes otherwise
+func (b remoteBackend) ListNotes(args NoteArgs) ([]Note, error) {
+	path := "/notes"
+	if args.BookID != nil {
+		path = fmt.Sprintf("/books/%d/notes", *args.BookID)
+	}
+	notes := []Note{}
+	err := b.doJSON(http.MethodGet, path, args, &notes)
+	if err != nil {
+		return nil, err
+	}
+	return notes, nil
+}
+
+func (b remoteBackend) LendBook(args LoanArgs) (*Loan, error) {
+	loan := &Loan{}
+	err := b.doCreate("/loans", args, loan)
+	if err != nil {
+		return nil, err
+	}
+	return loan, nil
+}
+
+func (b remoteBackend) ReturnBook(args LoanArgs) (*Loan, error) {
+	loan := &Loan{}
+	err := b.doJSON(http.MethodPost, "/loans/return", args, loan)
+	if err != nil {
+		return nil, err
+	}
+	return loan, nil
+}
+
+func (b remoteBackend) ListLoans(args LoanArgs) ([]Loan, error) {
+	loans := []Loan{}
+	err := b.doJSON(http.MethodGet, "/loans", args, &loans)
+	if err != nil {
+		return nil, err
+	}
+	return loans, nil
+}
+
+func (b remoteBackend) CreateCopy(args CopyArgs) (*Copy, error) {
+	if args.BookID == nil {
+		return nil, errors.New("choose the book and insert its ID number")
+	}
+	copy := &Copy{}
+	err := b.doCreate(fmt.Sprintf("/books/%d/copies", *args.BookID), args, copy)
+	if err != nil {
+		return nil, err
+	}
+	return copy, nil
+}
+
+func (b remoteBackend) UpdateCopy(args CopyArgs) (*Copy, error) {
+	if args.CopyID == nil {
+		return nil, errors.New("choose the copy to update and insert its ID number")
+	}
+	copy := &Copy{}
+	err := b.doJSON(http.MethodPatch, fmt.Sprintf("/copies/%d", *args.CopyID), args, copy)
+	if err != nil {
+		return nil, err
+	}
+	return copy, nil
+}
+
+func (b remoteBackend) DeleteCopy(args CopyArgs) (*Copy, error) {
+	if args.CopyID == nil {
+		return nil, errors.New("choose the copy to delete and insert its ID number")
+	}
+	copy := &Copy{}
+	err := b.doJSON(http.MethodDelete, fmt.Sprintf("/copies/%d", *args.CopyID), args, copy)
+	if err != nil {
+		return nil, err
+	}
+	return copy, nil
+}
+
+// ListCopies lists the copies of a book under the book, like the API, and searches all copies otherwise
+func (b remoteBackend) ListCopies(args CopyArgs) ([]Copy, error) {
+	path := "/copies"
+	if args.BookID != nil {
+		path = fmt.Sprintf("/books/%d/copies", *args.BookID)
+	}
+	copies := []Copy{}
+	err := b.doJSON(http.MethodGet, path, args, &copies)
+	if err != nil {
+		return nil, err
+	}
+	return copies, nil
+}
+
+func (b remoteBackend) CreateWish(args WishArgs) (*Wish, error) {
+	wish := &Wish{}
+	err := b.doCreate("/wishlist", args, wish)
+	if err != nil {
+		return nil, err
+	}
+	return wish, nil
+}
+
+func (b remoteBackend) UpdateWish(args WishArgs) (*Wish, error) {
+	if args.WishID == nil {
+		return nil, errors.New("choose the wish to update and insert its ID number")
+	}
+	wish := &Wish{}
+	err := b.doJSON(http.MethodPatch, fmt.Sprintf("/wishlist/%d", *args.WishID), args, wish)
+	if err != nil {
+		return nil, err
+	}
+	return wish, nil
+}
+
+func (b remoteBackend) DeleteWish(args WishArgs) (*Wish, error) {
+	if args.WishID == nil {
+		return nil, errors.New("choose the wish to delete and insert its ID number")
+	}
+	wish := &Wish{}
+	err := b.doJSON(http.MethodDelete, fmt.Sprintf("/wishlist/%d", *args.WishID), args, wish)
+	if err != nil {
+		return nil, err
+	}
+	return wish, nil
+}
+
+func (b remoteBackend) ListWishes(args WishArgs) ([]Wish, error) {
+	wishes := []Wish{}
+	err := b.doJSON(http.MethodGet, "/wishlist", args, &wishes)
+	if err != nil {
+		return nil, err
+	}
+	return wishes, nil
+}
+
+func (b remoteBackend) AcquireWish(args AcquireArgs) (*Acquisition, error) {
+	if args.WishID == nil {
+		return nil, errors.New("choose the wish to acquire and insert its ID number")
+	}
+	acquisition := &Acquisition{}
+	err := b.doCreate(fmt.Sprintf("/wishlist/%d/acquire", *args.WishID), args, acquisition)
+	if err != nil {
+		return nil, err
+	}
+	return acquisition, nil
+}
+
+func (b remoteBackend) RecordPurchase(args PurchaseArgs) (*Purchase, error) {
+	if args.BookID == nil {
+		return nil, errors.New("choose the book and insert its ID number")
+	}
+	purchase := &Purchase{}
+	err := b.doCreate(fmt.Sprintf("/books/%d/purchases", *args.BookID), args, purchase)
+	if err != nil {
+		return nil, err
+	}
+	return purchase, nil
+}
+
+func (b remoteBackend) ListPurchases(args PurchaseArgs) ([]Purchase, error) {
+	purchases := []Purchase{}
+	err := b.doJSON(http.MethodGet, "/purchases", args, &purchases)
+	if err != nil {
+		return nil, err
+	}
+	return purchases, nil
+}
+
+func (b remoteBackend) SpendingReport(args PurchaseArgs) ([]MonthlySpending, error) {
+	spending := []MonthlySpending{}
+	err := b.doJSON(http.MethodGet, "/purchases/spending", args, &spending)
+	if err != nil {
+		return nil, err
+	}
+	return spending, nil
+}
+
+func (b remoteBackend) CreateTag(args TagArgs) (*Tag, error) {
+	tag := &Tag{}
+	err := b.doCreate("/tags", args, tag)
+	if err != nil {
+		return nil, err
+	}
+	return tag, nil
+}
+
+func (b remoteBackend) UpdateTag(args TagArgs) (*Tag, error) {
+	if args.TagID == nil {
+		return nil, errors.New("choose the tag to update and insert its ID number")
+	}
+	tag := &Tag{}
+	err := b.doJSON(http.MethodPatch, fmt.Sprintf("/tags/%d", *args.TagID), args, tag)
+	if err != nil {
+		return nil, err
+	}
+	return tag, nil
+}
+
+func (b remoteBackend) DeleteTag(args TagArgs) (*Tag, error) {
+	if args.TagID == nil {
+		return nil, errors.New("choose the tag to delete and insert its ID number")
+	}
+	tag := &Tag{}
+	err := b.doJSON(http.MethodDelete, fmt.Sprintf("/tags/%d", *args.TagID), args, tag)
+	if err != nil {
+		return nil, err
+	}
+	return tag, nil
+}
+
+func (b remoteBackend) ListTags(args TagArgs) ([]Tag, error) {
+	tags := []Tag{}
+	err := b.doJSON(http.MethodGet, "/tags", args, &tags)
+	if err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+func (b remoteBackend) TagBook(args BookTagsArgs) (*Book, error) {
+	if args.BookID == nil {
+		return nil, errors.New("choose the book and insert its ID number")
+	}
+	book := &Book{}
+	err := b.doJSON(http.MethodPost, fmt.Sprintf("/books/%d/tags", *args.BookID), args, book)
+	if err != nil {
+		return nil, err
+	}
+	return book, nil
+}
+
+func (b remoteBackend) UntagBook(args BookTagsArgs) (*Book, error) {
+	if args.BookID == nil {
+		return nil, errors.New("choose the book and insert its ID number")
+	}
+	book := &Book{}
+	err := b.doJSON(http.MethodDelete, fmt.Sprintf("/books/%d/tags", *args.BookID), args, book)
+	if err != nil {
+		return nil, err
+	}
+	return book, nil
+}
+
+func (b remoteBackend) ImportBooksCSV(r io.Reader, args ImportArgs) (*ImportReport, error) {
+	values := map[string]string{
+		"format":  "csv",
+		"map":     formatColumnMapping(args.Columns),
+		"dry_run": strconv.FormatBool(args.DryRun),
+	}
+	if args.BatchSize > 0 {
+		values["batch_size"] = strconv.Itoa(args.BatchSize)
+	}
+
+	report := &ImportReport{}
+	err := b.upload("/import/books", "books.csv", r, values, report)
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func (b remoteBackend) ImportShelvesCSV(r io.Reader, format string) (*ShelfImportReport, error) {
+	report := &ShelfImportReport{}
+	err := b.upload("/import/books", format+".csv", r, map[string]string{"format": format}, report)
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func (b remoteBackend) ImportCitations(r io.Reader, format string) (*ImportReport, error) {
+	report := &ImportReport{}
+	err := b.upload("/import/books", "citations."+format, r, map[string]string{"format": format}, report)
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func (b remoteBackend) ImportMARC(r io.Reader, format string) (*ImportReport, error) {
+	report := &ImportReport{}
+	err := b.upload("/import/books", "records."+format, r, map[string]string{"format": format}, report)
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func (b remoteBackend) ImportCalibreLibrary(dir string) (*ShelfImportReport, error) {
+	return nil, directOnly("importing a calibre library")
+}
+
+// ScanBooks reads the directory here and uploads every EPUB and PDF file to the
+// server, which answers 201 for a created book, 200 for a matched one and 400 with
+// the reason of a skipped file. Copies are not recorded, the files are not on the server.
+func (b remoteBackend) ScanBooks(dir string, args ScanArgs) (*ScanReport, error) {
+	if args.RecordCopy {
+		return nil, directOnly("recording ebook copies")
+	}
+
+	report := &ScanReport{Created: []ScanEntry{}, Matched: []ScanEntry{}, Skipped: []ScanEntry{}}
+	err := filepath.WalkDir(dir, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if _, ok := scanFormats[strings.ToLower(filepath.Ext(name))]; !ok || entry.IsDir() {
+			return nil
+		}
+
+		file, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		fileReport := &ScanReport{}
+		err = b.upload("/books/from-file", filepath.Base(name), file, nil, fileReport)
+		var answer remoteError
+		if errors.As(err, &answer) && answer.status == http.StatusBadRequest {
+			report.Skipped = append(report.Skipped, ScanEntry{Path: name, Reason: answer.message})
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// the server only knows the name of the upload
+		for _, entry := range fileReport.Created {
+			entry.Path = name
+			report.Created = append(report.Created, entry)
+		}
+		for _, entry := range fileReport.Matched {
+			entry.Path = name
+			report.Matched = append(report.Matched, entry)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func (b remoteBackend) ExportCatalogue(w io.Writer, args ExportArgs) error {
+	query := url.Values{"format": {args.Format}}
+	if args.CollectionID != nil {
+		query.Set("collection_id", strconv.Itoa(*args.CollectionID))
+	}
+	return b.download("/export?"+query.Encode(), w)
+}
+
+func (b remoteBackend) ExportCollectionCitations(w io.Writer, collectionID int, format string) error {
+	query := url.Values{"format": {format}}
+	return b.download(fmt.Sprintf("/collections/%d/export?%s", collectionID, query.Encode()), w)
+}
+
+func (b remoteBackend) Backup(w io.Writer) (*BackupManifest, error) {
+	return nil, directOnly("backup")
+}
+
+func (b remoteBackend) Restore(r io.ReaderAt, size int64, args RestoreArgs) (*RestoreReport, error) {
+	return nil, directOnly("restore")
+}
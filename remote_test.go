@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// the remote backend is tested against a stand-in server answering like the handlers do
+
+func TestRemoteBackend_CreateAndListBooks(t *testing.T) {
+	// Setup
+	var authorization string
+	var listArgs BookArgs
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		switch r.Method {
+		case http.MethodPost:
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprintf(w, "Book Mort created with ID 4\n")
+			json.NewEncoder(w).Encode(Book{BookID: 4, Title: "Mort", Author: "Terry Pratchett"})
+		case http.MethodGet:
+			json.NewDecoder(r.Body).Decode(&listArgs)
+			json.NewEncoder(w).Encode([]Book{{BookID: 4, Title: "Mort"}})
+		}
+	}))
+	defer server.Close()
+	remote := newRemoteBackend(Profile{URL: server.URL + "/", Token: "secret"})
+	title := "Mort"
+
+	// Function to test
+	book, err := remote.CreateBook(BookArgs{Title: &title})
+	require.NoError(t, err)
+	books, err := remote.ListBooks(BookArgs{Title: &title})
+	require.NoError(t, err)
+
+	// Verification
+	assert.Equal(t, "Bearer secret", authorization)
+	assert.Equal(t, 4, book.BookID)
+	assert.Equal(t, "Terry Pratchett", book.Author)
+	assert.Equal(t, "Mort", *listArgs.Title)
+	assert.Len(t, books, 1)
+}
+
+func TestRemoteBackend_ServerError(t *testing.T) {
+	// Setup
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no book title set, book not created", http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	// Function to test
+	book, err := newRemoteBackend(Profile{URL: server.URL}).CreateBook(BookArgs{})
+
+	// Verification
+	assert.Nil(t, book)
+	assert.EqualError(t, err, "no book title set, book not created")
+}
+
+func TestRemoteBackend_ScanBooks(t *testing.T) {
+	// Setup
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "mort.epub"), []byte("epub"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "broken.pdf"), []byte("pdf"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("txt"), 0o644))
+
+	uploads := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, header, err := r.FormFile("file")
+		require.NoError(t, err)
+		uploads = append(uploads, header.Filename)
+		if header.Filename == "broken.pdf" {
+			http.Error(w, "no pdf trailer found", http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(ScanReport{Created: []ScanEntry{{Path: header.Filename, BookID: 4}}})
+	}))
+	defer server.Close()
+
+	// Function to test
+	report, err := newRemoteBackend(Profile{URL: server.URL}).ScanBooks(dir, ScanArgs{})
+	copyReport, copyErr := newRemoteBackend(Profile{URL: server.URL}).ScanBooks(dir, ScanArgs{RecordCopy: true})
+
+	// Verification
+	require.NoError(t, err)
+	assert.Equal(t, []string{"broken.pdf", "mort.epub"}, uploads)
+	require.Len(t, report.Created, 1)
+	assert.Equal(t, filepath.Join(dir, "mort.epub"), report.Created[0].Path)
+	require.Len(t, report.Skipped, 1)
+	assert.Equal(t, "no pdf trailer found", report.Skipped[0].Reason)
+
+	// the uploaded files have no location on the server to record as copies
+	assert.Nil(t, copyReport)
+	assert.EqualError(t, copyErr, "recording ebook copies needs a direct database connection, run it with -direct")
+}
+
+func TestRequireAPIToken(t *testing.T) {
+	// Setup
+	config := &Config{}
+	config.Server.APIToken = "secret"
+	router := newRouter(config)
+
+	for _, test := range []struct {
+		authorization string
+		status        int
+	}{
+		{authorization: "", status: http.StatusUnauthorized},
+		{authorization: "secret", status: http.StatusUnauthorized},
+		{authorization: "Bearer wrong", status: http.StatusUnauthorized},
+		{authorization: "Bearer secret", status: http.StatusOK},
+	} {
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		request.Header.Set("Authorization", test.authorization)
+		recorder := httptest.NewRecorder()
+
+		// Function to test
+		router.ServeHTTP(recorder, request)
+
+		// Verification
+		assert.Equal(t, test.status, recorder.Code, test.authorization)
+	}
+}
+
+func TestLoadProfile(t *testing.T) {
+	// Setup
+	path := filepath.Join(t.TempDir(), "profiles.yml")
+	require.NoError(t, os.WriteFile(path, []byte("default: team\nprofiles:\n  team:\n    url: http://books.example.com\n    token: secret\n  local:\n    url: http://localhost:8080\n"), 0o600))
+	t.Setenv("BOOKISH_PROFILES", path)
+
+	// Function to test
+	team, err := LoadProfile("")
+	require.NoError(t, err)
+	local, err := LoadProfile("local")
+	require.NoError(t, err)
+	_, err = LoadProfile("missing")
+
+	// Verification
+	assert.Equal(t, Profile{Name: "team", URL: "http://books.example.com", Token: "secret"}, *team)
+	assert.Equal(t, "http://localhost:8080", local.URL)
+	assert.Error(t, err)
+}
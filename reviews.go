@@ -0,0 +1,211 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// bookSorts are the orders ListBooks can sort books in
+var bookSorts = []string{"id", "rating"}
+
+// checkRating accepts ratings from half a star to five stars, in half stars
+func checkRating(rating float64) error {
+	if rating < 0.5 || rating > 5 || math.Mod(rating*2, 1) != 0 {
+		return fmt.Errorf("invalid rating %g, expected 0.5 to 5 stars in half stars", rating)
+	}
+	return nil
+}
+
+// CreateReview records the rating and the review of a user for a book. Either may be
+// left out, but not both; the review is markdown and kept as it is written.
+func CreateReview(db *sql.DB, r ReviewArgs) (*Review, error) {
+	if r.BookID == nil {
+		return nil, errors.New("choose the book and insert its ID number")
+	}
+	if r.Rating == nil && (r.Review == nil || strings.TrimSpace(*r.Review) == "") {
+		return nil, errors.New("no rating or review set, review not created")
+	}
+	if r.Rating != nil {
+		err := checkRating(*r.Rating)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // no-op once the transaction is committed
+
+	// check if there is a book with the chosen ID
+	_, err = listBooks(tx, BookArgs{BookID: r.BookID})
+	if err != nil {
+		return nil, err
+	}
+	userID, err := upsertUser(tx, r.User)
+	if err != nil {
+		return nil, err
+	}
+
+	var reviewID int
+	err = tx.QueryRow("INSERT INTO reviews (user_id, book_id, rating, review) VALUES ($1, $2, $3, NULLIF($4, '')) ON CONFLICT DO NOTHING RETURNING review_id", userID, *r.BookID, r.Rating, r.Review).Scan(&reviewID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			err = errors.New("review already exists in the database, edit it instead")
+		}
+		return nil, err
+	}
+
+	reviews, err := listReviews(tx, ReviewArgs{ReviewID: &reviewID})
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return &reviews[0], nil
+}
+
+// UpdateReview changes the rating or the review of a user for a book, the fields left
+// out keep their value. A rating of 0 or an empty review clears it, as long as the
+// other one is kept.
+func UpdateReview(db *sql.DB, r ReviewArgs) (*Review, error) {
+	if r.BookID == nil {
+		return nil, errors.New("choose the book and insert its ID number")
+	}
+	if r.User == nil || strings.TrimSpace(*r.User) == "" {
+		return nil, errors.New("no user set, choose whose review this is")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // no-op once the transaction is committed
+
+	reviews, err := listReviews(tx, ReviewArgs{BookID: r.BookID, User: r.User})
+	if err != nil {
+		return nil, err
+	}
+	reviewID := reviews[0].ReviewID
+
+	sets := []string{}
+	params := []any{}
+	set := func(column string, value any) {
+		params = append(params, value)
+		sets = append(sets, fmt.Sprintf("%s = $%d", column, len(params)))
+	}
+	if r.Rating != nil {
+		if *r.Rating == 0 {
+			set("rating", nil)
+		} else {
+			err := checkRating(*r.Rating)
+			if err != nil {
+				return nil, err
+			}
+			set("rating", *r.Rating)
+		}
+	}
+	if r.Review != nil {
+		set("review", optionalValue(*r.Review))
+	}
+
+	if len(sets) > 0 {
+		params = append(params, reviewID)
+		_, err = tx.Exec(fmt.Sprintf("UPDATE reviews SET %s, updated_at = CURRENT_TIMESTAMP WHERE review_id = $%d", strings.Join(sets, ", "), len(params)), params...)
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23514" { // both the rating and the review are cleared
+			return nil, errors.New("a review needs a rating or a text, both cannot be cleared")
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	reviews, err = listReviews(tx, ReviewArgs{ReviewID: &reviewID})
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return &reviews[0], nil
+}
+
+// ListReviews lists the reviews of a book, of a user, or all of them
+func ListReviews(db *sql.DB, r ReviewArgs) ([]Review, error) {
+	return listReviews(db, r)
+}
+
+func listReviews(q querier, r ReviewArgs) ([]Review, error) {
+	reviews := []Review{}
+
+	query := `
+		SELECT reviews.review_id, reviews.book_id, books.title, users.name, reviews.rating,
+		       reviews.review, reviews.created_at, reviews.updated_at
+		FROM reviews
+		JOIN books ON reviews.book_id = books.book_id
+		JOIN users ON reviews.user_id = users.user_id
+		`
+
+	whereClauses := []string{}
+	params := []any{}
+	bind := func(value any) string {
+		params = append(params, value)
+		return fmt.Sprintf("$%d", len(params))
+	}
+	if r.ReviewID != nil {
+		whereClauses = append(whereClauses, "reviews.review_id = "+bind(*r.ReviewID))
+	}
+	if r.BookID != nil {
+		whereClauses = append(whereClauses, "reviews.book_id = "+bind(*r.BookID))
+	}
+	if r.User != nil {
+		whereClauses = append(whereClauses, "users.name = "+bind(strings.TrimSpace(*r.User)))
+	}
+	if len(whereClauses) > 0 {
+		query += "WHERE " + strings.Join(whereClauses, " AND ")
+	}
+	query += " ORDER BY reviews.book_id, reviews.updated_at DESC"
+
+	rows, err := q.Query(query, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var review Review
+		var rating sql.NullFloat64
+		var text sql.NullString
+		err := rows.Scan(&review.ReviewID, &review.BookID, &review.Title, &review.User, &rating, &text, &review.CreatedAt, &review.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		if rating.Valid {
+			review.Rating = &rating.Float64
+		}
+		review.Review = text.String
+		reviews = append(reviews, review)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(reviews) == 0 {
+		return nil, errors.New("no review with the chosen specification")
+	}
+	return reviews, nil
+}
@@ -0,0 +1,677 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"database/sql"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// scanFormats reads the metadata of each supported ebook format, keyed by file extension
+var scanFormats = map[string]func(r io.ReaderAt, size int64) (*FileMetadata, error){
+	".epub": ReadEPUBMetadata,
+	".pdf":  ReadPDFMetadata,
+}
+
+type epubContainer struct {
+	Rootfiles []struct {
+		FullPath string `xml:"full-path,attr"`
+	} `xml:"rootfiles>rootfile"`
+}
+
+type epubPackage struct {
+	Titles      []string      `xml:"metadata>title"`
+	Creators    []epubCreator `xml:"metadata>creator"`
+	Identifiers []struct {
+		Scheme string `xml:"http://www.idpf.org/2007/opf scheme,attr"`
+		Value  string `xml:",chardata"`
+	} `xml:"metadata>identifier"`
+	Languages  []string `xml:"metadata>language"`
+	Publishers []string `xml:"metadata>publisher"`
+	Dates      []struct {
+		Event string `xml:"http://www.idpf.org/2007/opf event,attr"`
+		Value string `xml:",chardata"`
+	} `xml:"metadata>date"`
+	Subjects []string `xml:"metadata>subject"`
+	// EPUB 3 refines elements with property metas, EPUB 2 and Calibre use name and content
+	Metas []struct {
+		Refines  string `xml:"refines,attr"`
+		Property string `xml:"property,attr"`
+		Name     string `xml:"name,attr"`
+		Content  string `xml:"content,attr"`
+		Value    string `xml:",chardata"`
+	} `xml:"metadata>meta"`
+}
+
+type epubCreator struct {
+	ID    string `xml:"id,attr"`
+	Role  string `xml:"http://www.idpf.org/2007/opf role,attr"`
+	Value string `xml:",chardata"`
+}
+
+// ReadEPUBMetadata reads the Dublin Core metadata of the package document an EPUB
+// container points to. Creators count as authors unless their role (opf:role in
+// EPUB 2, a refining meta in EPUB 3) says they are, for example, an illustrator.
+func ReadEPUBMetadata(r io.ReaderAt, size int64) (*FileMetadata, error) {
+	archive, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("not an epub file: %w", err)
+	}
+
+	var container epubContainer
+	err = readEPUBFile(archive, "META-INF/container.xml", &container)
+	if err != nil {
+		return nil, err
+	}
+	if len(container.Rootfiles) == 0 || container.Rootfiles[0].FullPath == "" {
+		return nil, errors.New("epub container has no package document")
+	}
+
+	var pkg epubPackage
+	err = readEPUBFile(archive, container.Rootfiles[0].FullPath, &pkg)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := &FileMetadata{Format: "epub", Authors: []string{}, Identifiers: []string{}}
+	metadata.Title = firstValue(pkg.Titles)
+	metadata.Language = firstValue(pkg.Languages)
+	metadata.Publisher = firstValue(pkg.Publishers)
+
+	roles := map[string]string{}
+	for _, meta := range pkg.Metas {
+		if meta.Property == "role" {
+			roles[strings.TrimPrefix(meta.Refines, "#")] = strings.TrimSpace(meta.Value)
+		}
+	}
+	for _, creator := range pkg.Creators {
+		role := creator.Role
+		if role == "" {
+			role = roles[creator.ID]
+		}
+		if name := strings.TrimSpace(creator.Value); name != "" && (role == "" || role == "aut") {
+			metadata.Authors = append(metadata.Authors, name)
+		}
+	}
+
+	for _, identifier := range pkg.Identifiers {
+		value := strings.TrimSpace(identifier.Value)
+		if value == "" {
+			continue
+		}
+		metadata.Identifiers = append(metadata.Identifiers, value)
+		if metadata.ISBN == "" {
+			metadata.ISBN = identifierISBN(value, identifier.Scheme)
+		}
+	}
+
+	// EPUB 2 files may carry several dates, the publication one is preferred
+	for _, date := range pkg.Dates {
+		if metadata.Date == "" || strings.EqualFold(date.Event, "publication") {
+			metadata.Date = strings.TrimSpace(date.Value)
+		}
+	}
+
+	return metadata, nil
+}
+
+func readEPUBFile(archive *zip.Reader, name string, v any) error {
+	file, err := archive.Open(name)
+	if err != nil {
+		return fmt.Errorf("epub is missing %s", name)
+	}
+	defer file.Close()
+
+	err = xml.NewDecoder(file).Decode(v)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", path.Base(name), err)
+	}
+	return nil
+}
+
+func firstValue(values []string) string {
+	for _, value := range values {
+		if value = strings.TrimSpace(value); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// identifierISBN returns the ISBN of an identifier such as "urn:isbn:9780261102217"
+// or a bare number with an ISBN scheme, or an empty string
+func identifierISBN(identifier string, scheme string) string {
+	lower := strings.ToLower(identifier)
+	switch {
+	case strings.HasPrefix(lower, "urn:isbn:"):
+		identifier = identifier[len("urn:isbn:"):]
+	case strings.HasPrefix(lower, "isbn:"):
+		identifier = identifier[len("isbn:"):]
+	case !strings.EqualFold(scheme, "isbn"):
+		return ""
+	}
+
+	isbn, err := SanitizeISBN(&identifier)
+	if err != nil || isbn == nil {
+		return ""
+	}
+	return *isbn
+}
+
+var (
+	pdfInfoReference = regexp.MustCompile(`/Info\s+(\d+)\s+(\d+)\s+R`)
+	pdfPrevious      = regexp.MustCompile(`/Prev\s+(\d+)`)
+	pdfDate          = regexp.MustCompile(`^D:(\d{4})(\d{2})?(\d{2})?`)
+)
+
+// pdfWindow is how much of a pdf file is read at once: the start and the end of the
+// file for the trailers, an xref section or the information dictionary
+const pdfWindow = 64 << 10
+
+// readPDFRegion reads up to length bytes of r from offset, within the size of the file
+func readPDFRegion(r io.ReaderAt, size int64, offset int64, length int64) ([]byte, error) {
+	if offset < 0 {
+		offset = 0
+	}
+	if offset+length > size {
+		length = size - offset
+	}
+	if length <= 0 {
+		return []byte{}, nil
+	}
+	region := make([]byte, length)
+	read, err := r.ReadAt(region, offset)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return region[:read], nil
+}
+
+// ReadPDFMetadata reads the document information dictionary the trailer refers to.
+// Only the trailers at the end of the file, or at its start for linearized files, and
+// the dictionary itself are read, the dictionary is found through the xref table.
+// Dictionaries stored in compressed object streams cannot be read.
+func ReadPDFMetadata(r io.ReaderAt, size int64) (*FileMetadata, error) {
+	head, err := readPDFRegion(r, size, 0, pdfWindow)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(head, []byte("%PDF-")) {
+		return nil, errors.New("not a pdf file")
+	}
+	tail, err := readPDFRegion(r, size, size-pdfWindow, pdfWindow)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := &FileMetadata{Format: "pdf", Authors: []string{}, Identifiers: []string{}}
+
+	// incremental updates append trailers, the last one is current
+	references := pdfInfoReference.FindAllSubmatch(tail, -1)
+	if len(references) == 0 {
+		references = pdfInfoReference.FindAllSubmatch(head, -1)
+	}
+	if len(references) == 0 {
+		return metadata, nil
+	}
+	reference := references[len(references)-1]
+	number, _ := strconv.Atoi(string(reference[1]))
+	object := regexp.MustCompile(`(?:^|\s)` + string(reference[1]) + `\s+` + string(reference[2]) + `\s+obj\s*<<`)
+
+	dictionary, err := findPDFObject(r, size, tail, number, object)
+	if err != nil || dictionary == nil {
+		return metadata, err
+	}
+
+	info := parsePDFDictionary(dictionary)
+	metadata.Title = info["Title"]
+	for _, author := range strings.Split(info["Author"], ";") {
+		if author = strings.TrimSpace(author); author != "" {
+			metadata.Authors = append(metadata.Authors, author)
+		}
+	}
+	if match := pdfDate.FindStringSubmatch(info["CreationDate"]); match != nil {
+		metadata.Date = strings.TrimRight(strings.Join(match[1:], "-"), "-")
+	}
+
+	return metadata, nil
+}
+
+// findPDFObject returns the content of a dictionary object after its "<<", or nil when
+// the object is not in the file. The offset of the object is read from the xref
+// tables; files with xref streams, or broken tables, are searched a window at a time.
+func findPDFObject(r io.ReaderAt, size int64, tail []byte, number int, object *regexp.Regexp) ([]byte, error) {
+	if offset, ok := pdfObjectOffset(r, size, tail, number); ok {
+		region, err := readPDFRegion(r, size, offset, pdfWindow)
+		if err != nil {
+			return nil, err
+		}
+		if location := object.FindIndex(region); location != nil && location[0] <= 1 {
+			return region[location[1]:], nil
+		}
+	}
+
+	// the windows overlap so an object header is never split between two of them
+	const overlap = 64
+	for offset := int64(0); offset < size; offset += pdfWindow - overlap {
+		region, err := readPDFRegion(r, size, offset, pdfWindow)
+		if err != nil {
+			return nil, err
+		}
+		if location := object.FindIndex(region); location != nil {
+			return readPDFRegion(r, size, offset+int64(location[1]), pdfWindow)
+		}
+	}
+	return nil, nil
+}
+
+// pdfObjectOffset looks an object up in the xref tables, starting with the one of the
+// last startxref and following the /Prev of each trailer to the older ones
+func pdfObjectOffset(r io.ReaderAt, size int64, tail []byte, number int) (int64, bool) {
+	start := bytes.LastIndex(tail, []byte("startxref"))
+	if start < 0 {
+		return 0, false
+	}
+	fields := bytes.Fields(tail[start+len("startxref"):])
+	if len(fields) == 0 {
+		return 0, false
+	}
+	xref, err := strconv.ParseInt(string(fields[0]), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	visited := map[int64]bool{}
+	for xref >= 0 && xref < size && !visited[xref] {
+		visited[xref] = true
+		section, err := readPDFRegion(r, size, xref, pdfWindow)
+		if err != nil {
+			return 0, false
+		}
+		tokens := bytes.Fields(section)
+		if len(tokens) == 0 || string(tokens[0]) != "xref" {
+			return 0, false // an xref stream
+		}
+
+		// subsections are a first object number and a count, then an offset, a
+		// generation and n or f for each object
+		index := 1
+		for index+1 < len(tokens) && string(tokens[index]) != "trailer" {
+			first, firstErr := strconv.Atoi(string(tokens[index]))
+			count, countErr := strconv.Atoi(string(tokens[index+1]))
+			if firstErr != nil || countErr != nil || count < 0 || count > len(tokens) {
+				return 0, false
+			}
+			index += 2
+			if number >= first && number < first+count {
+				entry := index + 3*(number-first)
+				if entry+2 >= len(tokens) || string(tokens[entry+2]) != "n" {
+					return 0, false
+				}
+				offset, err := strconv.ParseInt(string(tokens[entry]), 10, 64)
+				return offset, err == nil
+			}
+			index += 3 * count
+		}
+
+		// the object was not changed by this update, it is in an older section
+		trailer := bytes.Index(section, []byte("trailer"))
+		if trailer < 0 {
+			return 0, false
+		}
+		previous := pdfPrevious.FindSubmatch(section[trailer:])
+		if previous == nil {
+			return 0, false
+		}
+		xref, _ = strconv.ParseInt(string(previous[1]), 10, 64)
+	}
+	return 0, false
+}
+
+// parsePDFDictionary reads the string values of a dictionary, starting after its "<<",
+// other values such as names, numbers and references are skipped
+func parsePDFDictionary(content []byte) map[string]string {
+	values := map[string]string{}
+	key := ""
+	for index := 0; index < len(content); index++ {
+		switch character := content[index]; {
+		case character == '>' && index+1 < len(content) && content[index+1] == '>':
+			return values
+		case character == '/':
+			end := index + 1
+			for end < len(content) && !bytes.ContainsAny(content[end:end+1], " \t\r\n/<>()[]") {
+				end++
+			}
+			if key == "" {
+				key = string(content[index+1 : end])
+			} else {
+				key = "" // a name value
+			}
+			index = end - 1
+		case character == '(':
+			value, end := readPDFLiteralString(content, index+1)
+			if key != "" {
+				values[key] = decodePDFText(value)
+			}
+			key = ""
+			index = end
+		case character == '<':
+			end := bytes.IndexByte(content[index:], '>')
+			if end < 0 {
+				return values
+			}
+			if key != "" {
+				value, err := decodeHex(string(content[index+1 : index+end]))
+				if err == nil {
+					values[key] = decodePDFText(value)
+				}
+			}
+			key = ""
+			index += end
+		case character == ' ' || character == '\t' || character == '\r' || character == '\n':
+		default:
+			// numbers, booleans and references end the current entry
+			for index+1 < len(content) && !bytes.ContainsAny(content[index+1:index+2], "/>") {
+				index++
+			}
+			key = ""
+		}
+	}
+	return values
+}
+
+// readPDFLiteralString reads a (string) with balanced parentheses and escapes,
+// returning its bytes and the index of the closing parenthesis
+func readPDFLiteralString(content []byte, start int) ([]byte, int) {
+	value := []byte{}
+	depth := 0
+	for index := start; index < len(content); index++ {
+		character := content[index]
+		switch {
+		case character == '\\' && index+1 < len(content):
+			index++
+			escaped := content[index]
+			switch escaped {
+			case 'n':
+				value = append(value, '\n')
+			case 'r':
+				value = append(value, '\r')
+			case 't':
+				value = append(value, '\t')
+			case 'b':
+				value = append(value, '\b')
+			case 'f':
+				value = append(value, '\f')
+			case '\r', '\n':
+				// a line continuation
+			default:
+				if escaped >= '0' && escaped <= '7' {
+					end := index
+					for end < len(content) && end < index+3 && content[end] >= '0' && content[end] <= '7' {
+						end++
+					}
+					octal, _ := strconv.ParseUint(string(content[index:end]), 8, 8)
+					value = append(value, byte(octal))
+					index = end - 1
+				} else {
+					value = append(value, escaped)
+				}
+			}
+		case character == '(':
+			depth++
+			value = append(value, character)
+		case character == ')':
+			if depth == 0 {
+				return value, index
+			}
+			depth--
+			value = append(value, character)
+		default:
+			value = append(value, character)
+		}
+	}
+	return value, len(content)
+}
+
+func decodeHex(text string) ([]byte, error) {
+	text = strings.Join(strings.Fields(text), "")
+	if len(text)%2 == 1 {
+		text += "0"
+	}
+	value := make([]byte, len(text)/2)
+	for index := range value {
+		number, err := strconv.ParseUint(text[2*index:2*index+2], 16, 8)
+		if err != nil {
+			return nil, err
+		}
+		value[index] = byte(number)
+	}
+	return value, nil
+}
+
+// decodePDFText decodes UTF-16 text, marked by its byte order mark, or PDFDocEncoding,
+// which matches Latin-1 for the characters used in titles and names
+func decodePDFText(value []byte) string {
+	if len(value) >= 2 && value[0] == 0xFE && value[1] == 0xFF {
+		units := []uint16{}
+		for index := 2; index+1 < len(value); index += 2 {
+			units = append(units, uint16(value[index])<<8|uint16(value[index+1]))
+		}
+		return strings.TrimSpace(string(utf16.Decode(units)))
+	}
+
+	runes := make([]rune, len(value))
+	for index, character := range value {
+		runes[index] = rune(character)
+	}
+	return strings.TrimSpace(string(runes))
+}
+
+// ReadFileMetadata reads the metadata of an EPUB or PDF file, chosen by its extension.
+// Files without a title are named after the file.
+func ReadFileMetadata(name string, r io.ReaderAt, size int64) (*FileMetadata, error) {
+	extension := strings.ToLower(filepath.Ext(name))
+	read, ok := scanFormats[extension]
+	if !ok {
+		return nil, fmt.Errorf("unsupported file %s, expected an epub or pdf file", filepath.Base(name))
+	}
+
+	metadata, err := read(r, size)
+	if err != nil {
+		return nil, err
+	}
+	metadata.Path = name
+	if metadata.Title == "" {
+		metadata.Title = strings.TrimSuffix(filepath.Base(name), filepath.Ext(name))
+	}
+	return metadata, nil
+}
+
+func (metadata *FileMetadata) bookArgs() BookArgs {
+	book := BookArgs{Title: &metadata.Title, Author: joinAuthors(metadata.Authors), Publisher: optionalValue(metadata.Publisher)}
+	if metadata.ISBN != "" {
+		book.ISBN = &metadata.ISBN
+	}
+
+	// dates may carry a time, as in 1937-09-21T00:00:00Z, only the day is kept
+	date := metadata.Date
+	for _, length := range []int{10, 7, 4} {
+		if len(date) < length {
+			continue
+		}
+		if candidate := date[:length]; candidate != "" {
+			if _, err := SanitizePublishedDate(&candidate); err == nil {
+				book.PublishedDate = &candidate
+				break
+			}
+		}
+	}
+	return book
+}
+
+// ScanBooks reads every EPUB and PDF file under dir and creates a book for each,
+// in one transaction where each file is guarded by a savepoint. Books already in the
+// database are matched by ISBN or by title and author like in shelf imports.
+// The files are recorded by absolute path, so the copies stay valid whatever
+// directory the scan ran from.
+func ScanBooks(db *sql.DB, dir string, args ScanArgs) (*ScanReport, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := []string{}
+	err = filepath.WalkDir(dir, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if _, ok := scanFormats[strings.ToLower(filepath.Ext(name))]; ok && !entry.IsDir() {
+			paths = append(paths, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return scanFiles(db, paths, args, func(name string) (*FileMetadata, error) {
+		file, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		info, err := file.Stat()
+		if err != nil {
+			return nil, err
+		}
+		return ReadFileMetadata(name, file, info.Size())
+	})
+}
+
+// AddBookFromFile creates a book from the metadata of a single uploaded EPUB or PDF
+// file. The name selects the format, no copy is recorded as the upload is only read
+// and has no location on the server.
+func AddBookFromFile(db *sql.DB, name string, r io.ReaderAt, size int64) (*ScanReport, error) {
+	return scanFiles(db, []string{name}, ScanArgs{}, func(name string) (*FileMetadata, error) {
+		return ReadFileMetadata(name, r, size)
+	})
+}
+
+func scanFiles(db *sql.DB, paths []string, args ScanArgs, read func(name string) (*FileMetadata, error)) (*ScanReport, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // no-op once the transaction is committed
+
+	index, err := loadBookIndex(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ScanReport{Created: []ScanEntry{}, Matched: []ScanEntry{}, Skipped: []ScanEntry{}}
+	for _, name := range paths {
+		entry := ScanEntry{Path: name}
+		metadata, err := read(name)
+		if err != nil {
+			entry.Reason = err.Error()
+			report.Skipped = append(report.Skipped, entry)
+			continue
+		}
+		entry.Metadata = metadata
+
+		err = scanFile(tx, index, entry, args, report)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+// scanFile creates or matches the book of a file and records the file as its ebook copy.
+// A file that fails is skipped, the error returned is one of the savepoint, after which
+// the transaction cannot go on.
+func scanFile(tx *sql.Tx, index *bookIndex, entry ScanEntry, args ScanArgs, report *ScanReport) error {
+	book := entry.Metadata.bookArgs()
+	bookID, matched := index.find(book)
+	entry.BookID = bookID
+
+	_, err := tx.Exec("SAVEPOINT scan_file")
+	if err != nil {
+		return err
+	}
+	err = func() error {
+		if !matched {
+			created, err := createBook(tx, book)
+			if err != nil {
+				return err
+			}
+			entry.BookID = created.BookID
+		}
+
+		if args.RecordCopy {
+			copy, err := upsertEbookCopy(tx, entry.BookID, entry.Path)
+			if err != nil {
+				return err
+			}
+			entry.CopyID = copy.CopyID
+		}
+		return nil
+	}()
+	if err != nil {
+		_, rollbackErr := tx.Exec("ROLLBACK TO SAVEPOINT scan_file")
+		if rollbackErr != nil {
+			return rollbackErr
+		}
+	} else {
+		_, releaseErr := tx.Exec("RELEASE SAVEPOINT scan_file")
+		if releaseErr != nil {
+			return releaseErr
+		}
+	}
+
+	switch {
+	case err != nil:
+		entry.BookID = 0
+		entry.CopyID = 0
+		entry.Reason = err.Error()
+		report.Skipped = append(report.Skipped, entry)
+	case matched:
+		report.Matched = append(report.Matched, entry)
+	default:
+		index.add(entry.BookID, *book.Title, *SanitizeAuthorName(book.Author), entry.Metadata.ISBN)
+		report.Created = append(report.Created, entry)
+	}
+	return nil
+}
+
+// upsertEbookCopy records a file as an ebook copy of a book. A file is recorded only once,
+// scanning it again returns its existing copy.
+func upsertEbookCopy(q querier, bookID int, location string) (*Copy, error) {
+	copy := Copy{Format: "ebook", Location: location}
+
+	err := q.QueryRow("INSERT INTO copies (book_id, format, location) VALUES ($1, $2, $3) ON CONFLICT (location) WHERE format = 'ebook' DO UPDATE SET location = EXCLUDED.location RETURNING copy_id, book_id, creation_date", bookID, copy.Format, location).Scan(&copy.CopyID, &copy.BookID, &copy.CreationDate)
+	if err != nil {
+		return nil, err
+	}
+
+	return &copy, nil
+}
@@ -0,0 +1,192 @@
+package main_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"bookish"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// the metadata readers need no database, so these tests run outside the suite
+
+const testPackageDocument = `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="uid">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="uid">urn:uuid:5b9b6c1e-9d4b-4f8e-a1a2-1c2d3e4f5a6b</dc:identifier>
+    <dc:identifier>urn:isbn:9780261102217</dc:identifier>
+    <dc:title>The Hobbit</dc:title>
+    <dc:creator id="author">J. R. R. Tolkien</dc:creator>
+    <dc:creator id="illustrator">Alan Lee</dc:creator>
+    <meta refines="#author" property="role" scheme="marc:relators">aut</meta>
+    <meta refines="#illustrator" property="role" scheme="marc:relators">ill</meta>
+    <dc:language>en</dc:language>
+    <dc:publisher>HarperCollins</dc:publisher>
+    <dc:date>1937-09-21T00:00:00Z</dc:date>
+  </metadata>
+</package>`
+
+// writeTestEPUB builds an EPUB holding only the container and the package document
+func writeTestEPUB(t *testing.T, packageDocument string) []byte {
+	var content bytes.Buffer
+	archive := zip.NewWriter(&content)
+	for name, text := range map[string]string{
+		"mimetype": "application/epub+zip",
+		"META-INF/container.xml": `<?xml version="1.0"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles><rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/></rootfiles>
+</container>`,
+		"OEBPS/content.opf": packageDocument,
+	} {
+		file, err := archive.Create(name)
+		require.NoError(t, err)
+		_, err = file.Write([]byte(text))
+		require.NoError(t, err)
+	}
+	require.NoError(t, archive.Close())
+	return content.Bytes()
+}
+
+const testPDF = "%PDF-1.4\n" +
+	"1 0 obj\n<< /Type /Catalog /Pages 2 0 R >>\nendobj\n" +
+	"2 0 obj\n<< /Type /Pages /Kids [] /Count 0 >>\nendobj\n" +
+	"3 0 obj\n<< /Title (Good Omens \\(Hardcover\\)) /Author (Terry Pratchett; Neil Gaiman) /Producer (TeX) /CreationDate (D:19900501120000Z) /Trapped /False >>\nendobj\n" +
+	"trailer\n<< /Size 4 /Root 1 0 R /Info 3 0 R >>\n%%EOF\n"
+
+func TestReadEPUBMetadata(t *testing.T) {
+	// Setup
+	epub := writeTestEPUB(t, testPackageDocument)
+
+	// Function to test
+	metadata, err := main.ReadFileMetadata("hobbit.epub", bytes.NewReader(epub), int64(len(epub)))
+
+	// Verification
+	require.NoError(t, err)
+	assert.Equal(t, "epub", metadata.Format)
+	assert.Equal(t, "The Hobbit", metadata.Title)
+	assert.Equal(t, []string{"J. R. R. Tolkien"}, metadata.Authors)
+	assert.Len(t, metadata.Identifiers, 2)
+	assert.Equal(t, "9780261102217", metadata.ISBN)
+	assert.Equal(t, "en", metadata.Language)
+	assert.Equal(t, "HarperCollins", metadata.Publisher)
+	assert.Equal(t, "1937-09-21T00:00:00Z", metadata.Date)
+}
+
+func TestReadPDFMetadata(t *testing.T) {
+	// Function to test
+	metadata, err := main.ReadFileMetadata("omens.pdf", strings.NewReader(testPDF), int64(len(testPDF)))
+
+	// Verification
+	require.NoError(t, err)
+	assert.Equal(t, "pdf", metadata.Format)
+	assert.Equal(t, "Good Omens (Hardcover)", metadata.Title)
+	assert.Equal(t, []string{"Terry Pratchett", "Neil Gaiman"}, metadata.Authors)
+	assert.Equal(t, "1990-05-01", metadata.Date)
+}
+
+func TestReadPDFMetadata_UTF16AndNoTitle(t *testing.T) {
+	// Setup
+	pdf := "%PDF-1.7\n4 0 obj\n<</Author <FEFF00C9006D0069006C0065> /Title ()>>\nendobj\ntrailer\n<</Info 4 0 R>>\n"
+
+	// Function to test
+	metadata, err := main.ReadFileMetadata(filepath.Join("scans", "Untitled scan.pdf"), strings.NewReader(pdf), int64(len(pdf)))
+
+	// Verification
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Émile"}, metadata.Authors)
+	assert.Equal(t, "Untitled scan", metadata.Title) // named after the file
+}
+
+// countingReader counts the bytes read from a file
+type countingReader struct {
+	io.ReaderAt
+	read int
+}
+
+func (r *countingReader) ReadAt(p []byte, offset int64) (int, error) {
+	n, err := r.ReaderAt.ReadAt(p, offset)
+	r.read += n
+	return n, err
+}
+
+func TestReadPDFMetadata_XrefTables(t *testing.T) {
+	// Setup
+	// a large file with an incremental update that changed the catalog only, the xref
+	// table of the update refers to the one of the original file with /Prev
+	var pdf bytes.Buffer
+	pdf.WriteString("%PDF-1.4\n")
+	offsets := []int{}
+	for _, object := range []string{
+		"1 0 obj\n<< /Type /Catalog >>\nendobj\n",
+		"2 0 obj\n<< /Length 1000000 >>\nstream\n" + strings.Repeat("x", 1000000) + "\nendstream\nendobj\n",
+		"3 0 obj\n<< /Title (Mort) /Author (Terry Pratchett) >>\nendobj\n",
+	} {
+		offsets = append(offsets, pdf.Len())
+		pdf.WriteString(object)
+	}
+	xref := pdf.Len()
+	fmt.Fprintf(&pdf, "xref\n0 4\n0000000000 65535 f \n%010d 00000 n \n%010d 00000 n \n%010d 00000 n \n", offsets[0], offsets[1], offsets[2])
+	fmt.Fprintf(&pdf, "trailer\n<< /Size 4 /Root 1 0 R /Info 3 0 R >>\nstartxref\n%d\n%%%%EOF\n", xref)
+	catalog := pdf.Len()
+	pdf.WriteString("1 0 obj\n<< /Type /Catalog /Lang (en) >>\nendobj\n")
+	update := pdf.Len()
+	fmt.Fprintf(&pdf, "xref\n1 1\n%010d 00000 n \n", catalog)
+	fmt.Fprintf(&pdf, "trailer\n<< /Size 4 /Root 1 0 R /Info 3 0 R /Prev %d >>\nstartxref\n%d\n%%%%EOF\n", xref, update)
+	reader := &countingReader{ReaderAt: bytes.NewReader(pdf.Bytes())}
+
+	// Function to test
+	metadata, err := main.ReadPDFMetadata(reader, int64(pdf.Len()))
+
+	// Verification
+	require.NoError(t, err)
+	assert.Equal(t, "Mort", metadata.Title)
+	assert.Equal(t, []string{"Terry Pratchett"}, metadata.Authors)
+	// the large stream in the middle is never read
+	assert.Less(t, reader.read, 4*64<<10)
+}
+
+func TestReadFileMetadata_Unsupported(t *testing.T) {
+	// Setup
+	file, err := os.CreateTemp(t.TempDir(), "*.mobi")
+	require.NoError(t, err)
+	defer file.Close()
+
+	// Function to test
+	metadata, err := main.ReadFileMetadata(file.Name(), file, 0)
+
+	// Verification
+	assert.Error(t, err)
+	assert.Nil(t, metadata)
+}
+
+func TestAddBookFromFile_RollbackFails(t *testing.T) {
+	// Setup
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT books.book_id").WillReturnRows(sqlmock.NewRows([]string{"book_id", "title", "name", "isbn"}))
+	mock.ExpectExec("SAVEPOINT scan_file").WillReturnResult(sqlmock.NewResult(0, 0))
+	// creating the book fails as its queries are not expected, then so does the rollback
+	mock.ExpectExec("ROLLBACK TO SAVEPOINT scan_file").WillReturnError(errors.New("connection lost"))
+	mock.ExpectRollback()
+
+	// Function to test
+	report, err := main.AddBookFromFile(db, "omens.pdf", strings.NewReader(testPDF), int64(len(testPDF)))
+
+	// Verification
+	assert.Nil(t, report)
+	assert.EqualError(t, err, "connection lost")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
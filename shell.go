@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"github.com/chzyer/readline"
+)
+
+func createShellCommand() *Command {
+	return &Command{
+		name:        "shell",
+		description: "Run commands one after the other on one connection, with history and completion",
+		run: func(out io.Writer, args []string) error {
+			// open the backend first, a wrong profile or database is reported before the prompt
+			library, err := currentBackend()
+			if err != nil {
+				return err
+			}
+			return runShell(library, os.Stdin, out, os.Stderr)
+		},
+	}
+}
+
+// shellCommands are the commands run by the shell, which cannot start a server, another
+// shell or the tui, which would take the terminal from the prompt. Completion scripts are
+// of no use in the shell either.
+func shellCommands() []*Command {
+	left := map[string]bool{"shell": true, "serve": true, "tui": true, "completion": true}
+	commands := []*Command{}
+	for _, command := range cliCommands() {
+		if !left[command.name] {
+			commands = append(commands, command)
+		}
+	}
+	return commands
+}
+
+// runShell reads commands until exit or the end of the input. A terminal gets a prompt
+// with history and completion; piped input runs as a script, which fails when one of
+// its commands failed.
+func runShell(library backend, in io.Reader, out io.Writer, stderr io.Writer) error {
+	completer := &shellCompleter{library: library}
+	readLine := func() (string, error) { return "", io.EOF }
+
+	file, ok := in.(*os.File)
+	interactive := ok && readline.IsTerminal(int(file.Fd()))
+	if interactive {
+		terminal, err := readline.NewEx(&readline.Config{
+			Prompt:          cliName + "> ",
+			HistoryFile:     shellHistoryPath(),
+			AutoComplete:    completer,
+			InterruptPrompt: "^C",
+			EOFPrompt:       "exit",
+		})
+		if err != nil {
+			return err
+		}
+		defer terminal.Close()
+		readLine = terminal.Readline
+		fmt.Fprintf(out, "Type help for the commands, exit or Ctrl-D to leave.\n")
+	} else {
+		scanner := bufio.NewScanner(in)
+		readLine = func() (string, error) {
+			if scanner.Scan() {
+				return scanner.Text(), nil
+			}
+			if scanner.Err() != nil {
+				return "", scanner.Err()
+			}
+			return "", io.EOF
+		}
+	}
+
+	failed := 0
+	for {
+		line, err := readLine()
+		if errors.Is(err, readline.ErrInterrupt) {
+			continue // Ctrl-C drops the line being typed
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		args, err := splitShellLine(line)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			failed++
+			continue
+		}
+		if len(args) == 0 || strings.HasPrefix(args[0], "#") {
+			continue
+		}
+		if args[0] == "exit" || args[0] == "quit" {
+			break
+		}
+
+		// the commands are built again for every line, their flags keep the values they parsed
+		if runCLI(shellCommands(), nil, args, out, stderr) != exitOK {
+			failed++
+		}
+		completer.forget()
+	}
+
+	if failed > 0 && !interactive {
+		return fmt.Errorf("%d commands failed", failed)
+	}
+	return nil
+}
+
+// shellHistoryPath is bookish/shell_history in the user configuration directory, or
+// empty, which keeps no history, when the directory cannot be created
+func shellHistoryPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	dir = filepath.Join(dir, cliName)
+	if os.MkdirAll(dir, 0o700) != nil {
+		return ""
+	}
+	return filepath.Join(dir, "shell_history")
+}
+
+// splitShellLine splits a line into words like a shell does: quotes group words, and a
+// backslash escapes the next character
+func splitShellLine(line string) ([]string, error) {
+	words, _, quote := scanShellWords(line)
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+	return words, nil
+}
+
+// scanShellWords returns the words of a line, whether the line ends inside its last
+// word, and the quote left open at the end of the line, if any
+func scanShellWords(line string) ([]string, bool, rune) {
+	words := []string{}
+	var word strings.Builder
+	inWord, escaped := false, false
+	quote := rune(0)
+
+	for _, character := range line {
+		switch {
+		case escaped:
+			word.WriteRune(character)
+			escaped = false
+		case character == '\\' && quote != '\'':
+			escaped, inWord = true, true
+		case quote != 0:
+			if character == quote {
+				quote = 0
+			} else {
+				word.WriteRune(character)
+			}
+		case character == '"' || character == '\'':
+			quote, inWord = character, true
+		case unicode.IsSpace(character):
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(character)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, inWord, quote
+}
+
+// shellCompleter completes commands, subcommands, flags, and the flag values the commands
+// define, reading names and ids from the library. They are read again after every
+// command, which may have changed them.
+type shellCompleter struct {
+	library backend
+	loaded  map[string][]string
+}
+
+func (completer *shellCompleter) forget() {
+	completer.loaded = nil
+}
+
+// Do is the readline completion: it returns what can be typed after the cursor, and
+// the length of the word being completed
+func (completer *shellCompleter) Do(line []rune, pos int) ([][]rune, int) {
+	words, partial, quote := scanShellWords(string(line[:pos]))
+	current := ""
+	if partial {
+		current, words = words[len(words)-1], words[:len(words)-1]
+	}
+
+	suffixes := [][]rune{}
+	for _, candidate := range completer.candidates(words) {
+		if !strings.HasPrefix(candidate, current) {
+			continue
+		}
+		rest := candidate[len(current):]
+		if quote != 0 {
+			rest += string(quote)
+		} else {
+			rest = strings.NewReplacer(" ", "\\ ", "\"", "\\\"", "'", "\\'").Replace(rest)
+		}
+		suffixes = append(suffixes, []rune(rest+" "))
+	}
+	return suffixes, len([]rune(current))
+}
+
+// candidates lists the words that can follow the words already typed
+func (completer *shellCompleter) candidates(words []string) []string {
+	commands := shellCommands()
+	names := func() []string {
+		list := []string{"help", "exit"}
+		for _, command := range commands {
+			if !command.hidden {
+				list = append(list, command.name)
+			}
+		}
+		return list
+	}
+	subcommands := func(command *Command) []string {
+		list := []string{}
+		for _, subcommand := range command.subcommands {
+			list = append(list, subcommand.name)
+		}
+		return list
+	}
+
+	if len(words) == 0 {
+		return names()
+	}
+	if words[0] == "help" {
+		if len(words) == 1 {
+			return names()
+		}
+		if command := findCommand(commands, words[1]); command != nil && len(words) == 2 {
+			return subcommands(command)
+		}
+		return nil
+	}
+
+	command := findCommand(commands, words[0])
+	if command == nil {
+		return nil
+	}
+	flags, values := command.flags, command.values
+	if len(command.subcommands) > 0 {
+		if len(words) == 1 {
+			return subcommands(command)
+		}
+		subcommand := command.subcommand(words[1])
+		if subcommand == nil {
+			return nil
+		}
+		flags, values = subcommand.flags, subcommand.values
+	}
+	if flags == nil {
+		return completer.values(valuesOf(values, ""))
+	}
+
+	// the value of the flag before the cursor, or another flag
+	if last := flags.Lookup(strings.TrimLeft(words[len(words)-1], "-")); last != nil && strings.HasPrefix(words[len(words)-1], "-") && !isBoolFlag(last) {
+		return completer.values(valuesOf(values, last.Name))
+	}
+	list := completer.values(valuesOf(values, ""))
+	flags.VisitAll(func(f *flag.Flag) {
+		list = append(list, "-"+f.Name)
+	})
+	return list
+}
+
+func isBoolFlag(f *flag.Flag) bool {
+	boolFlag, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && boolFlag.IsBoolFlag()
+}
+
+// values returns the fixed words or the library values of a flag, paths are left to the
+// user. A library that cannot be read completes nothing, completion is a convenience.
+func (completer *shellCompleter) values(values flagValues) []string {
+	if values.library == "" || values.library == completeProfiles {
+		return values.words
+	}
+	if list, ok := completer.loaded[values.library]; ok {
+		return list
+	}
+
+	list := []string{}
+	read, _ := libraryValues(completer.library, values.library)
+	for _, value := range read {
+		list = append(list, value.value)
+	}
+	if completer.loaded == nil {
+		completer.loaded = map[string][]string{}
+	}
+	completer.loaded[values.library] = list
+	return list
+}
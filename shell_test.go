@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// shelfBackend answers the list calls of the shell from memory, other calls are not expected
+type shelfBackend struct {
+	backend
+	books       []Book
+	collections []Collection
+}
+
+func (b shelfBackend) ListBooks(args BookArgs) ([]Book, error) {
+	return b.books, nil
+}
+
+func (b shelfBackend) ListCollections(args CollectionArgs) ([]Collection, error) {
+	return b.collections, nil
+}
+
+func testShelf() shelfBackend {
+	return shelfBackend{
+		books: []Book{
+			{BookID: 3, Title: "The Hobbit", Author: "J. R. R. Tolkien"},
+			{BookID: 4, Title: "The Silmarillion", Author: "J. R. R. Tolkien"},
+			{BookID: 5, Title: "Mort", Author: "Terry Pratchett"},
+		},
+		collections: []Collection{{CollectionID: 1, CollectionName: "Fantasy"}},
+	}
+}
+
+func TestSplitShellLine(t *testing.T) {
+	// Function to test
+	words, err := splitShellLine(`book create -t "The Hobbit" -a J.\ R.\ R.\ Tolkien  '-x'`)
+	_, unterminated := splitShellLine(`book list -t "The Hob`)
+
+	// Verification
+	require.NoError(t, err)
+	assert.Equal(t, []string{"book", "create", "-t", "The Hobbit", "-a", "J. R. R. Tolkien", "-x"}, words)
+	assert.Error(t, unterminated)
+}
+
+func TestShellCompleter(t *testing.T) {
+	completer := &shellCompleter{library: testShelf()}
+	complete := func(line string) []string {
+		suffixes, _ := completer.Do([]rune(line), len([]rune(line)))
+		list := []string{}
+		for _, suffix := range suffixes {
+			list = append(list, string(suffix))
+		}
+		return list
+	}
+
+	// Verification
+	assert.Equal(t, []string{"ook ", "ackup "}, complete("b"))
+	assert.Equal(t, []string{"ollection ", "opy "}, complete("c"))
+	assert.ElementsMatch(t, []string{"create ", "list ", "add ", "remove ", "export "}, complete("collection "))
+	assert.Contains(t, complete("book list -"), "output ")
+	assert.Equal(t, []string{"son ", "sonl "}, complete("book list -output j"))
+	assert.Equal(t, []string{"Hobbit\" ", "Silmarillion\" "}, complete(`book list -t "The `))
+	assert.Equal(t, []string{"\\ Hobbit ", "\\ Silmarillion "}, complete("book list -t The"))
+	assert.Equal(t, []string{".\\ R.\\ R.\\ Tolkien "}, complete("book create -a J"))
+	assert.Equal(t, []string{"antasy "}, complete("collection list -n F"))
+	assert.Empty(t, complete("lend "))
+}
+
+func TestRunShell_Script(t *testing.T) {
+	// Setup
+	cliBackend = testShelf()
+	defer func() { cliBackend = nil }()
+	script := strings.Join([]string{
+		"# titles of the books",
+		"book list -output csv",
+		"",
+		"book list -quiet",
+		"book lend",
+		"exit",
+		"book list",
+	}, "\n")
+	var out, stderr bytes.Buffer
+
+	// Function to test
+	err := runShell(cliBackend, strings.NewReader(script), &out, &stderr)
+
+	// Verification
+	assert.EqualError(t, err, "1 commands failed")
+	assert.Equal(t, ""+
+		"book_id,title,author,isbn,published_date,edition,publisher,pages,rating,tags\n"+
+		"3,The Hobbit,J. R. R. Tolkien,,,,,,,\n"+
+		"4,The Silmarillion,J. R. R. Tolkien,,,,,,,\n"+
+		"5,Mort,Terry Pratchett,,,,,,,\n"+
+		"3\n4\n5\n", out.String())
+	assert.Contains(t, stderr.String(), `unknown book subcommand "lend"`)
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+)
+
+// sqliteFile reads the tables of an SQLite 3 database file, just enough to import
+// from other applications (such as Calibre) without a driver. Only UTF-8 databases
+// and ordinary rowid tables are supported, and uncommitted WAL content is not seen.
+type sqliteFile struct {
+	content  []byte
+	pageSize int
+	usable   int
+	tables   map[string]sqliteTable
+}
+
+type sqliteTable struct {
+	rootPage    int
+	columns     []string
+	rowidColumn int // index of the INTEGER PRIMARY KEY column, which is stored as the rowid, or -1
+}
+
+func openSQLiteFile(name string) (*sqliteFile, error) {
+	content, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return readSQLiteFile(name, content)
+}
+
+// sqliteCorrupted is the error of an offset, a size or a page number of the file that
+// points outside of it; every one read from the file is checked before it is used
+func sqliteCorrupted(format string, args ...any) error {
+	return fmt.Errorf(format+", the database is corrupted", args...)
+}
+
+func readSQLiteFile(name string, content []byte) (*sqliteFile, error) {
+	if len(content) < 100 || !bytes.HasPrefix(content, []byte("SQLite format 3\x00")) {
+		return nil, fmt.Errorf("%s is not an sqlite database", name)
+	}
+
+	file := &sqliteFile{content: content, tables: map[string]sqliteTable{}}
+	file.pageSize = int(binary.BigEndian.Uint16(content[16:18]))
+	if file.pageSize == 1 {
+		file.pageSize = 65536
+	}
+	file.usable = file.pageSize - int(content[20])
+	// page sizes are powers of two from 512, and at least 480 bytes of a page are usable
+	if file.pageSize < 512 || file.pageSize&(file.pageSize-1) != 0 || file.usable < 480 {
+		return nil, sqliteCorrupted("invalid sqlite page size %d", file.pageSize)
+	}
+	if encoding := binary.BigEndian.Uint32(content[56:60]); encoding > 1 {
+		return nil, fmt.Errorf("%s is not a UTF-8 sqlite database", name)
+	}
+
+	// the schema table is rooted at the first page
+	schema := sqliteTable{rootPage: 1, columns: []string{"type", "name", "tbl_name", "rootpage", "sql"}, rowidColumn: -1}
+	rows, err := file.readTable(schema)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		if row["type"] != "table" {
+			continue
+		}
+		name, _ := row["name"].(string)
+		rootPage, _ := row["rootpage"].(int64)
+		sql, _ := row["sql"].(string)
+		columns, rowidColumn := sqliteColumns(sql)
+		file.tables[strings.ToLower(name)] = sqliteTable{rootPage: int(rootPage), columns: columns, rowidColumn: rowidColumn}
+	}
+
+	return file, nil
+}
+
+// table returns every row of a table as a map of column name to value, values are
+// nil, int64, float64, string or []byte
+func (file *sqliteFile) table(name string) ([]map[string]any, error) {
+	table, ok := file.tables[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("no table %s in the database", name)
+	}
+	return file.readTable(table)
+}
+
+func (file *sqliteFile) page(number int) ([]byte, error) {
+	start := (number - 1) * file.pageSize
+	if number < 1 || start+file.pageSize > len(file.content) {
+		return nil, fmt.Errorf("page %d is outside the database", number)
+	}
+	return file.content[start : start+file.pageSize], nil
+}
+
+func (file *sqliteFile) readTable(table sqliteTable) ([]map[string]any, error) {
+	rows := []map[string]any{}
+	err := file.walkTablePage(table.rootPage, map[int]bool{}, func(rowid int64, payload []byte) error {
+		values, err := sqliteRecord(payload)
+		if err != nil {
+			return err
+		}
+
+		row := map[string]any{}
+		for index, column := range table.columns {
+			switch {
+			case index == table.rowidColumn:
+				row[column] = rowid
+			case index < len(values):
+				row[column] = values[index]
+			default:
+				row[column] = nil // columns added after the row was written
+			}
+		}
+		rows = append(rows, row)
+		return nil
+	})
+	return rows, err
+}
+
+// walkTablePage calls fn with the rowid and payload of every cell of a table b-tree.
+// visited holds the pages already walked, a page linked twice would loop forever.
+func (file *sqliteFile) walkTablePage(number int, visited map[int]bool, fn func(rowid int64, payload []byte) error) error {
+	if visited[number] {
+		return sqliteCorrupted("sqlite page %d is linked twice", number)
+	}
+	visited[number] = true
+	page, err := file.page(number)
+	if err != nil {
+		return err
+	}
+
+	header := 0
+	if number == 1 {
+		header = 100 // the file header comes first
+	}
+	pageType := page[header]
+	pointers := header + 8
+	if pageType == 0x05 {
+		pointers = header + 12 // interior pages also hold their right-most child
+	}
+	cellCount := int(binary.BigEndian.Uint16(page[header+3 : header+5]))
+	if pointers+2*cellCount > file.usable {
+		return sqliteCorrupted("sqlite page %d has more cells than fit in it", number)
+	}
+	// cell returns the offset of a cell, which must leave room for at least size bytes
+	cell := func(index int, size int) (int, error) {
+		offset := int(binary.BigEndian.Uint16(page[pointers+2*index:]))
+		if offset < pointers+2*cellCount || offset+size > file.usable {
+			return 0, sqliteCorrupted("cell %d of sqlite page %d is outside the page", index, number)
+		}
+		return offset, nil
+	}
+
+	switch pageType {
+	case 0x05: // interior table page
+		for index := 0; index < cellCount; index++ {
+			offset, err := cell(index, 4)
+			if err != nil {
+				return err
+			}
+			err = file.walkTablePage(int(binary.BigEndian.Uint32(page[offset:])), visited, fn)
+			if err != nil {
+				return err
+			}
+		}
+		return file.walkTablePage(int(binary.BigEndian.Uint32(page[header+8:])), visited, fn)
+
+	case 0x0D: // leaf table page
+		for index := 0; index < cellCount; index++ {
+			offset, err := cell(index, 1)
+			if err != nil {
+				return err
+			}
+			payloadSize, read := sqliteVarint(page[offset:file.usable])
+			offset += read
+			rowid, read := sqliteVarint(page[offset:file.usable])
+			offset += read
+			// a payload cannot be larger than the file that holds it
+			if payloadSize > uint64(len(file.content)) {
+				return sqliteCorrupted("cell %d of sqlite page %d is larger than the database", index, number)
+			}
+
+			payload, err := file.payload(page, offset, int(payloadSize))
+			if err != nil {
+				return err
+			}
+			err = fn(int64(rowid), payload)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("page %d is not a table page", number)
+	}
+}
+
+// payload reads a cell payload, following its overflow pages when it does not fit the page
+func (file *sqliteFile) payload(page []byte, offset int, size int) ([]byte, error) {
+	maxLocal := file.usable - 35
+	local := size
+	if size > maxLocal {
+		minLocal := (file.usable-12)*32/255 - 23
+		local = minLocal + (size-minLocal)%(file.usable-4)
+		if local > maxLocal {
+			local = minLocal
+		}
+	}
+	overflowed := local < size
+	cellEnd := offset + local
+	if overflowed {
+		cellEnd += 4 // the number of the first overflow page follows the local part
+	}
+	if cellEnd > file.usable {
+		return nil, sqliteCorrupted("sqlite cell overflows its page")
+	}
+
+	payload := append([]byte{}, page[offset:offset+local]...)
+	if !overflowed {
+		return payload, nil
+	}
+
+	next := int(binary.BigEndian.Uint32(page[offset+local:]))
+	visited := map[int]bool{}
+	for len(payload) < size {
+		if visited[next] {
+			return nil, sqliteCorrupted("sqlite overflow page %d is linked twice", next)
+		}
+		visited[next] = true
+		overflow, err := file.page(next)
+		if err != nil {
+			return nil, err
+		}
+		next = int(binary.BigEndian.Uint32(overflow))
+		end := file.usable
+		if remaining := size - len(payload); remaining < end-4 {
+			end = remaining + 4
+		}
+		payload = append(payload, overflow[4:end]...)
+	}
+	return payload, nil
+}
+
+// sqliteVarint decodes a big-endian variable length integer of up to nine bytes
+func sqliteVarint(content []byte) (uint64, int) {
+	var value uint64
+	for index := 0; index < 9 && index < len(content); index++ {
+		if index == 8 {
+			return value<<8 | uint64(content[index]), 9
+		}
+		value = value<<7 | uint64(content[index]&0x7F)
+		if content[index]&0x80 == 0 {
+			return value, index + 1
+		}
+	}
+	return value, len(content)
+}
+
+// sqliteRecord decodes the values of a record: a header of serial types, then the values
+func sqliteRecord(payload []byte) ([]any, error) {
+	headerSize, read := sqliteVarint(payload)
+	if headerSize > uint64(len(payload)) {
+		return nil, errors.New("invalid sqlite record header")
+	}
+
+	types := []uint64{}
+	for offset := read; offset < int(headerSize); {
+		serialType, read := sqliteVarint(payload[offset:])
+		types = append(types, serialType)
+		offset += read
+	}
+
+	values := []any{}
+	body := payload[headerSize:]
+	for _, serialType := range types {
+		var size uint64
+		switch {
+		case serialType >= 12:
+			size = (serialType - 12) / 2
+		case serialType >= 1 && serialType <= 4:
+			size = serialType
+		case serialType == 5:
+			size = 6
+		case serialType == 6 || serialType == 7:
+			size = 8
+		}
+		if size > uint64(len(body)) {
+			return nil, errors.New("invalid sqlite record, a value is truncated")
+		}
+		data := body[:size]
+		body = body[size:]
+
+		switch {
+		case serialType == 0:
+			values = append(values, nil)
+		case serialType >= 1 && serialType <= 6:
+			// sign extend the big-endian integer
+			number := int64(int8(data[0]))
+			for _, b := range data[1:] {
+				number = number<<8 | int64(b)
+			}
+			values = append(values, number)
+		case serialType == 7:
+			values = append(values, math.Float64frombits(binary.BigEndian.Uint64(data)))
+		case serialType == 8:
+			values = append(values, int64(0))
+		case serialType == 9:
+			values = append(values, int64(1))
+		case serialType >= 12 && serialType%2 == 0:
+			values = append(values, append([]byte{}, data...))
+		case serialType >= 13:
+			values = append(values, string(data))
+		default:
+			return nil, fmt.Errorf("unknown sqlite serial type %d", serialType)
+		}
+	}
+	return values, nil
+}
+
+// sqliteColumns reads the column names of a CREATE TABLE statement, along with the
+// index of its INTEGER PRIMARY KEY column, or -1
+func sqliteColumns(sql string) ([]string, int) {
+	columns := []string{}
+	rowidColumn := -1
+
+	start, end := strings.Index(sql, "("), strings.LastIndex(sql, ")")
+	if start < 0 || end < start {
+		return columns, rowidColumn
+	}
+
+	// split the definitions on the commas outside of parentheses and quotes
+	definitions := []string{}
+	depth, quote, last := 0, rune(0), start+1
+	for index, character := range sql[start+1 : end] {
+		switch {
+		case quote != 0:
+			if character == quote {
+				quote = 0
+			}
+		case character == '\'' || character == '"' || character == '`' || character == '[':
+			quote = character
+			if character == '[' {
+				quote = ']'
+			}
+		case character == '(':
+			depth++
+		case character == ')':
+			depth--
+		case character == ',' && depth == 0:
+			definitions = append(definitions, sql[last:start+1+index])
+			last = start + 2 + index
+		}
+	}
+	definitions = append(definitions, sql[last:end])
+
+	for _, definition := range definitions {
+		fields := strings.Fields(definition)
+		if len(fields) == 0 {
+			continue
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "CONSTRAINT", "PRIMARY", "UNIQUE", "CHECK", "FOREIGN":
+			continue
+		}
+
+		upper := strings.ToUpper(strings.Join(fields, " "))
+		if len(fields) > 1 && strings.ToUpper(fields[1]) == "INTEGER" && strings.Contains(upper, "PRIMARY KEY") {
+			rowidColumn = len(columns)
+		}
+		columns = append(columns, strings.Trim(fields[0], "\"'`[]"))
+	}
+	return columns, rowidColumn
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// the fixture uses 1 KiB pages, so its schema and tags tables span several b-tree
+// pages and the comment of the first book overflows its page
+
+func TestSQLiteFile_Table(t *testing.T) {
+	// Setup
+	database, err := openSQLiteFile("testdata/calibre/metadata.db")
+	require.NoError(t, err)
+
+	// Function to test
+	tags, tagsErr := database.table("tags")
+	comments, commentsErr := database.table("comments")
+	books, booksErr := database.table("books")
+
+	// Verification
+	require.NoError(t, tagsErr)
+	assert.Len(t, tags, 399)
+	assert.Equal(t, map[string]any{"id": int64(1), "name": "Fantasy", "link": ""}, tags[0])
+	assert.Equal(t, int64(399), tags[398]["id"])
+
+	require.NoError(t, commentsErr)
+	require.Len(t, comments, 1)
+	assert.Equal(t, strings.Repeat("The turtle moves. ", 300), comments[0]["text"])
+
+	require.NoError(t, booksErr)
+	require.Len(t, books, 2)
+	assert.Equal(t, "Good Omens", books[1]["title"])
+	assert.Equal(t, int64(1), books[1]["series_index"]) // whole REAL values are stored as integers
+	assert.Equal(t, int64(1), books[1]["flags"])
+}
+
+func TestSQLiteFile_Corrupted(t *testing.T) {
+	// Setup
+	fixture, err := os.ReadFile("testdata/calibre/metadata.db")
+	require.NoError(t, err)
+
+	// Function to test
+	// bytes all over the fixture are flipped in turn, reading must fail or succeed but never panic
+	for offset := 0; offset < len(fixture); offset += 31 {
+		content := append([]byte{}, fixture...)
+		content[offset] ^= 0xFF
+		database, err := readSQLiteFile("metadata.db", content)
+		if err != nil {
+			continue
+		}
+		for _, table := range []string{"books", "tags", "comments"} {
+			// Verification
+			assert.NotPanics(t, func() { _, _ = database.table(table) }, "byte %d flipped", offset)
+		}
+	}
+}
+
+func TestSQLiteColumns(t *testing.T) {
+	// Function to test
+	columns, rowidColumn := sqliteColumns(`CREATE TABLE ratings ( id INTEGER PRIMARY KEY, rating INTEGER CHECK(rating > -1 AND rating < 11), link TEXT NOT NULL DEFAULT '', UNIQUE (rating))`)
+
+	// Verification
+	assert.Equal(t, []string{"id", "rating", "link"}, columns)
+	assert.Equal(t, 0, rowidColumn)
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// tagKinds are what a tag can be, a tag without a kind is a plain label
+var tagKinds = []string{"genre", "subject", "mood"}
+
+// tagMatches tell whether ListBooks selects the books with all the tags or any of them
+var tagMatches = []string{"all", "any"}
+
+// tagSorts are the orders ListTags can sort tags in
+var tagSorts = []string{"name", "books"}
+
+func checkTagKind(kind string) error {
+	for _, known := range tagKinds {
+		if kind == known {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid kind %s, expected genre, subject or mood", kind)
+}
+
+// tagName is the sanitized name of a tag, tags are lower case like the tags of notes
+func tagName(name *string) (string, error) {
+	if name == nil {
+		return "", errors.New("no tag name set")
+	}
+	names := SanitizeTags([]string{*name})
+	if len(names) == 0 {
+		return "", errors.New("no tag name set")
+	}
+	return names[0], nil
+}
+
+// CreateTag creates a tag, its kind is optional
+func CreateTag(db *sql.DB, t TagArgs) (*Tag, error) {
+	name, err := tagName(t.Name)
+	if err != nil {
+		return nil, fmt.Errorf("%w, tag not created", err)
+	}
+	if t.Kind != nil && *t.Kind != "" {
+		err := checkTagKind(*t.Kind)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // no-op once the transaction is committed
+
+	var tagID int
+	err = tx.QueryRow("INSERT INTO tags (name, kind) VALUES ($1, NULLIF($2, '')) ON CONFLICT DO NOTHING RETURNING tag_id", name, t.Kind).Scan(&tagID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			err = errors.New("tag already exists in the database")
+		}
+		return nil, err
+	}
+
+	tags, err := listTags(tx, TagArgs{TagID: &tagID})
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return &tags[0], nil
+}
+
+// UpdateTag renames a tag or changes its kind, the tag is chosen by its ID. An empty
+// kind clears it.
+func UpdateTag(db *sql.DB, t TagArgs) (*Tag, error) {
+	if t.TagID == nil {
+		return nil, errors.New("choose the tag to update and insert its ID number")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // no-op once the transaction is committed
+
+	// check if there is a tag with the chosen ID
+	_, err = listTags(tx, TagArgs{TagID: t.TagID})
+	if err != nil {
+		return nil, err
+	}
+
+	sets := []string{}
+	params := []any{}
+	set := func(column string, value any) {
+		params = append(params, value)
+		sets = append(sets, fmt.Sprintf("%s = $%d", column, len(params)))
+	}
+	var name string
+	if t.Name != nil {
+		name, err = tagName(t.Name)
+		if err != nil {
+			return nil, fmt.Errorf("%w, tag not updated", err)
+		}
+		set("name", name)
+	}
+	if t.Kind != nil {
+		if *t.Kind == "" {
+			set("kind", nil)
+		} else {
+			err := checkTagKind(*t.Kind)
+			if err != nil {
+				return nil, err
+			}
+			set("kind", *t.Kind)
+		}
+	}
+
+	if len(sets) > 0 {
+		params = append(params, *t.TagID)
+		_, err = tx.Exec(fmt.Sprintf("UPDATE tags SET %s WHERE tag_id = $%d", strings.Join(sets, ", "), len(params)), params...)
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" { // the new name is taken by another tag
+			return nil, fmt.Errorf("tag %s already exists in the database", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	tags, err := listTags(tx, TagArgs{TagID: t.TagID})
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return &tags[0], nil
+}
+
+// DeleteTag removes the tag chosen by its ID from the database and from its books, and
+// returns it
+func DeleteTag(db *sql.DB, t TagArgs) (*Tag, error) {
+	if t.TagID == nil {
+		return nil, errors.New("choose the tag to delete and insert its ID number")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // no-op once the transaction is committed
+
+	tags, err := listTags(tx, TagArgs{TagID: t.TagID})
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec("DELETE FROM tags WHERE tag_id = $1", *t.TagID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return &tags[0], nil
+}
+
+// TagBook adds tags to a book, the tags that do not exist yet are created without a kind.
+// It returns the book with all its tags.
+func TagBook(db *sql.DB, t BookTagsArgs) (*Book, error) {
+	if t.BookID == nil {
+		return nil, errors.New("choose the book and insert its ID number")
+	}
+	names := SanitizeTags(t.Tags)
+	if len(names) == 0 {
+		return nil, errors.New("no tags set, choose the tags of the book")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // no-op once the transaction is committed
+
+	// check if there is a book with the chosen ID
+	_, err = listBooks(tx, BookArgs{BookID: t.BookID})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		var tagID int
+		err = tx.QueryRow("INSERT INTO tags (name) VALUES ($1) ON CONFLICT (name) DO UPDATE SET name = EXCLUDED.name RETURNING tag_id", name).Scan(&tagID)
+		if err != nil {
+			return nil, err
+		}
+		_, err = tx.Exec("INSERT INTO book_tags (book_id, tag_id) VALUES ($1, $2) ON CONFLICT DO NOTHING", *t.BookID, tagID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	books, err := listBooks(tx, BookArgs{BookID: t.BookID})
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return &books[0], nil
+}
+
+// UntagBook removes tags from a book, the tags themselves are kept. It returns the book
+// with the tags it still has.
+func UntagBook(db *sql.DB, t BookTagsArgs) (*Book, error) {
+	if t.BookID == nil {
+		return nil, errors.New("choose the book and insert its ID number")
+	}
+	names := SanitizeTags(t.Tags)
+	if len(names) == 0 {
+		return nil, errors.New("no tags set, choose the tags to remove from the book")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // no-op once the transaction is committed
+
+	books, err := listBooks(tx, BookArgs{BookID: t.BookID})
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := tx.Exec("DELETE FROM book_tags USING tags WHERE book_tags.tag_id = tags.tag_id AND book_tags.book_id = $1 AND tags.name = ANY($2)", *t.BookID, pq.Array(names))
+	if err != nil {
+		return nil, err
+	}
+	removed, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if removed == 0 {
+		return nil, fmt.Errorf("book %s has none of the tags %s", books[0].Title, strings.Join(names, ", "))
+	}
+
+	books, err = listBooks(tx, BookArgs{BookID: t.BookID})
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return &books[0], nil
+}
+
+// ListTags lists the tags with the number of books that have each of them, or the tags
+// of a kind or of a book.
+func ListTags(db *sql.DB, t TagArgs) ([]Tag, error) {
+	return listTags(db, t)
+}
+
+func listTags(q querier, t TagArgs) ([]Tag, error) {
+	tags := []Tag{}
+
+	query := `
+		SELECT tags.tag_id, tags.name, tags.kind, COUNT(book_tags.book_id), tags.creation_date
+		FROM tags
+		LEFT JOIN book_tags ON tags.tag_id = book_tags.tag_id
+		`
+
+	whereClauses := []string{}
+	params := []any{}
+	bind := func(value any) string {
+		params = append(params, value)
+		return fmt.Sprintf("$%d", len(params))
+	}
+	if t.TagID != nil {
+		whereClauses = append(whereClauses, "tags.tag_id = "+bind(*t.TagID))
+	}
+	if t.Name != nil {
+		name, err := tagName(t.Name)
+		if err != nil {
+			return nil, err
+		}
+		whereClauses = append(whereClauses, "tags.name = "+bind(name))
+	}
+	if t.Kind != nil {
+		err := checkTagKind(*t.Kind)
+		if err != nil {
+			return nil, err
+		}
+		whereClauses = append(whereClauses, "tags.kind = "+bind(*t.Kind))
+	}
+	if t.BookID != nil {
+		whereClauses = append(whereClauses, "tags.tag_id IN (SELECT tag_id FROM book_tags WHERE book_id = "+bind(*t.BookID)+")")
+	}
+	if len(whereClauses) > 0 {
+		query += "WHERE " + strings.Join(whereClauses, " AND ")
+	}
+	query += " GROUP BY tags.tag_id"
+
+	switch {
+	case t.Sort == nil || *t.Sort == "" || *t.Sort == "name":
+		query += " ORDER BY tags.name"
+	case *t.Sort == "books":
+		query += " ORDER BY COUNT(book_tags.book_id) DESC, tags.name"
+	default:
+		return nil, fmt.Errorf("invalid sort %s, expected %s", *t.Sort, strings.Join(tagSorts, " or "))
+	}
+
+	rows, err := q.Query(query, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var tag Tag
+		var kind sql.NullString
+		err := rows.Scan(&tag.TagID, &tag.Name, &kind, &tag.Books, &tag.CreationDate)
+		if err != nil {
+			return nil, err
+		}
+		tag.Kind = kind.String
+		tags = append(tags, tag)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(tags) == 0 {
+		return nil, errors.New("no tags with the chosen specification")
+	}
+	return tags, nil
+}
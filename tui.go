@@ -0,0 +1,641 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/chzyer/readline"
+)
+
+func createTuiCommand() *Command {
+	return &Command{
+		name:        "tui",
+		description: "Browse collections, search books and edit them in a full-screen terminal interface",
+		run: func(out io.Writer, args []string) error {
+			if !readline.IsTerminal(int(os.Stdin.Fd())) {
+				return errors.New("the tui needs a terminal, scripts can use the other commands or the shell")
+			}
+			library, err := currentBackend()
+			if err != nil {
+				return err
+			}
+			return runTUI(library, os.Stdin, out)
+		},
+	}
+}
+
+// runTUI draws the library on the alternate screen of the terminal and handles the keys
+// until q is pressed. The terminal is put back as it was, even when the library fails.
+func runTUI(library backend, in *os.File, out io.Writer) error {
+	model := newTUIModel(library)
+	err := model.reload()
+	if err != nil {
+		return err
+	}
+
+	fd := int(in.Fd())
+	state, err := readline.MakeRaw(fd)
+	if err != nil {
+		return err
+	}
+	defer readline.Restore(fd, state)
+	fmt.Fprint(out, "\x1b[?1049h\x1b[?25l") // alternate screen, hidden cursor
+	defer fmt.Fprint(out, "\x1b[?25h\x1b[?1049l")
+
+	keys := bufio.NewReader(in)
+	for !model.quit {
+		width, height, err := readline.GetSize(fd)
+		if err != nil || width <= 0 || height <= 0 {
+			width, height = 80, 24
+		}
+		// the lines are drawn over the previous screen, each one clearing what is left of its row
+		fmt.Fprint(out, "\x1b[H"+strings.Join(model.render(width, height), "\x1b[K\r\n")+"\x1b[K\x1b[J")
+
+		key, err := readKey(keys)
+		if err != nil {
+			return err
+		}
+		model.handleKey(key)
+	}
+	return nil
+}
+
+// readKey reads a key press from a terminal in raw mode: a printable character, or the
+// name of a special key such as "up", "enter" or "esc"
+func readKey(r *bufio.Reader) (string, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+
+	switch b {
+	case 0x1b:
+		// an escape sequence arrives all at once, a lone escape is the esc key
+		if r.Buffered() == 0 {
+			return "esc", nil
+		}
+		next, _ := r.ReadByte()
+		if next != '[' && next != 'O' {
+			return "esc", nil
+		}
+		code, _ := r.ReadByte()
+		switch code {
+		case 'A':
+			return "up", nil
+		case 'B':
+			return "down", nil
+		case 'C':
+			return "right", nil
+		case 'D':
+			return "left", nil
+		case 'Z':
+			return "shift+tab", nil
+		}
+		// skip the rest of longer sequences, such as the page keys
+		for code >= '0' && code <= '9' || code == ';' {
+			code, err = r.ReadByte()
+			if err != nil {
+				return "", err
+			}
+		}
+		return "", nil
+	case '\r', '\n':
+		return "enter", nil
+	case '\t':
+		return "tab", nil
+	case 0x7f, 0x08:
+		return "backspace", nil
+	case 0x03:
+		return "ctrl+c", nil
+	}
+
+	if b < 0x20 {
+		return "", nil // other control keys do nothing
+	}
+	err = r.UnreadByte()
+	if err != nil {
+		return "", err
+	}
+	character, _, err := r.ReadRune()
+	if err != nil {
+		return "", err
+	}
+	return string(character), nil
+}
+
+// modes of the tui, each one handles the keys differently
+const (
+	tuiBrowse = iota
+	tuiSearch
+	tuiPick // picking the collection to add a book to
+	tuiEdit
+)
+
+// panes of the browse mode
+const (
+	tuiShelves = iota
+	tuiBooks
+)
+
+// tuiField is a line of the edit form
+type tuiField struct {
+	label string
+	value string
+	start string // the value before editing, only changed fields are saved
+}
+
+// tuiModel is the state of the tui, kept apart from the terminal so the keys and the
+// screen can be tested. The left pane lists "All books" then the collections, the right
+// pane the books of the shelf selected on the left, narrowed by the search.
+type tuiModel struct {
+	library     backend
+	books       []Book
+	collections []Collection
+
+	mode   int
+	pane   int
+	shelf  int // 0 is all books, then the collections
+	cursor int // the selected book of the visible ones
+	search string
+	picker int
+	form   []tuiField
+	field  int
+	status string
+	quit   bool
+}
+
+func newTUIModel(library backend) *tuiModel {
+	return &tuiModel{library: library}
+}
+
+// reload reads the books and the collections again and keeps the selection in range
+func (m *tuiModel) reload() error {
+	books, err := m.library.ListBooks(BookArgs{})
+	if err != nil {
+		return err
+	}
+	collections, err := m.library.ListCollections(CollectionArgs{})
+	if err != nil {
+		return err
+	}
+	m.books, m.collections = books, collections
+
+	m.shelf = clamp(m.shelf, len(m.collections)+1)
+	m.cursor = clamp(m.cursor, len(m.visibleBooks()))
+	m.picker = clamp(m.picker, len(m.collections))
+	return nil
+}
+
+func clamp(index int, length int) int {
+	if index >= length {
+		index = length - 1
+	}
+	if index < 0 {
+		index = 0
+	}
+	return index
+}
+
+// currentCollection is the collection selected on the left, nil for all books
+func (m *tuiModel) currentCollection() *Collection {
+	if m.shelf == 0 || m.shelf > len(m.collections) {
+		return nil
+	}
+	return &m.collections[m.shelf-1]
+}
+
+// visibleBooks are the books of the current shelf whose title, author or ISBN contains the search
+func (m *tuiModel) visibleBooks() []Book {
+	books := m.books
+	if collection := m.currentCollection(); collection != nil {
+		books = collection.CollectionBooks
+	}
+	if m.search == "" {
+		return books
+	}
+
+	search := strings.ToLower(m.search)
+	found := []Book{}
+	for _, book := range books {
+		if strings.Contains(strings.ToLower(book.Title), search) ||
+			strings.Contains(strings.ToLower(book.Author), search) ||
+			strings.Contains(strings.ToLower(book.ISBN), search) {
+			found = append(found, book)
+		}
+	}
+	return found
+}
+
+func (m *tuiModel) currentBook() *Book {
+	books := m.visibleBooks()
+	if m.cursor >= len(books) {
+		return nil
+	}
+	return &books[m.cursor]
+}
+
+func (m *tuiModel) handleKey(key string) {
+	if key == "ctrl+c" {
+		m.quit = true
+		return
+	}
+	switch m.mode {
+	case tuiBrowse:
+		m.handleBrowseKey(key)
+	case tuiSearch:
+		m.handleSearchKey(key)
+	case tuiPick:
+		m.handlePickKey(key)
+	case tuiEdit:
+		m.handleEditKey(key)
+	}
+}
+
+func (m *tuiModel) handleBrowseKey(key string) {
+	m.status = ""
+	switch key {
+	case "q":
+		m.quit = true
+	case "tab", "shift+tab":
+		m.pane = tuiBooks - m.pane
+	case "left", "h":
+		m.pane = tuiShelves
+	case "right", "l":
+		m.pane = tuiBooks
+	case "enter":
+		if m.pane == tuiShelves {
+			m.pane = tuiBooks
+		}
+	case "up", "k":
+		m.move(-1)
+	case "down", "j":
+		m.move(1)
+	case "/":
+		m.mode = tuiSearch
+		m.pane = tuiBooks
+	case "r":
+		m.report(m.reload(), "Library reloaded")
+	case "a":
+		m.startPick()
+	case "d":
+		m.removeBook()
+	case "e":
+		m.startEdit()
+	}
+}
+
+func (m *tuiModel) move(step int) {
+	if m.pane == tuiShelves {
+		m.shelf = clamp(m.shelf+step, len(m.collections)+1)
+		m.cursor = 0
+		return
+	}
+	m.cursor = clamp(m.cursor+step, len(m.visibleBooks()))
+}
+
+// report shows the error of an action, or its message when it worked
+func (m *tuiModel) report(err error, message string) {
+	if err != nil {
+		m.status = "Error: " + err.Error()
+		return
+	}
+	m.status = message
+}
+
+func (m *tuiModel) handleSearchKey(key string) {
+	switch key {
+	case "enter":
+		m.mode = tuiBrowse
+	case "esc":
+		m.search = ""
+		m.mode = tuiBrowse
+	case "backspace":
+		if m.search != "" {
+			_, size := utf8.DecodeLastRuneInString(m.search)
+			m.search = m.search[:len(m.search)-size]
+		}
+	default:
+		if utf8.RuneCountInString(key) == 1 {
+			m.search += key
+		}
+	}
+	m.cursor = clamp(m.cursor, len(m.visibleBooks()))
+}
+
+func (m *tuiModel) startPick() {
+	if m.currentBook() == nil {
+		m.status = "No book selected"
+		return
+	}
+	if len(m.collections) == 0 {
+		m.status = "No collection to add the book to, create one with bookish collection create"
+		return
+	}
+	m.mode = tuiPick
+}
+
+func (m *tuiModel) handlePickKey(key string) {
+	switch key {
+	case "esc", "q":
+		m.mode = tuiBrowse
+	case "up", "k":
+		m.picker = clamp(m.picker-1, len(m.collections))
+	case "down", "j":
+		m.picker = clamp(m.picker+1, len(m.collections))
+	case "enter":
+		m.mode = tuiBrowse
+		book := m.currentBook()
+		if book == nil {
+			return
+		}
+		collection, added, err := m.library.AddBookToCollection(AddBookToCollectionArgs{BookID: &book.BookID, CollectionID: &m.collections[m.picker].CollectionID})
+		if err != nil {
+			m.report(err, "")
+			return
+		}
+		m.report(m.reload(), fmt.Sprintf("Book %s added to collection %s", added.Title, collection.CollectionName))
+	}
+}
+
+func (m *tuiModel) removeBook() {
+	book := m.currentBook()
+	collection := m.currentCollection()
+	if book == nil {
+		m.status = "No book selected"
+		return
+	}
+	if collection == nil {
+		m.status = "Select a collection on the left to remove books from it"
+		return
+	}
+	_, removed, err := m.library.RemoveBookFromCollection(AddBookToCollectionArgs{BookID: &book.BookID, CollectionID: &collection.CollectionID})
+	if err != nil {
+		m.report(err, "")
+		return
+	}
+	name := collection.CollectionName
+	m.report(m.reload(), fmt.Sprintf("Book %s removed from collection %s", removed.Title, name))
+}
+
+func (m *tuiModel) startEdit() {
+	book := m.currentBook()
+	if book == nil {
+		m.status = "No book selected"
+		return
+	}
+
+	publishedDate, edition := "", ""
+	if book.PublishedDate != nil {
+		publishedDate = book.PublishedDate.Format("2006-01-02")
+	}
+	if book.Edition != nil {
+		edition = strconv.Itoa(*book.Edition)
+	}
+	m.form = []tuiField{
+		{label: "Title", value: book.Title},
+		{label: "Author", value: book.Author},
+		{label: "ISBN", value: book.ISBN},
+		{label: "Published date", value: publishedDate},
+		{label: "Edition", value: edition},
+		{label: "Publisher", value: book.Publisher},
+	}
+	for i := range m.form {
+		m.form[i].start = m.form[i].value
+	}
+	m.field = 0
+	m.mode = tuiEdit
+}
+
+func (m *tuiModel) handleEditKey(key string) {
+	field := &m.form[m.field]
+	switch key {
+	case "esc":
+		m.mode = tuiBrowse
+		m.status = "Edit cancelled"
+	case "up", "shift+tab":
+		m.field = clamp(m.field-1, len(m.form))
+	case "down", "tab":
+		m.field = clamp(m.field+1, len(m.form))
+	case "backspace":
+		if field.value != "" {
+			_, size := utf8.DecodeLastRuneInString(field.value)
+			field.value = field.value[:len(field.value)-size]
+		}
+	case "enter":
+		m.saveEdit()
+	default:
+		if utf8.RuneCountInString(key) == 1 {
+			field.value += key
+		}
+	}
+}
+
+// saveEdit updates the changed fields of the book, the form stays open when they are refused
+func (m *tuiModel) saveEdit() {
+	book := m.currentBook()
+	if book == nil {
+		m.mode = tuiBrowse
+		return
+	}
+
+	bookArgs := BookArgs{BookID: &book.BookID}
+	changed := false
+	for i := range m.form {
+		field := &m.form[i]
+		if field.value == field.start {
+			continue
+		}
+		changed = true
+		value := strings.TrimSpace(field.value)
+		switch field.label {
+		case "Title":
+			bookArgs.Title = &value
+		case "Author":
+			bookArgs.Author = &value
+		case "ISBN":
+			bookArgs.ISBN = &value
+		case "Published date":
+			bookArgs.PublishedDate = &value
+		case "Edition":
+			edition := 0 // clears the edition
+			if value != "" {
+				number, err := strconv.Atoi(value)
+				if err != nil {
+					m.status = fmt.Sprintf("Error: invalid edition %q, editions are numbers", value)
+					return
+				}
+				edition = number
+			}
+			bookArgs.Edition = &edition
+		case "Publisher":
+			bookArgs.Publisher = &value
+		}
+	}
+	if !changed {
+		m.mode = tuiBrowse
+		m.status = "Nothing changed"
+		return
+	}
+
+	updated, err := m.library.UpdateBook(bookArgs)
+	if err != nil {
+		m.report(err, "")
+		return
+	}
+	m.mode = tuiBrowse
+	m.report(m.reload(), fmt.Sprintf("Book %s updated", updated.Title))
+}
+
+// render returns the lines of the screen, each one at most width characters long
+func (m *tuiModel) render(width int, height int) []string {
+	lines := []string{
+		fmt.Sprintf(" %s - %d books, %d collections", cliName, len(m.books), len(m.collections)),
+		strings.Repeat("─", width),
+	}
+
+	rows := height - 4 // title, rule, status and keys
+	if rows < 1 {
+		rows = 1
+	}
+	leftWidth := width / 3
+	if leftWidth > 30 {
+		leftWidth = 30
+	}
+	left := m.renderShelves(rows)
+	var right []string
+	switch m.mode {
+	case tuiPick:
+		right = m.renderPicker(rows)
+	case tuiEdit:
+		right = m.renderForm()
+	default:
+		right = m.renderBooks(rows)
+	}
+	for i := 0; i < rows; i++ {
+		line := fitWidth(at(left, i), leftWidth) + "│ " + at(right, i)
+		lines = append(lines, line)
+	}
+
+	lines = append(lines, " "+m.status, " "+m.keyHelp())
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(fitWidth(line, width), " ")
+	}
+	return lines
+}
+
+func at(lines []string, i int) string {
+	if i < len(lines) {
+		return lines[i]
+	}
+	return ""
+}
+
+// fitWidth cuts or pads a line to width characters
+func fitWidth(line string, width int) string {
+	characters := []rune(line)
+	if len(characters) > width {
+		return string(characters[:width])
+	}
+	return line + strings.Repeat(" ", width-len(characters))
+}
+
+// marker shows the selected line, with a full marker in the pane that has the keys
+func marker(selected bool, focused bool) string {
+	switch {
+	case selected && focused:
+		return "> "
+	case selected:
+		return "- "
+	}
+	return "  "
+}
+
+// window is the first line to show of a list so that its selected line is visible
+func window(selected int, rows int) int {
+	if selected < rows {
+		return 0
+	}
+	return selected - rows + 1
+}
+
+func (m *tuiModel) renderShelves(rows int) []string {
+	shelves := []string{fmt.Sprintf("All books (%d)", len(m.books))}
+	for _, collection := range m.collections {
+		shelves = append(shelves, fmt.Sprintf("%s (%d)", collection.CollectionName, len(collection.CollectionBooks)))
+	}
+
+	lines := []string{}
+	for i := window(m.shelf, rows); i < len(shelves) && len(lines) < rows; i++ {
+		lines = append(lines, marker(i == m.shelf, m.mode == tuiBrowse && m.pane == tuiShelves)+shelves[i])
+	}
+	return lines
+}
+
+func (m *tuiModel) renderBooks(rows int) []string {
+	title := "All books"
+	if collection := m.currentCollection(); collection != nil {
+		title = collection.CollectionName
+	}
+	if m.search != "" || m.mode == tuiSearch {
+		title += fmt.Sprintf(" matching %q", m.search)
+	}
+	lines := []string{title, ""}
+
+	books := m.visibleBooks()
+	if len(books) == 0 {
+		return append(lines, "  No books")
+	}
+	for i := window(m.cursor, rows-2); i < len(books) && len(lines) < rows; i++ {
+		book := books[i]
+		line := fmt.Sprintf("%4d  %s - %s", book.BookID, book.Title, book.Author)
+		if book.PublishedDate != nil {
+			line += fmt.Sprintf(" (%d)", book.PublishedDate.Year())
+		}
+		lines = append(lines, marker(i == m.cursor, m.mode != tuiPick && m.pane == tuiBooks)+line)
+	}
+	return lines
+}
+
+func (m *tuiModel) renderPicker(rows int) []string {
+	lines := []string{"Add to collection", ""}
+	if book := m.currentBook(); book != nil {
+		lines[0] = fmt.Sprintf("Add %s to collection", book.Title)
+	}
+	for i := window(m.picker, rows-2); i < len(m.collections) && len(lines) < rows; i++ {
+		lines = append(lines, marker(i == m.picker, true)+m.collections[i].CollectionName)
+	}
+	return lines
+}
+
+func (m *tuiModel) renderForm() []string {
+	lines := []string{"Edit book", ""}
+	if book := m.currentBook(); book != nil {
+		lines[0] = fmt.Sprintf("Edit book %d", book.BookID)
+	}
+	for i, field := range m.form {
+		value := field.value
+		if i == m.field {
+			value += "_" // the cursor
+		}
+		lines = append(lines, fmt.Sprintf("%s%-15s %s", marker(i == m.field, true), field.label+":", value))
+	}
+	return lines
+}
+
+func (m *tuiModel) keyHelp() string {
+	switch m.mode {
+	case tuiSearch:
+		return "type to search  enter keep  esc clear"
+	case tuiPick:
+		return "↑/↓ choose  enter add  esc cancel"
+	case tuiEdit:
+		return "↑/↓ field  enter save  esc cancel  (empty clears a field, edition 0 too)"
+	}
+	return "tab pane  ↑/↓ move  / search  a add  d remove  e edit  r reload  q quit"
+}
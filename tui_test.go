@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// editableShelf keeps the changes of the tui in memory
+type editableShelf struct {
+	shelfBackend
+	updates []BookArgs
+}
+
+func (b *editableShelf) AddBookToCollection(args AddBookToCollectionArgs) (*Collection, *Book, error) {
+	for i := range b.collections {
+		if b.collections[i].CollectionID == *args.CollectionID {
+			for _, book := range b.books {
+				if book.BookID == *args.BookID {
+					b.collections[i].CollectionBooks = append(b.collections[i].CollectionBooks, book)
+					return &b.collections[i], &book, nil
+				}
+			}
+		}
+	}
+	return nil, nil, assert.AnError
+}
+
+func (b *editableShelf) RemoveBookFromCollection(args AddBookToCollectionArgs) (*Collection, *Book, error) {
+	for i := range b.collections {
+		books := b.collections[i].CollectionBooks
+		for j, book := range books {
+			if b.collections[i].CollectionID == *args.CollectionID && book.BookID == *args.BookID {
+				b.collections[i].CollectionBooks = append(books[:j:j], books[j+1:]...)
+				return &b.collections[i], &book, nil
+			}
+		}
+	}
+	return nil, nil, assert.AnError
+}
+
+func (b *editableShelf) UpdateBook(args BookArgs) (*Book, error) {
+	b.updates = append(b.updates, args)
+	for i := range b.books {
+		if b.books[i].BookID == *args.BookID && args.Title != nil {
+			b.books[i].Title = *args.Title
+		}
+	}
+	return &Book{BookID: *args.BookID, Title: *args.Title}, nil
+}
+
+func testTUI(t *testing.T) (*tuiModel, *editableShelf) {
+	library := &editableShelf{shelfBackend: testShelf()}
+	model := newTUIModel(library)
+	require.NoError(t, model.reload())
+	return model, library
+}
+
+// pressKeys sends the named keys as they are and types the other words character by character
+func pressKeys(model *tuiModel, keys ...string) {
+	named := map[string]bool{"up": true, "down": true, "tab": true, "enter": true, "esc": true, "backspace": true}
+	for _, key := range keys {
+		if named[key] {
+			model.handleKey(key)
+			continue
+		}
+		for _, character := range key {
+			model.handleKey(string(character))
+		}
+	}
+}
+
+func TestTUI_Render(t *testing.T) {
+	// Setup
+	model, _ := testTUI(t)
+
+	// Function to test
+	screen := model.render(80, 10)
+
+	// Verification
+	require.Len(t, screen, 10)
+	assert.Equal(t, " bookish - 3 books, 1 collections", screen[0])
+	// the shelves take a third of the width
+	assert.Equal(t, fitWidth("> All books (3)", 26)+"│ All books", screen[2])
+	assert.Equal(t, fitWidth("  Fantasy (0)", 26)+"│", screen[3])
+	assert.Equal(t, fitWidth("", 26)+"│ -    3  The Hobbit - J. R. R. Tolkien", screen[4])
+	assert.Contains(t, screen[9], "q quit")
+}
+
+func TestTUI_Search(t *testing.T) {
+	// Setup
+	model, _ := testTUI(t)
+
+	// Function to test
+	pressKeys(model, "/", "MORX", "backspace", "T", "enter")
+
+	// Verification
+	require.Len(t, model.visibleBooks(), 1)
+	assert.Equal(t, "Mort", model.currentBook().Title)
+	assert.Contains(t, strings.Join(model.render(80, 10), "\n"), `All books matching "MORT"`)
+
+	pressKeys(model, "/", "esc")
+	assert.Len(t, model.visibleBooks(), 3)
+}
+
+func TestTUI_AddAndRemove(t *testing.T) {
+	// Setup
+	model, library := testTUI(t)
+
+	// Function to test
+	pressKeys(model, "tab", "down", "a", "enter")
+	require.Len(t, library.collections[0].CollectionBooks, 1)
+	assert.Equal(t, "Book The Silmarillion added to collection Fantasy", model.status)
+
+	pressKeys(model, "tab", "down", "d")
+
+	// Verification
+	assert.Equal(t, "Book The Silmarillion removed from collection Fantasy", model.status)
+	assert.Empty(t, library.collections[0].CollectionBooks)
+	assert.Empty(t, model.visibleBooks())
+}
+
+func TestTUI_RemoveNeedsCollection(t *testing.T) {
+	// Setup
+	model, _ := testTUI(t)
+
+	// Function to test
+	pressKeys(model, "tab", "d")
+
+	// Verification
+	assert.Equal(t, "Select a collection on the left to remove books from it", model.status)
+}
+
+func TestTUI_Edit(t *testing.T) {
+	// Setup
+	model, library := testTUI(t)
+
+	// Function to test
+	pressKeys(model, "tab", "e", "backspace", "backspace", "backspace", "backspace", "backspace", "backspace", "Rivendell", "down", "down", "0-261-10295-6", "enter")
+
+	// Verification
+	require.Len(t, library.updates, 1)
+	update := library.updates[0]
+	assert.Equal(t, 3, *update.BookID)
+	assert.Equal(t, "The Rivendell", *update.Title)
+	assert.Equal(t, "0-261-10295-6", *update.ISBN)
+	assert.Nil(t, update.Author)
+	assert.Nil(t, update.Edition)
+	assert.Equal(t, tuiBrowse, model.mode)
+	assert.Equal(t, "Book The Rivendell updated", model.status)
+	assert.Equal(t, "The Rivendell", model.currentBook().Title)
+}
+
+func TestTUI_EditCancel(t *testing.T) {
+	// Setup
+	model, library := testTUI(t)
+
+	// Function to test
+	pressKeys(model, "tab", "e", "x", "esc")
+
+	// Verification
+	assert.Empty(t, library.updates)
+	assert.Equal(t, tuiBrowse, model.mode)
+}
+
+func TestReadKey(t *testing.T) {
+	// Setup
+	keys := bufio.NewReader(strings.NewReader("\x1b[Aj\r\x7fé\x1b[5~\t"))
+
+	// Function to test
+	read := []string{}
+	for i := 0; i < 7; i++ {
+		key, err := readKey(keys)
+		require.NoError(t, err)
+		read = append(read, key)
+	}
+
+	// Verification
+	assert.Equal(t, []string{"up", "j", "enter", "backspace", "é", "", "tab"}, read)
+}
@@ -1,6 +1,12 @@
 package main
 
-import "strconv"
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
 
 func SanitizeAuthorName(name *string) *string {
 	if name == nil {
@@ -17,3 +23,139 @@ func SanitizeIdNumber(id *string) (*int, error) {
 	}
 	return &intId, nil
 }
+
+func SanitizeISBN(isbn *string) (*string, error) {
+	if isbn == nil {
+		return nil, nil
+	}
+
+	// keep only digits and the ISBN-10 check character
+	digits := strings.Map(func(r rune) rune {
+		switch {
+		case r >= '0' && r <= '9':
+			return r
+		case r == 'x' || r == 'X':
+			return 'X'
+		case r == '-' || r == ' ':
+			return -1
+		}
+		return '?'
+	}, *isbn)
+	if digits == "" {
+		return nil, nil
+	}
+
+	invalid := fmt.Errorf("invalid ISBN %s", *isbn)
+	switch len(digits) {
+	case 10:
+		sum := 0
+		for i, r := range digits {
+			value := int(r - '0')
+			if r == 'X' && i == 9 {
+				value = 10
+			} else if r < '0' || r > '9' {
+				return nil, invalid
+			}
+			sum += value * (10 - i)
+		}
+		if sum%11 != 0 {
+			return nil, invalid
+		}
+	case 13:
+		sum := 0
+		for i, r := range digits {
+			if r < '0' || r > '9' {
+				return nil, invalid
+			}
+			weight := 1
+			if i%2 == 1 {
+				weight = 3
+			}
+			sum += int(r-'0') * weight
+		}
+		if sum%10 != 0 {
+			return nil, invalid
+		}
+	default:
+		return nil, invalid
+	}
+
+	return &digits, nil
+}
+
+// accepted layouts for published dates, from the most to the least precise
+var publishedDateLayouts = []string{"2006-01-02", "2006/01/02", "2006-01", "2006"}
+
+func SanitizePublishedDate(date *string) (*time.Time, error) {
+	if date == nil || strings.TrimSpace(*date) == "" {
+		return nil, nil
+	}
+
+	for _, layout := range publishedDateLayouts {
+		publishedDate, err := time.Parse(layout, strings.TrimSpace(*date))
+		if err == nil {
+			return &publishedDate, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid published date %s, expected YYYY-MM-DD, YYYY-MM or YYYY", *date)
+}
+
+// SanitizeDate reads a day written as YYYY-MM-DD, an empty date is no date
+func SanitizeDate(date *string) (*time.Time, error) {
+	if date == nil || strings.TrimSpace(*date) == "" {
+		return nil, nil
+	}
+
+	day, err := time.Parse("2006-01-02", strings.TrimSpace(*date))
+	if err != nil {
+		return nil, fmt.Errorf("invalid date %s, expected YYYY-MM-DD", *date)
+	}
+	return &day, nil
+}
+
+// SanitizeEdition reads edition numbers written as "2", "2nd" or "2nd ed."
+func SanitizeEdition(edition *string) (*int, error) {
+	if edition == nil || strings.TrimSpace(*edition) == "" {
+		return nil, nil
+	}
+
+	digits := strings.TrimSpace(*edition)
+	end := strings.IndexFunc(digits, func(r rune) bool { return r < '0' || r > '9' })
+	if end >= 0 {
+		digits = digits[:end]
+	}
+
+	editionNumber, err := strconv.Atoi(digits)
+	if err != nil || editionNumber < 1 {
+		return nil, fmt.Errorf("invalid edition %s", *edition)
+	}
+	return &editionNumber, nil
+}
+
+// SanitizeTags lower cases and trims tags, leaving out empty and repeated ones
+func SanitizeTags(tags []string) []string {
+	sanitized := []string{}
+	seen := map[string]bool{}
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		sanitized = append(sanitized, tag)
+	}
+	return sanitized
+}
+
+// SanitizeCurrency reads ISO 4217 currency codes written in any case, such as "eur"
+func SanitizeCurrency(currency *string) (string, error) {
+	if currency == nil || strings.TrimSpace(*currency) == "" {
+		return "", errors.New("no currency set, expected a currency code such as EUR or USD")
+	}
+
+	code := strings.ToUpper(strings.TrimSpace(*currency))
+	if len(code) != 3 || strings.IndexFunc(code, func(r rune) bool { return r < 'A' || r > 'Z' }) >= 0 {
+		return "", fmt.Errorf("invalid currency %s, expected a currency code such as EUR or USD", *currency)
+	}
+	return code, nil
+}
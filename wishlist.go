@@ -0,0 +1,323 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// wishPriorities are how much a book on the wishlist is wanted, the list starts with the high ones
+var wishPriorities = []string{"high", "normal", "low"}
+
+func checkWishPriority(priority string) error {
+	for _, known := range wishPriorities {
+		if priority == known {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid priority %s, expected high, normal or low", priority)
+}
+
+// CreateWish adds a book we do not own yet to the wishlist. The author defaults to
+// Anonymous like for books, the priority to normal; the ISBN, the desired edition and the
+// notes are optional.
+func CreateWish(db *sql.DB, w WishArgs) (*Wish, error) {
+	if w.Title == nil || strings.TrimSpace(*w.Title) == "" {
+		return nil, errors.New("no book title set, wish not created")
+	}
+	priority := "normal"
+	if w.Priority != nil && *w.Priority != "" {
+		priority = *w.Priority
+	}
+	err := checkWishPriority(priority)
+	if err != nil {
+		return nil, err
+	}
+	isbn, err := SanitizeISBN(w.ISBN)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // no-op once the transaction is committed
+
+	var wishID int
+	err = tx.QueryRow("INSERT INTO wishlist (title, author, isbn, edition, priority, notes) VALUES ($1, $2, $3, NULLIF($4, ''), $5, NULLIF($6, '')) ON CONFLICT DO NOTHING RETURNING wish_id",
+		strings.TrimSpace(*w.Title), *SanitizeAuthorName(w.Author), isbn, w.Edition, priority, w.Notes).Scan(&wishID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			err = errors.New("book is already on the wishlist")
+		}
+		return nil, err
+	}
+
+	wishes, err := listWishes(tx, WishArgs{WishID: &wishID})
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return &wishes[0], nil
+}
+
+// UpdateWish changes the fields of a wish that are set in w, the wish is chosen by its
+// ID. An empty ISBN, edition or notes clears them.
+func UpdateWish(db *sql.DB, w WishArgs) (*Wish, error) {
+	if w.WishID == nil {
+		return nil, errors.New("choose the wish to update and insert its ID number")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // no-op once the transaction is committed
+
+	// check if there is a wish with the chosen ID
+	_, err = listWishes(tx, WishArgs{WishID: w.WishID})
+	if err != nil {
+		return nil, err
+	}
+
+	sets := []string{}
+	params := []any{}
+	set := func(column string, value any) {
+		params = append(params, value)
+		sets = append(sets, fmt.Sprintf("%s = $%d", column, len(params)))
+	}
+	if w.Title != nil {
+		if strings.TrimSpace(*w.Title) == "" {
+			return nil, errors.New("no book title set, wish not updated")
+		}
+		set("title", strings.TrimSpace(*w.Title))
+	}
+	if w.Author != nil {
+		set("author", *SanitizeAuthorName(optionalValue(*w.Author)))
+	}
+	if w.ISBN != nil {
+		isbn, err := SanitizeISBN(optionalValue(*w.ISBN))
+		if err != nil {
+			return nil, err
+		}
+		set("isbn", isbn)
+	}
+	if w.Edition != nil {
+		set("edition", optionalValue(*w.Edition))
+	}
+	if w.Priority != nil {
+		err := checkWishPriority(*w.Priority)
+		if err != nil {
+			return nil, err
+		}
+		set("priority", *w.Priority)
+	}
+	if w.Notes != nil {
+		set("notes", optionalValue(*w.Notes))
+	}
+
+	if len(sets) > 0 {
+		params = append(params, *w.WishID)
+		_, err = tx.Exec(fmt.Sprintf("UPDATE wishlist SET %s WHERE wish_id = $%d", strings.Join(sets, ", "), len(params)), params...)
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" { // the new title and author are wished already
+			return nil, errors.New("book is already on the wishlist")
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	wishes, err := listWishes(tx, WishArgs{WishID: w.WishID})
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return &wishes[0], nil
+}
+
+// DeleteWish removes the wish chosen by its ID and returns it
+func DeleteWish(db *sql.DB, w WishArgs) (*Wish, error) {
+	if w.WishID == nil {
+		return nil, errors.New("choose the wish to delete and insert its ID number")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // no-op once the transaction is committed
+
+	wish, err := deleteWish(tx, *w.WishID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return wish, nil
+}
+
+func deleteWish(q querier, wishID int) (*Wish, error) {
+	wishes, err := listWishes(q, WishArgs{WishID: &wishID})
+	if err != nil {
+		return nil, err
+	}
+	_, err = q.Exec("DELETE FROM wishlist WHERE wish_id = $1", wishID)
+	if err != nil {
+		return nil, err
+	}
+	return &wishes[0], nil
+}
+
+// AcquireWish turns a wish into an owned book in one step: the book is created like with
+// CreateBook, or found when the library has it already, the copy is recorded when a format
+// is set and the purchase when a price is set, and the wish leaves the wishlist.
+func AcquireWish(db *sql.DB, a AcquireArgs) (*Acquisition, error) {
+	if a.WishID == nil {
+		return nil, errors.New("choose the wish to acquire and insert its ID number")
+	}
+	if a.Price == nil && (a.Store != nil || a.Currency != nil) {
+		return nil, errors.New("no price set, set the price of the purchase with its store and currency")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // no-op once the transaction is committed
+
+	wish, err := deleteWish(tx, *a.WishID)
+	if err != nil {
+		return nil, err
+	}
+
+	acquisition := &Acquisition{}
+	books, err := listBooks(tx, BookArgs{Title: &wish.Title, Author: &wish.Author})
+	switch {
+	case err == errNoBooks:
+		bookArgs := BookArgs{Title: &wish.Title, Author: &wish.Author, ISBN: optionalValue(wish.ISBN)}
+		// the desired edition is kept as the edition number when it starts with one, like "2nd hardcover"
+		bookArgs.Edition, _ = SanitizeEdition(&wish.Edition)
+		book, err := createBook(tx, bookArgs)
+		if err != nil {
+			return nil, err
+		}
+		acquisition.Book = *book
+	case err != nil:
+		return nil, err
+	default:
+		acquisition.Book = books[0]
+	}
+	bookID := acquisition.Book.BookID
+
+	if a.Format != nil && *a.Format != "" {
+		acquisition.Copy, err = createCopy(tx, CopyArgs{BookID: &bookID, Format: a.Format, Location: a.Location, AcquiredDate: a.Date, Price: a.Price})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if a.Price != nil {
+		purchaseArgs := PurchaseArgs{BookID: &bookID, Store: a.Store, Price: a.Price, Currency: a.Currency, PurchaseDate: a.Date}
+		if acquisition.Copy != nil {
+			purchaseArgs.CopyID = &acquisition.Copy.CopyID
+		}
+		acquisition.Purchase, err = recordPurchase(tx, purchaseArgs)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return acquisition, nil
+}
+
+// ListWishes lists the wishlist, the high priority books first, or the wishes with a
+// priority or whose title has the searched text, ignoring case.
+func ListWishes(db *sql.DB, w WishArgs) ([]Wish, error) {
+	return listWishes(db, w)
+}
+
+func listWishes(q querier, w WishArgs) ([]Wish, error) {
+	wishes := []Wish{}
+
+	query := `
+		SELECT wish_id, title, author, isbn, edition, priority, notes, creation_date
+		FROM wishlist
+		`
+
+	whereClauses := []string{}
+	params := []any{}
+	bind := func(value any) string {
+		params = append(params, value)
+		return fmt.Sprintf("$%d", len(params))
+	}
+	if w.WishID != nil {
+		whereClauses = append(whereClauses, "wish_id = "+bind(*w.WishID))
+	}
+	if w.Title != nil && strings.TrimSpace(*w.Title) != "" {
+		whereClauses = append(whereClauses, "title ILIKE '%' || "+bind(likeEscaper.Replace(strings.TrimSpace(*w.Title)))+" || '%'")
+	}
+	if w.Author != nil {
+		whereClauses = append(whereClauses, "author = "+bind(*w.Author))
+	}
+	if w.Priority != nil {
+		err := checkWishPriority(*w.Priority)
+		if err != nil {
+			return nil, err
+		}
+		whereClauses = append(whereClauses, "priority = "+bind(*w.Priority))
+	}
+	if len(whereClauses) > 0 {
+		query += "WHERE " + strings.Join(whereClauses, " AND ")
+	}
+	query += " ORDER BY CASE priority WHEN 'high' THEN 1 WHEN 'normal' THEN 2 ELSE 3 END, wish_id"
+
+	rows, err := q.Query(query, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var wish Wish
+		var isbn, edition, notes sql.NullString
+		err := rows.Scan(&wish.WishID, &wish.Title, &wish.Author, &isbn, &edition, &wish.Priority, &notes, &wish.CreationDate)
+		if err != nil {
+			return nil, err
+		}
+		wish.ISBN = isbn.String
+		wish.Edition = edition.String
+		wish.Notes = notes.String
+		wishes = append(wishes, wish)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(wishes) == 0 {
+		return nil, errors.New("no wishes with the chosen specification")
+	}
+	return wishes, nil
+}